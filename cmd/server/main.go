@@ -1,21 +1,23 @@
 package main
 
 import (
+	"context"
 	"crypto/ecdsa"
 	"flag"
 	"fmt"
 	"log"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/flashbots/rpc-endpoint/server"
+	"github.com/flashbots/rpc-endpoint/tracing"
 )
 
 var (
 	defaultListenAddress = "127.0.0.1:9000"
 	defaultProxyUrl      = "http://127.0.0.1:8545"
-	defaultRelayUrl      = "https://relay.flashbots.net"
 	defaultRedisUrl      = "localhost:6379"
 
 	version = "dev" // is set during build process
@@ -24,11 +26,63 @@ var (
 var versionPtr = flag.Bool("version", false, "just print the program version")
 var listenAddress = flag.String("listen", getEnvOrDefault("LISTEN_ADDR", defaultListenAddress), "Listen address")
 var proxyUrl = flag.String("proxy", getEnvOrDefault("PROXY_URL", defaultProxyUrl), "URL for default JSON-RPC proxy target (eth node, Infura, etc.)")
-var redisUrl = flag.String("redis", getEnvOrDefault("REDIS_URL", defaultRedisUrl), "URL for Redis (use 'dev' to use integrated in-memory redis)")
+var proxyUrls = flag.String("proxyUrls", os.Getenv("PROXY_URLS"), "Comma-separated list of JSON-RPC proxy targets with health checks and failover (overrides -proxy)")
+var wsProxyUrl = flag.String("wsProxy", os.Getenv("WS_PROXY_URL"), "WebSocket URL of a node for eth_subscribe passthrough (subscriptions are disabled if empty)")
+var proxyMaxBlockLag = flag.Uint64("proxyMaxBlockLag", server.DefaultProxyPoolConfig.MaxBlockLag, "Take proxy targets out of rotation if they are more than this many blocks behind")
+var proxyHealthCheckInterval = flag.Duration("proxyHealthCheckInterval", server.DefaultProxyPoolConfig.HealthCheckInterval, "Interval between proxy target health checks")
+var shutdownDrainDelay = flag.Duration("shutdownDrainDelay", 5*time.Second, "On shutdown, report draining in /health for this long before closing the listener")
+var shutdownTimeout = flag.Duration("shutdownTimeout", server.DefaultShutdownTimeout, "Maximum time to wait for in-flight requests on shutdown")
+var requestTimeout = flag.Duration("requestTimeout", server.DefaultRequestTimeouts.Request, "Deadline of a JSON-RPC request (timed out requests get error -32002)")
+var proxyTimeout = flag.Duration("proxyTimeout", server.DefaultRequestTimeouts.Proxy, "Deadline of a request to a proxy target")
+var relayTimeout = flag.Duration("relayTimeout", server.DefaultRequestTimeouts.Relay, "Deadline of a request to the relay")
+var txStatusTimeout = flag.Duration("txStatusTimeout", server.DefaultRequestTimeouts.TxStatus, "Deadline of a request to the protect tx status API")
+var txTrackerMinInterval = flag.Duration("txTrackerMinInterval", server.DefaultTxTrackerConfig.MinInterval, "Interval between status lookups of a private tx, doubled while the status doesn't change")
+var txTrackerMaxInterval = flag.Duration("txTrackerMaxInterval", server.DefaultTxTrackerConfig.MaxInterval, "Maximum interval between status lookups of a private tx")
+var txTrackerMaxAge = flag.Duration("txTrackerMaxAge", server.DefaultTxTrackerConfig.MaxAge, "How long after sending the status of a private tx is looked up")
+var txTrackerWorkers = flag.Int("txTrackerWorkers", server.DefaultTxTrackerConfig.Workers, "Number of concurrent status lookups of private txs")
+var customProxyAllowedHosts = flag.String("customProxyAllowedHosts", os.Getenv("CUSTOM_PROXY_ALLOWED_HOSTS"), "Comma-separated hosts that ?url= may point to, '*.example.com' matches subdomains (any public host if empty)")
+var customProxyAllowPrivate = flag.Bool("customProxyAllowPrivate", false, "Allow ?url= to point to loopback, private and link-local addresses (only for local development)")
+var customProxyTimeout = flag.Duration("customProxyTimeout", server.DefaultCustomProxyPolicy.Timeout, "Deadline of a request to a ?url= proxy target")
+var customProxyMaxResponseSize = flag.Int64("customProxyMaxResponseSize", server.DefaultCustomProxyPolicy.MaxResponseSize, "Maximum response size of a ?url= proxy target in bytes")
+var redisUrl = flag.String("redis", getEnvOrDefault("REDIS_URL", defaultRedisUrl), "Redis address or redis[s]://[user:password@]host:port[,host:port...][/db] url (use 'dev' for the in-memory state backend)")
+var redisMode = flag.String("redisMode", getEnvOrDefault("REDIS_MODE", server.RedisModeSingle), "Redis mode: single, sentinel or cluster")
+var redisSentinelMaster = flag.String("redisSentinelMaster", os.Getenv("REDIS_SENTINEL_MASTER"), "Name of the master to get from the sentinels")
+var redisSentinelPassword = flag.String("redisSentinelPassword", os.Getenv("REDIS_SENTINEL_PASSWORD"), "Password of the sentinels, if different from the master")
+var redisTLSSkipVerify = flag.Bool("redisTLSSkipVerify", false, "Don't verify the Redis server certificate with rediss://")
+var redisPoolSize = flag.Int("redisPoolSize", 0, "Max Redis connections per node (default: 10 per CPU)")
+var redisMinIdleConns = flag.Int("redisMinIdleConns", 0, "Min idle Redis connections to keep open")
+var redisDialTimeout = flag.Duration("redisDialTimeout", 0, "Timeout for connecting to Redis (default: 5s)")
+var redisReadTimeout = flag.Duration("redisReadTimeout", 0, "Timeout for Redis reads (default: 3s)")
+var redisWriteTimeout = flag.Duration("redisWriteTimeout", 0, "Timeout for Redis writes (default: read timeout)")
+var redisPoolTimeout = flag.Duration("redisPoolTimeout", 0, "Time to wait for a free Redis connection (default: read timeout + 1s)")
+var stateBackend = flag.String("store", getEnvOrDefault("STATE_STORE", server.StateBackendRedis), "State backend: redis, memory or leveldb")
+var statePath = flag.String("storePath", getEnvOrDefault("STATE_STORE_PATH", "rpc-endpoint-state"), "Directory of the leveldb state database")
+var txLifecycleRetention = flag.Duration("txLifecycleRetention", server.DefaultTxLifecycleRetention, "How long lifecycle records of private txs are kept (served at /tx/{hash})")
+
+var protectionPolicyFile = flag.String("protectionPolicy", os.Getenv("PROTECTION_POLICY_FILE"), "YAML/JSON file with frontrunning protection rules (reloaded on SIGHUP)")
+var rateLimitsFile = flag.String("rateLimits", os.Getenv("RATE_LIMITS_FILE"), "YAML file with per-method rate limits (rate limiting is disabled if empty)")
+var simulationMode = flag.String("simulate", os.Getenv("SIMULATION_MODE"), "Simulate txs before sending them to the relay and reject reverting ones: 'relay' (eth_callBundle) or 'node' (eth_call), disabled if empty")
+var responseCacheSize = flag.Int("cacheSize", 0, "Number of responses to cache in memory for immutable and block-scoped read calls (caching is disabled if 0)")
+var responseCacheRedis = flag.Bool("cacheRedis", false, "Also cache responses in Redis, shared between replicas")
+var ofacListFile = flag.String("ofacList", os.Getenv("OFAC_LIST_FILE"), "File with OFAC sanctioned addresses, one per line or SDN XML (reloaded on change)")
+var chainName = flag.String("chain", getEnvOrDefault("CHAIN", "mainnet"), "Network to serve: "+strings.Join(server.ChainNames(), ", ")+", or the chain id of a custom network")
+var protectTxApiHost = flag.String("protectApiHost", os.Getenv("PROTECT_API_HOST"), "Protect tx status API host (default: the one of the chain)")
+var checkContract = flag.String("checkContract", os.Getenv("CHECK_CONTRACT"), "Address of the RPC check contract (default: the one of the chain)")
+var ofacListReloadInterval = flag.Duration("ofacListReloadInterval", 30*time.Second, "How often to check the OFAC list file for changes")
+var adminApiKey = flag.String("adminApiKey", os.Getenv("ADMIN_API_KEY"), "API key for the /admin endpoints (disabled if empty)")
+var logLevel = flag.String("logLevel", getEnvOrDefault("LOG_LEVEL", "info"), "Log level: debug, info, warn or error")
+var logLevels = flag.String("logLevels", os.Getenv("LOG_LEVELS"), "Comma-separated log levels of subsystems, e.g. 'ws=warn,sendTxToRelay=debug'")
+var logJson = flag.Bool("logJson", os.Getenv("LOG_JSON") != "", "Log one JSON object per line")
+var logFullPayloads = flag.Bool("logFullPayloads", false, "Don't truncate raw txs and other long hex payloads in the logs")
+var traceExporter = flag.String("traceExporter", os.Getenv("TRACE_EXPORTER"), "Export traces: 'otlp' (OTLP/HTTP to -otlpEndpoint) or 'stdout', disabled if empty")
+var otlpEndpoint = flag.String("otlpEndpoint", getEnvOrDefault("OTEL_EXPORTER_OTLP_ENDPOINT", "http://localhost:4318"), "OpenTelemetry collector for -traceExporter otlp (/v1/traces is appended)")
+var otlpHeaders = flag.String("otlpHeaders", os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"), "Comma-separated key=value headers of the requests to the collector")
+var traceSampleRatio = flag.Float64("traceSampleRatio", 1, "Fraction of new traces to record (requests with a traceparent header follow its sampled flag)")
 
 // Flags for using the relay
-var relayUrl = flag.String("relayUrl", getEnvOrDefault("RELAY_URL", defaultRelayUrl), "URL for relay")
+var relayUrl = flag.String("relayUrl", os.Getenv("RELAY_URL"), "URL for relay (default: the relay of the chain)")
 var relaySigningKey = flag.String("signingKey", os.Getenv("RELAY_SIGNING_KEY"), "Signing key for relay requests")
+var relaysFile = flag.String("relays", os.Getenv("RELAYS_FILE"), "YAML file with the relays and builders to send private txs to (default: only -relayUrl)")
 
 func main() {
 	var key *ecdsa.PrivateKey
@@ -44,6 +98,24 @@ func main() {
 
 	log.Printf("rpc-endpoint %s\n", version)
 
+	logConfig := server.LogConfig{JSON: *logJson, FullPayloads: *logFullPayloads}
+	if logConfig.Level, err = server.ParseLogLevel(*logLevel); err != nil {
+		log.Fatal(err)
+	}
+	if logConfig.Subsystems, err = server.ParseSubsystemLogLevels(*logLevels); err != nil {
+		log.Fatal(err)
+	}
+	logger := server.NewLoggerWithConfig("", logConfig)
+
+	tracer, err := newTracer()
+	if err != nil {
+		log.Fatal("Tracing init error:", err)
+	}
+	if tracer != nil {
+		tracing.SetTracer(tracer)
+		log.Printf("Exporting traces: %s, sample ratio %.2f\n", *traceExporter, *traceSampleRatio)
+	}
+
 	if *relaySigningKey == "" {
 		log.Fatal("Cannot use the relay without a signing key.")
 	}
@@ -62,12 +134,210 @@ func main() {
 
 	log.Printf("Signing key: %s\n", crypto.PubkeyToAddress(key.PublicKey).Hex())
 
+	chain, err := server.GetChainConfig(*chainName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *relayUrl != "" {
+		chain.RelayUrl = *relayUrl
+	}
+	if *protectTxApiHost != "" {
+		chain.ProtectTxApiHost = *protectTxApiHost
+	}
+	if *checkContract != "" {
+		chain.CheckContract = *checkContract
+	}
+	if err = chain.Validate(); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Chain: %s (chain id %d) - relay: %s\n", chain.Name, chain.ChainId, chain.RelayUrl)
+
+	var protectionPolicy *server.ProtectionPolicy
+	if *protectionPolicyFile != "" {
+		protectionPolicy, err = server.LoadProtectionPolicyFile(*protectionPolicyFile)
+		if err != nil {
+			log.Fatal("Error loading protection policy:", err)
+		}
+		log.Printf("Loaded protection policy from %s with %d rules\n", *protectionPolicyFile, len(protectionPolicy.Rules))
+	}
+
+	var ofacList *server.OFACList
+	if *ofacListFile != "" {
+		ofacList, err = server.LoadOFACListFile(*ofacListFile)
+		if err != nil {
+			log.Fatal("Error loading OFAC list:", err)
+		}
+		log.Printf("Loaded OFAC list from %s - version: %s, entries: %d, invalid: %d\n", *ofacListFile, ofacList.Version, ofacList.Len(), ofacList.Invalid)
+	}
+
+	var relays []server.RelayTarget
+	if *relaysFile != "" {
+		relaysConfig, err := server.LoadRelaysConfigFile(*relaysFile)
+		if err != nil {
+			log.Fatal("Error loading relays:", err)
+		}
+		if relays, err = relaysConfig.Targets(logger); err != nil {
+			log.Fatal("Error loading relays:", err)
+		}
+		for _, relay := range relaysConfig.Relays {
+			log.Printf("Relay %s: %s\n", relay.Name, relay.Url)
+		}
+	}
+
+	var rateLimits *server.RateLimitConfig
+	if *rateLimitsFile != "" {
+		rateLimits, err = server.LoadRateLimitConfigFile(*rateLimitsFile)
+		if err != nil {
+			log.Fatal("Error loading rate limits:", err)
+		}
+		log.Printf("Loaded rate limits from %s\n", *rateLimitsFile)
+	}
+
+	// A single -proxy url is shorthand for a pool with one node
+	proxyTargets := []string{*proxyUrl}
+	if *proxyUrls != "" {
+		proxyTargets = splitList(*proxyUrls)
+		if len(proxyTargets) == 0 {
+			log.Fatal("No proxy urls in -proxyUrls")
+		}
+	}
+	log.Printf("Proxy targets: %s\n", strings.Join(proxyTargets, ", "))
+
+	customProxy := server.CustomProxyPolicy{
+		AllowPrivate:    *customProxyAllowPrivate,
+		Timeout:         *customProxyTimeout,
+		MaxResponseSize: *customProxyMaxResponseSize,
+	}
+	if *customProxyAllowedHosts != "" {
+		// An empty list would allow any public host
+		customProxy.AllowedHosts = splitList(*customProxyAllowedHosts)
+		if len(customProxy.AllowedHosts) == 0 {
+			log.Fatal("No hosts in -customProxyAllowedHosts")
+		}
+	}
+
+	if *redisUrl == "dev" {
+		*stateBackend = server.StateBackendMemory
+	}
+	switch *stateBackend {
+	case server.StateBackendRedis:
+		log.Println("Connecting to redis at", server.RedactRedisUrl(*redisUrl), "...")
+	case server.StateBackendLevelDB:
+		log.Println("Using leveldb state at", *statePath)
+	default:
+		log.Println("Using state backend", *stateBackend)
+	}
+	redisConfig := &server.RedisConfig{
+		Url:              *redisUrl,
+		Mode:             *redisMode,
+		SentinelMaster:   *redisSentinelMaster,
+		SentinelPassword: *redisSentinelPassword,
+		TLSSkipVerify:    *redisTLSSkipVerify,
+		PoolSize:         *redisPoolSize,
+		MinIdleConns:     *redisMinIdleConns,
+		DialTimeout:      *redisDialTimeout,
+		ReadTimeout:      *redisReadTimeout,
+		WriteTimeout:     *redisWriteTimeout,
+		PoolTimeout:      *redisPoolTimeout,
+	}
+	stateStore, err := server.NewStateStore(*stateBackend, redisConfig, *statePath, time.Now)
+	if err != nil {
+		log.Fatal("State store init error:", err)
+	}
+
 	// Start the endpoint
-	s, err := server.NewRpcEndPointServer(version, *listenAddress, *proxyUrl, *relayUrl, key, *redisUrl)
+	s, err := server.NewRpcEndPointServer(server.RpcEndPointServerConfig{
+		Version:            version,
+		ListenAddress:      *listenAddress,
+		ProxyUrls:          proxyTargets,
+		WsProxyUrl:         *wsProxyUrl,
+		AdminApiKey:        *adminApiKey,
+		RelaySigningKey:    key,
+		Chain:              chain,
+		StateStore:         stateStore,
+		Relays:             relays,
+		DebugDontSendTx:    os.Getenv("DEBUG_DONT_SEND_RAWTX") != "",
+		SimulationMode:     *simulationMode,
+		RateLimits:         rateLimits,
+		ResponseCacheSize:  *responseCacheSize,
+		ResponseCacheRedis: *responseCacheRedis,
+		ProxyPool: server.ProxyPoolConfig{
+			HealthCheckInterval: *proxyHealthCheckInterval,
+			MaxBlockLag:         *proxyMaxBlockLag,
+		},
+		Timeouts: server.RequestTimeouts{
+			Request:  *requestTimeout,
+			Proxy:    *proxyTimeout,
+			Relay:    *relayTimeout,
+			TxStatus: *txStatusTimeout,
+		},
+		TxTracker: server.TxTrackerConfig{
+			MinInterval: *txTrackerMinInterval,
+			MaxInterval: *txTrackerMaxInterval,
+			MaxAge:      *txTrackerMaxAge,
+			Workers:     *txTrackerWorkers,
+		},
+		TxLifecycleRetention: *txLifecycleRetention,
+		CustomProxy:          customProxy,
+		ProtectionPolicy:     protectionPolicy,
+		OFACList:             ofacList,
+		Logger:               logger,
+		ShutdownDrainDelay:   *shutdownDrainDelay,
+		ShutdownTimeout:      *shutdownTimeout,
+	})
 	if err != nil {
 		log.Fatal("Server init error:", err)
 	}
+	if *protectionPolicyFile != "" {
+		go server.WatchProtectionPolicySignal(*protectionPolicyFile, logger, s.SetProtectionPolicy)
+	}
+	if *ofacListFile != "" {
+		go server.WatchOFACListFile(*ofacListFile, *ofacListReloadInterval, logger, s.SetOFACList)
+	}
 	s.Start()
+
+	if tracer != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := tracer.Shutdown(ctx); err != nil {
+			log.Println("Tracing shutdown error:", err)
+		}
+	}
+	log.Println("Shutdown complete")
+}
+
+// Returns the tracer of the -traceExporter flag, or nil if tracing is disabled
+func newTracer() (*tracing.Tracer, error) {
+	var exporter tracing.Exporter
+	switch *traceExporter {
+	case "":
+		return nil, nil
+	case "stdout":
+		exporter = tracing.NewWriterExporter(os.Stdout)
+	case "otlp":
+		headers, err := tracing.ParseOTLPHeaders(*otlpHeaders)
+		if err != nil {
+			return nil, err
+		}
+		exporter = tracing.NewOTLPExporter(*otlpEndpoint, "rpc-endpoint", headers)
+	default:
+		return nil, fmt.Errorf("invalid trace exporter %s (use otlp or stdout)", *traceExporter)
+	}
+	if *traceSampleRatio <= 0 || *traceSampleRatio > 1 {
+		return nil, fmt.Errorf("invalid trace sample ratio %v, must be in (0, 1]", *traceSampleRatio)
+	}
+	return tracing.NewTracer(tracing.Config{Exporter: exporter, SampleRatio: *traceSampleRatio}), nil
+}
+
+// Splits a comma-separated flag value, without whitespace around the entries and without empty entries
+func splitList(value string) []string {
+	list := []string{}
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			list = append(list, entry)
+		}
+	}
+	return list
 }
 
 func getEnvOrDefault(key string, defaultValue string) string {
@@ -0,0 +1,332 @@
+/*
+Package metrics implements the few Prometheus metric types the rpc endpoint needs (counters, histograms and gauges with
+labels), and a handler which serves them in the Prometheus text exposition format.
+*/
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Default histogram buckets for durations in seconds
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type metric interface {
+	name() string
+	write(w io.Writer)
+}
+
+type Registry struct {
+	mu      sync.RWMutex
+	metrics map[string]metric
+}
+
+func NewRegistry() *Registry {
+	return &Registry{metrics: make(map[string]metric)}
+}
+
+// All metrics created with the New* functions are registered here
+var DefaultRegistry = NewRegistry()
+
+func (r *Registry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, found := r.metrics[m.name()]; found {
+		panic("duplicate metric: " + m.name())
+	}
+	r.metrics[m.name()] = m
+}
+
+// Write writes all metrics in the Prometheus text format, sorted by name
+func (r *Registry) Write(w io.Writer) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	names := make([]string, 0, len(r.metrics))
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		r.metrics[name].write(w)
+	}
+}
+
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		bw := bufio.NewWriter(w)
+		r.Write(bw)
+		bw.Flush()
+	})
+}
+
+// Handler serves the metrics of the default registry
+func Handler() http.Handler {
+	return DefaultRegistry.Handler()
+}
+
+// Labels
+type labeled struct {
+	metricName string
+	help       string
+	labelNames []string
+
+	mu     sync.Mutex
+	keys   []string            // label keys in insertion order
+	labels map[string][]string // label key -> label values
+}
+
+func newLabeled(name, help string, labelNames []string) labeled {
+	return labeled{
+		metricName: name,
+		help:       help,
+		labelNames: labelNames,
+		labels:     make(map[string][]string),
+	}
+}
+
+func (l *labeled) name() string {
+	return l.metricName
+}
+
+// key returns the map key for the label values, and remembers the values on first use. Must hold l.mu.
+func (l *labeled) key(labelValues []string) string {
+	if len(labelValues) != len(l.labelNames) {
+		panic(fmt.Sprintf("metric %s: expected %d label values, got %d", l.metricName, len(l.labelNames), len(labelValues)))
+	}
+
+	key := strings.Join(labelValues, "\xff")
+	if _, found := l.labels[key]; !found {
+		l.labels[key] = append([]string{}, labelValues...)
+		l.keys = append(l.keys, key)
+	}
+	return key
+}
+
+// sortedKeys returns the label keys sorted by label values. Must hold l.mu.
+func (l *labeled) sortedKeys() []string {
+	keys := append([]string{}, l.keys...)
+	sort.Strings(keys)
+	return keys
+}
+
+func (l *labeled) writeHeader(w io.Writer, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", l.metricName, escapeHelp(l.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", l.metricName, typ)
+}
+
+// labelString formats label values (plus optional extra label) as {a="x",b="y"}
+func (l *labeled) labelString(key string, extraName, extraValue string) string {
+	pairs := make([]string, 0, len(l.labelNames)+1)
+	for i, value := range l.labels[key] {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, l.labelNames[i], escapeLabelValue(value)))
+	}
+	if extraName != "" {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extraName, escapeLabelValue(extraValue)))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// Counter
+type CounterVec struct {
+	labeled
+	values map[string]float64
+}
+
+func NewCounterVec(name, help string, labelNames ...string) *CounterVec {
+	c := &CounterVec{
+		labeled: newLabeled(name, help, labelNames),
+		values:  make(map[string]float64),
+	}
+	DefaultRegistry.register(c)
+	return c
+}
+
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *CounterVec) Add(v float64, labelValues ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[c.key(labelValues)] += v
+}
+
+func (c *CounterVec) Value(labelValues ...string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[strings.Join(labelValues, "\xff")]
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeHeader(w, "counter")
+	for _, key := range c.sortedKeys() {
+		fmt.Fprintf(w, "%s%s %s\n", c.metricName, c.labelString(key, "", ""), formatFloat(c.values[key]))
+	}
+}
+
+// Histogram
+type histogramValue struct {
+	bucketCounts []uint64 // cumulative counts are computed when writing
+	count        uint64
+	sum          float64
+}
+
+type HistogramVec struct {
+	labeled
+	buckets []float64
+	values  map[string]*histogramValue
+}
+
+func NewHistogramVec(name, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	h := &HistogramVec{
+		labeled: newLabeled(name, help, labelNames),
+		buckets: append([]float64{}, buckets...),
+		values:  make(map[string]*histogramValue),
+	}
+	sort.Float64s(h.buckets)
+	DefaultRegistry.register(h)
+	return h
+}
+
+func (h *HistogramVec) Observe(v float64, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	key := h.key(labelValues)
+	value, found := h.values[key]
+	if !found {
+		value = &histogramValue{bucketCounts: make([]uint64, len(h.buckets))}
+		h.values[key] = value
+	}
+
+	for i, upperBound := range h.buckets {
+		if v <= upperBound {
+			value.bucketCounts[i]++
+			break
+		}
+	}
+	value.count++
+	value.sum += v
+}
+
+func (h *HistogramVec) Count(labelValues ...string) uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if value, found := h.values[strings.Join(labelValues, "\xff")]; found {
+		return value.count
+	}
+	return 0
+}
+
+func (h *HistogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.writeHeader(w, "histogram")
+	for _, key := range h.sortedKeys() {
+		value := h.values[key]
+		var cumulative uint64
+		for i, upperBound := range h.buckets {
+			cumulative += value.bucketCounts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.metricName, h.labelString(key, "le", formatFloat(upperBound)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.metricName, h.labelString(key, "le", "+Inf"), value.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.metricName, h.labelString(key, "", ""), formatFloat(value.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.metricName, h.labelString(key, "", ""), value.count)
+	}
+}
+
+// Gauge
+type GaugeVec struct {
+	labeled
+	values map[string]float64
+}
+
+func NewGaugeVec(name, help string, labelNames ...string) *GaugeVec {
+	g := &GaugeVec{
+		labeled: newLabeled(name, help, labelNames),
+		values:  make(map[string]float64),
+	}
+	DefaultRegistry.register(g)
+	return g
+}
+
+func (g *GaugeVec) Set(v float64, labelValues ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.values[g.key(labelValues)] = v
+}
+
+func (g *GaugeVec) Value(labelValues ...string) float64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.values[strings.Join(labelValues, "\xff")]
+}
+
+func (g *GaugeVec) write(w io.Writer) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.writeHeader(w, "gauge")
+	for _, key := range g.sortedKeys() {
+		fmt.Fprintf(w, "%s%s %s\n", g.metricName, g.labelString(key, "", ""), formatFloat(g.values[key]))
+	}
+}
+
+// Gauge (value is read when the metrics are scraped)
+type GaugeFunc struct {
+	labeled
+	f func() float64
+}
+
+func NewGaugeFunc(name, help string, f func() float64) *GaugeFunc {
+	g := &GaugeFunc{
+		labeled: newLabeled(name, help, nil),
+		f:       f,
+	}
+	DefaultRegistry.register(g)
+	return g
+}
+
+func (g *GaugeFunc) write(w io.Writer) {
+	g.writeHeader(w, "gauge")
+	fmt.Fprintf(w, "%s %s\n", g.metricName, formatFloat(g.f()))
+}
+
+// Formatting helpers
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+var helpReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func escapeLabelValue(v string) string {
+	return labelValueReplacer.Replace(v)
+}
+
+func escapeHelp(v string) string {
+	return helpReplacer.Replace(v)
+}
@@ -0,0 +1,89 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCounterVec(t *testing.T) {
+	c := NewCounterVec("test_requests_total", "Number of requests", "method")
+	c.Inc("eth_call")
+	c.Inc("eth_call")
+	c.Add(3, "eth_chainId")
+	c.Inc(`weird"method`)
+
+	require.Equal(t, float64(2), c.Value("eth_call"))
+	require.Equal(t, float64(3), c.Value("eth_chainId"))
+	require.Equal(t, float64(0), c.Value("eth_blockNumber"))
+
+	var buf bytes.Buffer
+	c.write(&buf)
+	expected := `# HELP test_requests_total Number of requests
+# TYPE test_requests_total counter
+test_requests_total{method="eth_call"} 2
+test_requests_total{method="eth_chainId"} 3
+test_requests_total{method="weird\"method"} 1
+`
+	require.Equal(t, expected, buf.String())
+
+	// Wrong number of labels
+	require.Panics(t, func() { c.Inc() })
+}
+
+func TestCounterWithoutLabels(t *testing.T) {
+	c := NewCounterVec("test_events_total", "Number of events")
+	c.Inc()
+
+	var buf bytes.Buffer
+	c.write(&buf)
+	require.True(t, strings.HasSuffix(buf.String(), "test_events_total 1\n"))
+}
+
+func TestHistogramVec(t *testing.T) {
+	h := NewHistogramVec("test_duration_seconds", "Duration", []float64{1, 0.1}, "upstream")
+	h.Observe(0.05, "a")
+	h.Observe(0.5, "a")
+	h.Observe(5, "a")
+	require.Equal(t, uint64(3), h.Count("a"))
+
+	var buf bytes.Buffer
+	h.write(&buf)
+	expected := `# HELP test_duration_seconds Duration
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{upstream="a",le="0.1"} 1
+test_duration_seconds_bucket{upstream="a",le="1"} 2
+test_duration_seconds_bucket{upstream="a",le="+Inf"} 3
+test_duration_seconds_sum{upstream="a"} 5.55
+test_duration_seconds_count{upstream="a"} 3
+`
+	require.Equal(t, expected, buf.String())
+}
+
+func TestGaugeVec(t *testing.T) {
+	g := NewGaugeVec("test_queue_depth", "Queue depth", "chain")
+	g.Set(3, "mainnet")
+	g.Set(1, "mainnet")
+	g.Set(0.5, "goerli")
+	require.Equal(t, float64(1), g.Value("mainnet"))
+
+	var buf bytes.Buffer
+	g.write(&buf)
+	expected := `# HELP test_queue_depth Queue depth
+# TYPE test_queue_depth gauge
+test_queue_depth{chain="goerli"} 0.5
+test_queue_depth{chain="mainnet"} 1
+`
+	require.Equal(t, expected, buf.String())
+}
+
+func TestRegistry(t *testing.T) {
+	NewGaugeFunc("test_gauge", "A gauge", func() float64 { return 7 })
+	require.Panics(t, func() { NewGaugeFunc("test_gauge", "A gauge", func() float64 { return 7 }) })
+
+	var buf bytes.Buffer
+	DefaultRegistry.Write(&buf)
+	require.Contains(t, buf.String(), "# TYPE test_gauge gauge\ntest_gauge 7\n")
+}
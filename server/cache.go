@@ -0,0 +1,281 @@
+/*
+Response cache for read calls that are proxied to the nodes. Each request is classified as:
+
+- immutable: the result never changes (eth_chainId, blocks by hash, state at a block deep enough to not be reorged)
+- block-scoped: the result is valid until the next block ("latest" state, eth_blockNumber, eth_gasPrice)
+- never cached: everything else (pending state, filters, eth_getLogs, nonces, ...)
+
+Block-scoped entries are keyed by the head block number of the proxy pool, which is updated by the health checks. As
+the head can lag behind by up to the health check interval, their TTL is bounded by the block time of the chain, so
+they are at most about one block stale. Entries are kept in an in-memory LRU, and optionally in Redis to share
+them between replicas.
+*/
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/flashbots/rpc-endpoint/types"
+	"github.com/go-redis/redis/v8"
+	lru "github.com/hashicorp/golang-lru"
+)
+
+// Blocks at least this deep are treated as final
+var CacheReorgDepth uint64 = 64
+
+var CacheImmutableTTL = time.Duration(1 * time.Hour)
+var CacheBlockScopedTTL = time.Duration(1 * time.Minute)
+
+var RedisPrefixResponseCache = RedisPrefix + "response-cache:"
+
+type cachePolicy int
+
+const (
+	cacheNever cachePolicy = iota
+	cacheBlockScoped
+	cacheImmutable
+	cacheMinedTx // immutable once the tx is mined deep enough, not cached before
+)
+
+// Methods without block parameter
+var cacheMethodPolicies = map[string]cachePolicy{
+	"eth_chainId":                           cacheImmutable,
+	"eth_getBlockByHash":                    cacheImmutable,
+	"eth_getBlockTransactionCountByHash":    cacheImmutable,
+	"eth_getUncleCountByBlockHash":          cacheImmutable,
+	"eth_getTransactionByBlockHashAndIndex": cacheImmutable,
+	"eth_getUncleByBlockHashAndIndex":       cacheImmutable,
+	"eth_getTransactionByHash":              cacheMinedTx,
+	"eth_getTransactionReceipt":             cacheMinedTx,
+	"eth_blockNumber":                       cacheBlockScoped,
+	"eth_gasPrice":                          cacheBlockScoped,
+	"eth_maxPriorityFeePerGas":              cacheBlockScoped,
+}
+
+// Methods with a block parameter, and its position in the params. A missing block parameter means "latest".
+var cacheBlockParamIndex = map[string]int{
+	"eth_getBalance":                          1,
+	"eth_getCode":                             1,
+	"eth_getStorageAt":                        2,
+	"eth_call":                                1,
+	"eth_estimateGas":                         1,
+	"eth_feeHistory":                          1,
+	"eth_getBlockByNumber":                    0,
+	"eth_getBlockTransactionCountByNumber":    0,
+	"eth_getUncleCountByBlockNumber":          0,
+	"eth_getTransactionByBlockNumberAndIndex": 0,
+	"eth_getUncleByBlockNumberAndIndex":       0,
+}
+
+// Policy for a specific block number, given the current head (0 if unknown)
+func blockNumberCachePolicy(blockNumber uint64, head uint64) cachePolicy {
+	if head == 0 || blockNumber > head {
+		return cacheNever
+	}
+	if blockNumber+CacheReorgDepth <= head {
+		return cacheImmutable
+	}
+	return cacheBlockScoped
+}
+
+// Policy for a block parameter: a tag, a hex number, or an EIP-1898 object with blockHash or blockNumber
+func blockParamCachePolicy(param interface{}, head uint64) cachePolicy {
+	switch p := param.(type) {
+	case nil:
+		return cacheBlockScoped
+	case string:
+		switch p {
+		case "latest", "safe", "finalized":
+			return cacheBlockScoped
+		case "earliest":
+			return cacheImmutable
+		case "pending":
+			return cacheNever
+		}
+		blockNumber, err := hexutil.DecodeUint64(p)
+		if err != nil {
+			return cacheNever
+		}
+		return blockNumberCachePolicy(blockNumber, head)
+	case map[string]interface{}:
+		if _, ok := p["blockHash"]; ok {
+			return cacheImmutable
+		}
+		if blockNumber, ok := p["blockNumber"]; ok {
+			return blockParamCachePolicy(blockNumber, head)
+		}
+	}
+	return cacheNever
+}
+
+func requestCachePolicy(req *types.JsonRpcRequest, head uint64) cachePolicy {
+	if req.NamedParams != nil {
+		return cacheNever // the key is made of the positional params
+	}
+	if policy, ok := cacheMethodPolicies[req.Method]; ok {
+		return policy
+	}
+
+	index, ok := cacheBlockParamIndex[req.Method]
+	if !ok {
+		return cacheNever
+	}
+	if index >= len(req.Params) {
+		return blockParamCachePolicy(nil, head)
+	}
+	return blockParamCachePolicy(req.Params[index], head)
+}
+
+// Cache key of the request. Block-scoped keys include the head block number, so they change with every block.
+func requestCacheKey(req *types.JsonRpcRequest, policy cachePolicy, head uint64) (string, error) {
+	params, err := json.Marshal(req.Params) // map keys are sorted, so equal params give equal keys
+	if err != nil {
+		return "", err
+	}
+
+	key := req.Method + ":" + string(params)
+	if policy == cacheBlockScoped {
+		key = hexutil.EncodeUint64(head) + ":" + key
+	}
+	return key, nil
+}
+
+// Final policy for a response: only non-null results are cached, and txs only once they are final
+func responseCachePolicy(policy cachePolicy, result json.RawMessage, head uint64) cachePolicy {
+	if len(result) == 0 || string(result) == "null" {
+		return cacheNever
+	}
+	if policy != cacheMinedTx {
+		return policy
+	}
+
+	var tx struct {
+		BlockNumber *hexutil.Uint64 `json:"blockNumber"`
+	}
+	if err := json.Unmarshal(result, &tx); err != nil || tx.BlockNumber == nil {
+		return cacheNever // pending tx
+	}
+	if blockNumberCachePolicy(uint64(*tx.BlockNumber), head) != cacheImmutable {
+		return cacheNever // could still be reorged into another block
+	}
+	return cacheImmutable
+}
+
+type cacheEntry struct {
+	result  json.RawMessage
+	expires time.Time
+}
+
+type ResponseCache struct {
+	lru         *lru.Cache
+	redisClient redis.UniversalClient // optional
+	chainId     uint64                // replicas of other chains may share the same Redis
+	clock       Clock
+}
+
+func NewResponseCache(size int, redisClient redis.UniversalClient, chainId uint64, clock Clock) (*ResponseCache, error) {
+	lruCache, err := lru.New(size)
+	if err != nil {
+		return nil, err
+	}
+	return &ResponseCache{lru: lruCache, redisClient: redisClient, chainId: chainId, clock: clock}, nil
+}
+
+func (c *ResponseCache) redisKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return RedisPrefixResponseCache + strconv.FormatUint(c.chainId, 10) + ":" + hex.EncodeToString(hash[:])
+}
+
+func (c *ResponseCache) Get(ctx context.Context, key string) (result json.RawMessage, found bool) {
+	if value, ok := c.lru.Get(key); ok {
+		entry := value.(*cacheEntry)
+		if c.clock().Before(entry.expires) {
+			return entry.result, true
+		}
+		c.lru.Remove(key)
+	}
+
+	if c.redisClient == nil {
+		return nil, false
+	}
+
+	redisKey := c.redisKey(key)
+	val, err := c.redisClient.Get(ctx, redisKey).Result()
+	if err != nil {
+		return nil, false
+	}
+
+	// Keep it in memory for the remaining TTL
+	if ttl, err := c.redisClient.PTTL(ctx, redisKey).Result(); err == nil && ttl > 0 {
+		c.lru.Add(key, &cacheEntry{result: json.RawMessage(val), expires: c.clock().Add(ttl)})
+	}
+	return json.RawMessage(val), true
+}
+
+func (c *ResponseCache) Set(ctx context.Context, key string, result json.RawMessage, ttl time.Duration) error {
+	c.lru.Add(key, &cacheEntry{result: result, expires: c.clock().Add(ttl)})
+	if c.redisClient == nil {
+		return nil
+	}
+	return c.redisClient.Set(ctx, c.redisKey(key), string(result), ttl).Err()
+}
+
+func cachePolicyTTL(policy cachePolicy, blockTime time.Duration) time.Duration {
+	if policy == cacheImmutable {
+		return CacheImmutableTTL
+	}
+	if blockTime < CacheBlockScopedTTL {
+		return blockTime
+	}
+	return CacheBlockScopedTTL
+}
+
+// Like proxyRequestRead, but answers cacheable requests from the cache, and caches their results
+func (r *RpcRequest) cachedProxyRequestRead() error {
+	if r.cache == nil || r.proxyPool.custom { // custom urls may point to other chains or state
+		return r.proxyRequestRead()
+	}
+
+	head := r.proxyPool.HeadBlockNumber()
+	policy := requestCachePolicy(r.jsonReq, head)
+	if policy == cacheNever || (policy == cacheBlockScoped && (head == 0 || r.chain.BlockTime == 0)) {
+		return r.proxyRequestRead()
+	}
+
+	key, err := requestCacheKey(r.jsonReq, policy, head)
+	if err != nil {
+		r.logger.logError("[cache] failed to create key: %v", err)
+		return r.proxyRequestRead()
+	}
+
+	methodLabel := metricsMethodLabel(r.jsonReq.Method)
+	if result, found := r.cache.Get(r.ctx, key); found {
+		metricCacheRequests.Inc(methodLabel, "hit")
+		r.jsonRes = types.NewJsonRpcResponse(r.jsonReq.Id, result)
+		return nil
+	}
+	metricCacheRequests.Inc(methodLabel, "miss")
+
+	if err = r.proxyRequestRead(); err != nil {
+		return err
+	}
+	if r.jsonRes.Error != nil {
+		return nil
+	}
+
+	policy = responseCachePolicy(policy, r.jsonRes.Result, head)
+	if policy == cacheNever {
+		return nil
+	}
+
+	if err = r.cache.Set(r.ctx, key, r.jsonRes.Result, cachePolicyTTL(policy, r.chain.BlockTime)); err != nil {
+		r.logger.logError("[cache] set failed: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,210 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/flashbots/rpc-endpoint/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestCachePolicy(t *testing.T) {
+	head := uint64(1000)
+	tests := []struct {
+		method string
+		params []interface{}
+		head   uint64
+		policy cachePolicy
+	}{
+		{"eth_chainId", nil, head, cacheImmutable},
+		{"eth_getBlockByHash", []interface{}{"0xabc", false}, head, cacheImmutable},
+		{"eth_blockNumber", nil, head, cacheBlockScoped},
+		{"eth_getTransactionReceipt", []interface{}{"0xabc"}, head, cacheMinedTx},
+		{"eth_getBalance", []interface{}{"0xabc"}, head, cacheBlockScoped},
+		{"eth_getBalance", []interface{}{"0xabc", "latest"}, head, cacheBlockScoped},
+		{"eth_getBalance", []interface{}{"0xabc", "pending"}, head, cacheNever},
+		{"eth_getBalance", []interface{}{"0xabc", "earliest"}, head, cacheImmutable},
+		{"eth_call", []interface{}{map[string]interface{}{"to": "0xabc"}, "0x64"}, head, cacheImmutable},
+		{"eth_call", []interface{}{map[string]interface{}{"to": "0xabc"}, "0x3e0"}, head, cacheBlockScoped}, // 992: not final yet
+		{"eth_call", []interface{}{map[string]interface{}{"to": "0xabc"}, "0x3e9"}, head, cacheNever},       // 1001: future block
+		{"eth_call", []interface{}{map[string]interface{}{"to": "0xabc"}, "0x64"}, 0, cacheNever},           // head unknown
+		{"eth_call", []interface{}{map[string]interface{}{"to": "0xabc"}, map[string]interface{}{"blockHash": "0xdef"}}, head, cacheImmutable},
+		{"eth_getStorageAt", []interface{}{"0xabc", "0x0", "0x64"}, head, cacheImmutable},
+		{"eth_getBlockByNumber", []interface{}{"invalid", false}, head, cacheNever},
+		{"eth_getLogs", []interface{}{map[string]interface{}{"blockHash": "0xdef"}}, head, cacheNever},
+		{"eth_getTransactionCount", []interface{}{"0xabc", "0x64"}, head, cacheNever},
+		{"eth_sendRawTransaction", []interface{}{"0xabc"}, head, cacheNever},
+	}
+
+	for _, test := range tests {
+		req := types.NewJsonRpcRequest(1, test.method, test.params)
+		require.Equal(t, test.policy, requestCachePolicy(req, test.head), "%s %v", test.method, test.params)
+	}
+}
+
+func TestResponseCachePolicy(t *testing.T) {
+	require.Equal(t, cacheNever, responseCachePolicy(cacheImmutable, json.RawMessage("null"), 1000))
+	require.Equal(t, cacheImmutable, responseCachePolicy(cacheImmutable, json.RawMessage(`"0x1"`), 1000))
+
+	// Txs are only cached once they are final
+	require.Equal(t, cacheNever, responseCachePolicy(cacheMinedTx, json.RawMessage(`{"blockNumber":null}`), 1000))
+	require.Equal(t, cacheNever, responseCachePolicy(cacheMinedTx, json.RawMessage(`{"blockNumber":"0x3e0"}`), 1000))
+	require.Equal(t, cacheImmutable, responseCachePolicy(cacheMinedTx, json.RawMessage(`{"blockNumber":"0x64"}`), 1000))
+}
+
+func TestRequestCacheKey(t *testing.T) {
+	req1 := types.NewJsonRpcRequest(1, "eth_call", []interface{}{map[string]interface{}{"to": "0xabc", "data": "0x1"}, "latest"})
+	req2 := types.NewJsonRpcRequest(2, "eth_call", []interface{}{map[string]interface{}{"data": "0x1", "to": "0xabc"}, "latest"})
+
+	key1, err := requestCacheKey(req1, cacheBlockScoped, 1000)
+	require.Nil(t, err, err)
+	key2, _ := requestCacheKey(req2, cacheBlockScoped, 1000)
+	require.Equal(t, key1, key2)
+
+	// Block-scoped keys change with the head
+	key3, _ := requestCacheKey(req1, cacheBlockScoped, 1001)
+	require.NotEqual(t, key1, key3)
+	key4, _ := requestCacheKey(req1, cacheImmutable, 1000)
+	key5, _ := requestCacheKey(req1, cacheImmutable, 1001)
+	require.Equal(t, key4, key5)
+}
+
+func TestResponseCacheExpiryAndRedis(t *testing.T) {
+	resetRedis()
+	timeNow := time.Unix(1640000000, 0)
+	clock := &testClock{now: timeNow}
+
+	cache, err := NewResponseCache(10, redisState.RedisClient, 1, clock.Now)
+	require.Nil(t, err, err)
+
+	err = cache.Set(ctx, "key", json.RawMessage(`"0x1"`), time.Minute)
+	require.Nil(t, err, err)
+	result, found := cache.Get(ctx, "key")
+	require.True(t, found)
+	require.Equal(t, `"0x1"`, string(result))
+
+	// Another replica finds it in Redis
+	cache2, _ := NewResponseCache(10, redisState.RedisClient, 1, clock.Now)
+	result, found = cache2.Get(ctx, "key")
+	require.True(t, found)
+	require.Equal(t, `"0x1"`, string(result))
+
+	// Expired in memory and in Redis
+	clock.Set(timeNow.Add(2 * time.Minute))
+	redisServer.FastForward(2 * time.Minute)
+	_, found = cache.Get(ctx, "key")
+	require.False(t, found)
+}
+
+// Servers of different chains sharing one Redis don't answer from each other's cache
+func TestResponseCacheRedisPerChain(t *testing.T) {
+	resetRedis()
+
+	newServer := func(chain string) *httptest.Server {
+		node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"jsonrpc":"2.0","id":1,"result":"%s"}`, hexutil.EncodeUint64(Chains[chain].ChainId))
+		}))
+		t.Cleanup(node.Close)
+
+		s, err := NewRpcEndPointServer(RpcEndPointServerConfig{
+			ProxyUrls:          []string{node.URL},
+			Chain:              Chains[chain],
+			StateStore:         redisState,
+			ResponseCacheSize:  10,
+			ResponseCacheRedis: true,
+		})
+		require.Nil(t, err, err)
+		server := httptest.NewServer(s.Handler())
+		t.Cleanup(server.Close)
+		return server
+	}
+
+	chainId := func(url string) string {
+		body, _ := json.Marshal(types.NewJsonRpcRequest(1, "eth_chainId", nil))
+		resp, err := http.Post(url, "application/json", bytes.NewReader(body))
+		require.Nil(t, err, err)
+		defer resp.Body.Close()
+		res := new(types.JsonRpcResponse)
+		err = json.NewDecoder(resp.Body).Decode(res)
+		require.Nil(t, err, err)
+		return string(res.Result)
+	}
+
+	goerli, sepolia := newServer("goerli"), newServer("sepolia")
+	require.Equal(t, `"0x5"`, chainId(goerli.URL))
+	require.Equal(t, `"0xaa36a7"`, chainId(sepolia.URL))
+	require.Equal(t, `"0x5"`, chainId(goerli.URL))
+}
+
+func TestCachePolicyTTL(t *testing.T) {
+	require.Equal(t, CacheImmutableTTL, cachePolicyTTL(cacheImmutable, 12*time.Second))
+	require.Equal(t, 12*time.Second, cachePolicyTTL(cacheBlockScoped, 12*time.Second))
+	require.Equal(t, CacheBlockScopedTTL, cachePolicyTTL(cacheBlockScoped, time.Hour))
+}
+
+func TestCachedProxyRequest(t *testing.T) {
+	deps := newTestDeps()
+	var err error
+	deps.cache, err = NewResponseCache(100, nil, 1, time.Now)
+	require.Nil(t, err, err)
+
+	var numRequests int32
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&numRequests, 1)
+		var jsonReq types.JsonRpcRequest
+		json.NewDecoder(req.Body).Decode(&jsonReq)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"jsonrpc":"2.0","id":%v,"result":"0x1"}`, jsonReq.Id)
+	}))
+	defer node.Close()
+
+	process := func(pool *ProxyPool, id int, method string) *types.JsonRpcResponse {
+		req := NewRpcRequest(context.Background(), deps, NewLogger("test"), types.NewJsonRpcRequest(id, method, nil), pool, "", "", "")
+		return req.ProcessRequest()
+	}
+
+	// Immutable: second request is answered from the cache, with its own id
+	pool := NewProxyPool([]string{node.URL}, ProxyPoolConfig{})
+	res := process(pool, 1, "eth_chainId")
+	require.Equal(t, `"0x1"`, string(res.Result))
+	res = process(pool, 2, "eth_chainId")
+	require.Equal(t, `"0x1"`, string(res.Result))
+	require.Equal(t, 2, res.Id)
+	require.Equal(t, int32(1), atomic.LoadInt32(&numRequests))
+
+	// Block-scoped: not cached while the head is unknown, then cached per head
+	process(pool, 3, "eth_gasPrice")
+	require.Equal(t, int32(2), atomic.LoadInt32(&numRequests))
+	pool.headBlockNumber = 100
+	process(pool, 4, "eth_gasPrice")
+	process(pool, 5, "eth_gasPrice")
+	require.Equal(t, int32(3), atomic.LoadInt32(&numRequests))
+	pool.headBlockNumber = 101
+	process(pool, 6, "eth_gasPrice")
+	require.Equal(t, int32(4), atomic.LoadInt32(&numRequests))
+
+	// Never cached
+	process(pool, 7, "eth_getFilterChanges")
+	process(pool, 8, "eth_getFilterChanges")
+	require.Equal(t, int32(6), atomic.LoadInt32(&numRequests))
+
+	// Block-scoped responses aren't cached without a block time
+	deps.chain.BlockTime = 0
+	process(pool, 9, "eth_gasPrice")
+	require.Equal(t, int32(7), atomic.LoadInt32(&numRequests))
+	deps.chain.BlockTime = Chains["mainnet"].BlockTime
+
+	// Custom urls bypass the cache
+	customPool := NewCustomProxyPool(node.URL, http.DefaultClient)
+	process(customPool, 10, "eth_chainId")
+	require.Equal(t, int32(8), atomic.LoadInt32(&numRequests))
+}
@@ -0,0 +1,113 @@
+// Chain configuration, so the same binary can serve mainnet, testnets or a local devnet.
+package server
+
+import (
+	"fmt"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+type ChainConfig struct {
+	Name             string
+	ChainId          uint64
+	RelayUrl         string
+	ProtectTxApiHost string
+	CheckContract    string        // eth_calls to this contract are answered with 1, to check if the RPC is used (disabled if empty)
+	BlockTime        time.Duration // upper bound for the TTL of cached "latest" responses (not cached if 0)
+}
+
+// Known networks, selected with -chain
+var Chains = map[string]ChainConfig{
+	"mainnet": {
+		Name:             "mainnet",
+		ChainId:          1,
+		RelayUrl:         "https://relay.flashbots.net",
+		ProtectTxApiHost: "https://protect.flashbots.net",
+		BlockTime:        12 * time.Second,
+		// 0xf1a54b075 --> 0xflashbots
+		// https://etherscan.io/address/0xf1a54b0759b58661cea17cff19dd37940a9b5f1a#readContract
+		CheckContract: "0xf1a54b0759b58661cea17cff19dd37940a9b5f1a",
+	},
+	"goerli": {
+		Name:             "goerli",
+		ChainId:          5,
+		RelayUrl:         "https://relay-goerli.flashbots.net",
+		ProtectTxApiHost: "https://protect-goerli.flashbots.net",
+		BlockTime:        12 * time.Second,
+	},
+	"sepolia": {
+		Name:             "sepolia",
+		ChainId:          11155111,
+		RelayUrl:         "https://relay-sepolia.flashbots.net",
+		ProtectTxApiHost: "https://protect-sepolia.flashbots.net",
+		BlockTime:        12 * time.Second,
+	},
+}
+
+func ChainNames() []string {
+	names := make([]string, 0, len(Chains))
+	for name := range Chains {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// GetChainConfig returns the config of a known network by name, or a custom config for a decimal chain id (e.g. a
+// local devnet), which has no relay url and protect api host until they are set explicitly.
+func GetChainConfig(name string) (ChainConfig, error) {
+	if chain, ok := Chains[strings.ToLower(name)]; ok {
+		return chain, nil
+	}
+
+	chainId, err := strconv.ParseUint(name, 10, 64)
+	if err != nil || chainId == 0 {
+		return ChainConfig{}, fmt.Errorf("unknown chain: %s (use one of %s, or a chain id)", name, strings.Join(ChainNames(), ", "))
+	}
+	for _, chain := range Chains {
+		if chain.ChainId == chainId {
+			return chain, nil
+		}
+	}
+	return ChainConfig{Name: name, ChainId: chainId}, nil
+}
+
+func (c ChainConfig) Validate() error {
+	if c.ChainId == 0 {
+		return fmt.Errorf("chain %s: chain id must not be 0", c.Name)
+	}
+	if c.RelayUrl == "" {
+		return fmt.Errorf("chain %s: no relay url", c.Name)
+	}
+	if c.ProtectTxApiHost == "" {
+		return fmt.Errorf("chain %s: no protect tx api host", c.Name)
+	}
+	if c.CheckContract != "" && !common.IsHexAddress(c.CheckContract) {
+		return fmt.Errorf("chain %s: invalid check contract address: %s", c.Name, c.CheckContract)
+	}
+	return nil
+}
+
+// Result of net_version: the chain id in decimal
+func (c ChainConfig) NetVersion() string {
+	return strconv.FormatUint(c.ChainId, 10)
+}
+
+// IsCheckContract returns true if the address is the RPC check contract of this chain
+func (c ChainConfig) IsCheckContract(address string) bool {
+	return c.CheckContract != "" && strings.EqualFold(address, c.CheckContract)
+}
+
+// AllowsTxChainId returns false if the tx was signed for another chain. Legacy txs without replay protection
+// (chain id 0) are valid on every chain and allowed.
+func (c ChainConfig) AllowsTxChainId(chainId *big.Int) bool {
+	if chainId == nil || chainId.Sign() == 0 {
+		return true
+	}
+	return chainId.IsUint64() && chainId.Uint64() == c.ChainId
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetChainConfig(t *testing.T) {
+	chain, err := GetChainConfig("Goerli")
+	require.Nil(t, err, err)
+	require.Equal(t, uint64(5), chain.ChainId)
+	require.Equal(t, "5", chain.NetVersion())
+
+	// Known chain id
+	chain, err = GetChainConfig("11155111")
+	require.Nil(t, err, err)
+	require.Equal(t, "sepolia", chain.Name)
+
+	// Custom chain needs relay and protect api
+	chain, err = GetChainConfig("1337")
+	require.Nil(t, err, err)
+	require.Equal(t, uint64(1337), chain.ChainId)
+	require.NotNil(t, chain.Validate())
+	chain.RelayUrl = "http://localhost:8080"
+	chain.ProtectTxApiHost = "http://localhost:8081"
+	require.Nil(t, chain.Validate())
+	chain.CheckContract = "0x123"
+	require.NotNil(t, chain.Validate())
+
+	_, err = GetChainConfig("foo")
+	require.NotNil(t, err)
+	_, err = GetChainConfig("0")
+	require.NotNil(t, err)
+
+	for _, chain := range Chains {
+		require.Nil(t, chain.Validate())
+	}
+}
+
+func TestChainConfigChecks(t *testing.T) {
+	chain := Chains["mainnet"]
+	require.True(t, chain.IsCheckContract("0xF1A54B0759B58661CEA17CFF19DD37940A9B5F1A"))
+	require.False(t, chain.IsCheckContract("0xf1a54b0759b58661cea17cff19dd37940a9b5f1b"))
+	require.False(t, Chains["goerli"].IsCheckContract(""))
+
+	require.True(t, chain.AllowsTxChainId(big.NewInt(1)))
+	require.True(t, chain.AllowsTxChainId(big.NewInt(0))) // unprotected legacy tx
+	require.True(t, chain.AllowsTxChainId(nil))
+	require.False(t, chain.AllowsTxChainId(big.NewInt(5)))
+	require.False(t, chain.AllowsTxChainId(new(big.Int).Lsh(big.NewInt(1), 70)))
+}
@@ -0,0 +1,163 @@
+// Configuration and dependencies of an RpcEndPointServer. Everything a server and its requests use is passed in the
+// config instead of package-level globals, so several servers (e.g. one per chain) can run in one process.
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/flashbots/rpc-endpoint/tracing"
+	"github.com/flashbots/rpc-endpoint/types"
+	"github.com/pkg/errors"
+)
+
+var DefaultShutdownTimeout = time.Duration(30 * time.Second)
+
+var DefaultTxLifecycleRetention = time.Duration(30 * 24 * time.Hour) // 30 days
+
+// Deadlines of a request and of each call it makes to a node, the relay or the tx status API. Redis commands are
+// limited by the read and write timeouts of the Redis config.
+type RequestTimeouts struct {
+	Request  time.Duration
+	Proxy    time.Duration
+	Relay    time.Duration
+	TxStatus time.Duration
+}
+
+var DefaultRequestTimeouts = RequestTimeouts{
+	Request:  time.Duration(30 * time.Second),
+	Proxy:    time.Duration(10 * time.Second),
+	Relay:    time.Duration(10 * time.Second),
+	TxStatus: time.Duration(5 * time.Second),
+}
+
+// Sets the zero fields to the defaults
+func (t RequestTimeouts) withDefaults() RequestTimeouts {
+	if t.Request == 0 {
+		t.Request = DefaultRequestTimeouts.Request
+	}
+	if t.Proxy == 0 {
+		t.Proxy = DefaultRequestTimeouts.Proxy
+	}
+	if t.Relay == 0 {
+		t.Relay = DefaultRequestTimeouts.Relay
+	}
+	if t.TxStatus == 0 {
+		t.TxStatus = DefaultRequestTimeouts.TxStatus
+	}
+	return t
+}
+
+// Clock returns the current time. It is injected so tests can control time.
+type Clock func() time.Time
+
+// TxStatusClient looks up the status of private transactions
+type TxStatusClient interface {
+	GetTxStatus(ctx context.Context, txHash string) (*types.PrivateTxApiResponse, error)
+}
+
+// ProtectTxStatusClient queries the tx status API of Flashbots Protect
+type ProtectTxStatusClient struct {
+	ApiHost    string
+	HttpClient *http.Client
+}
+
+func NewProtectTxStatusClient(apiHost string) *ProtectTxStatusClient {
+	return &ProtectTxStatusClient{ApiHost: apiHost, HttpClient: tracing.NewClient()}
+}
+
+func (c *ProtectTxStatusClient) GetTxStatus(ctx context.Context, txHash string) (*types.PrivateTxApiResponse, error) {
+	privTxApiUrl := fmt.Sprintf("%s/tx/%s", c.ApiHost, txHash)
+	req, err := http.NewRequestWithContext(ctx, "GET", privTxApiUrl, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "privTxApi request failed for "+txHash)
+	}
+	resp, err := c.HttpClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "privTxApi call failed for "+txHash)
+	}
+	defer resp.Body.Close()
+
+	bodyBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "privTxApi body-read failed for "+txHash)
+	}
+
+	respObj := new(types.PrivateTxApiResponse)
+	err = json.Unmarshal(bodyBytes, respObj)
+	if err != nil {
+		msg := fmt.Sprintf("privTxApi jsonUnmarshal failed for %s - status: %d / body: %s", txHash, resp.StatusCode, string(bodyBytes))
+		return nil, errors.Wrap(err, msg)
+	}
+
+	return respObj, nil
+}
+
+type RpcEndPointServerConfig struct {
+	Version         string
+	ListenAddress   string
+	ProxyUrls       []string
+	WsProxyUrl      string // eth_subscribe is disabled if empty
+	AdminApiKey     string // bearer token for the /admin endpoints, which are disabled if empty
+	RelaySigningKey *ecdsa.PrivateKey
+	Chain           ChainConfig // default: mainnet
+
+	StateStore     StateStore     // required, closed on shutdown
+	Relays         []RelayTarget  // private tx targets, default: a FlashbotsRelayClient for the relay of the chain
+	TxStatusClient TxStatusClient // default: ProtectTxStatusClient for the protect api host of the chain
+	Clock          Clock          // default: time.Now
+	Logger         Logger         // default: NewLogger(""), request loggers are children of it
+
+	DebugDontSendTx      bool              // don't send raw transactions anywhere
+	SimulationMode       string            // simulation is disabled if empty
+	RateLimits           *RateLimitConfig  // rate limiting is disabled if nil
+	ResponseCacheSize    int               // caching is disabled if 0
+	ResponseCacheRedis   bool              // also store cached responses in Redis (needs the redis state backend)
+	ProxyPool            ProxyPoolConfig   // zero fields are set to DefaultProxyPoolConfig
+	Timeouts             RequestTimeouts   // zero fields are set to DefaultRequestTimeouts
+	CustomProxy          CustomProxyPolicy // for ?url= proxy targets, zero fields are set to DefaultCustomProxyPolicy
+	TxTracker            TxTrackerConfig   // zero fields are set to DefaultTxTrackerConfig
+	TxLifecycleRetention time.Duration     // how long lifecycle records are kept, default: DefaultTxLifecycleRetention
+	ProtectionPolicy     *ProtectionPolicy // default: DefaultProtectionPolicy(), can be replaced with SetProtectionPolicy
+	OFACList             *OFACList         // default: BuiltinOFACList(), can be replaced with SetOFACList
+
+	// On shutdown /health reports draining for this long before the listener is closed, so load balancers stop routing to us
+	ShutdownDrainDelay time.Duration
+	// Maximum time to wait for in-flight requests on shutdown (default: DefaultShutdownTimeout)
+	ShutdownTimeout time.Duration
+}
+
+// Services and settings of a server that its requests use
+type requestDeps struct {
+	state           StateStore
+	relays          []RelayTarget  // the first one also simulates
+	txStatus        TxStatusClient // only used by the tx tracker
+	txTracker       *txTracker
+	clock           Clock
+	chain           ChainConfig
+	relaySigningKey *ecdsa.PrivateKey
+	rateLimiter     *RateLimiter   // nil if rate limiting is disabled
+	cache           *ResponseCache // nil if caching is disabled
+	simulationMode  string
+	debugDontSendTx bool
+	timeouts        RequestTimeouts
+
+	txLifecycleRetention time.Duration
+
+	customProxyPolicy CustomProxyPolicy
+	customProxyClient *http.Client
+
+	reloadableLock   sync.RWMutex // protectionPolicy and ofacList are replaced on reload
+	protectionPolicy *ProtectionPolicy
+	ofacList         *OFACList
+
+	// In-flight requests, including batch workers, WebSocket messages and background writes, which are waited for on
+	// shutdown
+	inflight *sync.WaitGroup
+}
@@ -0,0 +1,251 @@
+/*
+Requests can be proxied to a node of the user's choice with ?url=. To keep the server from being used to reach internal
+services (e.g. cloud metadata at 169.254.169.254 or Redis on localhost), custom urls must pass a policy:
+
+  - the scheme must be allowed (http and https by default)
+  - if an allowlist is configured, the host must be on it
+  - the host must not resolve to loopback, private, link-local or other non-public addresses, which is checked again
+    for every connection so DNS rebinding doesn't help
+
+Custom urls use a dedicated HTTP client with tight timeouts and a response size limit, which doesn't follow redirects.
+*/
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/flashbots/rpc-endpoint/tracing"
+	"github.com/pkg/errors"
+)
+
+var ErrCustomProxyResponseTooLarge = errors.New("custom proxy response too large")
+
+type CustomProxyPolicy struct {
+	Schemes         []string      // default: http, https
+	AllowedHosts    []string      // if set, only these hosts are allowed ("*.example.com" also matches subdomains)
+	AllowPrivate    bool          // allow non-public addresses, e.g. for a local devnet
+	Timeout         time.Duration // whole request including the response body, default: 5s
+	DialTimeout     time.Duration // connecting, TLS handshake and DNS lookups, default: 2s
+	MaxResponseSize int64         // bytes, default: 5 MB
+}
+
+var DefaultCustomProxyPolicy = CustomProxyPolicy{
+	Schemes:         []string{"http", "https"},
+	Timeout:         time.Duration(5 * time.Second),
+	DialTimeout:     time.Duration(2 * time.Second),
+	MaxResponseSize: 5 * 1024 * 1024,
+}
+
+// Sets the zero fields to the defaults
+func (p CustomProxyPolicy) withDefaults() CustomProxyPolicy {
+	if len(p.Schemes) == 0 {
+		p.Schemes = DefaultCustomProxyPolicy.Schemes
+	}
+	if p.Timeout == 0 {
+		p.Timeout = DefaultCustomProxyPolicy.Timeout
+	}
+	if p.DialTimeout == 0 {
+		p.DialTimeout = DefaultCustomProxyPolicy.DialTimeout
+	}
+	if p.MaxResponseSize == 0 {
+		p.MaxResponseSize = DefaultCustomProxyPolicy.MaxResponseSize
+	}
+	return p
+}
+
+// Address ranges which aren't reachable on the public internet
+var nonPublicNetworks = mustParseCIDRs(
+	"0.0.0.0/8",      // "this" network
+	"10.0.0.0/8",     // private
+	"100.64.0.0/10",  // carrier-grade NAT
+	"127.0.0.0/8",    // loopback
+	"169.254.0.0/16", // link-local, cloud metadata
+	"172.16.0.0/12",  // private
+	"192.0.0.0/24",   // IETF protocol assignments
+	"192.168.0.0/16", // private
+	"198.18.0.0/15",  // benchmarking
+	"224.0.0.0/4",    // multicast
+	"240.0.0.0/4",    // reserved, broadcast
+	"::/128",         // unspecified
+	"::1/128",        // loopback
+	"64:ff9b::/96",   // IPv4/IPv6 translation, may map to any of the above
+	"fc00::/7",       // unique local
+	"fe80::/10",      // link-local
+	"ff00::/8",       // multicast
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks[i] = network
+	}
+	return networks
+}
+
+// IsPublicIP returns false for loopback, private, link-local, multicast and reserved addresses
+func IsPublicIP(ip net.IP) bool {
+	for _, network := range nonPublicNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+func (p CustomProxyPolicy) isHostAllowed(host string) bool {
+	if len(p.AllowedHosts) == 0 {
+		return true
+	}
+	for _, allowed := range p.AllowedHosts {
+		allowed = strings.ToLower(allowed)
+		if host == allowed {
+			return true
+		}
+		if strings.HasPrefix(allowed, "*.") && strings.HasSuffix(host, allowed[1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckUrl returns an error if requests must not be proxied to the url. The host is resolved with ctx.
+func (p CustomProxyPolicy) CheckUrl(ctx context.Context, rawUrl string) error {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return errors.New("invalid url")
+	}
+
+	schemeAllowed := false
+	for _, scheme := range p.Schemes {
+		if strings.EqualFold(u.Scheme, scheme) {
+			schemeAllowed = true
+		}
+	}
+	if !schemeAllowed {
+		return fmt.Errorf("scheme %q not allowed", u.Scheme)
+	}
+
+	host := strings.ToLower(u.Hostname())
+	if host == "" {
+		return errors.New("no host")
+	}
+	if !p.isHostAllowed(host) {
+		return fmt.Errorf("host %s not allowed", host)
+	}
+	if p.AllowPrivate {
+		return nil
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		if !IsPublicIP(ip) {
+			return fmt.Errorf("address %s not allowed", host)
+		}
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, p.DialTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return fmt.Errorf("cannot resolve host %s", host)
+	}
+	for _, addr := range addrs {
+		if !IsPublicIP(addr.IP) {
+			return fmt.Errorf("host %s resolves to non-public address", host)
+		}
+	}
+	return nil
+}
+
+// Checks the resolved address of every connection, as DNS may answer differently than for CheckUrl
+func checkPublicDialAddress(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !IsPublicIP(ip) {
+		return fmt.Errorf("address %s not allowed", host)
+	}
+	return nil
+}
+
+// NewCustomProxyClient returns the HTTP client for requests to custom urls
+func NewCustomProxyClient(policy CustomProxyPolicy) *http.Client {
+	policy = policy.withDefaults()
+	dialer := &net.Dialer{Timeout: policy.DialTimeout}
+	if !policy.AllowPrivate {
+		dialer.Control = checkPublicDialAddress
+	}
+
+	transport := &http.Transport{
+		Proxy:                 nil, // the environment proxy could reach internal hosts for us
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   policy.DialTimeout,
+		ResponseHeaderTimeout: policy.Timeout,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   2,
+		IdleConnTimeout:       30 * time.Second,
+	}
+
+	return &http.Client{
+		Transport: &tracing.Transport{Base: &maxResponseSizeTransport{transport: transport, maxSize: policy.MaxResponseSize}}, // no trace context for third parties
+		Timeout:   policy.Timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return errors.New("redirects are not followed") // they could point anywhere
+		},
+	}
+}
+
+// Fails responses with a larger Content-Length, and reads of bodies beyond maxSize
+type maxResponseSizeTransport struct {
+	transport http.RoundTripper
+	maxSize   int64
+}
+
+func (t *maxResponseSizeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.ContentLength > t.maxSize {
+		resp.Body.Close()
+		return nil, ErrCustomProxyResponseTooLarge
+	}
+	resp.Body = &maxSizeBody{ReadCloser: resp.Body, remaining: t.maxSize}
+	return resp, nil
+}
+
+type maxSizeBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (b *maxSizeBody) Read(p []byte) (int, error) {
+	if b.remaining <= 0 {
+		// Only an error if there is more to read
+		var buf [1]byte
+		n, err := b.ReadCloser.Read(buf[:])
+		if n > 0 {
+			return 0, ErrCustomProxyResponseTooLarge
+		}
+		return 0, err
+	}
+	if int64(len(p)) > b.remaining {
+		p = p[:b.remaining]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	return n, err
+}
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/flashbots/rpc-endpoint/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCustomProxyPolicyCheckUrl(t *testing.T) {
+	ctx := context.Background()
+	policy := DefaultCustomProxyPolicy
+
+	for _, rawUrl := range []string{
+		"http://8.8.8.8",
+		"https://8.8.8.8:8545/path?foo=bar",
+		"HTTPS://[2001:4860:4860::8888]",
+	} {
+		require.Nil(t, policy.CheckUrl(ctx, rawUrl), rawUrl)
+	}
+
+	for _, rawUrl := range []string{
+		"ftp://8.8.8.8",
+		"file:///etc/passwd",
+		"http://",
+		"http://169.254.169.254/latest/meta-data",
+		"http://127.0.0.1:6379",
+		"http://localhost:6379",
+		"http://10.0.0.1",
+		"http://172.16.5.4",
+		"http://192.168.1.1",
+		"http://100.64.0.1",
+		"http://0.0.0.0",
+		"http://[::1]:8545",
+		"http://[::ffff:127.0.0.1]",
+		"http://[fe80::1]",
+		"http://[fd00::1]",
+	} {
+		require.NotNil(t, policy.CheckUrl(ctx, rawUrl), rawUrl)
+	}
+
+	// Private addresses can be allowed for local development
+	policy.AllowPrivate = true
+	require.Nil(t, policy.CheckUrl(ctx, "http://localhost:8545"))
+	require.NotNil(t, policy.CheckUrl(ctx, "ws://localhost:8545"))
+
+	// Only hosts on the allowlist
+	policy.AllowedHosts = []string{"node.example.com", "*.infura.io"}
+	require.Nil(t, policy.CheckUrl(ctx, "https://node.example.com"))
+	require.Nil(t, policy.CheckUrl(ctx, "https://mainnet.INFURA.io/v3/key"))
+	require.NotNil(t, policy.CheckUrl(ctx, "https://infura.io"))
+	require.NotNil(t, policy.CheckUrl(ctx, "https://evilinfura.io"))
+	require.NotNil(t, policy.CheckUrl(ctx, "https://example.com"))
+	require.NotNil(t, policy.CheckUrl(ctx, "http://localhost:8545"))
+}
+
+func TestCustomProxyClient(t *testing.T) {
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/large":
+			w.Write(bytes.Repeat([]byte("x"), 1000))
+		case "/chunked": // no Content-Length
+			for i := 0; i < 10; i++ {
+				w.Write(bytes.Repeat([]byte("x"), 100))
+				w.(http.Flusher).Flush()
+			}
+		case "/redirect":
+			http.Redirect(w, req, "http://169.254.169.254/", http.StatusFound)
+		default:
+			w.Write([]byte("ok"))
+		}
+	}))
+	defer node.Close()
+
+	// The node is on loopback, which the dialer refuses even if the url wasn't checked
+	_, err := NewCustomProxyClient(CustomProxyPolicy{}).Get(node.URL)
+	require.NotNil(t, err)
+
+	client := NewCustomProxyClient(CustomProxyPolicy{AllowPrivate: true, MaxResponseSize: 100})
+	resp, err := client.Get(node.URL)
+	require.Nil(t, err, err)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.Nil(t, err, err)
+	require.Equal(t, "ok", string(body))
+
+	_, err = client.Get(node.URL + "/large")
+	require.True(t, errors.Is(err, ErrCustomProxyResponseTooLarge), err)
+
+	resp, err = client.Get(node.URL + "/chunked")
+	require.Nil(t, err, err)
+	_, err = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.Equal(t, ErrCustomProxyResponseTooLarge, err)
+
+	_, err = client.Get(node.URL + "/redirect")
+	require.NotNil(t, err)
+}
+
+func TestCustomProxyUrl(t *testing.T) {
+	node := newMockProxyNode(1)
+	defer node.Close()
+	var customRequests int32
+	customNode := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&customRequests, 1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x2"}`))
+	}))
+	defer customNode.Close()
+
+	blockNumber := func(policy CustomProxyPolicy) *types.JsonRpcResponse {
+		s, err := NewRpcEndPointServer(RpcEndPointServerConfig{
+			ProxyUrls:   []string{node.URL},
+			StateStore:  NewMemoryState(time.Now),
+			CustomProxy: policy,
+		})
+		require.Nil(t, err, err)
+		srv := httptest.NewServer(s.Handler())
+		defer srv.Close()
+
+		body, _ := json.Marshal(types.NewJsonRpcRequest(1, "eth_blockNumber", nil))
+		resp, err := http.Post(fmt.Sprintf("%s/?url=%s", srv.URL, customNode.URL), "application/json", bytes.NewReader(body))
+		require.Nil(t, err, err)
+		defer resp.Body.Close()
+		res := new(types.JsonRpcResponse)
+		err = json.NewDecoder(resp.Body).Decode(res)
+		require.Nil(t, err, err)
+		return res
+	}
+
+	// The custom node is on loopback
+	res := blockNumber(CustomProxyPolicy{})
+	require.NotNil(t, res.Error)
+	require.Equal(t, types.JsonRpcInvalidRequest, res.Error.Code)
+	require.True(t, strings.HasPrefix(res.Error.Message, "invalid url option: url: address 127.0.0.1 not allowed"), res.Error.Message)
+	require.Equal(t, int32(0), atomic.LoadInt32(&customRequests))
+
+	res = blockNumber(CustomProxyPolicy{AllowPrivate: true})
+	require.Nil(t, res.Error)
+	require.Equal(t, `"0x2"`, string(res.Result))
+	require.Equal(t, int32(1), atomic.LoadInt32(&customRequests))
+}
@@ -0,0 +1,127 @@
+// Parsing of JSON-RPC 2.0 payloads (single requests and batches) and batch processing, as in
+// https://www.jsonrpc.org/specification
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"sync"
+
+	"github.com/flashbots/rpc-endpoint/types"
+)
+
+// A request of a payload, or the error response if it's invalid
+type jsonRpcPayloadEntry struct {
+	req    *types.JsonRpcRequest
+	errRes *types.JsonRpcResponse
+}
+
+// parseJsonRpcPayload parses a single request or a batch. errRes is the response to the whole payload if it's not
+// valid JSON (-32700), an empty batch, or neither an object nor an array (-32600). Otherwise each request of the
+// payload has an entry, invalid ones with a -32600 response.
+func parseJsonRpcPayload(body []byte) (entries []jsonRpcPayloadEntry, isBatch bool, errRes *types.JsonRpcResponse) {
+	body = bytes.TrimSpace(body)
+	if !json.Valid(body) {
+		return nil, false, jsonRpcErrorResponse(nil, "parse error", types.JsonRpcParseError)
+	}
+
+	switch body[0] {
+	case '{':
+		return []jsonRpcPayloadEntry{parseJsonRpcRequest(body)}, false, nil
+	case '[':
+		var rawReqs []json.RawMessage
+		if err := json.Unmarshal(body, &rawReqs); err != nil {
+			return nil, false, jsonRpcErrorResponse(nil, "parse error", types.JsonRpcParseError)
+		}
+		if len(rawReqs) == 0 {
+			return nil, true, jsonRpcErrorResponse(nil, "invalid request: empty batch", types.JsonRpcInvalidRequest)
+		}
+		entries = make([]jsonRpcPayloadEntry, len(rawReqs))
+		for i, rawReq := range rawReqs {
+			entries[i] = parseJsonRpcRequest(rawReq)
+		}
+		return entries, true, nil
+	}
+	return nil, false, jsonRpcErrorResponse(nil, "invalid request", types.JsonRpcInvalidRequest)
+}
+
+func parseJsonRpcRequest(rawReq []byte) jsonRpcPayloadEntry {
+	req := new(types.JsonRpcRequest)
+	if err := json.Unmarshal(rawReq, req); err != nil {
+		return jsonRpcPayloadEntry{errRes: jsonRpcErrorResponse(nil, "invalid request", types.JsonRpcInvalidRequest)}
+	}
+	if err := validateJsonRpcRequest(req); err != nil {
+		var id interface{}
+		if isValidJsonRpcId(req.Id) {
+			id = req.Id
+		}
+		return jsonRpcPayloadEntry{errRes: jsonRpcErrorResponse(id, "invalid request: "+err.Error(), types.JsonRpcInvalidRequest)}
+	}
+	req.Version = "2.0" // if it was left out, for the request to the node
+	return jsonRpcPayloadEntry{req: req}
+}
+
+// A missing jsonrpc member is accepted, as some wallets and libraries leave it out
+func validateJsonRpcRequest(req *types.JsonRpcRequest) error {
+	if req.Version != "" && req.Version != "2.0" {
+		return errors.New(`jsonrpc must be "2.0"`)
+	}
+	if req.Method == "" {
+		return errors.New("missing method")
+	}
+	if !isValidJsonRpcId(req.Id) {
+		return errors.New("id must be a string, a number or null")
+	}
+	return nil
+}
+
+func isValidJsonRpcId(id interface{}) bool {
+	switch id.(type) {
+	case nil, string, float64:
+		return true
+	}
+	return false
+}
+
+// processJsonRpcBatch processes the valid requests of a batch concurrently with process, and returns the responses in
+// the order of the requests. Notifications get no response, so the result is empty if all requests are notifications.
+func processJsonRpcBatch(entries []jsonRpcPayloadEntry, process func(i int, req *types.JsonRpcRequest) *types.JsonRpcResponse) []*types.JsonRpcResponse {
+	responses := make([]*types.JsonRpcResponse, len(entries))
+	var wg sync.WaitGroup
+	for i, entry := range entries {
+		if entry.errRes != nil {
+			responses[i] = entry.errRes
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, req *types.JsonRpcRequest) {
+			defer wg.Done()
+			res := process(i, req)
+			if !req.IsNotification() {
+				responses[i] = res
+			}
+		}(i, entry.req)
+	}
+	wg.Wait()
+
+	answered := make([]*types.JsonRpcResponse, 0, len(responses))
+	for _, res := range responses {
+		if res != nil {
+			answered = append(answered, res)
+		}
+	}
+	return answered
+}
+
+func jsonRpcErrorResponse(id interface{}, msg string, errCode int) *types.JsonRpcResponse {
+	return &types.JsonRpcResponse{
+		Id:      id,
+		Version: "2.0",
+		Error: &types.JsonRpcError{
+			Code:    errCode,
+			Message: msg,
+		},
+	}
+}
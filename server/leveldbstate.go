@@ -0,0 +1,104 @@
+package server
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// LevelDBState keeps the state in an embedded LevelDB database on disk, so it survives restarts without a Redis server.
+// The database can only be opened by one process at a time.
+type LevelDBState struct {
+	kvState
+}
+
+func NewLevelDBState(path string, clock Clock) (*LevelDBState, error) {
+	if path == "" {
+		return nil, errors.New("no path for leveldb state")
+	}
+
+	db, err := leveldb.OpenFile(path, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "leveldb open error")
+	}
+
+	kv := &levelDBKV{db: db, clock: clock}
+	if err = kv.deleteExpired(); err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "leveldb cleanup error")
+	}
+
+	s := &LevelDBState{}
+	s.kvState = *newKVState(kv, clock)
+	return s, nil
+}
+
+// Values are stored with the expiry time (unix nanoseconds, big endian) in front
+type levelDBKV struct {
+	db    *leveldb.DB
+	clock Clock
+}
+
+func encodeLevelDBValue(value string, expires time.Time) []byte {
+	data := make([]byte, 8+len(value))
+	binary.BigEndian.PutUint64(data, uint64(expires.UnixNano()))
+	copy(data[8:], value)
+	return data
+}
+
+func decodeLevelDBValue(data []byte) (value string, expires time.Time, err error) {
+	if len(data) < 8 {
+		return "", time.Time{}, errors.New("invalid leveldb value")
+	}
+	return string(data[8:]), time.Unix(0, int64(binary.BigEndian.Uint64(data))), nil
+}
+
+func (l *levelDBKV) get(key string) (value string, found bool, err error) {
+	data, err := l.db.Get([]byte(key), nil)
+	if err == leveldb.ErrNotFound {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+
+	value, expires, err := decodeLevelDBValue(data)
+	if err != nil {
+		return "", false, err
+	}
+	if !l.clock().Before(expires) {
+		return "", false, nil
+	}
+	return value, true, nil
+}
+
+func (l *levelDBKV) set(key string, value string, expiry time.Duration) error {
+	return l.db.Put([]byte(key), encodeLevelDBValue(value, l.clock().Add(expiry)), nil)
+}
+
+func (l *levelDBKV) del(key string) error {
+	return l.db.Delete([]byte(key), nil)
+}
+
+func (l *levelDBKV) deleteExpired() error {
+	now := l.clock()
+	batch := new(leveldb.Batch)
+	iter := l.db.NewIterator(util.BytesPrefix([]byte(RedisPrefix)), nil)
+	for iter.Next() {
+		_, expires, err := decodeLevelDBValue(iter.Value())
+		if err != nil || !now.Before(expires) {
+			batch.Delete(append([]byte{}, iter.Key()...))
+		}
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	return l.db.Write(batch, nil)
+}
+
+func (l *levelDBKV) close() error {
+	return l.db.Close()
+}
@@ -1,33 +1,306 @@
+/*
+Leveled logging with fields, as text (the standard logger) or as one JSON object per line.
+
+Messages which start with a [subsystem] tag, like "[relay] ..." or "[ws] ...", belong to that subsystem, and the level
+can be set per subsystem. Long hex payloads such as raw transactions are truncated, and sensitive fields are redacted.
+*/
 package server
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"io"
 	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type LogLevel int
+
+const (
+	LogLevelDebug LogLevel = iota - 1
+	LogLevelInfo           // default
+	LogLevelWarn
+	LogLevelError
 )
 
+var logLevelNames = map[LogLevel]string{
+	LogLevelDebug: "debug",
+	LogLevelInfo:  "info",
+	LogLevelWarn:  "warn",
+	LogLevelError: "error",
+}
+
+func (l LogLevel) String() string {
+	return logLevelNames[l]
+}
+
+func ParseLogLevel(s string) (LogLevel, error) {
+	for level, name := range logLevelNames {
+		if strings.EqualFold(s, name) {
+			return level, nil
+		}
+	}
+	return LogLevelInfo, fmt.Errorf("unknown log level %q", s)
+}
+
+// ParseSubsystemLogLevels parses levels like "relay=debug,ws=warn"
+func ParseSubsystemLogLevels(s string) (map[string]LogLevel, error) {
+	levels := make(map[string]LogLevel)
+	if s == "" {
+		return levels, nil
+	}
+	for _, entry := range strings.Split(s, ",") {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid subsystem log level %q, must be subsystem=level", entry)
+		}
+		level, err := ParseLogLevel(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		levels[parts[0]] = level
+	}
+	return levels, nil
+}
+
+type LogConfig struct {
+	Level        LogLevel            // default: info
+	Subsystems   map[string]LogLevel // levels of subsystems, instead of Level
+	JSON         bool                // one JSON object per line instead of text
+	FullPayloads bool                // don't truncate long hex payloads (raw txs, calldata)
+	Output       io.Writer           // for JSON, default: stdout (text goes to the standard logger)
+}
+
+// Hex strings longer than this (e.g. raw txs, but not hashes or addresses) are truncated
+const logMaxHexLength = 130
+
+var longHexRegexp = regexp.MustCompile(fmt.Sprintf(`0x[0-9a-fA-F]{%d,}`, logMaxHexLength-1))
+
+// Fields of which only the first characters are logged
+var redactedLogFields = map[string]bool{
+	"apiKey":    true,
+	"signature": true,
+}
+
+// truncateHex shortens long hex strings in s to their start and length
+func truncateHex(s string) string {
+	return longHexRegexp.ReplaceAllStringFunc(s, func(hex string) string {
+		return fmt.Sprintf("%s...(%d chars)", hex[:18], len(hex))
+	})
+}
+
 type Logger interface {
-	log(format string, v ...interface{})
+	log(format string, v ...interface{}) // info
+	logDebug(format string, v ...interface{})
+	logWarn(format string, v ...interface{})
 	logError(format string, v ...interface{})
 	CreateChildLogger(suffix string) Logger
+	// With returns a logger which adds the field to all messages
+	With(key string, value interface{}) Logger
+}
+
+type logField struct {
+	key   string
+	value interface{}
+}
+
+// Config and output shared by a logger and its children
+type logSink struct {
+	config LogConfig
+	mu     sync.Mutex // for JSON output
 }
 
 type Log struct {
-	uid string
+	uid    string
+	fields []logField
+	sink   *logSink
 }
 
 func NewLogger(uid string) Logger {
-	return &Log{uid: uid}
+	return NewLoggerWithConfig(uid, LogConfig{})
 }
+
+func NewLoggerWithConfig(uid string, config LogConfig) Logger {
+	if config.Output == nil {
+		config.Output = os.Stdout
+	}
+	return &Log{uid: uid, sink: &logSink{config: config}}
+}
+
 func (l *Log) log(format string, v ...interface{}) {
-	prefix := fmt.Sprintf("[%s] ", l.uid)
-	log.Printf(prefix+format, v...)
+	l.write(LogLevelInfo, format, v...)
+}
+
+func (l *Log) logDebug(format string, v ...interface{}) {
+	l.write(LogLevelDebug, format, v...)
+}
+
+func (l *Log) logWarn(format string, v ...interface{}) {
+	l.write(LogLevelWarn, format, v...)
 }
 
 func (l *Log) logError(format string, v ...interface{}) {
-	prefix := fmt.Sprintf("[%s] ERROR: ", l.uid)
-	log.Printf(prefix+format, v...)
+	l.write(LogLevelError, format, v...)
 }
 
+func (l *Log) prefix() string {
+	if l.uid == "" {
+		return ""
+	}
+	return fmt.Sprintf("[%s] ", l.uid)
+}
+
+// Child loggers are prefixed with the uid of the parent, if any, and have its fields
 func (l *Log) CreateChildLogger(suffix string) Logger {
-	return NewLogger(l.uid + "/" + suffix)
+	uid := suffix
+	if l.uid != "" {
+		uid = l.uid + "/" + suffix
+	}
+	return &Log{uid: uid, fields: l.fields, sink: l.sink}
+}
+
+func (l *Log) With(key string, value interface{}) Logger {
+	fields := make([]logField, len(l.fields), len(l.fields)+1)
+	copy(fields, l.fields)
+	return &Log{uid: l.uid, fields: append(fields, logField{key, value}), sink: l.sink}
+}
+
+// Subsystem of the message, from its [subsystem] tag
+func logSubsystem(format string) string {
+	if !strings.HasPrefix(format, "[") {
+		return ""
+	}
+	end := strings.Index(format, "] ")
+	if end < 0 {
+		return ""
+	}
+	return format[1:end]
+}
+
+func (l *Log) enabled(level LogLevel, subsystem string) bool {
+	minLevel := l.sink.config.Level
+	if subsystemLevel, ok := l.sink.config.Subsystems[subsystem]; ok && subsystem != "" {
+		minLevel = subsystemLevel
+	}
+	return level >= minLevel
+}
+
+func (l *Log) fieldValue(field logField) interface{} {
+	value := field.value
+	if err, ok := value.(error); ok {
+		value = err.Error()
+	}
+	s, ok := value.(string)
+	if !ok {
+		return value
+	}
+
+	if redactedLogFields[field.key] {
+		if len(s) > 4 {
+			s = s[:4]
+		}
+		return s + "***"
+	}
+	if !l.sink.config.FullPayloads {
+		return truncateHex(s)
+	}
+	return s
+}
+
+// Fields without value are left out
+func (l *Log) loggedFields() []logField {
+	fields := make([]logField, 0, len(l.fields))
+	for _, field := range l.fields {
+		if field.value != nil && field.value != "" {
+			fields = append(fields, logField{field.key, l.fieldValue(field)})
+		}
+	}
+	return fields
+}
+
+func (l *Log) write(level LogLevel, format string, v ...interface{}) {
+	subsystem := logSubsystem(format)
+	if !l.enabled(level, subsystem) {
+		return
+	}
+
+	msg := fmt.Sprintf(format, v...)
+	if !l.sink.config.FullPayloads {
+		msg = truncateHex(msg)
+	}
+
+	if l.sink.config.JSON {
+		l.writeJSON(level, subsystem, msg)
+		return
+	}
+
+	var line strings.Builder
+	line.WriteString(l.prefix())
+	switch level {
+	case LogLevelDebug:
+		line.WriteString("DEBUG: ")
+	case LogLevelWarn:
+		line.WriteString("WARN: ")
+	case LogLevelError:
+		line.WriteString("ERROR: ")
+	}
+	line.WriteString(msg)
+	for _, field := range l.loggedFields() {
+		fmt.Fprintf(&line, " %s=%v", field.key, field.value)
+	}
+	log.Print(line.String())
+}
+
+func (l *Log) writeJSON(level LogLevel, subsystem, msg string) {
+	entry := map[string]interface{}{
+		"time":  time.Now().UTC().Format(time.RFC3339Nano),
+		"level": level.String(),
+		"msg":   strings.TrimPrefix(msg, "["+subsystem+"] "),
+	}
+	if l.uid != "" {
+		entry["logger"] = l.uid
+	}
+	if subsystem != "" {
+		entry["subsystem"] = subsystem
+	}
+	for _, field := range l.loggedFields() {
+		entry[field.key] = field.value
+	}
+
+	// time, level and msg first, then the rest by name
+	keys := make([]string, 0, len(entry))
+	for key := range entry {
+		if key != "time" && key != "level" && key != "msg" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	keys = append([]string{"time", "level", "msg"}, keys...)
+
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, key := range keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		keyJSON, _ := json.Marshal(key)
+		valueJSON, err := json.Marshal(entry[key])
+		if err != nil {
+			valueJSON, _ = json.Marshal(fmt.Sprint(entry[key]))
+		}
+		buf.Write(keyJSON)
+		buf.WriteByte(':')
+		buf.Write(valueJSON)
+	}
+	buf.WriteString("}\n")
+
+	l.sink.mu.Lock()
+	defer l.sink.mu.Unlock()
+	l.sink.config.Output.Write(buf.Bytes())
 }
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/flashbots/rpc-endpoint/testutils"
+	"github.com/flashbots/rpc-endpoint/types"
+	"github.com/stretchr/testify/require"
+)
+
+// Returns a JSON logger and the decoded lines it wrote
+func newTestJsonLogger(config LogConfig) (Logger, func() []map[string]interface{}) {
+	buf := new(bytes.Buffer)
+	config.JSON = true
+	config.Output = buf
+	return NewLoggerWithConfig("", config), func() []map[string]interface{} {
+		var lines []map[string]interface{}
+		for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+			if line == "" {
+				continue
+			}
+			entry := make(map[string]interface{})
+			if err := json.Unmarshal([]byte(line), &entry); err != nil {
+				panic(err)
+			}
+			lines = append(lines, entry)
+		}
+		buf.Reset()
+		return lines
+	}
+}
+
+func TestParseLogLevels(t *testing.T) {
+	level, err := ParseLogLevel("WARN")
+	require.Nil(t, err, err)
+	require.Equal(t, LogLevelWarn, level)
+	_, err = ParseLogLevel("verbose")
+	require.NotNil(t, err)
+
+	levels, err := ParseSubsystemLogLevels("ws=debug,sendTxToRelay=error")
+	require.Nil(t, err, err)
+	require.Equal(t, map[string]LogLevel{"ws": LogLevelDebug, "sendTxToRelay": LogLevelError}, levels)
+	_, err = ParseSubsystemLogLevels("ws")
+	require.NotNil(t, err)
+	_, err = ParseSubsystemLogLevels("ws=verbose")
+	require.NotNil(t, err)
+}
+
+func TestLoggerLevels(t *testing.T) {
+	logger, lines := newTestJsonLogger(LogConfig{
+		Level:      LogLevelInfo,
+		Subsystems: map[string]LogLevel{"ws": LogLevelDebug, "relay": LogLevelError},
+	})
+
+	logger.logDebug("debug")
+	logger.log("info")
+	logger.logWarn("warn")
+	logger.logDebug("[ws] debug")
+	logger.logWarn("[relay] warn")
+	logger.logError("[relay] error")
+
+	var msgs []string
+	for _, entry := range lines() {
+		msgs = append(msgs, entry["level"].(string)+" "+entry["msg"].(string))
+	}
+	require.Equal(t, []string{"info info", "warn warn", "debug debug", "error error"}, msgs)
+}
+
+func TestLoggerJsonFields(t *testing.T) {
+	logger, lines := newTestJsonLogger(LogConfig{})
+
+	requestLogger := logger.With("requestId", "abc").With("ip", "127.0.0.1").With("origin", "")
+	requestLogger.With("method", "eth_call").log("[ws] proxy response %d", 200)
+	requestLogger.With("err", errors.New("failed")).logError("request failed")
+
+	entries := lines()
+	require.Equal(t, 2, len(entries))
+	require.Equal(t, map[string]interface{}{
+		"time":      entries[0]["time"],
+		"level":     "info",
+		"msg":       "proxy response 200",
+		"subsystem": "ws",
+		"requestId": "abc",
+		"ip":        "127.0.0.1",
+		"method":    "eth_call",
+	}, entries[0])
+	require.Equal(t, "failed", entries[1]["err"])
+	require.Nil(t, entries[1]["method"]) // the parent logger has no method
+
+	// Child loggers keep the fields
+	requestLogger.CreateChildLogger("child").log("msg")
+	entries = lines()
+	require.Equal(t, "child", entries[0]["logger"])
+	require.Equal(t, "abc", entries[0]["requestId"])
+}
+
+func TestLoggerRedaction(t *testing.T) {
+	rawTx := "0x" + strings.Repeat("ab", 100)
+	hash := "0x" + strings.Repeat("cd", 32)
+
+	logger, lines := newTestJsonLogger(LogConfig{})
+	logger.With("apiKey", "secret-key").With("txHash", hash).With("rawTx", rawTx).log("rawTx: %s, hash: %s", rawTx, hash)
+	entry := lines()[0]
+	require.Equal(t, "secr***", entry["apiKey"])
+	require.Equal(t, hash, entry["txHash"])
+	require.Equal(t, "0xabababababababab...(202 chars)", entry["rawTx"])
+	require.Equal(t, "rawTx: 0xabababababababab...(202 chars), hash: "+hash, entry["msg"])
+
+	logger, lines = newTestJsonLogger(LogConfig{FullPayloads: true})
+	logger.With("apiKey", "secret-key").log("rawTx: %s", rawTx)
+	entry = lines()[0]
+	require.Equal(t, "secr***", entry["apiKey"])
+	require.Equal(t, "rawTx: "+rawTx, entry["msg"])
+}
+
+// Relay requests are logged at debug level, with the raw tx truncated
+func TestRelayClientLogging(t *testing.T) {
+	relay := testutils.NewMockRelay()
+	defer relay.Close()
+	key, err := crypto.GenerateKey()
+	require.Nil(t, err, err)
+
+	logger, lines := newTestJsonLogger(LogConfig{})
+	client := NewFlashbotsRelayClient(relay.Url())
+	client.Logger = logger
+	_, err = client.SendPrivateTransaction(context.Background(), key, types.SendPrivateTransactionRequest{Tx: testutils.TestTx_BundleFailedTooManyTimes_RawTx})
+	require.Nil(t, err, err)
+	require.Equal(t, 0, len(lines()))
+
+	logger, lines = newTestJsonLogger(LogConfig{Level: LogLevelDebug})
+	client.Logger = logger
+	_, err = client.SendPrivateTransaction(context.Background(), key, types.SendPrivateTransactionRequest{Tx: testutils.TestTx_BundleFailedTooManyTimes_RawTx})
+	require.Nil(t, err, err)
+	entries := lines()
+	require.Equal(t, 1, len(entries))
+	require.Equal(t, "debug", entries[0]["level"])
+	require.Contains(t, entries[0]["msg"], "eth_sendPrivateTransaction")
+	require.NotContains(t, entries[0]["msg"], testutils.TestTx_BundleFailedTooManyTimes_RawTx)
+}
+
+func TestProxyPoolLogging(t *testing.T) {
+	failingNode := newFailingProxyNode()
+	defer failingNode.Close()
+
+	logger, lines := newTestJsonLogger(LogConfig{})
+	pool := NewProxyPool([]string{failingNode.URL}, ProxyPoolConfig{Logger: logger})
+	pool.CheckHealth()
+	pool.CheckHealth() // no change, no log
+
+	entries := lines()
+	require.Equal(t, 1, len(entries))
+	require.Equal(t, "warn", entries[0]["level"])
+	require.Contains(t, entries[0]["msg"], "marked unhealthy")
+}
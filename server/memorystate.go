@@ -0,0 +1,84 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// MemoryState keeps the state in memory. It is lost on restart and not shared between replicas.
+type MemoryState struct {
+	kvState
+}
+
+func NewMemoryState(clock Clock) *MemoryState {
+	s := &MemoryState{}
+	s.kvState = *newKVState(&memoryKV{entries: make(map[string]memoryEntry), clock: clock}, clock)
+	return s
+}
+
+type memoryEntry struct {
+	value   string
+	expires time.Time
+}
+
+type memoryKV struct {
+	mu      sync.RWMutex
+	entries map[string]memoryEntry // nil once closed
+	clock   Clock
+}
+
+func (m *memoryKV) get(key string) (value string, found bool, err error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.entries == nil {
+		return "", false, ErrStateStoreClosed
+	}
+
+	entry, found := m.entries[key]
+	if !found || !m.clock().Before(entry.expires) {
+		return "", false, nil
+	}
+	return entry.value, true, nil
+}
+
+func (m *memoryKV) set(key string, value string, expiry time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.entries == nil {
+		return ErrStateStoreClosed
+	}
+
+	m.entries[key] = memoryEntry{value: value, expires: m.clock().Add(expiry)}
+	return nil
+}
+
+func (m *memoryKV) del(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.entries == nil {
+		return ErrStateStoreClosed
+	}
+
+	delete(m.entries, key)
+	return nil
+}
+
+func (m *memoryKV) deleteExpired() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.clock()
+	for key, entry := range m.entries {
+		if !now.Before(entry.expires) {
+			delete(m.entries, key)
+		}
+	}
+	return nil
+}
+
+func (m *memoryKV) close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries = nil
+	return nil
+}
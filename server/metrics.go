@@ -0,0 +1,98 @@
+// Prometheus metrics of the rpc endpoint, served at /metrics
+package server
+
+import (
+	"net/url"
+	"runtime"
+
+	"github.com/flashbots/rpc-endpoint/metrics"
+)
+
+var (
+	metricRequests = metrics.NewCounterVec("rpcendpoint_requests_total",
+		"JSON-RPC requests by method", "method")
+	metricRequestDuration = metrics.NewHistogramVec("rpcendpoint_request_duration_seconds",
+		"Time to process a JSON-RPC request by method", metrics.DefBuckets, "method")
+
+	metricRequestTimeouts = metrics.NewCounterVec("rpcendpoint_request_timeouts_total",
+		"Requests that exceeded a deadline by stage (proxy, relay, simulation)", "stage")
+
+	metricProxyDuration = metrics.NewHistogramVec("rpcendpoint_proxy_duration_seconds",
+		"Latency of proxied requests by upstream", metrics.DefBuckets, "upstream")
+	metricProxyErrors = metrics.NewCounterVec("rpcendpoint_proxy_errors_total",
+		"Failed proxy requests (connection errors and 5xx responses) by upstream", "upstream")
+
+	metricCustomProxyRejected = metrics.NewCounterVec("rpcendpoint_custom_proxy_rejected_total",
+		"Requests with a custom proxy url that the custom proxy policy rejected")
+
+	metricRelayRequests = metrics.NewCounterVec("rpcendpoint_relay_requests_total",
+		"Requests to relays by type (send, cancel), relay and result (ok, relay_error, timeout, error)", "type", "relay", "result")
+	metricRelayDuration = metrics.NewHistogramVec("rpcendpoint_relay_duration_seconds",
+		"Latency of requests to relays by type (send, cancel) and relay", metrics.DefBuckets, "type", "relay")
+
+	metricCacheRequests = metrics.NewCounterVec("rpcendpoint_cache_requests_total",
+		"Lookups of cacheable requests in the response cache by method and result (hit, miss)", "method", "result")
+
+	metricSimulations = metrics.NewCounterVec("rpcendpoint_simulations_total",
+		"Tx simulations before relay submission by mode (relay, node) and result (ok, reverted, error)", "mode", "result")
+	metricSimulationDuration = metrics.NewHistogramVec("rpcendpoint_simulation_duration_seconds",
+		"Latency of tx simulations by mode (relay, node)", metrics.DefBuckets, "mode")
+
+	metricTxRouting = metrics.NewCounterVec("rpcendpoint_tx_routing_total",
+		"Routing decisions for eth_sendRawTransaction (relay or mempool)", "destination")
+	metricNonceFixIntercepts = metrics.NewCounterVec("rpcendpoint_nonce_fix_intercepts_total",
+		"eth_getTransactionCount calls intercepted by the Metamask nonce-fix")
+	metricNonceFixChanges = metrics.NewCounterVec("rpcendpoint_nonce_fix_changes_total",
+		"Metamask nonce-fixes set or removed by the tx tracker, by change (armed, cleared)", "change")
+
+	metricTxTrackerQueueDepth = metrics.NewGaugeVec("rpcendpoint_tx_tracker_queue_depth",
+		"Private txs whose status the tx tracker looks up, by chain", "chain")
+	metricTxTrackerLag = metrics.NewGaugeVec("rpcendpoint_tx_tracker_lag_seconds",
+		"How late the last status lookup of the tx tracker started, by chain", "chain")
+	metricTxTrackerChecks = metrics.NewCounterVec("rpcendpoint_tx_tracker_checks_total",
+		"Status lookups of the tx tracker by result (the status of the tx, or error)", "result")
+
+	metricRateLimited = metrics.NewCounterVec("rpcendpoint_rate_limited_total",
+		"Requests rejected by rate limits by method and limit type (ip, sender)", "method", "type")
+
+	metricRedisErrors = metrics.NewCounterVec("rpcendpoint_redis_errors_total",
+		"Failed Redis commands by command", "command")
+
+	_ = metrics.NewGaugeFunc("rpcendpoint_goroutines", "Number of goroutines", func() float64 {
+		return float64(runtime.NumGoroutine())
+	})
+)
+
+// Methods are user input, so only known ones are used as label to limit the number of time series
+var knownRpcMethods = map[string]bool{
+	"eth_accounts": true, "eth_blockNumber": true, "eth_call": true, "eth_chainId": true, "eth_coinbase": true,
+	"eth_estimateGas": true, "eth_feeHistory": true, "eth_gasPrice": true, "eth_getBalance": true,
+	"eth_getBlockByHash": true, "eth_getBlockByNumber": true, "eth_getBlockTransactionCountByHash": true,
+	"eth_getBlockTransactionCountByNumber": true, "eth_getCode": true, "eth_getFilterChanges": true,
+	"eth_getFilterLogs": true, "eth_getLogs": true, "eth_getProof": true, "eth_getStorageAt": true,
+	"eth_getTransactionByBlockHashAndIndex": true, "eth_getTransactionByBlockNumberAndIndex": true,
+	"eth_getTransactionByHash": true, "eth_getTransactionCount": true, "eth_getTransactionReceipt": true,
+	"eth_getUncleByBlockHashAndIndex": true, "eth_getUncleByBlockNumberAndIndex": true,
+	"eth_getUncleCountByBlockHash": true, "eth_getUncleCountByBlockNumber": true, "eth_maxPriorityFeePerGas": true,
+	"eth_mining": true, "eth_newBlockFilter": true, "eth_newFilter": true, "eth_newPendingTransactionFilter": true,
+	"eth_protocolVersion": true, "eth_sendRawTransaction": true, "eth_sendTransaction": true, "eth_sign": true,
+	"eth_signTransaction": true, "eth_subscribe": true, "eth_syncing": true, "eth_uninstallFilter": true,
+	"eth_unsubscribe": true, "net_listening": true, "net_peerCount": true, "net_version": true,
+	"web3_clientVersion": true, "web3_sha3": true,
+}
+
+func metricsMethodLabel(method string) string {
+	if knownRpcMethods[method] {
+		return method
+	}
+	return "other"
+}
+
+// Upstream urls can contain API keys, so only scheme and host are used as label
+func metricsUpstreamLabel(upstreamUrl string) string {
+	u, err := url.Parse(upstreamUrl)
+	if err != nil || u.Host == "" {
+		return "invalid"
+	}
+	return u.Scheme + "://" + u.Host
+}
@@ -0,0 +1,93 @@
+// Nonce-fix for Metamask: after a private tx of a sender failed, eth_getTransactionCount returns a too high nonce a few
+// times (see intercept_mm_eth_getTransactionCount), so Metamask drops the tx. The tx tracker arms the fix when a tx
+// fails, and clears it when a later tx of the sender is included. The intercept also clears it once the on-chain nonce
+// of the sender is past the failed nonce, e.g. because the next tx went through the public mempool.
+package server
+
+import (
+	"context"
+
+	"github.com/flashbots/rpc-endpoint/types"
+)
+
+// How many nonces after the one of a tx are checked for later txs of the sender
+const nonceFixNonceWindow = 16
+
+// updateNonceFix arms or clears the nonce-fix of the sender after the status of a tx changed. The order of the
+// changes doesn't matter: the fix isn't armed if a later tx of the sender was included already, and isn't cleared if
+// a later tx failed.
+func (t *txTracker) updateNonceFix(lifecycle *types.TxLifecycle) {
+	if lifecycle.From == "" {
+		return
+	}
+	ctx := context.Background()
+
+	switch lifecycle.Status {
+	case types.TxStatusFailed:
+		included, err := t.hasLaterTxOfSender(ctx, lifecycle, types.TxStatusIncluded)
+		if err != nil {
+			t.logger.logError("[nonce-fix] later txs of %s failed: %v", lifecycle.From, err)
+			return
+		}
+		if included {
+			return
+		}
+
+		created, err := t.deps.state.CreateNonceFixForAccount(ctx, lifecycle.From, lifecycle.Nonce)
+		if err != nil {
+			t.logger.logError("[nonce-fix] redis:CreateNonceFixForAccount failed: %v", err)
+			return
+		}
+		if created {
+			t.logger.log("[nonce-fix] set for %s, %s failed", lifecycle.From, lifecycle.Hash)
+			metricNonceFixChanges.Inc("armed")
+		}
+
+	case types.TxStatusIncluded:
+		failed, err := t.hasLaterTxOfSender(ctx, lifecycle, types.TxStatusFailed)
+		if err != nil {
+			t.logger.logError("[nonce-fix] later txs of %s failed: %v", lifecycle.From, err)
+			return
+		}
+		if failed {
+			return
+		}
+
+		_, found, err := t.deps.state.GetNonceFixForAccount(ctx, lifecycle.From)
+		if err != nil {
+			t.logger.logError("[nonce-fix] redis:GetNonceFixForAccount failed: %v", err)
+			return
+		}
+		if !found {
+			return
+		}
+		if err = t.deps.state.DelNonceFixForAccount(ctx, lifecycle.From); err != nil {
+			t.logger.logError("[nonce-fix] redis:DelNonceFixForAccount failed: %v", err)
+			return
+		}
+		t.logger.log("[nonce-fix] removed for %s, %s was included", lifecycle.From, lifecycle.Hash)
+		metricNonceFixChanges.Inc("cleared")
+	}
+}
+
+// hasLaterTxOfSender returns true if a private tx of the sender with a higher nonce has the status
+func (t *txTracker) hasLaterTxOfSender(ctx context.Context, lifecycle *types.TxLifecycle, status types.PrivateTxStatus) (bool, error) {
+	for nonce := lifecycle.Nonce + 1; nonce <= lifecycle.Nonce+nonceFixNonceWindow; nonce++ {
+		txHash, found, err := t.deps.state.GetTxHashForSenderAndNonce(ctx, lifecycle.From, nonce)
+		if err != nil {
+			return false, err
+		}
+		if !found {
+			continue
+		}
+
+		later, found, err := t.deps.state.GetTxLifecycle(ctx, txHash)
+		if err != nil {
+			return false, err
+		}
+		if found && later.Status == status {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/flashbots/rpc-endpoint/testutils"
+	"github.com/flashbots/rpc-endpoint/types"
+	"github.com/stretchr/testify/require"
+)
+
+// A tx tracker with a mock node, for the block number and receipts
+func newTestTxTrackerWithNode(t *testing.T) (*txTracker, *requestDeps) {
+	tracker, deps := newTestTxTracker(t, TxTrackerConfig{})
+	node := httptest.NewServer(http.HandlerFunc(testutils.RpcBackendHandler))
+	t.Cleanup(node.Close)
+	tracker.proxyPool = NewProxyPool([]string{node.URL}, ProxyPoolConfig{})
+	return tracker, deps
+}
+
+// Records a private tx of the sender that was sent to the relay, and looks up its status with the mock tx API
+func sendAndCheckTx(t *testing.T, tracker *txTracker, txHash, from string, nonce uint64, maxBlockNumber string, status types.PrivateTxStatus) {
+	ctx := context.Background()
+	deps := tracker.deps
+	fakeTxSent(t, deps, txHash)
+	err := deps.state.SetTxHashForSenderAndNonce(ctx, from, nonce, txHash)
+	require.Nil(t, err, err)
+	err = deps.state.UpdateTxLifecycle(ctx, txHash, DefaultTxLifecycleRetention, func(lifecycle *types.TxLifecycle, found bool) bool {
+		lifecycle.From = from
+		lifecycle.Nonce = nonce
+		lifecycle.Routing.MaxBlockNumber = maxBlockNumber
+		return true
+	})
+	require.Nil(t, err, err)
+
+	testutils.MockTxApiSetStatus(txHash, status)
+	tracker.check(&trackedTx{hash: txHash, sentAt: time.Now(), interval: time.Second})
+}
+
+func nonceFixFound(t *testing.T, deps *requestDeps, from string) bool {
+	_, found, err := deps.state.GetNonceFixForAccount(context.Background(), from)
+	require.Nil(t, err, err)
+	return found
+}
+
+func TestNonceFixTxEvents(t *testing.T) {
+	tracker, deps := newTestTxTrackerWithNode(t)
+	from := "0xsender"
+
+	// Not set while the tx is pending
+	sendAndCheckTx(t, tracker, "0xtx1", from, 1, "", types.TxStatusPending)
+	require.False(t, nonceFixFound(t, deps, from))
+
+	// Set when it failed
+	testutils.MockTxApiSetStatus("0xtx1", types.TxStatusFailed)
+	tracker.check(&trackedTx{hash: "0xtx1", sentAt: time.Now(), interval: time.Second})
+	require.True(t, nonceFixFound(t, deps, from))
+
+	// Removed when a later tx is included
+	sendAndCheckTx(t, tracker, "0xtx2", from, 2, "", types.TxStatusIncluded)
+	require.False(t, nonceFixFound(t, deps, from))
+
+	// Not set for a failed tx if a later one was included already
+	sendAndCheckTx(t, tracker, "0xtx0", from, 0, "", types.TxStatusFailed)
+	require.False(t, nonceFixFound(t, deps, from))
+
+	// Not removed when an earlier tx is included after a later one failed
+	sendAndCheckTx(t, tracker, "0xtx5", from, 5, "", types.TxStatusFailed)
+	require.True(t, nonceFixFound(t, deps, from))
+	sendAndCheckTx(t, tracker, "0xtx3", from, 3, "", types.TxStatusIncluded)
+	require.True(t, nonceFixFound(t, deps, from))
+}
+
+func TestNonceFixTxPastMaxBlock(t *testing.T) {
+	tracker, deps := newTestTxTrackerWithNode(t)
+	testutils.MockBackendBlockNumber = "0x10"
+
+	// Still pending within the margin after the max block
+	sendAndCheckTx(t, tracker, "0xtx1", "0xsender1", 1, "0xe", types.TxStatusPending)
+	lifecycle, _, err := deps.state.GetTxLifecycle(context.Background(), "0xtx1")
+	require.Nil(t, err, err)
+	require.Equal(t, types.TxStatusPending, lifecycle.Status)
+	require.False(t, nonceFixFound(t, deps, "0xsender1"))
+
+	// Failed after it, and the nonce-fix is set
+	sendAndCheckTx(t, tracker, "0xtx2", "0xsender2", 1, "0xd", types.TxStatusPending)
+	lifecycle, _, err = deps.state.GetTxLifecycle(context.Background(), "0xtx2")
+	require.Nil(t, err, err)
+	require.Equal(t, types.TxStatusFailed, lifecycle.Status)
+	require.Equal(t, "not included by max block 13", lifecycle.FailureReason)
+	require.Equal(t, types.TxEventSourceTracker, lifecycle.Events[len(lifecycle.Events)-1].Source)
+	require.True(t, nonceFixFound(t, deps, "0xsender2"))
+}
@@ -1,20 +1,223 @@
 // OFAC banned addresses
 package server
 
-var ofacBlacklist = map[string]bool{
-	"0x8576acc5c05d6ce88f4e49bf65bdf0c62f91353c": true,
-	"0xd882cFc20F52f2599D84b8e8D58C7FB62cfE344b": true,
-	"0x901bb9583b24D97e995513C6778dc6888AB6870e": true,
-	"0xa7e5d5a720f06526557c513402f2e6b5fa20b00":  true, // this is an invalid address, but is what"s listed in the ofac ban list
-	"0xA7e5d5A720f06526557c513402f2e6B5fA20b008": true, // the actual valid address
-	"0x7F367cC41522cE07553e823bf3be79A889DEbe1B": true,
-	"0x1da5821544e25c636c1417Ba96Ade4Cf6D2f9B5A": true,
-	"0x7Db418b5D567A4e0E8c59Ad71BE1FcE48f3E6107": true,
-	"0x72a5843cc08275C8171E582972Aa4fDa8C397B2A": true,
-	"0x7F19720A857F834887FC9A7bC0a0fBe7Fc7f8102": true,
-	"0x9F4cda013E354b8fC285BF4b9A60460cEe7f7Ea9": true,
-}
-
-func isOnOFACList(address string) bool {
-	return ofacBlacklist[address]
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/pkg/errors"
+)
+
+// Built-in list, used if no list file is given
+var ofacBlacklist = []string{
+	"0x8576acc5c05d6ce88f4e49bf65bdf0c62f91353c",
+	"0xd882cFc20F52f2599D84b8e8D58C7FB62cfE344b",
+	"0x901bb9583b24D97e995513C6778dc6888AB6870e",
+	"0xa7e5d5a720f06526557c513402f2e6b5fa20b00",  // this is an invalid address, but is what"s listed in the ofac ban list
+	"0xA7e5d5A720f06526557c513402f2e6B5fA20b008", // the actual valid address
+	"0x7F367cC41522cE07553e823bf3be79A889DEbe1B",
+	"0x1da5821544e25c636c1417Ba96Ade4Cf6D2f9B5A",
+	"0x7Db418b5D567A4e0E8c59Ad71BE1FcE48f3E6107",
+	"0x72a5843cc08275C8171E582972Aa4fDa8C397B2A",
+	"0x7F19720A857F834887FC9A7bC0a0fBe7Fc7f8102",
+	"0x9F4cda013E354b8fC285BF4b9A60460cEe7f7Ea9",
+}
+
+// ID type of Ethereum addresses in the OFAC SDN XML export
+const ofacSdnEthIdType = "Digital Currency Address - ETH"
+
+// OFACList is an immutable set of sanctioned addresses
+type OFACList struct {
+	addresses map[common.Address]bool
+	Version   string    // sha256 prefix of the sorted addresses
+	Source    string    // file the list was loaded from
+	LoadedAt  time.Time // time of (re)load
+	Invalid   int       // number of entries skipped because they are not valid addresses
+}
+
+// NewOFACList normalizes the given addresses, skipping invalid entries
+func NewOFACList(entries []string, source string) *OFACList {
+	list := &OFACList{
+		addresses: make(map[common.Address]bool),
+		Source:    source,
+		LoadedAt:  time.Now(),
+	}
+
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if !common.IsHexAddress(entry) {
+			list.Invalid++
+			continue
+		}
+		list.addresses[common.HexToAddress(entry)] = true
+	}
+
+	sorted := make([]string, 0, len(list.addresses))
+	for address := range list.addresses {
+		sorted = append(sorted, strings.ToLower(address.Hex()))
+	}
+	sort.Strings(sorted)
+	hash := sha256.Sum256([]byte(strings.Join(sorted, "\n")))
+	list.Version = hex.EncodeToString(hash[:6])
+	return list
+}
+
+func (l *OFACList) Contains(address common.Address) bool {
+	return l.addresses[address]
+}
+
+func (l *OFACList) Len() int {
+	return len(l.addresses)
+}
+
+type ofacSdnId struct {
+	IdType   string `xml:"idType"`
+	IdNumber string `xml:"idNumber"`
+}
+
+// ParseOFACList parses either the OFAC SDN XML export or a plain list with one address per line ('#' starts a comment)
+func ParseOFACList(data []byte) (entries []string, err error) {
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("<")) {
+		return parseOFACSdnXml(data)
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line != "" {
+			entries = append(entries, line)
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// Collects the ETH addresses of all <id> elements, wherever they are nested
+func parseOFACSdnXml(data []byte) (entries []string, err error) {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return entries, nil
+		} else if err != nil {
+			return nil, errors.Wrap(err, "parsing SDN XML")
+		}
+
+		start, ok := token.(xml.StartElement)
+		if !ok || start.Name.Local != "id" {
+			continue
+		}
+
+		var id ofacSdnId
+		if err = decoder.DecodeElement(&id, &start); err != nil {
+			return nil, errors.Wrap(err, "parsing SDN XML")
+		}
+		if strings.TrimSpace(id.IdType) == ofacSdnEthIdType {
+			entries = append(entries, strings.TrimSpace(id.IdNumber))
+		}
+	}
+}
+
+func LoadOFACListFile(path string) (*OFACList, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := ParseOFACList(data)
+	if err != nil {
+		return nil, errors.Wrap(err, path)
+	}
+
+	list := NewOFACList(entries, path)
+	if list.Len() == 0 {
+		return nil, errors.New(path + ": no valid addresses")
+	}
+	return list, nil
+}
+
+// BuiltinOFACList returns the list used if no list file is given
+func BuiltinOFACList() *OFACList {
+	return NewOFACList(ofacBlacklist, "builtin")
+}
+
+// Current list of the server, replaced on reload
+func (d *requestDeps) currentOFACList() *OFACList {
+	d.reloadableLock.RLock()
+	defer d.reloadableLock.RUnlock()
+	return d.ofacList
+}
+
+// SetOFACList replaces the list of the server for the next requests
+func (s *RpcEndPointServer) SetOFACList(list *OFACList) {
+	s.reloadableLock.Lock()
+	defer s.reloadableLock.Unlock()
+	s.ofacList = list
+}
+
+// Tracks modification time and size of the list file to detect changes
+type ofacListWatcher struct {
+	path    string
+	set     func(list *OFACList)
+	logger  Logger
+	modTime time.Time
+	size    int64
+}
+
+func newOFACListWatcher(path string, logger Logger, set func(list *OFACList)) *ofacListWatcher {
+	w := &ofacListWatcher{path: path, set: set, logger: logger}
+	if info, err := os.Stat(path); err == nil {
+		w.modTime, w.size = info.ModTime(), info.Size()
+	}
+	return w
+}
+
+// reloadIfChanged loads and activates the list if the file changed since the last check
+func (w *ofacListWatcher) reloadIfChanged() (reloaded bool, err error) {
+	info, err := os.Stat(w.path)
+	if err != nil {
+		return false, err
+	}
+	if info.ModTime().Equal(w.modTime) && info.Size() == w.size {
+		return false, nil
+	}
+
+	// A file that fails to load (e.g. while it's being written) is tried again on the next check
+	list, err := LoadOFACListFile(w.path)
+	if err != nil {
+		return false, err
+	}
+	w.modTime, w.size = info.ModTime(), info.Size()
+	w.set(list)
+	w.logger.log("[ofac] reloaded %s - version: %s, entries: %d, invalid: %d", w.path, list.Version, list.Len(), list.Invalid)
+	return true, nil
+}
+
+// WatchOFACListFile reloads the list whenever the modification time or size of the file changes, and passes it to set.
+// If the new file is invalid, the current list stays in place.
+func WatchOFACListFile(path string, interval time.Duration, logger Logger, set func(list *OFACList)) {
+	w := newOFACListWatcher(path, logger, set)
+	for {
+		time.Sleep(interval)
+		if _, err := w.reloadIfChanged(); err != nil {
+			logger.logError("[ofac] reload failed, keeping current list: %v", err)
+		}
+	}
+}
+
+func (d *requestDeps) isOnOFACList(address common.Address) bool {
+	return d.currentOFACList().Contains(address)
 }
@@ -0,0 +1,166 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/flashbots/rpc-endpoint/types"
+	"github.com/stretchr/testify/require"
+)
+
+var testOFACSdnXml = `<?xml version="1.0" standalone="yes"?>
+<sdnList xmlns="http://tempuri.org/sdnList.xsd">
+  <sdnEntry>
+    <uid>1</uid>
+    <idList>
+      <id>
+        <uid>11</uid>
+        <idType>Digital Currency Address - XBT</idType>
+        <idNumber>149w62rY42aZBox8fGcmqNsXUzSStKeq8C</idNumber>
+      </id>
+      <id>
+        <uid>12</uid>
+        <idType>Digital Currency Address - ETH</idType>
+        <idNumber>0x8576acc5c05d6ce88f4e49bf65bdf0c62f91353c</idNumber>
+      </id>
+    </idList>
+  </sdnEntry>
+  <sdnEntry>
+    <uid>2</uid>
+    <idList>
+      <id>
+        <uid>21</uid>
+        <idType>Digital Currency Address - ETH</idType>
+        <idNumber>0xa7e5d5a720f06526557c513402f2e6b5fa20b00</idNumber>
+      </id>
+    </idList>
+  </sdnEntry>
+</sdnList>`
+
+func TestOFACListChecksumInsensitive(t *testing.T) {
+	list := NewOFACList([]string{"0xd882cfc20f52f2599d84b8e8d58c7fb62cfe344b", "0x901BB9583B24D97E995513C6778DC6888AB6870E", "0x123"}, "test")
+	require.Equal(t, 2, list.Len())
+	require.Equal(t, 1, list.Invalid)
+	require.True(t, list.Contains(common.HexToAddress("0xd882cFc20F52f2599D84b8e8D58C7FB62cfE344b")))
+	require.True(t, list.Contains(common.HexToAddress("0x901bb9583b24D97e995513C6778dc6888AB6870e")))
+	require.False(t, list.Contains(common.HexToAddress("0x7AaBc7915DF92a85E199DbB4B1D21E637e1a90A2")))
+
+	// Version depends only on the normalized set of addresses
+	list2 := NewOFACList([]string{"0x901bb9583b24D97e995513C6778dc6888AB6870e", "0xd882cFc20F52f2599D84b8e8D58C7FB62cfE344b"}, "test")
+	require.Equal(t, list.Version, list2.Version)
+}
+
+func TestBuiltinOFACList(t *testing.T) {
+	// The lower-cased entry used to never match the checksummed sender
+	require.True(t, NewOFACList(ofacBlacklist, "builtin").Contains(common.HexToAddress("0x8576aCC5C05D6Ce88f4e49bf65BdF0C62F91353C")))
+}
+
+func TestParseOFACList(t *testing.T) {
+	entries, err := ParseOFACList([]byte("# sanctioned\n0x8576acc5c05d6ce88f4e49bf65bdf0c62f91353c\n\n  0xd882cFc20F52f2599D84b8e8D58C7FB62cfE344b # comment\n"))
+	require.Nil(t, err, err)
+	require.Equal(t, []string{"0x8576acc5c05d6ce88f4e49bf65bdf0c62f91353c", "0xd882cFc20F52f2599D84b8e8D58C7FB62cfE344b"}, entries)
+
+	entries, err = ParseOFACList([]byte(testOFACSdnXml))
+	require.Nil(t, err, err)
+	require.Equal(t, []string{"0x8576acc5c05d6ce88f4e49bf65bdf0c62f91353c", "0xa7e5d5a720f06526557c513402f2e6b5fa20b00"}, entries)
+
+	_, err = ParseOFACList([]byte("<sdnList><id>"))
+	require.NotNil(t, err)
+}
+
+func TestOFACListReload(t *testing.T) {
+	s := &RpcEndPointServer{requestDeps: newTestDeps()}
+	other := &RpcEndPointServer{requestDeps: newTestDeps()}
+
+	path := filepath.Join(t.TempDir(), "ofac.xml")
+	err := ioutil.WriteFile(path, []byte(testOFACSdnXml), 0644)
+	require.Nil(t, err, err)
+
+	list, err := LoadOFACListFile(path)
+	require.Nil(t, err, err)
+	require.Equal(t, 1, list.Len())
+	require.Equal(t, 1, list.Invalid)
+	require.Equal(t, path, list.Source)
+	s.SetOFACList(list)
+
+	// Unchanged file is not reloaded
+	w := newOFACListWatcher(path, NewLogger("test"), s.SetOFACList)
+	reloaded, err := w.reloadIfChanged()
+	require.Nil(t, err, err)
+	require.False(t, reloaded)
+
+	sanctioned := common.HexToAddress("0x7F367cC41522cE07553e823bf3be79A889DEbe1B")
+	require.False(t, s.isOnOFACList(sanctioned))
+
+	err = ioutil.WriteFile(path, []byte(sanctioned.Hex()+"\n"), 0644)
+	require.Nil(t, err, err)
+	err = os.Chtimes(path, time.Now(), time.Now().Add(time.Minute))
+	require.Nil(t, err, err)
+
+	reloaded, err = w.reloadIfChanged()
+	require.Nil(t, err, err)
+	require.True(t, reloaded)
+	require.True(t, s.isOnOFACList(sanctioned))
+	require.NotEqual(t, list.Version, s.currentOFACList().Version)
+
+	// An invalid file keeps the current list
+	err = ioutil.WriteFile(path, []byte("0x123\n"), 0644)
+	require.Nil(t, err, err)
+	reloaded, err = w.reloadIfChanged()
+	require.NotNil(t, err)
+	require.False(t, reloaded)
+	require.True(t, s.isOnOFACList(sanctioned))
+
+	// and is tried again until it loads
+	reloaded, err = w.reloadIfChanged()
+	require.NotNil(t, err)
+	require.False(t, reloaded)
+	err = ioutil.WriteFile(path, []byte(sanctioned.Hex()+"\n"+ofacBlacklist[0]+"\n"), 0644)
+	require.Nil(t, err, err)
+	reloaded, err = w.reloadIfChanged()
+	require.Nil(t, err, err)
+	require.True(t, reloaded)
+	require.Equal(t, 2, s.currentOFACList().Len())
+
+	// Other servers keep their list
+	require.Equal(t, BuiltinOFACList().Version, other.currentOFACList().Version)
+}
+
+func TestOFACListAdminEndpoint(t *testing.T) {
+	list := BuiltinOFACList()
+
+	adminRequest := func(s *RpcEndPointServer, apiKey string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/admin/ofac", nil)
+		if apiKey != "" {
+			req.Header.Set("Authorization", "Bearer "+apiKey)
+		}
+		rr := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Disabled without an admin API key
+	require.Equal(t, http.StatusNotFound, adminRequest(&RpcEndPointServer{requestDeps: newTestDeps()}, "").Code)
+
+	// Only allowed with the key
+	s := &RpcEndPointServer{requestDeps: newTestDeps(), adminApiKey: "secret"}
+	require.Equal(t, http.StatusUnauthorized, adminRequest(s, "").Code)
+	require.Equal(t, http.StatusUnauthorized, adminRequest(s, "wrong").Code)
+	rr := adminRequest(s, "secret")
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	var res types.OFACListResponse
+	err := json.Unmarshal(rr.Body.Bytes(), &res)
+	require.Nil(t, err, err)
+	require.Equal(t, list.Version, res.Version)
+	require.Equal(t, 10, res.Entries)
+	require.Equal(t, 1, res.Invalid)
+	require.NotContains(t, rr.Body.String(), "builtin") // no file paths
+}
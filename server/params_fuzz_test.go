@@ -0,0 +1,82 @@
+//go:build go1.18
+// +build go1.18
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/flashbots/rpc-endpoint/testutils"
+	"github.com/flashbots/rpc-endpoint/types"
+)
+
+// Methods the endpoint decodes the params of, instead of passing them through to the node
+var interceptedMethods = []string{
+	"eth_sendRawTransaction",
+	"eth_getTransactionCount",
+	"eth_call",
+	"eth_getTransactionReceipt",
+	"flashbots_debugProtectionDecision",
+}
+
+// Any params must get a response, and never panic
+func FuzzInterceptedMethodParams(f *testing.F) {
+	for _, params := range []string{
+		`[]`,
+		`[null]`,
+		`[1]`,
+		`[true]`,
+		`[[]]`,
+		`[{}]`,
+		`[""]`,
+		`["0x"]`,
+		`["xy"]`,
+		`["0x7AaBc7915DF92a85E199DbB4B1D21E637e1a90A2", "latest"]`,
+		`["0xc543e2ad05cffdee95b984df20edd2e38e124c54461faa1276adc36e826588c9"]`,
+		`[{"to": "0xf1a54b0759b58661cea17cff19dd37940a9b5f1a"}, "latest"]`,
+		`[{"to": 1}]`,
+		`[{"to": null, "data": "0x12"}]`,
+		`["` + testutils.TestTx_MM2_RawTx + `"]`,
+		`["` + testutils.TestTx_BundleFailedTooManyTimes_RawTx + `"]`,
+		`{"tx": "0x1234"}`,
+	} {
+		f.Add(params)
+	}
+
+	// The node answers null to everything, so the receipt check asks the tx status API
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":null}`))
+	}))
+	defer node.Close()
+	relay := testutils.NewMockRelay()
+	defer relay.Close()
+
+	deps := newTestDeps()
+	setupMockTxApi(f, deps)
+	deps.relays = []RelayTarget{{Name: DefaultRelayName, Client: NewFlashbotsRelayClient(relay.Url())}}
+	proxyPool := NewProxyPool([]string{node.URL}, ProxyPoolConfig{})
+
+	f.Fuzz(func(t *testing.T, params string) {
+		for _, method := range interceptedMethods {
+			payload := fmt.Sprintf(`{"jsonrpc":"2.0","id":1,"method":%q,"params":%s}`, method, params)
+			entries, _, errRes := parseJsonRpcPayload([]byte(payload))
+			if errRes != nil || entries[0].req == nil {
+				continue // not a valid request
+			}
+
+			req := NewRpcRequest(context.Background(), deps, NewLogger("fuzz"), entries[0].req, proxyPool, "127.0.0.1", "", "")
+			res := req.ProcessRequest()
+			if res == nil || (res.Error == nil && res.Result == nil) {
+				t.Fatalf("%s: no response for params %s", method, params)
+			}
+			if res.Error != nil && res.Error.Code == types.JsonRpcInvalidParams && res.Error.Message == "" {
+				t.Fatalf("%s: invalid params error without message for params %s", method, params)
+			}
+		}
+	})
+}
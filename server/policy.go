@@ -0,0 +1,264 @@
+/*
+Frontrunning protection policy: an ordered list of rules which decide whether a transaction is sent to the relay or to
+the mempool. The first rule whose conditions all match decides, otherwise the default action applies.
+
+The policy can be loaded from a YAML (or JSON) file, and is reloaded on SIGHUP:
+
+	defaultAction: protect
+	rules:
+	  - name: low-gas
+	    action: mempool
+	    gasLessThan: 42000
+	  - name: whitelisted-function
+	    action: mempool
+	    selectors: ["a9059cbb", "095ea7b3"]
+*/
+package server
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/ethereum/go-ethereum/common"
+	ethtypes "github.com/ethereum/go-ethereum/core/types"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+type PolicyAction string
+
+const (
+	PolicyActionProtect PolicyAction = "protect" // send to relay
+	PolicyActionMempool PolicyAction = "mempool" // send to public mempool
+)
+
+// Name of the pseudo-rule reported when no rule matched
+const PolicyDefaultRuleName = "default"
+
+// PolicyRule matches a transaction if all of its (non-empty) conditions match
+type PolicyRule struct {
+	Name   string       `yaml:"name"`
+	Action PolicyAction `yaml:"action"`
+
+	GasLessThan      uint64   `yaml:"gasLessThan,omitempty"`
+	GasGreaterThan   uint64   `yaml:"gasGreaterThan,omitempty"`
+	DataLenLessThan  int      `yaml:"dataLenLessThan,omitempty"`  // length of calldata in bytes
+	Selectors        []string `yaml:"selectors,omitempty"`        // 4-byte function selectors as hex
+	Targets          []string `yaml:"targets,omitempty"`          // addresses the tx is sent to
+	ValueLessThan    string   `yaml:"valueLessThan,omitempty"`    // in wei
+	ValueGreaterThan string   `yaml:"valueGreaterThan,omitempty"` // in wei
+	TxTypes          []int    `yaml:"txTypes,omitempty"`          // 0: legacy, 1: access list, 2: dynamic fee
+
+	selectors        map[string]bool
+	targets          map[common.Address]bool
+	valueLessThan    *big.Int
+	valueGreaterThan *big.Int
+	txTypes          map[uint8]bool
+}
+
+type ProtectionPolicy struct {
+	DefaultAction PolicyAction  `yaml:"defaultAction"`
+	Rules         []*PolicyRule `yaml:"rules"`
+
+	Source string `yaml:"-"` // file the policy was loaded from
+}
+
+// PolicyDecision records which rule decided about a transaction
+type PolicyDecision struct {
+	NeedsProtection bool         `json:"needsProtection"`
+	Action          PolicyAction `json:"action"`
+	Rule            string       `json:"rule"`
+}
+
+// DefaultProtectionPolicy is used if no policy file is given
+func DefaultProtectionPolicy() *ProtectionPolicy {
+	selectors := make([]string, 0, len(allowedFunctions))
+	for selector := range allowedFunctions {
+		selectors = append(selectors, selector)
+	}
+	sort.Strings(selectors)
+
+	policy := &ProtectionPolicy{
+		DefaultAction: PolicyActionProtect,
+		Rules: []*PolicyRule{
+			// Flashbots Relay will reject anything less than 42000 gas, so we just send those to the mempool
+			// Anyway things with that low of gas probably don't need frontrunning protection regardless
+			{Name: "low-gas", Action: PolicyActionMempool, GasLessThan: 42000},
+			{Name: "no-function-call", Action: PolicyActionMempool, DataLenLessThan: 4},
+			{Name: "whitelisted-function", Action: PolicyActionMempool, Selectors: selectors},
+		},
+		Source: "builtin",
+	}
+	if err := policy.validate(); err != nil {
+		panic(err)
+	}
+	return policy
+}
+
+func (p *ProtectionPolicy) validate() error {
+	if p.DefaultAction == "" {
+		p.DefaultAction = PolicyActionProtect
+	}
+	if p.DefaultAction != PolicyActionProtect && p.DefaultAction != PolicyActionMempool {
+		return fmt.Errorf("invalid default action: %s", p.DefaultAction)
+	}
+
+	for i, rule := range p.Rules {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule-%d", i+1)
+		}
+		if err := rule.validate(); err != nil {
+			return errors.Wrap(err, "rule "+rule.Name)
+		}
+	}
+	return nil
+}
+
+func (r *PolicyRule) validate() error {
+	if r.Action != PolicyActionProtect && r.Action != PolicyActionMempool {
+		return fmt.Errorf("invalid action: %s", r.Action)
+	}
+
+	r.selectors = make(map[string]bool)
+	for _, selector := range r.Selectors {
+		selector = strings.ToLower(strings.TrimPrefix(selector, "0x"))
+		if b, err := hex.DecodeString(selector); err != nil || len(b) != 4 {
+			return fmt.Errorf("invalid selector: %s", selector)
+		}
+		r.selectors[selector] = true
+	}
+
+	r.targets = make(map[common.Address]bool)
+	for _, target := range r.Targets {
+		if !common.IsHexAddress(target) {
+			return fmt.Errorf("invalid target: %s", target)
+		}
+		r.targets[common.HexToAddress(target)] = true
+	}
+
+	var ok bool
+	if r.ValueLessThan != "" {
+		if r.valueLessThan, ok = new(big.Int).SetString(r.ValueLessThan, 10); !ok {
+			return fmt.Errorf("invalid valueLessThan: %s", r.ValueLessThan)
+		}
+	}
+	if r.ValueGreaterThan != "" {
+		if r.valueGreaterThan, ok = new(big.Int).SetString(r.ValueGreaterThan, 10); !ok {
+			return fmt.Errorf("invalid valueGreaterThan: %s", r.ValueGreaterThan)
+		}
+	}
+
+	r.txTypes = make(map[uint8]bool)
+	for _, txType := range r.TxTypes {
+		if txType < 0 || txType > 255 {
+			return fmt.Errorf("invalid tx type: %d", txType)
+		}
+		r.txTypes[uint8(txType)] = true
+	}
+	return nil
+}
+
+func (r *PolicyRule) matches(tx *ethtypes.Transaction) bool {
+	if r.GasLessThan > 0 && tx.Gas() >= r.GasLessThan {
+		return false
+	}
+	if r.GasGreaterThan > 0 && tx.Gas() <= r.GasGreaterThan {
+		return false
+	}
+	if r.DataLenLessThan > 0 && len(tx.Data()) >= r.DataLenLessThan {
+		return false
+	}
+	if len(r.selectors) > 0 {
+		if len(tx.Data()) < 4 || !r.selectors[hex.EncodeToString(tx.Data()[:4])] {
+			return false
+		}
+	}
+	if len(r.targets) > 0 {
+		if tx.To() == nil || !r.targets[*tx.To()] {
+			return false
+		}
+	}
+	if r.valueLessThan != nil && tx.Value().Cmp(r.valueLessThan) >= 0 {
+		return false
+	}
+	if r.valueGreaterThan != nil && tx.Value().Cmp(r.valueGreaterThan) <= 0 {
+		return false
+	}
+	if len(r.txTypes) > 0 && !r.txTypes[tx.Type()] {
+		return false
+	}
+	return true
+}
+
+// Evaluate returns the decision of the first matching rule, or the default action
+func (p *ProtectionPolicy) Evaluate(tx *ethtypes.Transaction) PolicyDecision {
+	action, ruleName := p.DefaultAction, PolicyDefaultRuleName
+	for _, rule := range p.Rules {
+		if rule.matches(tx) {
+			action, ruleName = rule.Action, rule.Name
+			break
+		}
+	}
+
+	return PolicyDecision{
+		NeedsProtection: action == PolicyActionProtect,
+		Action:          action,
+		Rule:            ruleName,
+	}
+}
+
+func LoadProtectionPolicyFile(path string) (*ProtectionPolicy, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	policy := new(ProtectionPolicy)
+	if err = yaml.UnmarshalStrict(data, policy); err != nil {
+		return nil, errors.Wrap(err, "parsing "+path)
+	}
+
+	if err = policy.validate(); err != nil {
+		return nil, errors.Wrap(err, path)
+	}
+
+	policy.Source = path
+	return policy, nil
+}
+
+// Current policy of the server, replaced on reload
+func (d *requestDeps) currentProtectionPolicy() *ProtectionPolicy {
+	d.reloadableLock.RLock()
+	defer d.reloadableLock.RUnlock()
+	return d.protectionPolicy
+}
+
+// SetProtectionPolicy replaces the policy of the server for the next requests
+func (s *RpcEndPointServer) SetProtectionPolicy(policy *ProtectionPolicy) {
+	s.reloadableLock.Lock()
+	defer s.reloadableLock.Unlock()
+	s.protectionPolicy = policy
+}
+
+// WatchProtectionPolicySignal reloads the policy file on SIGHUP and passes it to set. If the new file is invalid, the
+// current policy stays in place.
+func WatchProtectionPolicySignal(path string, logger Logger, set func(policy *ProtectionPolicy)) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP)
+	for range sigCh {
+		policy, err := LoadProtectionPolicyFile(path)
+		if err != nil {
+			logger.logError("[policy] reload failed, keeping current policy: %v", err)
+			continue
+		}
+		set(policy)
+		logger.log("[policy] reloaded %s with %d rules", path, len(policy.Rules))
+	}
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/flashbots/rpc-endpoint/testutils"
+	"github.com/stretchr/testify/require"
+)
+
+func writePolicyFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	err := ioutil.WriteFile(path, []byte(content), 0644)
+	require.Nil(t, err, err)
+	return path
+}
+
+func TestDefaultProtectionPolicy(t *testing.T) {
+	policy := DefaultProtectionPolicy()
+
+	// Swap on 0x exchange proxy
+	tx, err := GetTx(testutils.TestTx_BundleFailedTooManyTimes_RawTx)
+	require.Nil(t, err, err)
+	decision := policy.Evaluate(tx)
+	require.True(t, decision.NeedsProtection)
+	require.Equal(t, PolicyActionProtect, decision.Action)
+	require.Equal(t, PolicyDefaultRuleName, decision.Rule)
+
+	// Plain eth transfer with 21000 gas
+	tx, err = GetTx(testutils.TestTx_MM2_RawTx)
+	require.Nil(t, err, err)
+	decision = policy.Evaluate(tx)
+	require.False(t, decision.NeedsProtection)
+	require.Equal(t, PolicyActionMempool, decision.Action)
+	require.Equal(t, "low-gas", decision.Rule)
+}
+
+func TestLoadProtectionPolicyFile(t *testing.T) {
+	path := writePolicyFile(t, `
+defaultAction: mempool
+rules:
+  - name: exchange-proxy
+    action: protect
+    targets: ["0xDef1C0ded9bec7F1a1670819833240f027b25EfF"]
+  - name: swaps
+    action: mempool
+    selectors: ["0xd9627aa4"]
+`)
+	policy, err := LoadProtectionPolicyFile(path)
+	require.Nil(t, err, err)
+	require.Equal(t, path, policy.Source)
+	require.Equal(t, 2, len(policy.Rules))
+
+	// First matching rule wins
+	tx, err := GetTx(testutils.TestTx_BundleFailedTooManyTimes_RawTx)
+	require.Nil(t, err, err)
+	decision := policy.Evaluate(tx)
+	require.True(t, decision.NeedsProtection)
+	require.Equal(t, "exchange-proxy", decision.Rule)
+
+	// No rule matches, so the default action applies
+	tx, err = GetTx(testutils.TestTx_MM2_RawTx)
+	require.Nil(t, err, err)
+	decision = policy.Evaluate(tx)
+	require.False(t, decision.NeedsProtection)
+	require.Equal(t, PolicyDefaultRuleName, decision.Rule)
+}
+
+func TestProtectionPolicyValueAndGas(t *testing.T) {
+	path := writePolicyFile(t, `
+rules:
+  - action: mempool
+    gasGreaterThan: 100000
+    valueGreaterThan: "100000000000000000"
+    txTypes: [2]
+`)
+	policy, err := LoadProtectionPolicyFile(path)
+	require.Nil(t, err, err)
+	require.Equal(t, PolicyActionProtect, policy.DefaultAction)
+	require.Equal(t, "rule-1", policy.Rules[0].Name)
+
+	// 0.1 eth is not greater than 0.1 eth
+	tx, err := GetTx(testutils.TestTx_BundleFailedTooManyTimes_RawTx)
+	require.Nil(t, err, err)
+	require.Equal(t, PolicyDefaultRuleName, policy.Evaluate(tx).Rule)
+
+	policy.Rules[0].ValueGreaterThan = "99999999999999999"
+	require.Nil(t, policy.validate())
+	require.Equal(t, "rule-1", policy.Evaluate(tx).Rule)
+}
+
+func TestLoadProtectionPolicyFileInvalid(t *testing.T) {
+	invalid := map[string]string{
+		"unknown field":   "rules:\n  - action: mempool\n    gasBelow: 1\n",
+		"invalid action":  "rules:\n  - action: drop\n",
+		"invalid target":  "rules:\n  - action: mempool\n    targets: [\"0x123\"]\n",
+		"short selector":  "rules:\n  - action: mempool\n    selectors: [\"a9059c\"]\n",
+		"invalid value":   "rules:\n  - action: mempool\n    valueLessThan: \"1 eth\"\n",
+		"invalid default": "defaultAction: drop\n",
+	}
+	for name, content := range invalid {
+		t.Run(name, func(t *testing.T) {
+			_, err := LoadProtectionPolicyFile(writePolicyFile(t, content))
+			require.NotNil(t, err)
+		})
+	}
+
+	_, err := LoadProtectionPolicyFile(filepath.Join(t.TempDir(), "missing.yaml"))
+	require.NotNil(t, err)
+}
@@ -0,0 +1,163 @@
+/*
+Per-request user preferences, configured in the endpoint URL as query parameters. The fast mode can also be selected
+with the /fast path:
+
+	https://rpc.example.net/?maxBlocks=10&builder=flashbots&builder=builder-a&mempoolFallback=false
+	https://rpc.example.net/fast
+
+	fast             send private txs to all relays, and ask them for fast inclusion
+	maxBlocks        number of blocks in which the relays try to include a private tx
+	maxBlockNumber   last block in which the relays try to include a private tx (instead of maxBlocks)
+	builder          relays to send private txs to, by name (repeated or comma-separated, default: all)
+	mempoolFallback  if false, txs are never sent to the mempool, even if the protection policy would (default: true)
+	url              custom node to proxy requests to, instead of ours
+
+Cancellations are sent to the relays the tx was sent to.
+
+Other paths and query parameters (e.g. /rpc or ?utm_source=...) are ignored, only invalid values of the options above
+are rejected.
+*/
+package server
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/flashbots/rpc-endpoint/types"
+	"github.com/pkg/errors"
+)
+
+// Upper limit of the maxBlocks preference
+var MaxPreferenceBlocks uint64 = 100
+
+type UserPreferences struct {
+	Fast            bool
+	MaxBlocks       uint64   // 0: relay default
+	MaxBlockNumber  uint64   // 0: relay default
+	Builders        []string // relay names, empty: all relays
+	MempoolFallback bool
+}
+
+func DefaultUserPreferences() UserPreferences {
+	return UserPreferences{MempoolFallback: true}
+}
+
+// Query parameters which aren't preferences
+var nonPreferenceQueryParams = map[string]bool{"url": true}
+
+// ParseUserPreferences reads the preferences from the request URL. Builders must be names of the relays. It also
+// returns the unknown path and query parameters, which are ignored.
+func ParseUserPreferences(u *url.URL, relays []RelayTarget) (prefs UserPreferences, ignored []string, err error) {
+	prefs = DefaultUserPreferences()
+
+	switch strings.Trim(u.Path, "/") {
+	case "":
+	case "fast":
+		prefs.Fast = true
+	default:
+		ignored = append(ignored, "path "+u.Path)
+	}
+
+	query := u.Query()
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys) // errors in a stable order
+
+	for _, key := range keys {
+		value := query.Get(key)
+		switch key {
+		case "fast":
+			prefs.Fast, err = parsePreferenceBool(key, value)
+		case "mempoolFallback":
+			prefs.MempoolFallback, err = parsePreferenceBool(key, value)
+		case "maxBlocks":
+			prefs.MaxBlocks, err = strconv.ParseUint(value, 10, 64)
+			if err != nil || prefs.MaxBlocks < 1 || prefs.MaxBlocks > MaxPreferenceBlocks {
+				err = fmt.Errorf("invalid maxBlocks %q, must be between 1 and %d", value, MaxPreferenceBlocks)
+			}
+		case "maxBlockNumber":
+			prefs.MaxBlockNumber, err = parseBlockNumber(value)
+			if err != nil || prefs.MaxBlockNumber == 0 {
+				err = fmt.Errorf("invalid maxBlockNumber %q", value)
+			}
+		case "builder":
+			prefs.Builders, err = parsePreferenceBuilders(query[key], relays)
+		default:
+			if !nonPreferenceQueryParams[key] {
+				ignored = append(ignored, "option "+key)
+			}
+		}
+		if err != nil {
+			return prefs, ignored, err
+		}
+	}
+
+	if prefs.MaxBlocks > 0 && prefs.MaxBlockNumber > 0 {
+		return prefs, ignored, errors.New("maxBlocks and maxBlockNumber cannot be used together")
+	}
+	return prefs, ignored, nil
+}
+
+// An empty value counts as true, so ?fast works like ?fast=true
+func parsePreferenceBool(key, value string) (bool, error) {
+	if value == "" {
+		return true, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s %q, must be true or false", key, value)
+	}
+	return b, nil
+}
+
+// Decimal or 0x-prefixed hex
+func parseBlockNumber(value string) (uint64, error) {
+	if strings.HasPrefix(value, "0x") {
+		return hexutil.DecodeUint64(value)
+	}
+	return strconv.ParseUint(value, 10, 64)
+}
+
+func parsePreferenceBuilders(values []string, relays []RelayTarget) ([]string, error) {
+	known := make(map[string]bool, len(relays))
+	names := make([]string, 0, len(relays))
+	for _, relay := range relays {
+		known[relay.Name] = true
+		names = append(names, relay.Name)
+	}
+
+	builders := make([]string, 0)
+	for _, value := range values {
+		for _, builder := range strings.Split(value, ",") {
+			if !known[builder] {
+				return nil, fmt.Errorf("unknown builder %q, available: %s", builder, strings.Join(names, ", "))
+			}
+			builders = append(builders, builder)
+		}
+	}
+	return builders, nil
+}
+
+// Relays to send private txs to
+func (p UserPreferences) selectRelays(relays []RelayTarget) []RelayTarget {
+	if p.Fast || len(p.Builders) == 0 {
+		return relays
+	}
+	return relaysByName(relays, p.Builders)
+}
+
+// Returns false (and sets the error response) if the request URL has invalid options
+func (r *RpcRequest) checkPreferences() bool {
+	if r.prefsErr == nil {
+		return true
+	}
+	r.logger.log("invalid url option: %v", r.prefsErr)
+	r.writeRpcError("invalid url option: "+r.prefsErr.Error(), types.JsonRpcInvalidRequest)
+	return false
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseUserPreferences(t *testing.T) {
+	relays := []RelayTarget{{Name: "flashbots"}, {Name: "builder-a"}, {Name: "builder-b"}}
+	parse := func(rawUrl string) (UserPreferences, error) {
+		u, err := url.Parse(rawUrl)
+		require.Nil(t, err, err)
+		prefs, _, err := ParseUserPreferences(u, relays)
+		return prefs, err
+	}
+
+	prefs, err := parse("http://rpc/?url=http://node")
+	require.Nil(t, err, err)
+	require.Equal(t, DefaultUserPreferences(), prefs)
+
+	// Unknown paths and options are ignored
+	u, _ := url.Parse("http://rpc/rpc?utm_source=wallet&fast")
+	prefs, ignored, err := ParseUserPreferences(u, relays)
+	require.Nil(t, err, err)
+	require.True(t, prefs.Fast)
+	require.Equal(t, []string{"path /rpc", "option utm_source"}, ignored)
+
+	prefs, err = parse("http://rpc/fast?maxBlocks=10&mempoolFallback=false")
+	require.Nil(t, err, err)
+	require.True(t, prefs.Fast)
+	require.Equal(t, uint64(10), prefs.MaxBlocks)
+	require.False(t, prefs.MempoolFallback)
+
+	prefs, err = parse("http://rpc/?fast&maxBlockNumber=0x10&builder=builder-a,builder-b&builder=flashbots")
+	require.Nil(t, err, err)
+	require.True(t, prefs.Fast)
+	require.Equal(t, uint64(16), prefs.MaxBlockNumber)
+	require.Equal(t, []string{"builder-a", "builder-b", "flashbots"}, prefs.Builders)
+
+	for rawUrl, msg := range map[string]string{
+		"http://rpc/?fast=yes":                             `invalid fast "yes", must be true or false`,
+		"http://rpc/?maxBlocks=0":                          `invalid maxBlocks "0", must be between 1 and 100`,
+		"http://rpc/?maxBlocks=101":                        `invalid maxBlocks "101", must be between 1 and 100`,
+		"http://rpc/?maxBlockNumber=abc":                   `invalid maxBlockNumber "abc"`,
+		"http://rpc/?maxBlocks=5&maxBlockNumber=100":       "maxBlocks and maxBlockNumber cannot be used together",
+		"http://rpc/?builder=builder-c":                    `unknown builder "builder-c", available: flashbots, builder-a, builder-b`,
+		"http://rpc/?builder=flashbots&mempoolFallback=no": `invalid mempoolFallback "no", must be true or false`,
+	} {
+		_, err = parse(rawUrl)
+		require.NotNil(t, err, rawUrl)
+		require.Equal(t, msg, err.Error(), rawUrl)
+	}
+}
+
+func TestUserPreferencesSelectRelays(t *testing.T) {
+	relays := []RelayTarget{{Name: "flashbots"}, {Name: "builder-a"}, {Name: "builder-b"}}
+
+	prefs := DefaultUserPreferences()
+	require.Equal(t, relays, prefs.selectRelays(relays))
+
+	prefs.Builders = []string{"builder-b", "flashbots"}
+	require.Equal(t, []RelayTarget{relays[0], relays[2]}, prefs.selectRelays(relays))
+
+	// Fast mode sends to all relays
+	prefs.Fast = true
+	require.Equal(t, relays, prefs.selectRelays(relays))
+}
@@ -0,0 +1,276 @@
+// Pool of upstream eth nodes with health checks and failover.
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/flashbots/rpc-endpoint/tracing"
+	"github.com/flashbots/rpc-endpoint/types"
+	"github.com/flashbots/rpc-endpoint/utils"
+	"github.com/pkg/errors"
+)
+
+type ProxyPoolConfig struct {
+	HealthCheckInterval time.Duration
+	MaxBlockLag         uint64 // nodes which are more than this many blocks behind the best node are taken out of rotation
+	Logger              Logger // for node health changes, default: NewLogger("")
+}
+
+var DefaultProxyPoolConfig = ProxyPoolConfig{
+	HealthCheckInterval: time.Duration(10 * time.Second),
+	MaxBlockLag:         3,
+}
+
+// Sets the zero fields to the defaults
+func (c ProxyPoolConfig) withDefaults() ProxyPoolConfig {
+	if c.HealthCheckInterval == 0 {
+		c.HealthCheckInterval = DefaultProxyPoolConfig.HealthCheckInterval
+	}
+	if c.MaxBlockLag == 0 {
+		c.MaxBlockLag = DefaultProxyPoolConfig.MaxBlockLag
+	}
+	if c.Logger == nil {
+		c.Logger = NewLogger("")
+	}
+	return c
+}
+
+var ErrNoProxyNodes = errors.New("no proxy nodes available")
+
+type ProxyNode struct {
+	Url string
+
+	mu          sync.RWMutex
+	healthy     bool
+	blockNumber uint64
+	lastError   error
+}
+
+func (n *ProxyNode) IsHealthy() bool {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.healthy
+}
+
+func (n *ProxyNode) setHealthy(healthy bool, err error) (changed bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	changed = n.healthy != healthy
+	n.healthy = healthy
+	n.lastError = err
+	return changed
+}
+
+// ProxyPool proxies requests to the first healthy node, and fails over to the next one on connection errors or 5xx responses.
+// Node health is re-evaluated periodically with eth_blockNumber, which also ejects nodes that fall behind the chain head.
+type ProxyPool struct {
+	nodes  []*ProxyNode
+	client *http.Client
+	config ProxyPoolConfig
+	custom bool // user supplied url, not one of ours
+
+	mu              sync.RWMutex
+	headBlockNumber uint64
+}
+
+func NewProxyPool(urls []string, config ProxyPoolConfig) *ProxyPool {
+	pool := &ProxyPool{client: tracing.NewClient(), config: config.withDefaults()}
+	for _, url := range urls {
+		pool.nodes = append(pool.nodes, &ProxyNode{Url: url, healthy: true})
+	}
+	return pool
+}
+
+// NewCustomProxyPool is used for requests that specify their own proxy url, which must have passed the
+// CustomProxyPolicy. The client should be one of NewCustomProxyClient.
+func NewCustomProxyPool(url string, client *http.Client) *ProxyPool {
+	pool := NewProxyPool([]string{url}, ProxyPoolConfig{})
+	pool.client = client
+	pool.custom = true
+	return pool
+}
+
+func (p *ProxyPool) markFailed(node *ProxyNode, err error) {
+	if node.setHealthy(false, err) {
+		p.config.Logger.logWarn("[proxy-pool] node %s marked unhealthy: %v", node.Url, err)
+	}
+}
+
+func (p *ProxyPool) metricsLabel(node *ProxyNode) string {
+	if p.custom {
+		return "custom"
+	}
+	return metricsUpstreamLabel(node.Url)
+}
+
+func (p *ProxyPool) Nodes() []*ProxyNode {
+	return p.nodes
+}
+
+// HeadBlockNumber returns the highest block number seen at the last health check (0 if unknown)
+func (p *ProxyPool) HeadBlockNumber() uint64 {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.headBlockNumber
+}
+
+// BlockNumber returns the head block number of the last health check, or queries it if no health check ran yet
+func (p *ProxyPool) BlockNumber(ctx context.Context) (uint64, error) {
+	if head := p.HeadBlockNumber(); head > 0 {
+		return head, nil
+	}
+
+	res, err := p.SendRpcAndParseResponse(ctx, types.NewJsonRpcRequest(1, "eth_blockNumber", []interface{}{}))
+	if err != nil {
+		return 0, err
+	}
+	return parseBlockNumberResponse(res)
+}
+
+// Nodes to try in order: healthy ones first, unhealthy ones as last resort
+func (p *ProxyPool) candidates() []*ProxyNode {
+	healthy := make([]*ProxyNode, 0, len(p.nodes))
+	unhealthy := make([]*ProxyNode, 0)
+	for _, node := range p.nodes {
+		if node.IsHealthy() {
+			healthy = append(healthy, node)
+		} else {
+			unhealthy = append(unhealthy, node)
+		}
+	}
+	return append(healthy, unhealthy...)
+}
+
+// ProxyRequest sends the body to the first node that responds without a connection error or 5xx status. When ctx ends,
+// no other nodes are tried, and the node isn't marked as failed because the deadline may be too short for any node.
+func (p *ProxyPool) ProxyRequest(ctx context.Context, body []byte) (resp *http.Response, nodeUrl string, err error) {
+	err = ErrNoProxyNodes
+	for _, node := range p.candidates() {
+		timeStart := time.Now()
+		resp, err = ProxyRequest(ctx, p.client, node.Url, body)
+		metricProxyDuration.Observe(time.Since(timeStart).Seconds(), p.metricsLabel(node))
+		if ctx.Err() != nil {
+			if err == nil {
+				resp.Body.Close()
+			}
+			return nil, "", errors.Wrap(ctx.Err(), node.Url)
+		}
+		if err != nil {
+			metricProxyErrors.Inc(p.metricsLabel(node))
+			p.markFailed(node, err)
+			continue
+		}
+
+		if resp.StatusCode >= http.StatusInternalServerError {
+			resp.Body.Close()
+			err = fmt.Errorf("proxy node %s responded with status %d", node.Url, resp.StatusCode)
+			metricProxyErrors.Inc(p.metricsLabel(node))
+			p.markFailed(node, err)
+			continue
+		}
+
+		return resp, node.Url, nil
+	}
+	return nil, "", err
+}
+
+// SendRpcAndParseResponse sends a JSON-RPC request to the first node that answers it, until ctx ends
+func (p *ProxyPool) SendRpcAndParseResponse(ctx context.Context, req *types.JsonRpcRequest) (res *types.JsonRpcResponse, err error) {
+	err = ErrNoProxyNodes
+	for _, node := range p.candidates() {
+		res, err = utils.SendRpcAndParseResponseToWithClient(ctx, p.client, node.Url, req)
+		if ctx.Err() != nil {
+			return nil, errors.Wrap(ctx.Err(), node.Url)
+		}
+		if err != nil {
+			metricProxyErrors.Inc(p.metricsLabel(node))
+			p.markFailed(node, err)
+			continue
+		}
+		return res, nil
+	}
+	return nil, err
+}
+
+func getBlockNumber(url string, timeout time.Duration) (uint64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req := types.NewJsonRpcRequest(1, "eth_blockNumber", []interface{}{})
+	res, err := utils.SendRpcAndParseResponseToWithContext(ctx, url, req)
+	if err != nil {
+		return 0, err
+	}
+	return parseBlockNumberResponse(res)
+}
+
+func parseBlockNumberResponse(res *types.JsonRpcResponse) (uint64, error) {
+	if res.Error != nil {
+		return 0, res.Error
+	}
+
+	var blockNumberHex string
+	if err := json.Unmarshal(res.Result, &blockNumberHex); err != nil {
+		return 0, errors.Wrap(err, "unmarshal")
+	}
+	return hexutil.DecodeUint64(blockNumberHex)
+}
+
+// CheckHealth queries eth_blockNumber on all nodes, and marks nodes as unhealthy if they fail or lag behind the best node
+func (p *ProxyPool) CheckHealth() {
+	var wg sync.WaitGroup
+	blockNumbers := make([]uint64, len(p.nodes))
+	errs := make([]error, len(p.nodes))
+	for i, node := range p.nodes {
+		wg.Add(1)
+		go func(i int, node *ProxyNode) {
+			defer wg.Done()
+			blockNumbers[i], errs[i] = getBlockNumber(node.Url, p.config.HealthCheckInterval)
+		}(i, node)
+	}
+	wg.Wait()
+
+	var head uint64
+	for i := range p.nodes {
+		if errs[i] == nil {
+			head = Max(head, blockNumbers[i])
+		}
+	}
+
+	for i, node := range p.nodes {
+		err := errs[i]
+		if err == nil && head-blockNumbers[i] > p.config.MaxBlockLag {
+			err = fmt.Errorf("block %d is %d blocks behind head %d", blockNumbers[i], head-blockNumbers[i], head)
+		}
+
+		node.mu.Lock()
+		if errs[i] == nil {
+			node.blockNumber = blockNumbers[i]
+		}
+		node.mu.Unlock()
+
+		if node.setHealthy(err == nil, err) {
+			if err == nil {
+				p.config.Logger.log("[proxy-pool] node %s is healthy again at block %d", node.Url, blockNumbers[i])
+			} else {
+				p.config.Logger.logWarn("[proxy-pool] node %s marked unhealthy: %v", node.Url, err)
+			}
+		}
+	}
+
+	p.mu.Lock()
+	p.headBlockNumber = Max(p.headBlockNumber, head)
+	p.mu.Unlock()
+}
+
+func (p *ProxyPool) StartHealthChecks() {
+	for {
+		p.CheckHealth()
+		time.Sleep(p.config.HealthCheckInterval)
+	}
+}
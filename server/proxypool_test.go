@@ -0,0 +1,122 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/flashbots/rpc-endpoint/types"
+	"github.com/stretchr/testify/require"
+)
+
+// Mock node which answers every request with the given block number
+func newMockProxyNode(blockNumber uint64) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"jsonrpc":"2.0","id":1,"result":"0x%x"}`, blockNumber)
+	}))
+}
+
+func newFailingProxyNode() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+}
+
+func TestProxyPoolFailover(t *testing.T) {
+	failingNode := newFailingProxyNode()
+	defer failingNode.Close()
+	goodNode := newMockProxyNode(100)
+	defer goodNode.Close()
+
+	pool := NewProxyPool([]string{failingNode.URL, goodNode.URL}, ProxyPoolConfig{})
+
+	// First request fails over to the second node, and marks the first one as unhealthy
+	resp, nodeUrl, err := pool.ProxyRequest(context.Background(), []byte(`{}`))
+	require.Nil(t, err, err)
+	resp.Body.Close()
+	require.Equal(t, goodNode.URL, nodeUrl)
+	require.False(t, pool.Nodes()[0].IsHealthy())
+	require.True(t, pool.Nodes()[1].IsHealthy())
+
+	// Unhealthy node is tried last
+	require.Equal(t, goodNode.URL, pool.candidates()[0].Url)
+
+	res, err := pool.SendRpcAndParseResponse(context.Background(), types.NewJsonRpcRequest(1, "eth_blockNumber", nil))
+	require.Nil(t, err, err)
+	require.Equal(t, `"0x64"`, string(res.Result))
+}
+
+func TestProxyPoolAllNodesFailing(t *testing.T) {
+	failingNode := newFailingProxyNode()
+	defer failingNode.Close()
+
+	pool := NewProxyPool([]string{failingNode.URL}, ProxyPoolConfig{})
+	_, _, err := pool.ProxyRequest(context.Background(), []byte(`{}`))
+	require.NotNil(t, err)
+
+	// A single node is still tried even if unhealthy
+	require.Equal(t, 1, len(pool.candidates()))
+
+	pool = NewProxyPool([]string{}, ProxyPoolConfig{})
+	_, _, err = pool.ProxyRequest(context.Background(), []byte(`{}`))
+	require.Equal(t, ErrNoProxyNodes, err)
+}
+
+func TestProxyPoolHealthCheckEjectsLaggingNodes(t *testing.T) {
+	headNode := newMockProxyNode(1000)
+	defer headNode.Close()
+	lagNode := newMockProxyNode(1000 - DefaultProxyPoolConfig.MaxBlockLag - 1)
+	defer lagNode.Close()
+	okNode := newMockProxyNode(1000 - DefaultProxyPoolConfig.MaxBlockLag)
+	defer okNode.Close()
+	failingNode := newFailingProxyNode()
+	defer failingNode.Close()
+
+	pool := NewProxyPool([]string{lagNode.URL, headNode.URL, okNode.URL, failingNode.URL}, ProxyPoolConfig{})
+	pool.CheckHealth()
+
+	require.False(t, pool.Nodes()[0].IsHealthy())
+	require.True(t, pool.Nodes()[1].IsHealthy())
+	require.True(t, pool.Nodes()[2].IsHealthy())
+	require.False(t, pool.Nodes()[3].IsHealthy())
+	require.Equal(t, uint64(1000), pool.HeadBlockNumber())
+
+	resp, nodeUrl, err := pool.ProxyRequest(context.Background(), []byte(`{}`))
+	require.Nil(t, err, err)
+	resp.Body.Close()
+	require.Equal(t, headNode.URL, nodeUrl)
+
+	// The allowed lag is configured per pool
+	pool = NewProxyPool([]string{lagNode.URL, headNode.URL}, ProxyPoolConfig{MaxBlockLag: DefaultProxyPoolConfig.MaxBlockLag + 1})
+	pool.CheckHealth()
+	require.True(t, pool.Nodes()[0].IsHealthy())
+}
+
+func TestProxyPoolDeadline(t *testing.T) {
+	slowNode := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ioutil.ReadAll(req.Body) // the context is cancelled on disconnect only once the body was read
+		<-req.Context().Done()
+	}))
+	defer slowNode.Close()
+	goodNode := newMockProxyNode(100)
+	defer goodNode.Close()
+
+	pool := NewProxyPool([]string{slowNode.URL, goodNode.URL}, ProxyPoolConfig{})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	// The deadline ends the request without failing over, and the slow node stays healthy
+	_, _, err := pool.ProxyRequest(ctx, []byte(`{}`))
+	require.True(t, errors.Is(err, context.DeadlineExceeded), err)
+	require.True(t, pool.Nodes()[0].IsHealthy())
+
+	_, err = pool.SendRpcAndParseResponse(ctx, types.NewJsonRpcRequest(1, "eth_blockNumber", nil))
+	require.True(t, errors.Is(err, context.DeadlineExceeded), err)
+	require.True(t, pool.Nodes()[0].IsHealthy())
+}
@@ -0,0 +1,256 @@
+/*
+Token-bucket rate limiting, stored in Redis so limits are shared across replicas. Requests are limited by client IP and
+method, and eth_sendRawTransaction additionally by the tx sender. The limits are loaded from a YAML file:
+
+	default:
+	  ip: {rate: 10, burst: 50}
+	methods:
+	  eth_sendRawTransaction:
+	    ip: {rate: 1, burst: 10}
+	    sender: {rate: 0.2, burst: 5}
+	exemptApiKeys: ["secret-key"]
+
+Rate is in requests per second, burst is the bucket size. Methods without own limits use the default. Without Redis
+(other state backends), the buckets are kept in memory and are per instance.
+*/
+package server
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+var RedisPrefixRateLimit = RedisPrefix + "ratelimit:"
+
+type RateLimit struct {
+	Rate  float64 `yaml:"rate"`  // tokens per second
+	Burst int     `yaml:"burst"` // bucket size
+}
+
+type MethodRateLimits struct {
+	IP     *RateLimit `yaml:"ip,omitempty"`
+	Sender *RateLimit `yaml:"sender,omitempty"` // only applies to eth_sendRawTransaction
+}
+
+type RateLimitConfig struct {
+	Default       MethodRateLimits            `yaml:"default"`
+	Methods       map[string]MethodRateLimits `yaml:"methods,omitempty"`
+	ExemptApiKeys []string                    `yaml:"exemptApiKeys,omitempty"`
+}
+
+func (l *RateLimit) validate() error {
+	if l == nil {
+		return nil
+	}
+	if l.Rate <= 0 || l.Burst < 1 {
+		return fmt.Errorf("rate must be > 0 and burst >= 1, got rate %v and burst %d", l.Rate, l.Burst)
+	}
+	return nil
+}
+
+func (c *RateLimitConfig) validate() error {
+	if err := c.Default.IP.validate(); err != nil {
+		return errors.Wrap(err, "default ip")
+	}
+	if err := c.Default.Sender.validate(); err != nil {
+		return errors.Wrap(err, "default sender")
+	}
+	for method, limits := range c.Methods {
+		if err := limits.IP.validate(); err != nil {
+			return errors.Wrap(err, method+" ip")
+		}
+		if err := limits.Sender.validate(); err != nil {
+			return errors.Wrap(err, method+" sender")
+		}
+	}
+	return nil
+}
+
+func LoadRateLimitConfigFile(path string) (*RateLimitConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	config := new(RateLimitConfig)
+	if err = yaml.UnmarshalStrict(data, config); err != nil {
+		return nil, errors.Wrap(err, "parsing "+path)
+	}
+
+	if err = config.validate(); err != nil {
+		return nil, errors.Wrap(err, path)
+	}
+	return config, nil
+}
+
+// KEYS[1]: bucket key - ARGV: rate (tokens per second), burst, now (ms)
+// Returns {allowed (0/1), milliseconds until the next token is available}
+var rateLimitScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+
+local bucket = redis.call("HMGET", KEYS[1], "tokens", "ts")
+local tokens = tonumber(bucket[1])
+local ts = tonumber(bucket[2])
+if tokens == nil or ts == nil then
+	tokens = burst
+	ts = now
+end
+
+tokens = math.min(burst, tokens + math.max(0, now - ts) * rate / 1000)
+
+local allowed = 0
+local wait = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+else
+	wait = math.ceil((1 - tokens) * 1000 / rate)
+end
+
+redis.call("HMSET", KEYS[1], "tokens", tostring(tokens), "ts", tostring(now))
+redis.call("PEXPIRE", KEYS[1], math.ceil(burst * 1000 / rate) + 1000)
+return {allowed, wait}
+`)
+
+type RateLimiter struct {
+	redisClient   redis.UniversalClient // buckets are kept in memory if nil
+	config        *RateLimitConfig
+	exemptApiKeys map[string]bool
+	clock         Clock
+
+	bucketsLock sync.Mutex // for the read-modify-write of a bucket
+	buckets     *lru.Cache // of *localBucket, the least recently used ones are dropped above rateLimitMaxLocalBuckets
+}
+
+type localBucket struct {
+	tokens  float64
+	ts      time.Time
+	expires time.Time
+}
+
+func NewRateLimiter(redisClient redis.UniversalClient, config *RateLimitConfig, clock Clock) *RateLimiter {
+	buckets, _ := lru.New(rateLimitMaxLocalBuckets) // only fails for a size <= 0
+	limiter := &RateLimiter{
+		redisClient:   redisClient,
+		config:        config,
+		exemptApiKeys: make(map[string]bool),
+		clock:         clock,
+		buckets:       buckets,
+	}
+	for _, key := range config.ExemptApiKeys {
+		limiter.exemptApiKeys[key] = true
+	}
+	return limiter
+}
+
+func (l *RateLimiter) IsExempt(apiKey string) bool {
+	return apiKey != "" && l.exemptApiKeys[apiKey]
+}
+
+func (l *RateLimiter) limitsFor(method string) (ip, sender *RateLimit) {
+	ip, sender = l.config.Default.IP, l.config.Default.Sender
+	if limits, ok := l.config.Methods[method]; ok {
+		if limits.IP != nil {
+			ip = limits.IP
+		}
+		if limits.Sender != nil {
+			sender = limits.Sender
+		}
+	}
+	return ip, sender
+}
+
+func (l *RateLimiter) allow(ctx context.Context, key string, limit *RateLimit) (allowed bool, retryAfter time.Duration, err error) {
+	if limit == nil {
+		return true, 0, nil
+	}
+	if l.redisClient == nil {
+		allowed, retryAfter = l.allowLocal(key, limit)
+		return allowed, retryAfter, nil
+	}
+
+	res, err := rateLimitScript.Run(ctx, l.redisClient, []string{key}, limit.Rate, limit.Burst, l.clock().UnixNano()/int64(time.Millisecond)).Int64Slice()
+	if err != nil {
+		return true, 0, err
+	}
+	if len(res) != 2 {
+		return true, 0, fmt.Errorf("unexpected rate limit script result: %v", res)
+	}
+	return res[0] == 1, time.Duration(res[1]) * time.Millisecond, nil
+}
+
+// Same token bucket as rateLimitScript, in memory
+func (l *RateLimiter) allowLocal(key string, limit *RateLimit) (allowed bool, retryAfter time.Duration) {
+	l.bucketsLock.Lock()
+	defer l.bucketsLock.Unlock()
+
+	now := l.clock()
+	var bucket *localBucket
+	if value, found := l.buckets.Get(key); found {
+		bucket = value.(*localBucket)
+	}
+	if bucket == nil || !now.Before(bucket.expires) {
+		bucket = &localBucket{tokens: float64(limit.Burst), ts: now}
+		l.buckets.Add(key, bucket)
+	}
+
+	if elapsed := now.Sub(bucket.ts); elapsed > 0 {
+		bucket.tokens = math.Min(float64(limit.Burst), bucket.tokens+elapsed.Seconds()*limit.Rate)
+	}
+	bucket.ts = now
+	bucket.expires = now.Add(time.Duration(float64(limit.Burst)/limit.Rate*float64(time.Second)) + time.Second)
+
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true, 0
+	}
+	wait := math.Ceil((1 - bucket.tokens) * 1000 / limit.Rate)
+	return false, time.Duration(wait) * time.Millisecond
+}
+
+// Maximum number of in-memory buckets. Dropping the least recently used one resets it to full, which mostly hits
+// expired buckets (full anyway) unless more clients than this are active within a refill window.
+const rateLimitMaxLocalBuckets = 100000
+
+// Bucket key for the ip returned by utils.GetIP: without port, and for X-Forwarded-For lists the entry added by our
+// load balancer (the last one), since clients can put anything in front of it
+func rateLimitIpKey(ip string) string {
+	if i := strings.LastIndex(ip, ","); i >= 0 {
+		ip = ip[i+1:]
+	}
+	ip = strings.TrimSpace(ip)
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		return host
+	}
+	return ip
+}
+
+// AllowIp takes a token from the bucket of the ip and method. On Redis errors the request is allowed.
+func (l *RateLimiter) AllowIp(ctx context.Context, ip string, method string) (allowed bool, retryAfter time.Duration, err error) {
+	limit, _ := l.limitsFor(method)
+	return l.allow(ctx, RedisPrefixRateLimit+"ip:"+rateLimitIpKey(ip)+":"+metricsMethodLabel(method), limit) // no buckets for arbitrary method names
+}
+
+// AllowSender takes a token from the bucket of the tx sender and method. On Redis errors the request is allowed.
+func (l *RateLimiter) AllowSender(ctx context.Context, txFrom string, method string) (allowed bool, retryAfter time.Duration, err error) {
+	_, limit := l.limitsFor(method)
+	return l.allow(ctx, RedisPrefixRateLimit+"sender:"+strings.ToLower(txFrom)+":"+metricsMethodLabel(method), limit)
+}
+
+// Seconds to wait before retrying, rounded up
+func retryAfterSeconds(retryAfter time.Duration) int64 {
+	return int64(math.Ceil(retryAfter.Seconds()))
+}
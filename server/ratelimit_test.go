@@ -0,0 +1,184 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+var ctx = context.Background()
+
+// Clock for tests, which returns the real time until it is set
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.now.IsZero() {
+		return time.Now()
+	}
+	return c.now
+}
+
+func (c *testClock) Set(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = now
+}
+
+func TestRateLimiterTokenBucket(t *testing.T) {
+	resetRedis()
+	timeNow := time.Unix(1640000000, 0)
+	clock := &testClock{now: timeNow}
+
+	limiter := NewRateLimiter(redisState.RedisClient, &RateLimitConfig{
+		Default: MethodRateLimits{IP: &RateLimit{Rate: 1, Burst: 2}},
+	}, clock.Now)
+
+	// Burst is available right away
+	for i := 0; i < 2; i++ {
+		allowed, _, err := limiter.AllowIp(ctx, "1.2.3.4", "eth_call")
+		require.Nil(t, err, err)
+		require.True(t, allowed)
+	}
+
+	allowed, retryAfter, err := limiter.AllowIp(ctx, "1.2.3.4", "eth_call")
+	require.Nil(t, err, err)
+	require.False(t, allowed)
+	require.Equal(t, time.Second, retryAfter)
+
+	// Buckets are per ip and method
+	allowed, _, _ = limiter.AllowIp(ctx, "1.2.3.5", "eth_call")
+	require.True(t, allowed)
+	allowed, _, _ = limiter.AllowIp(ctx, "1.2.3.4", "eth_getBalance")
+	require.True(t, allowed)
+
+	// Refills at the configured rate
+	clock.Set(timeNow.Add(500 * time.Millisecond))
+	allowed, retryAfter, _ = limiter.AllowIp(ctx, "1.2.3.4", "eth_call")
+	require.False(t, allowed)
+	require.Equal(t, 500*time.Millisecond, retryAfter)
+
+	clock.Set(timeNow.Add(1 * time.Second))
+	allowed, _, _ = limiter.AllowIp(ctx, "1.2.3.4", "eth_call")
+	require.True(t, allowed)
+	allowed, _, _ = limiter.AllowIp(ctx, "1.2.3.4", "eth_call")
+	require.False(t, allowed)
+}
+
+func TestRateLimiterMethodLimits(t *testing.T) {
+	resetRedis()
+	clock := &testClock{now: time.Unix(1640000000, 0)}
+
+	limiter := NewRateLimiter(redisState.RedisClient, &RateLimitConfig{
+		Default: MethodRateLimits{IP: &RateLimit{Rate: 10, Burst: 10}},
+		Methods: map[string]MethodRateLimits{
+			"eth_sendRawTransaction": {Sender: &RateLimit{Rate: 0.1, Burst: 1}},
+		},
+		ExemptApiKeys: []string{"secret"},
+	}, clock.Now)
+
+	// Method without own ip limit uses the default
+	ip, sender := limiter.limitsFor("eth_sendRawTransaction")
+	require.Equal(t, 10, ip.Burst)
+	require.Equal(t, 1, sender.Burst)
+
+	// No sender limit for other methods
+	_, sender = limiter.limitsFor("eth_call")
+	require.Nil(t, sender)
+	allowed, _, err := limiter.AllowSender(ctx, "0xabc", "eth_call")
+	require.Nil(t, err, err)
+	require.True(t, allowed)
+
+	// Senders are normalized
+	allowed, _, _ = limiter.AllowSender(ctx, "0xABC", "eth_sendRawTransaction")
+	require.True(t, allowed)
+	allowed, retryAfter, _ := limiter.AllowSender(ctx, "0xabc", "eth_sendRawTransaction")
+	require.False(t, allowed)
+	require.Equal(t, 10*time.Second, retryAfter)
+
+	require.True(t, limiter.IsExempt("secret"))
+	require.False(t, limiter.IsExempt(""))
+	require.False(t, limiter.IsExempt("other"))
+}
+
+func TestLoadRateLimitConfigFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ratelimits.yaml")
+	err := ioutil.WriteFile(path, []byte(`
+default:
+  ip: {rate: 10, burst: 50}
+methods:
+  eth_sendRawTransaction:
+    ip: {rate: 1, burst: 10}
+    sender: {rate: 0.2, burst: 5}
+exemptApiKeys: ["secret"]
+`), 0644)
+	require.Nil(t, err, err)
+
+	config, err := LoadRateLimitConfigFile(path)
+	require.Nil(t, err, err)
+	require.Equal(t, 50, config.Default.IP.Burst)
+	require.Nil(t, config.Default.Sender)
+	require.Equal(t, 0.2, config.Methods["eth_sendRawTransaction"].Sender.Rate)
+	require.Equal(t, []string{"secret"}, config.ExemptApiKeys)
+
+	err = ioutil.WriteFile(path, []byte("default:\n  ip: {rate: 0, burst: 1}\n"), 0644)
+	require.Nil(t, err, err)
+	_, err = LoadRateLimitConfigFile(path)
+	require.NotNil(t, err)
+}
+
+func TestRateLimitIpKey(t *testing.T) {
+	require.Equal(t, "1.2.3.4", rateLimitIpKey("1.2.3.4"))
+	require.Equal(t, "1.2.3.4", rateLimitIpKey("1.2.3.4:5678"))
+	require.Equal(t, "::1", rateLimitIpKey("[::1]:5678"))
+	require.Equal(t, "5.6.7.8", rateLimitIpKey("1.2.3.4, 5.6.7.8"))
+}
+
+func TestRateLimiterInMemory(t *testing.T) {
+	timeNow := time.Unix(1640000000, 0)
+	clock := &testClock{now: timeNow}
+
+	limiter := NewRateLimiter(nil, &RateLimitConfig{
+		Default: MethodRateLimits{IP: &RateLimit{Rate: 1, Burst: 2}},
+	}, clock.Now)
+
+	for i := 0; i < 2; i++ {
+		allowed, _, err := limiter.AllowIp(ctx, "1.2.3.4", "eth_call")
+		require.Nil(t, err, err)
+		require.True(t, allowed)
+	}
+
+	allowed, retryAfter, err := limiter.AllowIp(ctx, "1.2.3.4", "eth_call")
+	require.Nil(t, err, err)
+	require.False(t, allowed)
+	require.Equal(t, time.Second, retryAfter)
+
+	allowed, _, _ = limiter.AllowIp(ctx, "1.2.3.5", "eth_call")
+	require.True(t, allowed)
+
+	clock.Set(timeNow.Add(500 * time.Millisecond))
+	allowed, retryAfter, _ = limiter.AllowIp(ctx, "1.2.3.4", "eth_call")
+	require.False(t, allowed)
+	require.Equal(t, 500*time.Millisecond, retryAfter)
+
+	// Expired buckets start full again
+	clock.Set(timeNow.Add(time.Hour))
+	allowed, _, _ = limiter.AllowIp(ctx, "1.2.3.4", "eth_call")
+	require.True(t, allowed)
+
+	// The number of buckets is bounded
+	for i := 0; i < rateLimitMaxLocalBuckets+10; i++ {
+		limiter.AllowIp(ctx, fmt.Sprintf("10.0.%d.%d", i/256, i%256), "eth_call")
+	}
+	require.Equal(t, rateLimitMaxLocalBuckets, limiter.buckets.Len())
+}
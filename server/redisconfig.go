@@ -0,0 +1,238 @@
+/*
+Redis connection config. The url is either a plain address (host:port), or
+
+	redis[s]://[username:password@]host:port[,host:port...][/db]
+
+rediss:// connects with TLS. Several hosts are the seed nodes of a cluster (-redisMode cluster), or the sentinels to
+ask for the master (-redisMode sentinel with -redisSentinelMaster).
+*/
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+)
+
+const (
+	RedisModeSingle   = "single"
+	RedisModeSentinel = "sentinel"
+	RedisModeCluster  = "cluster"
+)
+
+type RedisConfig struct {
+	Url  string
+	Mode string // single (default), sentinel or cluster
+
+	SentinelMaster   string
+	SentinelPassword string // if the sentinels need another password than the master
+
+	TLSSkipVerify bool // don't verify the server certificate with rediss://
+
+	// Pool tuning, the go-redis defaults are used if 0
+	PoolSize     int
+	MinIdleConns int
+	DialTimeout  time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	PoolTimeout  time.Duration
+}
+
+// Parses the url and mode into go-redis options
+func (c *RedisConfig) options() (*redis.UniversalOptions, error) {
+	opts := &redis.UniversalOptions{
+		SentinelPassword: c.SentinelPassword,
+		PoolSize:         c.PoolSize,
+		MinIdleConns:     c.MinIdleConns,
+		DialTimeout:      c.DialTimeout,
+		ReadTimeout:      c.ReadTimeout,
+		WriteTimeout:     c.WriteTimeout,
+		PoolTimeout:      c.PoolTimeout,
+	}
+
+	if !strings.Contains(c.Url, "://") {
+		opts.Addrs = strings.Split(c.Url, ",")
+	} else {
+		u, err := url.Parse(c.Url)
+		if err != nil {
+			if urlErr, ok := err.(*url.Error); ok {
+				err = urlErr.Err // without the url, which can contain the password
+			}
+			return nil, errors.Wrap(err, "invalid url")
+		}
+
+		switch u.Scheme {
+		case "redis":
+		case "rediss":
+			opts.TLSConfig = &tls.Config{InsecureSkipVerify: c.TLSSkipVerify}
+		default:
+			return nil, fmt.Errorf("invalid scheme %s (use redis:// or rediss://)", u.Scheme)
+		}
+
+		if u.User != nil {
+			opts.Username = u.User.Username()
+			opts.Password, _ = u.User.Password()
+		}
+		opts.Addrs = strings.Split(u.Host, ",")
+
+		if db := strings.Trim(u.Path, "/"); db != "" {
+			opts.DB, err = strconv.Atoi(db)
+			if err != nil {
+				return nil, fmt.Errorf("invalid database number: %s", db)
+			}
+		}
+		if len(u.Query()) > 0 {
+			return nil, fmt.Errorf("unexpected url parameters: %s (use the flags for pool settings)", u.RawQuery)
+		}
+	}
+
+	for i, addr := range opts.Addrs {
+		addr = strings.TrimSpace(addr)
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return nil, fmt.Errorf("invalid address %q: %v", addr, err)
+		}
+		opts.Addrs[i] = addr
+	}
+	if opts.TLSConfig != nil && len(opts.Addrs) == 1 {
+		opts.TLSConfig.ServerName, _, _ = net.SplitHostPort(opts.Addrs[0])
+	}
+
+	switch c.Mode {
+	case "", RedisModeSingle:
+		if len(opts.Addrs) != 1 {
+			return nil, fmt.Errorf("%d addresses given, but mode is %s (use %s or %s for several)", len(opts.Addrs), RedisModeSingle, RedisModeSentinel, RedisModeCluster)
+		}
+	case RedisModeSentinel:
+		if c.SentinelMaster == "" {
+			return nil, errors.New("sentinel mode needs the master name")
+		}
+		opts.MasterName = c.SentinelMaster
+	case RedisModeCluster:
+		if opts.DB != 0 {
+			return nil, errors.New("cluster mode only supports database 0")
+		}
+	default:
+		return nil, fmt.Errorf("invalid mode %s (use %s, %s or %s)", c.Mode, RedisModeSingle, RedisModeSentinel, RedisModeCluster)
+	}
+	return opts, nil
+}
+
+// RedactRedisUrl returns the url without the password, for logging
+func RedactRedisUrl(redisUrl string) string {
+	u, err := url.Parse(redisUrl)
+	if err != nil || u.User == nil {
+		if strings.Contains(redisUrl, "@") {
+			return "<invalid url>"
+		}
+		return redisUrl
+	}
+	return u.Redacted()
+}
+
+func newRedisClient(c *RedisConfig) (redis.UniversalClient, *redis.UniversalOptions, error) {
+	opts, err := c.options()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "redis config")
+	}
+
+	var client redis.UniversalClient
+	switch c.Mode {
+	case RedisModeSentinel:
+		client = redis.NewFailoverClient(opts.Failover())
+	case RedisModeCluster:
+		client = redis.NewClusterClient(opts.Cluster())
+	default:
+		client = redis.NewClient(opts.Simple())
+	}
+	client.AddHook(redisTracingHook{})
+	return client, opts, nil
+}
+
+var redisCheckTimeout = 5 * time.Second
+
+// checkRedisConnection checks the connection step by step, so the error tells which part failed: dns, tcp, tls,
+// authentication, database selection, sentinel/cluster discovery, or writing.
+func checkRedisConnection(client redis.UniversalClient, opts *redis.UniversalOptions, mode string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisCheckTimeout)
+	defer cancel()
+
+	// The seed addresses must be reachable (for sentinel and cluster at least one of them)
+	var addrErrors []string
+	for _, addr := range opts.Addrs {
+		if err := checkRedisAddr(ctx, addr, opts.TLSConfig); err != nil {
+			addrErrors = append(addrErrors, err.Error())
+		}
+	}
+	if len(addrErrors) > 0 && (len(addrErrors) == len(opts.Addrs) || mode == RedisModeSingle || mode == "") {
+		return errors.New(strings.Join(addrErrors, "; "))
+	}
+
+	// Connecting runs AUTH and SELECT, and for sentinel and cluster the discovery of the nodes
+	if err := client.Ping(ctx).Err(); err != nil {
+		return classifyRedisError(err, mode)
+	}
+
+	// Replicas and some managed setups are read-only
+	key := RedisPrefix + "connection-check"
+	if err := client.Set(ctx, key, time.Now().Unix(), time.Minute).Err(); err != nil {
+		return errors.Wrap(err, "write check failed")
+	}
+	if err := client.Del(ctx, key).Err(); err != nil {
+		return errors.Wrap(err, "write check failed")
+	}
+	return nil
+}
+
+func checkRedisAddr(ctx context.Context, addr string, tlsConfig *tls.Config) error {
+	host, _, _ := net.SplitHostPort(addr)
+	if net.ParseIP(host) == nil {
+		if _, err := net.DefaultResolver.LookupHost(ctx, host); err != nil {
+			return errors.Wrapf(err, "dns lookup of %s failed", host)
+		}
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return errors.Wrapf(err, "tcp connection to %s failed", addr)
+	}
+	defer conn.Close()
+
+	if tlsConfig != nil {
+		config := tlsConfig.Clone()
+		if config.ServerName == "" {
+			config.ServerName = host
+		}
+		tlsConn := tls.Client(conn, config)
+		if deadline, ok := ctx.Deadline(); ok {
+			tlsConn.SetDeadline(deadline)
+		}
+		if err = tlsConn.Handshake(); err != nil {
+			return errors.Wrapf(err, "tls handshake with %s failed", addr)
+		}
+	}
+	return nil
+}
+
+func classifyRedisError(err error, mode string) error {
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "WRONGPASS") || strings.Contains(msg, "NOAUTH") || strings.Contains(msg, "invalid password") || strings.Contains(msg, "invalid username-password"):
+		return errors.Wrap(err, "authentication failed")
+	case strings.Contains(msg, "DB index") || strings.Contains(msg, "invalid DB"):
+		return errors.Wrap(err, "selecting the database failed")
+	case mode == RedisModeSentinel:
+		return errors.Wrap(err, "getting the master from the sentinels failed")
+	case mode == RedisModeCluster:
+		return errors.Wrap(err, "cluster discovery failed")
+	}
+	return errors.Wrap(err, "ping failed")
+}
@@ -2,11 +2,13 @@ package server
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/flashbots/rpc-endpoint/types"
 	"github.com/go-redis/redis/v8"
 	"github.com/pkg/errors"
 )
@@ -25,6 +27,9 @@ var RedisExpiryTxHashForSenderAndNonce = time.Duration(24 * time.Hour) // 1 day
 var RedisPrefixNonceFixForAccount = RedisPrefix + "txsender-with-nonce-fix:"
 var RedisExpiryNonceFixForAccount = time.Duration(24 * time.Hour)
 
+// Nonce of the failed tx which armed the nonce-fix of an account (same expiry as the nonce-fix)
+var RedisPrefixNonceFixNonce = RedisPrefix + "txsender-nonce-fix-nonce:"
+
 // Enable lookup of txFrom by txHash
 var RedisPrefixSenderOfTxHash = RedisPrefix + "txsender-of-txhash:"
 var RedisExpirySenderOfTxHash = time.Duration(24 * time.Hour) // 1 day
@@ -37,6 +42,12 @@ var RedisExpirySenderMaxNonce = time.Duration(2 * time.Hour)
 // var RedisPrefixLastPrivTxHashOfAccount = RedisPrefix + "last-txhash-of-txsender:"
 // var RedisExpiryLastPrivTxHashOfAccount = time.Duration(24 * time.Hour) // 1 day
 
+// Lifecycle record of a private tx
+var RedisPrefixTxLifecycle = RedisPrefix + "tx-lifecycle:"
+
+// Instance which tracks a private tx (expiry set by the tx tracker)
+var RedisPrefixTxTrackerClaim = RedisPrefix + "tx-tracker-claim:"
+
 func RedisKeyTxSentToRelay(txHash string) string {
 	return RedisPrefixTxSentToRelay + strings.ToLower(txHash)
 }
@@ -49,6 +60,10 @@ func RedisKeyNonceFixForAccount(txFrom string) string {
 	return RedisPrefixNonceFixForAccount + strings.ToLower(txFrom)
 }
 
+func RedisKeyNonceFixNonce(txFrom string) string {
+	return RedisPrefixNonceFixNonce + strings.ToLower(txFrom)
+}
+
 func RedisKeySenderOfTxHash(txHash string) string {
 	return RedisPrefixSenderOfTxHash + strings.ToLower(txHash)
 }
@@ -57,41 +72,111 @@ func RedisKeySenderMaxNonce(txFrom string) string {
 	return RedisPrefixSenderMaxNonce + strings.ToLower(txFrom)
 }
 
+func RedisKeyTxLifecycle(txHash string) string {
+	return RedisPrefixTxLifecycle + strings.ToLower(txHash)
+}
+
+func RedisKeyTxTrackerClaim(txHash string) string {
+	return RedisPrefixTxTrackerClaim + strings.ToLower(txHash)
+}
+
 // func RedisKeyLastPrivTxHashOfAccount(txFrom string) string {
 // 	return RedisPrefixLastPrivTxHashOfAccount + strings.ToLower(txFrom)
 // }
 
+// Counts failed redis commands (not-found is not a failure)
+type redisMetricsHook struct{}
+
+func (redisMetricsHook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	return ctx, nil
+}
+
+func (redisMetricsHook) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	if err := cmd.Err(); err != nil && err != redis.Nil {
+		metricRedisErrors.Inc(cmd.Name())
+	}
+	return nil
+}
+
+func (redisMetricsHook) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	return ctx, nil
+}
+
+func (h redisMetricsHook) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	for _, cmd := range cmds {
+		h.AfterProcess(ctx, cmd)
+	}
+	return nil
+}
+
 type RedisState struct {
-	RedisClient *redis.Client
+	RedisClient redis.UniversalClient
+	clock       Clock // for the tx-sent timestamps, expiry is done by Redis
 }
 
+// NewRedisState connects to a single Redis server at the address or url
 func NewRedisState(redisUrl string) (*RedisState, error) {
+	return NewRedisStateWithConfig(&RedisConfig{Url: redisUrl}, time.Now)
+}
+
+func NewRedisStateWithConfig(config *RedisConfig, clock Clock) (*RedisState, error) {
 	// Setup redis client and check connection
-	redisClient := redis.NewClient(&redis.Options{Addr: redisUrl})
+	redisClient, opts, err := newRedisClient(config)
+	if err != nil {
+		return nil, err
+	}
+	redisClient.AddHook(redisMetricsHook{})
 
-	// Try to get a key to see if there's an error with the connection
-	if err := redisClient.Get(context.Background(), "somekey").Err(); err != nil && err != redis.Nil {
+	if err = checkRedisConnection(redisClient, opts, config.Mode); err != nil {
+		redisClient.Close()
 		return nil, errors.Wrap(err, "redis init error")
 	}
 
 	// Create and return the RedisState
 	return &RedisState{
 		RedisClient: redisClient,
+		clock:       clock,
 	}, nil
 }
 
+func (s *RedisState) Close() error {
+	return s.RedisClient.Close()
+}
+
 //
 // Enable lookup of timeSentToRelay by txHash
 //
-func (s *RedisState) SetTxSentToRelay(txHash string) error {
+func (s *RedisState) SetTxSentToRelay(ctx context.Context, txHash string) error {
 	key := RedisKeyTxSentToRelay(txHash)
-	err := s.RedisClient.Set(context.Background(), key, Now().UTC().Unix(), RedisExpiryTxSentToRelay).Err()
+	err := s.RedisClient.Set(ctx, key, s.clock().UTC().Unix(), RedisExpiryTxSentToRelay).Err()
 	return err
 }
 
-func (s *RedisState) GetTxSentToRelay(txHash string) (timeSent time.Time, found bool, err error) {
+// KEYS[1]: tx-sent key - ARGV: time sent (unix), previous time sent ("" if none), expiry (ms). Returns 1 if marked.
+var markTxSentToRelayScript = redis.NewScript(`
+local cur = redis.call("GET", KEYS[1])
+if cur and cur ~= ARGV[2] then
+	return 0
+end
+redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[3])
+return 1
+`)
+
+// MarkTxSentToRelay marks the tx as sent now, if it is not marked yet or still marked with prevTimeSent (zero if it
+// wasn't marked before). Returns false if another request marked it in the meantime.
+func (s *RedisState) MarkTxSentToRelay(ctx context.Context, txHash string, prevTimeSent time.Time) (marked bool, err error) {
 	key := RedisKeyTxSentToRelay(txHash)
-	val, err := s.RedisClient.Get(context.Background(), key).Result()
+	prev := ""
+	if !prevTimeSent.IsZero() {
+		prev = strconv.FormatInt(prevTimeSent.Unix(), 10)
+	}
+	res, err := markTxSentToRelayScript.Run(ctx, s.RedisClient, []string{key}, s.clock().UTC().Unix(), prev, RedisExpiryTxSentToRelay.Milliseconds()).Int()
+	return res == 1, err
+}
+
+func (s *RedisState) GetTxSentToRelay(ctx context.Context, txHash string) (timeSent time.Time, found bool, err error) {
+	key := RedisKeyTxSentToRelay(txHash)
+	val, err := s.RedisClient.Get(ctx, key).Result()
 	if err == redis.Nil {
 		return time.Time{}, false, nil // just not found
 	} else if err != nil {
@@ -110,15 +195,15 @@ func (s *RedisState) GetTxSentToRelay(txHash string) (timeSent time.Time, found
 //
 // Enable lookup of txHash by txFrom+nonce
 //
-func (s *RedisState) SetTxHashForSenderAndNonce(txFrom string, nonce uint64, txHash string) error {
+func (s *RedisState) SetTxHashForSenderAndNonce(ctx context.Context, txFrom string, nonce uint64, txHash string) error {
 	key := RedisKeyTxHashForSenderAndNonce(txFrom, nonce)
-	err := s.RedisClient.Set(context.Background(), key, strings.ToLower(txHash), RedisExpiryTxHashForSenderAndNonce).Err()
+	err := s.RedisClient.Set(ctx, key, strings.ToLower(txHash), RedisExpiryTxHashForSenderAndNonce).Err()
 	return err
 }
 
-func (s *RedisState) GetTxHashForSenderAndNonce(txFrom string, nonce uint64) (txHash string, found bool, err error) {
+func (s *RedisState) GetTxHashForSenderAndNonce(ctx context.Context, txFrom string, nonce uint64) (txHash string, found bool, err error) {
 	key := RedisKeyTxHashForSenderAndNonce(txFrom, nonce)
-	txHash, err = s.RedisClient.Get(context.Background(), key).Result()
+	txHash, err = s.RedisClient.Get(ctx, key).Result()
 	if err == redis.Nil {
 		return "", false, nil // not found
 	} else if err != nil {
@@ -131,21 +216,80 @@ func (s *RedisState) GetTxHashForSenderAndNonce(txFrom string, nonce uint64) (tx
 //
 // nonce-fix per account
 //
-func (s *RedisState) SetNonceFixForAccount(txFrom string, numTimesSent uint64) error {
+func (s *RedisState) SetNonceFixForAccount(ctx context.Context, txFrom string, numTimesSent uint64) error {
 	key := RedisKeyNonceFixForAccount(txFrom)
-	err := s.RedisClient.Set(context.Background(), key, numTimesSent, RedisExpiryNonceFixForAccount).Err()
+	err := s.RedisClient.Set(ctx, key, numTimesSent, RedisExpiryNonceFixForAccount).Err()
 	return err
 }
 
-func (s *RedisState) DelNonceFixForAccount(txFrom string) error {
-	key := RedisKeyNonceFixForAccount(txFrom)
-	err := s.RedisClient.Del(context.Background(), key).Err()
+// KEYS[1]: nonce-fix key, KEYS[2]: failed nonce key - ARGV: failed nonce ("" if unknown), expiry (ms). Returns 1 if created.
+var createNonceFixScript = redis.NewScript(`
+if not redis.call("SET", KEYS[1], 0, "NX", "PX", ARGV[2]) then
+	return 0
+end
+if ARGV[1] == "" then
+	redis.call("DEL", KEYS[2])
+else
+	redis.call("SET", KEYS[2], ARGV[1], "PX", ARGV[2])
+end
+return 1
+`)
+
+// CreateNonceFixForAccount sets up a nonce-fix with 0 times sent for the failed nonce, if there is none yet
+func (s *RedisState) CreateNonceFixForAccount(ctx context.Context, txFrom string, failedNonce uint64) (created bool, err error) {
+	keys := []string{RedisKeyNonceFixForAccount(txFrom), RedisKeyNonceFixNonce(txFrom)}
+	nonce := ""
+	if failedNonce != NonceFixNonceUnknown {
+		nonce = strconv.FormatUint(failedNonce, 10)
+	}
+	res, err := createNonceFixScript.Run(ctx, s.RedisClient, keys, nonce, RedisExpiryNonceFixForAccount.Milliseconds()).Int64()
+	if err != nil {
+		return false, err
+	}
+	return res == 1, nil
+}
+
+// KEYS[1]: nonce-fix key, KEYS[2]: failed nonce key - ARGV: max times sent, expiry (ms).
+// Returns {times sent, failed nonce (-1 if unknown), 1 if incremented}.
+var incNonceFixScript = redis.NewScript(`
+local cur = redis.call("GET", KEYS[1])
+if not cur then
+	return {0, -1, 0}
+end
+local nonce = tonumber(redis.call("GET", KEYS[2]) or "-1")
+if tonumber(cur) >= tonumber(ARGV[1]) then
+	return {tonumber(cur), nonce, 0}
+end
+local n = redis.call("INCR", KEYS[1])
+redis.call("PEXPIRE", KEYS[1], ARGV[2])
+return {n, nonce, 1}
+`)
+
+// IncNonceFixForAccount increments the times sent of an existing nonce-fix, up to maxTimesSent
+func (s *RedisState) IncNonceFixForAccount(ctx context.Context, txFrom string, maxTimesSent uint64) (numTimesSent uint64, failedNonce uint64, incremented bool, err error) {
+	keys := []string{RedisKeyNonceFixForAccount(txFrom), RedisKeyNonceFixNonce(txFrom)}
+	res, err := incNonceFixScript.Run(ctx, s.RedisClient, keys, maxTimesSent, RedisExpiryNonceFixForAccount.Milliseconds()).Int64Slice()
+	if err != nil {
+		return 0, NonceFixNonceUnknown, false, err
+	}
+	if len(res) != 3 {
+		return 0, NonceFixNonceUnknown, false, fmt.Errorf("unexpected nonce-fix script result: %v", res)
+	}
+	failedNonce = NonceFixNonceUnknown
+	if res[1] >= 0 {
+		failedNonce = uint64(res[1])
+	}
+	return uint64(res[0]), failedNonce, res[2] == 1, nil
+}
+
+func (s *RedisState) DelNonceFixForAccount(ctx context.Context, txFrom string) error {
+	err := s.RedisClient.Del(ctx, RedisKeyNonceFixForAccount(txFrom), RedisKeyNonceFixNonce(txFrom)).Err()
 	return err
 }
 
-func (s *RedisState) GetNonceFixForAccount(txFrom string) (numTimesSent uint64, found bool, err error) {
+func (s *RedisState) GetNonceFixForAccount(ctx context.Context, txFrom string) (numTimesSent uint64, found bool, err error) {
 	key := RedisKeyNonceFixForAccount(txFrom)
-	val, err := s.RedisClient.Get(context.Background(), key).Result()
+	val, err := s.RedisClient.Get(ctx, key).Result()
 	if err == redis.Nil {
 		return 0, false, nil // not found
 	} else if err != nil {
@@ -162,15 +306,15 @@ func (s *RedisState) GetNonceFixForAccount(txFrom string) (numTimesSent uint64,
 //
 // Enable lookup of txFrom by txHash
 //
-func (s *RedisState) SetSenderOfTxHash(txHash string, txFrom string) error {
+func (s *RedisState) SetSenderOfTxHash(ctx context.Context, txHash string, txFrom string) error {
 	key := RedisKeySenderOfTxHash(txHash)
-	err := s.RedisClient.Set(context.Background(), key, strings.ToLower(txFrom), RedisExpirySenderOfTxHash).Err()
+	err := s.RedisClient.Set(ctx, key, strings.ToLower(txFrom), RedisExpirySenderOfTxHash).Err()
 	return err
 }
 
-func (s *RedisState) GetSenderOfTxHash(txHash string) (txSender string, found bool, err error) {
+func (s *RedisState) GetSenderOfTxHash(ctx context.Context, txHash string) (txSender string, found bool, err error) {
 	key := RedisKeySenderOfTxHash(txHash)
-	txSender, err = s.RedisClient.Get(context.Background(), key).Result()
+	txSender, err = s.RedisClient.Get(ctx, key).Result()
 	if err == redis.Nil { // not found
 		return "", false, nil
 	} else if err != nil {
@@ -201,25 +345,25 @@ func (s *RedisState) GetSenderOfTxHash(txHash string) (txSender string, found bo
 // 	return strings.ToLower(txHash), true, nil
 // }
 
-func (s *RedisState) SetSenderMaxNonce(txFrom string, nonce uint64) error {
-	prevMaxNonce, found, err := s.GetSenderMaxNonce(txFrom)
-	if err != nil {
-		return err
-	}
-
-	// Do nothing if current nonce is not higher than already existing
-	if found && prevMaxNonce >= nonce {
-		return nil
-	}
-
+// KEYS[1]: max nonce key - ARGV: nonce, expiry (ms). Returns 1 if the nonce was stored.
+var senderMaxNonceScript = redis.NewScript(`
+local prev = redis.call("GET", KEYS[1])
+if prev and tonumber(prev) >= tonumber(ARGV[1]) then
+	return 0
+end
+redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2])
+return 1
+`)
+
+// SetSenderMaxNonce stores the nonce if it is higher than the current max nonce of the sender
+func (s *RedisState) SetSenderMaxNonce(ctx context.Context, txFrom string, nonce uint64) error {
 	key := RedisKeySenderMaxNonce(txFrom)
-	err = s.RedisClient.Set(context.Background(), key, nonce, RedisExpirySenderMaxNonce).Err()
-	return err
+	return senderMaxNonceScript.Run(ctx, s.RedisClient, []string{key}, nonce, RedisExpirySenderMaxNonce.Milliseconds()).Err()
 }
 
-func (s *RedisState) GetSenderMaxNonce(txFrom string) (senderMaxNonce uint64, found bool, err error) {
+func (s *RedisState) GetSenderMaxNonce(ctx context.Context, txFrom string) (senderMaxNonce uint64, found bool, err error) {
 	key := RedisKeySenderMaxNonce(txFrom)
-	val, err := s.RedisClient.Get(context.Background(), key).Result()
+	val, err := s.RedisClient.Get(ctx, key).Result()
 	if err == redis.Nil {
 		return 0, false, nil // not found
 	} else if err != nil {
@@ -232,3 +376,73 @@ func (s *RedisState) GetSenderMaxNonce(txFrom string) (senderMaxNonce uint64, fo
 	}
 	return senderMaxNonce, true, nil
 }
+
+func getTxLifecycle(ctx context.Context, client redis.Cmdable, key string) (lifecycle *types.TxLifecycle, found bool, err error) {
+	data, err := client.Get(ctx, key).Bytes()
+	if err == redis.Nil {
+		return nil, false, nil // not found
+	} else if err != nil {
+		return nil, false, err
+	}
+
+	lifecycle = new(types.TxLifecycle)
+	if err = json.Unmarshal(data, lifecycle); err != nil {
+		return nil, true, err
+	}
+	return lifecycle, true, nil
+}
+
+func (s *RedisState) GetTxLifecycle(ctx context.Context, txHash string) (lifecycle *types.TxLifecycle, found bool, err error) {
+	return getTxLifecycle(ctx, s.RedisClient, RedisKeyTxLifecycle(txHash))
+}
+
+// How often UpdateTxLifecycle retries if the record was changed concurrently
+var maxTxLifecycleUpdateAttempts = 10
+
+// UpdateTxLifecycle saves the updated record only if it wasn't changed since reading it (optimistic locking with WATCH)
+func (s *RedisState) UpdateTxLifecycle(ctx context.Context, txHash string, retention time.Duration, update func(lifecycle *types.TxLifecycle, found bool) (save bool)) error {
+	key := RedisKeyTxLifecycle(txHash)
+	for i := 0; i < maxTxLifecycleUpdateAttempts; i++ {
+		err := s.RedisClient.Watch(ctx, func(tx *redis.Tx) error {
+			lifecycle, found, err := getTxLifecycle(ctx, tx, key)
+			if err != nil {
+				return err
+			}
+			if !found {
+				lifecycle = &types.TxLifecycle{}
+			}
+			if !update(lifecycle, found) {
+				return nil
+			}
+
+			data, err := json.Marshal(lifecycle)
+			if err != nil {
+				return err
+			}
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.Set(ctx, key, data, retention)
+				return nil
+			})
+			return err
+		}, key)
+		if err != redis.TxFailedErr {
+			return err
+		}
+	}
+	return errors.Wrap(redis.TxFailedErr, "too many concurrent updates of "+key)
+}
+
+// KEYS[1]: claim key - ARGV: owner, expiry (ms). Returns 1 if claimed.
+var claimTxTrackingScript = redis.NewScript(`
+local cur = redis.call("GET", KEYS[1])
+if cur and cur ~= ARGV[1] then
+	return 0
+end
+redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2])
+return 1
+`)
+
+func (s *RedisState) ClaimTxTracking(ctx context.Context, txHash string, owner string, expiry time.Duration) (claimed bool, err error) {
+	res, err := claimTxTrackingScript.Run(ctx, s.RedisClient, []string{RedisKeyTxTrackerClaim(txHash)}, owner, expiry.Milliseconds()).Int()
+	return res == 1, err
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/flashbots/rpc-endpoint/tracing"
+	"github.com/flashbots/rpc-endpoint/types"
+	"github.com/metachris/flashbotsrpc"
+	"github.com/pkg/errors"
+)
+
+// RelayClient sends private transactions to the relay
+type RelayClient interface {
+	SendPrivateTransaction(ctx context.Context, privKey *ecdsa.PrivateKey, param types.SendPrivateTransactionRequest) (txHash string, err error)
+	CancelPrivateTransaction(ctx context.Context, privKey *ecdsa.PrivateKey, param flashbotsrpc.FlashbotsCancelPrivateTransactionRequest) (cancelled bool, err error)
+	CallWithFlashbotsSignature(ctx context.Context, method string, privKey *ecdsa.PrivateKey, params ...interface{}) (json.RawMessage, error)
+}
+
+// FlashbotsRelayClient signs requests like flashbotsrpc, and returns the same errors (flashbotsrpc.ErrRelayErrorResponse
+// and flashbotsrpc.RpcError), but the requests are cancelled with the context.
+type FlashbotsRelayClient struct {
+	Url        string
+	HttpClient *http.Client
+	Logger     Logger            // if set, requests and responses are logged at debug level
+	SigningKey *ecdsa.PrivateKey // signs instead of the key passed to the calls, if set
+	Unsigned   bool              // don't sign requests, for builders that don't need the X-Flashbots-Signature header
+}
+
+func NewFlashbotsRelayClient(url string) *FlashbotsRelayClient {
+	return &FlashbotsRelayClient{Url: url, HttpClient: tracing.NewClient()}
+}
+
+type relayRpcRequest struct {
+	ID      int           `json:"id"`
+	JSONRPC string        `json:"jsonrpc"`
+	Method  string        `json:"method"`
+	Params  []interface{} `json:"params"`
+}
+
+type relayRpcResponse struct {
+	Result json.RawMessage        `json:"result"`
+	Error  *flashbotsrpc.RpcError `json:"error"`
+}
+
+func (c *FlashbotsRelayClient) CallWithFlashbotsSignature(ctx context.Context, method string, privKey *ecdsa.PrivateKey, params ...interface{}) (json.RawMessage, error) {
+	body, err := json.Marshal(relayRpcRequest{ID: 1, JSONRPC: "2.0", Method: method, Params: params})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", c.Url, bytes.NewBuffer(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+
+	if !c.Unsigned {
+		if c.SigningKey != nil {
+			privKey = c.SigningKey
+		}
+		hashedBody := crypto.Keccak256Hash(body).Hex()
+		sig, err := crypto.Sign(accounts.TextHash([]byte(hashedBody)), privKey)
+		if err != nil {
+			return nil, errors.Wrap(err, "sign")
+		}
+		req.Header.Set("X-Flashbots-Signature", crypto.PubkeyToAddress(privKey.PublicKey).Hex()+":"+hexutil.Encode(sig))
+	}
+
+	resp, err := c.HttpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.Logger != nil {
+		c.Logger.logDebug("[relay] %s - request: %s - response: %s", method, body, data)
+	}
+
+	// On error, the relay responds with {"error":"..."} instead of JSON-RPC
+	errorResp := new(flashbotsrpc.RelayErrorResponse)
+	if err := json.Unmarshal(data, errorResp); err == nil && errorResp.Error != "" {
+		return nil, fmt.Errorf("%w: %s", flashbotsrpc.ErrRelayErrorResponse, errorResp.Error)
+	}
+
+	rpcResp := new(relayRpcResponse)
+	if err := json.Unmarshal(data, rpcResp); err != nil {
+		return nil, err
+	}
+	if rpcResp.Error != nil {
+		return nil, *rpcResp.Error
+	}
+	return rpcResp.Result, nil
+}
+
+func (c *FlashbotsRelayClient) SendPrivateTransaction(ctx context.Context, privKey *ecdsa.PrivateKey, param types.SendPrivateTransactionRequest) (txHash string, err error) {
+	rawMsg, err := c.CallWithFlashbotsSignature(ctx, "eth_sendPrivateTransaction", privKey, param)
+	if err != nil {
+		return "", err
+	}
+	err = json.Unmarshal(rawMsg, &txHash)
+	return txHash, err
+}
+
+func (c *FlashbotsRelayClient) CancelPrivateTransaction(ctx context.Context, privKey *ecdsa.PrivateKey, param flashbotsrpc.FlashbotsCancelPrivateTransactionRequest) (cancelled bool, err error) {
+	rawMsg, err := c.CallWithFlashbotsSignature(ctx, "eth_cancelPrivateTransaction", privKey, param)
+	if err != nil {
+		return false, err
+	}
+	err = json.Unmarshal(rawMsg, &cancelled)
+	return cancelled, err
+}
@@ -0,0 +1,193 @@
+/*
+Private transactions are sent to all relay targets (relays or builder endpoints) in parallel, and cancellations to the
+same set. A tx is accepted if at least one target accepts it. The targets can be loaded from a YAML file:
+
+	relays:
+	  - name: flashbots
+	    url: https://relay.flashbots.net
+	  - name: builder-a
+	    url: https://rpc.builder-a.example
+	    unsigned: true # no X-Flashbots-Signature header
+	  - name: builder-b
+	    url: https://rpc.builder-b.example
+	    signingKey: 0x... # sign with this key instead of the relay signing key
+
+The first target is also used for eth_callBundle simulations.
+*/
+package server
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/flashbots/rpc-endpoint/tracing"
+	"github.com/metachris/flashbotsrpc"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// Name of the relay of the chain, if no relays are configured
+var DefaultRelayName = "relay"
+
+// RelayTarget is a named private transaction submission target
+type RelayTarget struct {
+	Name   string
+	Client RelayClient
+}
+
+type RelayTargetConfig struct {
+	Name       string `yaml:"name"`
+	Url        string `yaml:"url"`
+	Unsigned   bool   `yaml:"unsigned,omitempty"`
+	SigningKey string `yaml:"signingKey,omitempty"` // hex private key, default: the relay signing key
+}
+
+type RelaysConfig struct {
+	Relays []RelayTargetConfig `yaml:"relays"`
+}
+
+func (c *RelaysConfig) validate() error {
+	if len(c.Relays) == 0 {
+		return errors.New("no relays")
+	}
+	names := make(map[string]bool)
+	for i, relay := range c.Relays {
+		if relay.Name == "" {
+			return fmt.Errorf("relay %d: no name", i)
+		}
+		if names[relay.Name] {
+			return fmt.Errorf("relay %s: duplicate name", relay.Name)
+		}
+		names[relay.Name] = true
+		if relay.Url == "" {
+			return fmt.Errorf("relay %s: no url", relay.Name)
+		}
+		if relay.Unsigned && relay.SigningKey != "" {
+			return fmt.Errorf("relay %s: unsigned with signing key", relay.Name)
+		}
+	}
+	return nil
+}
+
+// Targets creates a FlashbotsRelayClient for each relay, which logs its requests with the logger
+func (c *RelaysConfig) Targets(logger Logger) ([]RelayTarget, error) {
+	targets := make([]RelayTarget, 0, len(c.Relays))
+	for _, relay := range c.Relays {
+		client := NewFlashbotsRelayClient(relay.Url)
+		client.Logger = logger
+		client.Unsigned = relay.Unsigned
+		if relay.SigningKey != "" {
+			key, err := crypto.HexToECDSA(strings.TrimPrefix(relay.SigningKey, "0x"))
+			if err != nil {
+				return nil, errors.Wrap(err, "relay "+relay.Name+": signing key")
+			}
+			client.SigningKey = key
+		}
+		targets = append(targets, RelayTarget{Name: relay.Name, Client: client})
+	}
+	return targets, nil
+}
+
+func LoadRelaysConfigFile(path string) (*RelaysConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	config := new(RelaysConfig)
+	if err = yaml.UnmarshalStrict(data, config); err != nil {
+		return nil, errors.Wrap(err, "parsing "+path)
+	}
+
+	if err = config.validate(); err != nil {
+		return nil, errors.Wrap(err, path)
+	}
+	return config, nil
+}
+
+// Result of a call to one relay target
+type RelayResult struct {
+	Relay    string
+	Accepted bool
+	Err      error
+	Duration time.Duration
+}
+
+// Returns nil if any relay accepted the call, otherwise the error of the first relay
+func relayFanOutError(results []RelayResult) error {
+	for _, result := range results {
+		if result.Accepted {
+			return nil
+		}
+	}
+	if len(results) == 0 {
+		return errors.New("no relays")
+	}
+	return results[0].Err
+}
+
+func relayResultLabel(err error) string {
+	switch {
+	case err == nil:
+		return "ok"
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+		return "timeout"
+	case errors.Is(err, flashbotsrpc.ErrRelayErrorResponse):
+		return "relay_error"
+	}
+	return "error"
+}
+
+// The relays with one of the names, in their order
+func relaysByName(relays []RelayTarget, names []string) []RelayTarget {
+	selected := make([]RelayTarget, 0, len(names))
+	for _, relay := range relays {
+		for _, name := range names {
+			if relay.Name == name {
+				selected = append(selected, relay)
+				break
+			}
+		}
+	}
+	return selected
+}
+
+// Calls the relays in parallel, each with the relay deadline, and records the result of each. callType is send or
+// cancel.
+func (r *RpcRequest) fanOutToRelays(callType string, relays []RelayTarget, call func(ctx context.Context, relay RelayClient) error) []RelayResult {
+	results := make([]RelayResult, len(relays))
+	var wg sync.WaitGroup
+	for i, relay := range relays {
+		wg.Add(1)
+		go func(i int, relay RelayTarget) {
+			defer wg.Done()
+			ctx, cancel := r.stageContext(r.timeouts.Relay)
+			defer cancel()
+			ctx, span := tracing.Start(ctx, "relay "+relay.Name, tracing.Attr("relay.name", relay.Name), tracing.Attr("relay.call", callType))
+			defer span.End()
+
+			timeStart := time.Now()
+			err := call(ctx, relay.Client)
+			duration := time.Since(timeStart)
+			span.RecordError(err)
+			metricRelayDuration.Observe(duration.Seconds(), callType, relay.Name)
+			metricRelayRequests.Inc(callType, relay.Name, relayResultLabel(err))
+			results[i] = RelayResult{Relay: relay.Name, Accepted: err == nil, Err: err, Duration: duration}
+		}(i, relay)
+	}
+	wg.Wait()
+
+	for _, result := range results {
+		if result.Accepted {
+			r.logger.log("[relay] %s %s: accepted after %.6f sec", callType, result.Relay, result.Duration.Seconds())
+		} else {
+			r.logger.log("[relay] %s %s: %v", callType, result.Relay, result.Err)
+		}
+	}
+	return results
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadRelaysConfigFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "relays.yaml")
+	err := ioutil.WriteFile(path, []byte(`
+relays:
+  - name: flashbots
+    url: https://relay.flashbots.net
+  - name: builder-a
+    url: https://builder-a.example
+    unsigned: true
+  - name: builder-b
+    url: https://builder-b.example
+    signingKey: 0x7bdeed70a07d5a45546e83a88dd430f71348592e747d2d3eb23f32db003eb0e1
+`), 0644)
+	require.Nil(t, err, err)
+
+	config, err := LoadRelaysConfigFile(path)
+	require.Nil(t, err, err)
+	targets, err := config.Targets(NewLogger(""))
+	require.Nil(t, err, err)
+	require.Equal(t, 3, len(targets))
+	require.Equal(t, "flashbots", targets[0].Name)
+	require.Equal(t, "https://relay.flashbots.net", targets[0].Client.(*FlashbotsRelayClient).Url)
+	require.True(t, targets[1].Client.(*FlashbotsRelayClient).Unsigned)
+	require.NotNil(t, targets[2].Client.(*FlashbotsRelayClient).SigningKey)
+
+	for _, invalid := range []string{
+		"relays: []\n",
+		"relays:\n  - name: a\n",
+		"relays:\n  - url: https://a.example\n",
+		"relays:\n  - {name: a, url: https://a.example}\n  - {name: a, url: https://b.example}\n",
+		"relays:\n  - {name: a, url: https://a.example, unsigned: true, signingKey: '0x01'}\n",
+	} {
+		err = ioutil.WriteFile(path, []byte(invalid), 0644)
+		require.Nil(t, err, err)
+		_, err = LoadRelaysConfigFile(path)
+		require.NotNil(t, err, invalid)
+	}
+}
@@ -1,35 +1,55 @@
 package server
 
 import (
-	"crypto/ecdsa"
-	"encoding/json"
+	"context"
+	"github.com/flashbots/rpc-endpoint/tracing"
 	"github.com/flashbots/rpc-endpoint/types"
 	"github.com/flashbots/rpc-endpoint/utils"
 	"github.com/google/uuid"
+	"github.com/pkg/errors"
 	"io/ioutil"
 	"net/http"
-	"strconv"
+	"regexp"
+	"strings"
 	"time"
 )
 
+// RequestIdHeader has the id of the request in the logs, it is taken from the request if set (e.g. by a load balancer)
+const RequestIdHeader = "X-Request-Id"
+
+var validRequestId = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,64}$`)
+
+// requestId returns the valid X-Request-Id of the request, or a new one
+func requestId(req *http.Request) string {
+	if id := req.Header.Get(RequestIdHeader); validRequestId.MatchString(id) {
+		return id
+	}
+	return uuid.New().String()
+}
+
 // RPC request handler for a single/ batch JSON-RPC request
 type RpcRequestHandler struct {
-	respw           *http.ResponseWriter
-	req             *http.Request
-	logger          Logger
-	timeStarted     time.Time
-	defaultProxyUrl string
-	relaySigningKey *ecdsa.PrivateKey
-	uid             string
+	*requestDeps
+	respw       *http.ResponseWriter
+	req         *http.Request
+	rootLogger  Logger
+	logger      Logger
+	timeStarted time.Time
+	proxyPool   *ProxyPool
+	uid         string
+	ctx         context.Context // request context with the request deadline
+	prefs       UserPreferences
+	prefsErr    error
 }
 
-func NewRpcRequestHandler(respw *http.ResponseWriter, req *http.Request, proxyUrl string, relaySigningKey *ecdsa.PrivateKey) *RpcRequestHandler {
+func NewRpcRequestHandler(deps *requestDeps, rootLogger Logger, respw *http.ResponseWriter, req *http.Request, proxyPool *ProxyPool) *RpcRequestHandler {
 	return &RpcRequestHandler{
-		respw:           respw,
-		req:             req,
-		timeStarted:     Now(),
-		defaultProxyUrl: proxyUrl,
-		relaySigningKey: relaySigningKey,
+		requestDeps: deps,
+		respw:       respw,
+		req:         req,
+		rootLogger:  rootLogger,
+		timeStarted: time.Now(),
+		proxyPool:   proxyPool,
 	}
 }
 
@@ -43,24 +63,53 @@ func (r *RpcRequestHandler) process() {
 
 	ip := utils.GetIP(r.req)             // Fetch ip
 	origin := r.req.Header.Get("Origin") // Fetch origin
+	r.uid = requestId(r.req)
+	(*r.respw).Header().Set(RequestIdHeader, r.uid)
+
+	// Continue the trace of the client, if it sent a traceparent header
+	ctx, span := tracing.StartWithKind(tracing.Extract(r.req.Context(), r.req.Header), "HTTP POST", tracing.SpanKindServer, tracing.Attr("request.id", r.uid))
+	defer span.End()
+
 	// Logger setup
-	r.uid = uuid.New().String()
-	r.logger = NewLogger(r.uid)
+	r.logger = r.rootLogger.With("requestId", r.uid).With("ip", ip).With("origin", origin).With("apiKey", r.req.Header.Get(ApiKeyHeader))
+	if span.IsRecording() {
+		r.logger = r.logger.With("traceId", span.SpanContext().TraceID.String())
+	}
 	r.logger.log("POST request received")
 
+	// The request is cancelled when the client goes away or the request deadline is exceeded
+	var cancel context.CancelFunc
+	r.ctx, cancel = context.WithTimeout(ctx, r.timeouts.Request)
+	defer cancel()
+
 	// Validate if ip blacklisted
 	if IsBlacklisted(ip) {
-		r.logger.log("Blocked IP: %s", ip)
+		r.logger.logWarn("Blocked IP: %s", ip)
 		r._writeHeaderStatus(http.StatusUnauthorized)
 		return
 	}
 
+	// Options in the URL, invalid ones are reported in the response to each request
+	var ignoredOptions []string
+	r.prefs, ignoredOptions, r.prefsErr = ParseUserPreferences(r.req.URL, r.relays)
+	if len(ignoredOptions) > 0 {
+		r.logger.logDebug("ignored url options: %s", strings.Join(ignoredOptions, ", "))
+	}
+
 	// If users specify a proxy url in their rpc endpoint they can have their requests proxied to that endpoint instead of Infura
 	// e.g. https://rpc.flashbots.net?url=http://RPC-ENDPOINT.COM
 	customProxyUrl, ok := r.req.URL.Query()["url"]
 	if ok && len(customProxyUrl[0]) > 1 {
-		r.defaultProxyUrl = customProxyUrl[0]
-		r.logger.log("Using custom url: %s", r.defaultProxyUrl)
+		if err := r.customProxyPolicy.CheckUrl(r.ctx, customProxyUrl[0]); err != nil {
+			r.logger.logWarn("Rejected custom url %s: %v", customProxyUrl[0], err)
+			metricCustomProxyRejected.Inc()
+			if r.prefsErr == nil {
+				r.prefsErr = errors.Wrap(err, "url")
+			}
+		} else {
+			r.proxyPool = NewCustomProxyPool(customProxyUrl[0], r.customProxyClient)
+			r.logger.log("Using custom url: %s", customProxyUrl[0])
+		}
 	}
 
 	// Decode request JSON RPC
@@ -72,61 +121,56 @@ func (r *RpcRequestHandler) process() {
 		return
 	}
 
-	if len(body) == 0 {
-		r._writeHeaderStatus(http.StatusBadRequest)
+	// Parse JSON RPC payload
+	entries, isBatch, errRes := parseJsonRpcPayload(body)
+	if errRes != nil {
+		r.logger.logError("Parse payload: %s", errRes.Error.Message)
+		r._writeRpcResponse(errRes)
 		return
 	}
-
-	// Parse JSON RPC payload
-	var jsonReq *types.JsonRpcRequest
-	if err = json.Unmarshal(body, &jsonReq); err != nil {
-		var jsonBatchReq []*types.JsonRpcRequest
-		if err = json.Unmarshal(body, &jsonBatchReq); err != nil {
-			r.logger.logError("Parse payload %v", err)
-			r._writeHeaderStatus(http.StatusBadRequest)
-			return
-		}
-		// Process batch request
-		r.processBatchRequest(jsonBatchReq, ip, origin)
+	if isBatch {
+		r.processBatchRequest(entries, ip, origin)
 		return
 	}
-	// Process single request
-	r.processRequest(jsonReq, ip, origin)
-
+	r.processRequest(entries[0], ip, origin)
 }
 
 // processRequest handles single request
-func (r *RpcRequestHandler) processRequest(jsonReq *types.JsonRpcRequest, ip, origin string) {
+func (r *RpcRequestHandler) processRequest(entry jsonRpcPayloadEntry, ip, origin string) {
+	if entry.errRes != nil {
+		r._writeRpcResponse(entry.errRes)
+		return
+	}
+
 	// Handle single request
-	rpcReq := NewRpcRequest(r.logger, jsonReq, r.defaultProxyUrl, r.relaySigningKey, ip, origin)
+	rpcReq := NewRpcRequest(r.ctx, r.requestDeps, r.logger, entry.req, r.proxyPool, ip, origin, r.req.Header.Get(ApiKeyHeader))
+	rpcReq.prefs, rpcReq.prefsErr = r.prefs, r.prefsErr
 	res := rpcReq.ProcessRequest()
+
+	// Notifications are processed, but not answered
+	if entry.req.IsNotification() {
+		r._writeHeaderStatus(http.StatusNoContent)
+		return
+	}
 	// Write response
 	r._writeRpcResponse(res)
 }
 
 // processBatchRequest handles multiple batch request
-func (r *RpcRequestHandler) processBatchRequest(jsonBatchReq []*types.JsonRpcRequest, ip, origin string) {
-	resCh := make(chan *types.JsonRpcResponse, len(jsonBatchReq)) // Chan to hold response from each go routine
-	for i := 0; i < cap(resCh); i++ {
-		// Process each individual request
-		// Scatter worker
-		go func(count int, rpcReq *types.JsonRpcRequest) {
-			// Create child logger
-			l := r.logger.CreateChildLogger(strconv.FormatInt(int64(count), 10))
-			// Create rpc request
-			req := NewRpcRequest(l, rpcReq, r.defaultProxyUrl, r.relaySigningKey, ip, origin) // Set each individual request
-			res := req.ProcessRequest()
-			resCh <- res
-		}(i, jsonBatchReq[i])
-	}
+func (r *RpcRequestHandler) processBatchRequest(entries []jsonRpcPayloadEntry, ip, origin string) {
+	responses := processJsonRpcBatch(entries, func(i int, jsonReq *types.JsonRpcRequest) *types.JsonRpcResponse {
+		l := r.logger.With("batchIndex", i)
+		// Create rpc request
+		req := NewRpcRequest(r.ctx, r.requestDeps, l, jsonReq, r.proxyPool, ip, origin, r.req.Header.Get(ApiKeyHeader)) // Set each individual request
+		req.prefs, req.prefsErr = r.prefs, r.prefsErr
+		return req.ProcessRequest()
+	})
 
-	response := make([]*types.JsonRpcResponse, 0)
-	// Gather responses
-	for i := 0; i < cap(resCh); i++ {
-		res := <-resCh
-		response = append(response, res) // Add it to batch response list
+	// A batch of only notifications is not answered
+	if len(responses) == 0 {
+		r._writeHeaderStatus(http.StatusNoContent)
+		return
 	}
-	close(resCh)
 	// Write consolidated response
-	r._writeRpcBatchResponse(response)
+	r._writeRpcBatchResponse(responses)
 }
@@ -1,15 +1,17 @@
 package server
 
 import (
+	"encoding/json"
 	"fmt"
 	"strings"
 
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/flashbots/rpc-endpoint/types"
 )
 
-var ProtectTxApiHost = "https://protect.flashbots.net"
-
-// If public getTransactionReceipt of a submitted tx is null, then check internal API to see if tx has failed
+// If public getTransactionReceipt of a submitted tx is null, make sure that the tx tracker looks up its status (e.g.
+// after a restart). The tracker also arms the nonce-fix if the tx failed.
 func (r *RpcRequest) check_post_getTransactionReceipt(jsonResp *types.JsonRpcResponse) (requestFinished bool) {
 	if jsonResp == nil {
 		return false
@@ -20,99 +22,82 @@ func (r *RpcRequest) check_post_getTransactionReceipt(jsonResp *types.JsonRpcRes
 		return false
 	}
 
-	if len(r.jsonReq.Params) < 1 {
+	// An invalid hash would have been an error response of the node
+	var txHash common.Hash
+	if err := r.jsonReq.DecodeParams(&txHash); err != nil {
 		return false
 	}
 
-	txHashLower := strings.ToLower(r.jsonReq.Params[0].(string))
+	txHashLower := strings.ToLower(txHash.Hex())
 	r.logger.log("[post_getTransactionReceipt] eth_getTransactionReceipt is null, check if it was a private tx: %s", txHashLower)
 
-	// get tx status from private-tx-api
-	statusApiResponse, err := GetTxStatus(txHashLower)
-	if err != nil {
-		r.logger.logError("[post_getTransactionReceipt] privateTxApi failed: %s", err)
+	// Txs without a lifecycle record were not sent to the relays by us
+	txStatus, found := r.cachedTxStatus(txHashLower)
+	if found {
+		r.logger.log("[post_getTransactionReceipt] private tx status: %s", txStatus)
 		return false
 	}
 
-	ensureAccountFixIsInPlace := func() {
-		// Get the sender of this transaction
-		txFromLower, txFromFound, err := RState.GetSenderOfTxHash(txHashLower)
-		if err != nil {
-			r.logger.logError("[post_getTransactionReceipt] redis:GetSenderOfTxHash failed: %v", err)
-			return
-		}
-
-		if !txFromFound { // cannot sent nonce-fix if we don't have the sender
-			return
-		}
-
-		// Check if nonceFix is already in place for this user
-		_, nonceFixAlreadyExists, err := RState.GetNonceFixForAccount(txFromLower)
-		if err != nil {
-			r.logger.logError("[post_getTransactionReceipt] redis:GetNonceFixForAccount failed: %s", err)
-			return
-		}
-
-		if nonceFixAlreadyExists {
-			return
-		}
+	// In debug mode txs are not sent, so the nonce-fix is set here to try it with wallets
+	if r.debugDontSendTx {
+		r.ensureAccountFixIsInPlace(txHashLower)
+	}
+	return false
+}
 
-		// Setup a new nonce-fix for this user
-		err = RState.SetNonceFixForAccount(txFromLower, 0)
-		if err != nil {
-			r.logger.logError("[post_getTransactionReceipt] redis error: %s", err)
-			return
-		}
+func (r *RpcRequest) ensureAccountFixIsInPlace(txHashLower string) {
+	// Get the sender of this transaction
+	txFromLower, txFromFound, err := r.state.GetSenderOfTxHash(r.ctx, txHashLower)
+	if err != nil {
+		r.logger.logError("[post_getTransactionReceipt] redis:GetSenderOfTxHash failed: %v", err)
+		return
+	}
 
-		r.logger.log("[post_getTransactionReceipt] nonce-fix set for: %s", txFromLower)
+	if !txFromFound { // cannot sent nonce-fix if we don't have the sender
+		return
 	}
 
-	r.logger.log("[post_getTransactionReceipt] priv-tx-api status: %s", statusApiResponse.Status)
-	if statusApiResponse.Status == types.TxStatusFailed || (DebugDontSendTx && statusApiResponse.Status == types.TxStatusUnknown) {
-		r.logger.log("[post_getTransactionReceipt] failed private tx, ensure account fix is in place")
-		ensureAccountFixIsInPlace()
-		// r.writeRpcError("Transaction failed") // If this is sent before metamask dropped the tx (received 4x invalid nonce), then it doesn't call getTransactionCount anymore
-		// TODO: return standard failed tx payload?
-		return false
+	// Setup a new nonce-fix for this user, if there is none already
+	created, err := r.state.CreateNonceFixForAccount(r.ctx, txFromLower, NonceFixNonceUnknown)
+	if err != nil {
+		r.logger.logError("[post_getTransactionReceipt] redis:CreateNonceFixForAccount failed: %s", err)
+		return
+	}
 
-		// } else if statusApiResponse.Status == types.TxStatusIncluded {
-		// 	// NOTE: This branch can never happen, because if tx is included then Receipt will not return null
-		// 	// TODO? If latest tx of this user was a successful, then we should remove the nonce fix
-		// 	// This could lead to a ping-pong between checking 2 tx, with one check adding and another removing the nonce fix
-		// 	// See also the branch tmp-check_post_getTransactionReceipt-removeNonceFix
-		// 	_ = 1
+	if !created {
+		return
 	}
 
-	return false
+	r.logger.log("[post_getTransactionReceipt] nonce-fix set for: %s", txFromLower)
 }
 
 func (r *RpcRequest) intercept_mm_eth_getTransactionCount() (requestFinished bool) {
-	if len(r.jsonReq.Params) < 1 {
+	// Invalid params are left to the node to answer
+	var address common.Address
+	if err := r.jsonReq.DecodeParams(&address); err != nil {
 		return false
 	}
 
-	addr := strings.ToLower(r.jsonReq.Params[0].(string))
+	addr := strings.ToLower(address.Hex())
 
-	// Check if nonceFix is in place for this user
-	numTimesSent, nonceFixInPlace, err := RState.GetNonceFixForAccount(addr)
+	// Count the intercept if nonceFix is in place for this user. Intercept max 4 times (after which Metamask marks it as dropped)
+	numTimesSent, failedNonce, intercept, err := r.state.IncNonceFixForAccount(r.ctx, addr, 4)
 	if err != nil {
-		r.logger.logError("redis:GetAccountWithNonceFix error:", err)
+		r.logger.logError("redis:IncNonceFixForAccount error:", err)
 		return false
 	}
 
-	if !nonceFixInPlace {
+	if !intercept {
 		return false
 	}
 
-	// Intercept max 4 times (after which Metamask marks it as dropped)
-	numTimesSent += 1
-	if numTimesSent > 4 {
-		return false
-	}
-
-	err = RState.SetNonceFixForAccount(addr, numTimesSent)
-	if err != nil {
-		r.logger.logError("redis:SetAccountWithNonceFix error:", err)
+	// The failed tx can't be dropped anymore once a tx with its nonce is on chain
+	if failedNonce != NonceFixNonceUnknown && r.onChainNoncePast(address, failedNonce) {
+		if err = r.state.DelNonceFixForAccount(r.ctx, addr); err != nil {
+			r.logger.logError("redis:DelNonceFixForAccount error: %v", err)
+		}
+		r.logger.log("[nonce-fix] removed for %s, nonce %d is on chain", addr, failedNonce)
+		metricNonceFixChanges.Inc("cleared")
 		return false
 	}
 
@@ -122,27 +107,49 @@ func (r *RpcRequest) intercept_mm_eth_getTransactionCount() (requestFinished boo
 	var wrongNonce uint64 = 1e9 + 1
 	resp := fmt.Sprintf("0x%x", wrongNonce)
 	r.writeRpcResult(resp)
+	metricNonceFixIntercepts.Inc()
 	r.logger.log("Intercepted eth_getTransactionCount for %s", addr)
 	return true
 }
 
-// Returns true if request has already received a response, false if req should contiue to normal proxy
-func (r *RpcRequest) intercept_eth_call_to_FlashRPC_Contract() (requestFinished bool) {
-	if len(r.jsonReq.Params) < 1 {
+// onChainNoncePast returns true if the transaction count of the address is past the nonce. Errors are logged, and
+// count as not past.
+func (r *RpcRequest) onChainNoncePast(address common.Address, nonce uint64) bool {
+	ctx, cancel := r.stageContext(r.timeouts.Proxy)
+	defer cancel()
+	res, err := r.proxyPool.SendRpcAndParseResponse(ctx, types.NewJsonRpcRequest(1, "eth_getTransactionCount", []interface{}{address.Hex(), "latest"}))
+	if err != nil {
+		r.logger.logError("[nonce-fix] eth_getTransactionCount failed: %v", err)
+		return false
+	}
+
+	var txCountHex string
+	if err = json.Unmarshal(res.Result, &txCountHex); err != nil {
+		r.logger.logError("[nonce-fix] eth_getTransactionCount unmarshall failed: %v - result: %s", err, res.Result)
+		return false
+	}
+	txCount, err := hexutil.DecodeUint64(txCountHex)
+	if err != nil {
+		r.logger.logError("[nonce-fix] eth_getTransactionCount invalid result: %v - result: %s", err, res.Result)
 		return false
 	}
+	return txCount > nonce
+}
 
-	ethCallReq := r.jsonReq.Params[0].(map[string]interface{})
-	if ethCallReq["to"] == nil {
+// Returns true if request has already received a response, false if req should contiue to normal proxy
+func (r *RpcRequest) intercept_eth_call_to_FlashRPC_Contract() (requestFinished bool) {
+	var callArgs types.CallArgs
+	if !r.decodeParams(&callArgs) {
+		return true
+	}
+	if callArgs.To == nil {
 		return false
 	}
 
-	addressTo := strings.ToLower(ethCallReq["to"].(string))
+	addressTo := strings.ToLower(callArgs.To.Hex())
 
-	// Only handle calls to the Flashbots RPC check contract
-	// 0xf1a54b075 --> 0xflashbots
-	// https://etherscan.io/address/0xf1a54b0759b58661cea17cff19dd37940a9b5f1a#readContract
-	if addressTo != "0xf1a54b0759b58661cea17cff19dd37940a9b5f1a" {
+	// Only handle calls to the Flashbots RPC check contract of the chain
+	if !r.chain.IsCheckContract(addressTo) {
 		return false
 	}
 
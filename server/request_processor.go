@@ -4,7 +4,7 @@ Request represents an incoming client request
 package server
 
 import (
-	"crypto/ecdsa"
+	"context"
 	"encoding/json"
 	"errors"
 	"io/ioutil"
@@ -12,50 +12,79 @@ import (
 	"strings"
 	"time"
 
+	"github.com/ethereum/go-ethereum/common/hexutil"
 	ethtypes "github.com/ethereum/go-ethereum/core/types"
+	"github.com/flashbots/rpc-endpoint/tracing"
 	"github.com/flashbots/rpc-endpoint/types"
-	"github.com/flashbots/rpc-endpoint/utils"
 	"github.com/metachris/flashbotsrpc"
 )
 
 type RpcRequest struct {
-	logger          Logger
-	jsonReq         *types.JsonRpcRequest
-	jsonRes         *types.JsonRpcResponse
-	rawTxHex        string
-	tx              *ethtypes.Transaction
-	txFrom          string
-	defaultProxyUrl string
-	relaySigningKey *ecdsa.PrivateKey
-	ip              string
-	origin          string
+	*requestDeps
+	ctx       context.Context
+	logger    Logger
+	jsonReq   *types.JsonRpcRequest
+	jsonRes   *types.JsonRpcResponse
+	rawTxHex  string
+	tx        *ethtypes.Transaction
+	txFrom    string
+	proxyPool *ProxyPool
+	ip        string
+	origin    string
+	apiKey    string
+	prefs     UserPreferences
+	prefsErr  error // invalid options in the request URL
+
+	// When the tx was previously sent to the relay (zero if never), as seen by blockResendingTxToRelay
+	prevTimeSentToRelay time.Time
+
+	// Result of each relay for the tx sent or cancelled by this request
+	relayResults []RelayResult
+
+	protectionDecision PolicyDecision // of the tx sent by this request
 }
 
-func NewRpcRequest(logger Logger, jsonReq *types.JsonRpcRequest, defaultProxyUrl string, relaySigningKey *ecdsa.PrivateKey, ip, origin string) *RpcRequest {
+func NewRpcRequest(ctx context.Context, deps *requestDeps, logger Logger, jsonReq *types.JsonRpcRequest, proxyPool *ProxyPool, ip, origin, apiKey string) *RpcRequest {
 	return &RpcRequest{
-		logger:          logger,
-		jsonReq:         jsonReq,
-		defaultProxyUrl: defaultProxyUrl,
-		relaySigningKey: relaySigningKey,
-		ip:              ip,
-		origin:          origin,
+		requestDeps: deps,
+		ctx:         ctx,
+		logger:      logger.With("method", jsonReq.Method),
+		jsonReq:     jsonReq,
+		proxyPool:   proxyPool,
+		ip:          ip,
+		origin:      origin,
+		apiKey:      apiKey,
+		prefs:       DefaultUserPreferences(),
 	}
 }
 
 func (r *RpcRequest) ProcessRequest() *types.JsonRpcResponse {
+	timeStarted := time.Now()
+	methodLabel := metricsMethodLabel(r.jsonReq.Method)
+	metricRequests.Inc(methodLabel)
+	defer func() {
+		metricRequestDuration.Observe(time.Since(timeStarted).Seconds(), methodLabel)
+	}()
+	defer r.startSpan(methodLabel, tracing.Attr("rpc.system", "jsonrpc"), tracing.Attr("rpc.method", methodLabel))()
+
+	if !r.checkIpRateLimit() || !r.checkPreferences() {
+		return r.jsonRes
+	}
+
 	switch {
 	case r.jsonReq.Method == "eth_sendRawTransaction":
 		r.handle_sendRawTransaction()
 	case r.jsonReq.Method == "eth_getTransactionCount" && r.intercept_mm_eth_getTransactionCount(): // intercept if MM needs to show an error to user
 	case r.jsonReq.Method == "eth_call" && r.intercept_eth_call_to_FlashRPC_Contract(): // intercept if Flashbots isRPC contract
-	case r.jsonReq.Method == "net_version": // don't need to proxy to node, it's always 1 (mainnet)
-		r.writeRpcResult("1")
+	case r.jsonReq.Method == "flashbots_debugProtectionDecision":
+		r.handle_debugProtectionDecision()
+	case r.jsonReq.Method == "net_version": // don't need to proxy to node, it's the configured chain id
+		r.writeRpcResult(r.chain.NetVersion())
 	default:
-		// Proxy the request to a node
-		readJsonRpcSuccess := r.proxyRequestRead(r.defaultProxyUrl)
-		if !readJsonRpcSuccess {
+		// Proxy the request to a node (or answer it from the cache)
+		if err := r.cachedProxyRequestRead(); err != nil {
 			r.logger.log("Proxy to node failed: %s", r.jsonReq.Method)
-			r.writeRpcError("internal server error", types.JsonRpcInternalError)
+			r.writeProxyError(err)
 			return r.jsonRes
 		}
 
@@ -71,31 +100,29 @@ func (r *RpcRequest) ProcessRequest() *types.JsonRpcResponse {
 	return r.jsonRes
 }
 
-// Proxies the incoming request to the target URL, and tries to parse JSON-RPC response (and check for specific)
-func (r *RpcRequest) proxyRequestRead(proxyUrl string) (readJsonRpsResponseSuccess bool) {
-	timeProxyStart := Now() // for measuring execution time
-	r.logger.log("proxyRequest to: %s", proxyUrl)
+// Proxies the incoming request to the proxy pool, and tries to parse JSON-RPC response (and check for specific)
+func (r *RpcRequest) proxyRequestRead() error {
+	defer r.startSpan("proxy")()
+	timeProxyStart := time.Now() // for measuring execution time
 
 	body, err := json.Marshal(r.jsonReq)
 	if err != nil {
 		r.logger.logError("failed to marshal request before making proxy request: %v", err)
-		return false
+		return err
 	}
 
 	// Proxy request
-	proxyResp, err := ProxyRequest(proxyUrl, body)
+	ctx, cancel := r.stageContext(r.timeouts.Proxy)
+	defer cancel()
+	proxyResp, proxyUrl, err := r.proxyPool.ProxyRequest(ctx, body)
 	if err != nil {
-		r.logger.logError("failed to make proxy request: %v / resp: %v", err, proxyResp)
-		if proxyResp == nil {
-			return false
-		} else {
-			return false
-		}
+		r.logger.logError("failed to make proxy request: %v", err)
+		return err
 	}
 
 	// Afterwards, check time and result
 	timeProxyNeeded := time.Since(timeProxyStart)
-	r.logger.log("proxy response %d after %.6f sec", proxyResp.StatusCode, timeProxyNeeded.Seconds())
+	r.logger.log("proxy response %d from %s after %.6f sec", proxyResp.StatusCode, proxyUrl, timeProxyNeeded.Seconds())
 	// r.logger.log("proxy response %d after %.6f: %v", proxyResp.StatusCode, timeProxyNeeded.Seconds(), proxyResp)
 
 	// Read body
@@ -103,22 +130,23 @@ func (r *RpcRequest) proxyRequestRead(proxyUrl string) (readJsonRpsResponseSucce
 	proxyRespBody, err := ioutil.ReadAll(proxyResp.Body)
 	if err != nil {
 		r.logger.logError("failed to read proxy request body: %v", err)
-		return false
+		return err
 	}
 
 	// Unmarshall JSON-RPC response and check for error inside
 	jsonRpcResp := new(types.JsonRpcResponse)
 	if err = json.Unmarshal(proxyRespBody, jsonRpcResp); err != nil {
 		r.logger.logError("failed decoding proxy json-rpc response: %v - data: %s", err, proxyRespBody)
-		return false
+		return err
 	}
 	r.jsonRes = jsonRpcResp
-	return true
+	return nil
 }
 
-// Check whether to block resending this tx. Send only if (a) not sent before, (b) sent and status=failed, (c) sent, status=unknown and sent at least 5 min ago
+// Check whether to block resending this tx. Send only if (a) not sent before, (b) sent and status=failed/rejected/cancelled, (c) sent, status=unknown and sent at least 5 min ago
 func (r *RpcRequest) blockResendingTxToRelay(txHash string) bool {
-	timeSent, txWasSentToRelay, err := RState.GetTxSentToRelay(txHash)
+	defer r.startSpan("blockResendingTxToRelay")()
+	timeSent, txWasSentToRelay, err := r.state.GetTxSentToRelay(r.ctx, txHash)
 	if err != nil {
 		r.logger.logError("[shouldSendTxToRelay] redis:GetTxSentToRelay error: %v", err)
 		return false // don't block on redis error
@@ -127,28 +155,24 @@ func (r *RpcRequest) blockResendingTxToRelay(txHash string) bool {
 	if !txWasSentToRelay {
 		return false // don't block if not sent before
 	}
-
-	// was sent before. check status and time
-	txStatusApiResponse, err := GetTxStatus(txHash)
-	if err != nil {
-		r.logger.logError("[shouldSendTxToRelay] GetTxStatus error: %v", err)
-		return false // don't block on redis error
-	}
-
-	// Allow sending to relay if tx has failed, or if it's still unknown after a while
-	txStatus := types.PrivateTxStatus(txStatusApiResponse.Status)
-	if txStatus == types.TxStatusFailed {
-		return false // don't block if tx failed
-	} else if txStatus == types.TxStatusUnknown && time.Since(timeSent).Minutes() >= 5 {
-		return false // don't block if unknown and sent at least 5 min ago
-	} else {
-		// block tx if pending or already included
-		return true
+	r.prevTimeSentToRelay = timeSent
+
+	// was sent before. check status (stored by the tx tracker, unknown if there's no lifecycle record) and time
+	txStatus, _ := r.cachedTxStatus(txHash)
+	switch txStatus {
+	case types.TxStatusFailed, types.TxStatusRejected, types.TxStatusCancelled:
+		return false // don't block if the relays dropped the tx
+	case types.TxStatusPending, types.TxStatusIncluded:
+		return true // block tx if pending or already included
+	default:
+		// don't block if unknown and sent at least 5 min ago
+		return r.clock().Sub(timeSent).Minutes() < 5
 	}
 }
 
 // Send tx to relay and finish request (write response)
 func (r *RpcRequest) sendTxToRelay() {
+	defer r.startSpan("sendTxToRelay")()
 	txHash := strings.ToLower(r.tx.Hash().Hex())
 
 	// Check if tx was already forwarded and should be blocked now
@@ -158,14 +182,27 @@ func (r *RpcRequest) sendTxToRelay() {
 		return
 	}
 
+	// Reject txs that would revert before they are marked as sent
+	if r.simulationMode != "" && !r.simulationAllowsTx() {
+		return
+	}
+
 	r.logger.log("[sendTxToRelay] sending %s -- from ip: %s / address: %s / to: %s", txHash, r.ip, r.txFrom, r.tx.To())
 
-	// mark tx as sent to relay
-	err := RState.SetTxSentToRelay(txHash)
+	// mark tx as sent to relay, unless a concurrent request for the same tx was faster
+	marked, err := r.state.MarkTxSentToRelay(r.ctx, txHash, r.prevTimeSentToRelay)
 	if err != nil {
-		r.logger.logError("[sendTxToRelay] redis:SetTxSentToRelay failed: %v", err)
+		r.logger.logError("[sendTxToRelay] redis:MarkTxSentToRelay failed: %v", err)
+	} else if !marked {
+		r.logger.log("[sendTxToRelay] blocked %s - sent concurrently", txHash)
+		r.writeRpcResult(txHash)
+		return
 	}
 
+	// Once marked, resends of the tx are blocked, so it has to reach the relays even if the client goes away now. The
+	// following calls only have their stage deadlines.
+	r.ctx = detachedContext{r.ctx}
+
 	txTo := r.tx.To()
 	if txTo == nil {
 		r.writeRpcError("invalid target", types.JsonRpcInternalError)
@@ -179,44 +216,62 @@ func (r *RpcRequest) sendTxToRelay() {
 		return
 	}
 
-	go RState.SetSenderMaxNonce(r.txFrom, r.tx.Nonce())
+	r.inflight.Add(1)
+	go func() {
+		defer r.inflight.Done()
+		r.state.SetSenderMaxNonce(context.Background(), r.txFrom, r.tx.Nonce()) // outlives the request
+	}()
 
 	// only allow large transactions to certain addresses - default max tx size is 128KB
 	// https://github.com/ethereum/go-ethereum/blob/master/core/tx_pool.go#L53
 	if r.tx.Size() > 131072 {
 		if _, found := allowedLargeTxTargets[txTo.Hex()]; !found {
-			r.logger.logError("sendTxToRelay] large tx to not allowed target - hash: %s - target: %s", txHash, txTo)
+			r.logger.logError("[sendTxToRelay] large tx to not allowed target - hash: %s - target: %s", txHash, txTo)
 			r.writeRpcError("invalid target for large tx", types.JsonRpcInternalError)
 			return
 		}
-		r.logger.log("sendTxToRelay] allowed large tx - hash: %s - target: %s", txHash, txTo)
+		r.logger.log("[sendTxToRelay] allowed large tx - hash: %s - target: %s", txHash, txTo)
 	}
 
 	// remember this tx based on from+nonce (for cancel-tx)
-	err = RState.SetTxHashForSenderAndNonce(r.txFrom, r.tx.Nonce(), txHash)
+	err = r.state.SetTxHashForSenderAndNonce(r.ctx, r.txFrom, r.tx.Nonce(), txHash)
 	if err != nil {
 		r.logger.logError("[sendTxToRelay] redis:SetTxHashForSenderAndNonce failed: %v", err)
 	}
 
-	// err = RState.SetLastPrivTxHashOfAccount(r.txFrom, txHash)
+	// err = r.state.SetLastPrivTxHashOfAccount(r.ctx, r.txFrom, txHash)
 	// if err != nil {
 	// 	r.logError("[sendTxToRelay] redis:SetLastTxHashOfAccount failed: %v", err)
 	// }
 
-	if DebugDontSendTx {
+	if r.debugDontSendTx {
 		r.logger.log("faked sending tx to relay, did nothing")
 		r.writeRpcResult(txHash)
 		return
 	}
 
-	sendPrivTxArgs := flashbotsrpc.FlashbotsSendPrivateTransactionRequest{Tx: r.rawTxHex}
-	_, err = FlashbotsRPC.FlashbotsSendPrivateTransaction(r.relaySigningKey, sendPrivTxArgs)
+	sendPrivTxArgs, err := r.sendPrivateTransactionArgs()
 	if err != nil {
+		r.logger.logError("[sendTxToRelay] block number for maxBlocks failed: %v", err)
+		r.writeProxyError(err)
+		return
+	}
+	relays := r.prefs.selectRelays(r.relays)
+	r.relayResults = r.fanOutToRelays("send", relays, func(ctx context.Context, relay RelayClient) error {
+		_, err := relay.SendPrivateTransaction(ctx, r.relaySigningKey, sendPrivTxArgs)
+		return err
+	})
+	r.recordTxSent(sendPrivTxArgs, relays)
+	if err = relayFanOutError(r.relayResults); err != nil {
+		if r.writeContextError(err, "relay") {
+			return
+		}
 		if errors.Is(err, flashbotsrpc.ErrRelayErrorResponse) {
-			r.logger.log("[sendTxToRelay] %v - rawTx: %s", err, r.rawTxHex)
+			r.logger.logWarn("[sendTxToRelay] %v", err)
 			r.writeRpcError(err.Error(), types.JsonRpcInternalError)
 		} else {
-			r.logger.logError("[sendTxToRelay] relay call failed: %v - rawTx: %s", err, r.rawTxHex)
+			r.logger.logError("[sendTxToRelay] relay call failed: %v", err)
+			r.logger.logDebug("[sendTxToRelay] rawTx: %s", r.rawTxHex)
 			r.writeRpcError(err.Error(), types.JsonRpcInternalError)
 		}
 		return
@@ -226,14 +281,38 @@ func (r *RpcRequest) sendTxToRelay() {
 	r.logger.log("[sendTxToRelay] sent %s", txHash)
 }
 
+// Params for eth_sendPrivateTransaction with the user preferences
+func (r *RpcRequest) sendPrivateTransactionArgs() (types.SendPrivateTransactionRequest, error) {
+	args := types.SendPrivateTransactionRequest{Tx: r.rawTxHex}
+	if r.prefs.Fast {
+		args.Preferences = &types.PrivateTxPreferences{Fast: true}
+	}
+
+	maxBlockNumber := r.prefs.MaxBlockNumber
+	if r.prefs.MaxBlocks > 0 {
+		ctx, cancel := r.stageContext(r.timeouts.Proxy)
+		defer cancel()
+		blockNumber, err := r.proxyPool.BlockNumber(ctx)
+		if err != nil {
+			return args, err
+		}
+		maxBlockNumber = blockNumber + r.prefs.MaxBlocks
+	}
+	if maxBlockNumber > 0 {
+		args.MaxBlockNumber = hexutil.EncodeUint64(maxBlockNumber)
+	}
+	return args, nil
+}
+
 // Sends cancel-tx to relay as cancelPrivateTransaction, if initial tx was sent there too.
 func (r *RpcRequest) handleCancelTx() (requestCompleted bool) {
+	defer r.startSpan("handleCancelTx")()
 	cancelTxHash := strings.ToLower(r.tx.Hash().Hex())
 	txFromLower := strings.ToLower(r.txFrom)
 	r.logger.log("[cancel-tx] %s - check %s/%d", cancelTxHash, txFromLower, r.tx.Nonce())
 
 	// Get initial txHash by sender+nonce
-	initialTxHash, txHashFound, err := RState.GetTxHashForSenderAndNonce(txFromLower, r.tx.Nonce())
+	initialTxHash, txHashFound, err := r.state.GetTxHashForSenderAndNonce(r.ctx, txFromLower, r.tx.Nonce())
 	if err != nil {
 		r.logger.logError("[cancel-tx] redis:GetTxHashForSenderAndNonce failed %v", err)
 		r.writeRpcError("internal server error", types.JsonRpcInternalError)
@@ -245,7 +324,7 @@ func (r *RpcRequest) handleCancelTx() (requestCompleted bool) {
 	}
 
 	// Check if initial tx was sent to relay
-	_, txWasSentToRelay, err := RState.GetTxSentToRelay(initialTxHash)
+	_, txWasSentToRelay, err := r.state.GetTxSentToRelay(r.ctx, initialTxHash)
 	if err != nil {
 		r.logger.logError("[cancel-tx] redis:GetTxSentToRelay failed: %s", err)
 		r.writeRpcError("internal server error", types.JsonRpcInternalError)
@@ -257,7 +336,7 @@ func (r *RpcRequest) handleCancelTx() (requestCompleted bool) {
 	}
 
 	// Should send cancel-tx to relay. Check if cancel-tx was already sent before
-	_, cancelTxAlreadySentToRelay, err := RState.GetTxSentToRelay(cancelTxHash)
+	_, cancelTxAlreadySentToRelay, err := r.state.GetTxSentToRelay(r.ctx, cancelTxHash)
 	if err != nil {
 		r.logger.logError("[cancel-tx] redis:GetTxSentToRelay error: %v", err)
 		r.writeRpcError("internal server error", types.JsonRpcInternalError)
@@ -271,21 +350,29 @@ func (r *RpcRequest) handleCancelTx() (requestCompleted bool) {
 
 	r.logger.log("[cancel-tx] sending to relay: %s for %s/%d", initialTxHash, txFromLower, r.tx.Nonce())
 
-	if DebugDontSendTx {
+	if r.debugDontSendTx {
 		r.logger.log("faked sending cancel-tx to relay, did nothing")
 		r.writeRpcResult(initialTxHash)
 		return true
 	}
 
 	cancelPrivTxArgs := flashbotsrpc.FlashbotsCancelPrivateTransactionRequest{TxHash: initialTxHash}
-	_, err = FlashbotsRPC.FlashbotsCancelPrivateTransaction(r.relaySigningKey, cancelPrivTxArgs)
-	if err != nil {
+	r.relayResults = r.fanOutToRelays("cancel", r.cancelRelays(initialTxHash), func(ctx context.Context, relay RelayClient) error {
+		_, err := relay.CancelPrivateTransaction(ctx, r.relaySigningKey, cancelPrivTxArgs)
+		return err
+	})
+	r.recordTxCancelled(initialTxHash, cancelTxHash)
+	if err = relayFanOutError(r.relayResults); err != nil {
+		if r.writeContextError(err, "relay") {
+			return true
+		}
 		if errors.Is(err, flashbotsrpc.ErrRelayErrorResponse) {
 			// errors could be: 'tx not found', 'tx was already cancelled', 'tx has already expired'
-			r.logger.log("[cancel-tx] %v - rawTx: %s", err, r.rawTxHex)
+			r.logger.logWarn("[cancel-tx] %v", err)
 			r.writeRpcError(err.Error(), types.JsonRpcInternalError)
 		} else {
-			r.logger.logError("[cancel-tx] relay call failed: %v - rawTx: %s", err, r.rawTxHex)
+			r.logger.logError("[cancel-tx] relay call failed: %v", err)
+			r.logger.logDebug("[cancel-tx] rawTx: %s", r.rawTxHex)
 			r.writeRpcError("internal server error", types.JsonRpcInternalError)
 		}
 		return true
@@ -295,13 +382,32 @@ func (r *RpcRequest) handleCancelTx() (requestCompleted bool) {
 	return true
 }
 
+// Relays to cancel a tx at: the relays it was sent to, or all relays if they aren't known
+func (r *RpcRequest) cancelRelays(txHash string) []RelayTarget {
+	lifecycle, found, err := r.state.GetTxLifecycle(r.ctx, strings.ToLower(txHash))
+	if err != nil {
+		r.logger.logError("[cancel-tx] redis:GetTxLifecycle failed: %v", err)
+		return r.relays
+	}
+	if !found {
+		return r.relays
+	}
+	if relays := relaysByName(r.relays, lifecycle.Routing.Relays); len(relays) > 0 {
+		return relays
+	}
+	return r.relays
+}
+
 func (r *RpcRequest) GetAddressNonceRange(address string) (minNonce, maxNonce uint64) {
+	defer r.startSpan("GetAddressNonceRange")()
 	// Get minimum nonce by asking the eth node for the current transaction count
 	_req := types.NewJsonRpcRequest(1, "eth_getTransactionCount", []interface{}{r.txFrom, "latest"})
-	_res, err := utils.SendRpcAndParseResponseTo(r.defaultProxyUrl, _req)
+	ctx, cancel := r.stageContext(r.timeouts.Proxy)
+	defer cancel()
+	_res, err := r.proxyPool.SendRpcAndParseResponse(ctx, _req)
 	if err != nil {
 		r.logger.logError("[sendTxToRelay] eth_getTransactionCount failed: %v", err)
-		r.writeRpcError("internal server error", types.JsonRpcInternalError)
+		r.writeProxyError(err)
 		return
 	}
 	_userNonceStr := ""
@@ -317,7 +423,7 @@ func (r *RpcRequest) GetAddressNonceRange(address string) (minNonce, maxNonce ui
 	minNonce = _userNonceBigInt.Uint64()
 
 	// Get maximum nonce by looking at redis, which has current pending transactions
-	_redisMaxNonce, _, _ := RState.GetSenderMaxNonce(r.txFrom)
+	_redisMaxNonce, _, _ := r.state.GetSenderMaxNonce(r.ctx, r.txFrom)
 	maxNonce = Max(minNonce, _redisMaxNonce)
 	return minNonce, maxNonce
 }
@@ -334,6 +440,59 @@ func (r *RpcRequest) writeRpcError(msg string, errCode int) {
 
 }
 
+// Returns a context for a call to a node, the relay or the tx status API, which ends after the timeout or with the request
+func (r *RpcRequest) stageContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(r.ctx, timeout)
+}
+
+// detachedContext has the values of its parent (e.g. the trace span), but not its deadline and cancellation
+type detachedContext struct {
+	parent context.Context
+}
+
+func (c detachedContext) Deadline() (time.Time, bool)       { return time.Time{}, false }
+func (c detachedContext) Done() <-chan struct{}             { return nil }
+func (c detachedContext) Err() error                        { return nil }
+func (c detachedContext) Value(key interface{}) interface{} { return c.parent.Value(key) }
+
+// If err is because a deadline was exceeded or the request was cancelled, sets the error response and returns true
+func (r *RpcRequest) writeContextError(err error, stage string) bool {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		metricRequestTimeouts.Inc(stage)
+		r.logger.log("[timeout] %s deadline exceeded for %s", stage, r.jsonReq.Method)
+		r.writeRpcError("request timed out", types.JsonRpcTimeout)
+		return true
+	case errors.Is(err, context.Canceled):
+		r.logger.log("[timeout] request cancelled during %s for %s", stage, r.jsonReq.Method)
+		r.writeRpcError("request cancelled", types.JsonRpcInternalError)
+		return true
+	}
+	return false
+}
+
+// Decodes the params into the targets, or sets a -32602 error response and returns false
+func (r *RpcRequest) decodeParams(targets ...interface{}) bool {
+	if err := r.jsonReq.DecodeParams(targets...); err != nil {
+		r.logger.log("invalid params for %s: %v", r.jsonReq.Method, err)
+		r.writeRpcError(err.Error(), types.JsonRpcInvalidParams)
+		return false
+	}
+	return true
+}
+
+// Sets the error response for a failed call to a node
+func (r *RpcRequest) writeProxyError(err error) {
+	if !r.writeContextError(err, "proxy") {
+		r.writeRpcError("internal server error", types.JsonRpcInternalError)
+	}
+}
+
+func (r *RpcRequest) writeRpcErrorWithData(msg string, errCode int, data interface{}) {
+	r.writeRpcError(msg, errCode)
+	r.jsonRes.Error.Data = data
+}
+
 func (r *RpcRequest) writeRpcResult(result interface{}) {
 	resBytes, err := json.Marshal(result)
 	if err != nil {
@@ -347,3 +506,48 @@ func (r *RpcRequest) writeRpcResult(result interface{}) {
 		Result:  resBytes,
 	}
 }
+
+func (r *RpcRequest) isRateLimited() bool {
+	return r.rateLimiter != nil && !r.rateLimiter.IsExempt(r.apiKey)
+}
+
+func (r *RpcRequest) writeRateLimitError(limitType string, retryAfter time.Duration) {
+	metricRateLimited.Inc(metricsMethodLabel(r.jsonReq.Method), limitType)
+	r.writeRpcErrorWithData("rate limit exceeded", types.JsonRpcLimitExceeded, &types.RateLimitErrorData{RetryAfter: retryAfterSeconds(retryAfter)})
+}
+
+// Returns false (and sets the error response) if the ip is over its limit for the method
+func (r *RpcRequest) checkIpRateLimit() bool {
+	if !r.isRateLimited() {
+		return true
+	}
+
+	allowed, retryAfter, err := r.rateLimiter.AllowIp(r.ctx, r.ip, r.jsonReq.Method)
+	if err != nil {
+		r.logger.logError("[rate-limit] ip check failed: %v", err)
+		return true
+	}
+	if !allowed {
+		r.logger.log("[rate-limit] ip %s over limit for %s, retry after %s", r.ip, r.jsonReq.Method, retryAfter)
+		r.writeRateLimitError("ip", retryAfter)
+	}
+	return allowed
+}
+
+// Returns false (and sets the error response) if the tx sender is over its limit for the method
+func (r *RpcRequest) checkSenderRateLimit() bool {
+	if !r.isRateLimited() {
+		return true
+	}
+
+	allowed, retryAfter, err := r.rateLimiter.AllowSender(r.ctx, r.txFrom, r.jsonReq.Method)
+	if err != nil {
+		r.logger.logError("[rate-limit] sender check failed: %v", err)
+		return true
+	}
+	if !allowed {
+		r.logger.log("[rate-limit] sender %s over limit for %s, retry after %s", r.txFrom, r.jsonReq.Method, retryAfter)
+		r.writeRateLimitError("sender", retryAfter)
+	}
+	return allowed
+}
@@ -1,46 +1,67 @@
 package server
 
 import (
+	"context"
+	"crypto/ecdsa"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
-	"github.com/alicebob/miniredis"
 	"github.com/flashbots/rpc-endpoint/testutils"
 	"github.com/flashbots/rpc-endpoint/types"
 	"github.com/stretchr/testify/require"
 )
 
-func setupRedis() {
-	redisServer, err := miniredis.Run()
-	if err != nil {
-		panic(err)
-	}
+// Request deps of a mainnet server with an in-memory state store
+func newTestDeps() *requestDeps {
+	return &requestDeps{
+		state:    NewMemoryState(time.Now),
+		clock:    time.Now,
+		chain:    Chains["mainnet"],
+		timeouts: DefaultRequestTimeouts,
+		inflight: new(sync.WaitGroup),
+
+		txLifecycleRetention: DefaultTxLifecycleRetention,
 
-	RState, err = NewRedisState(redisServer.Addr())
-	if err != nil {
-		panic(err)
+		protectionPolicy: DefaultProtectionPolicy(),
+		ofacList:         BuiltinOFACList(),
 	}
 }
 
-func setupMockTxApi() {
+func setupMockTxApi(t testing.TB, deps *requestDeps) {
 	txApiServer := httptest.NewServer(http.HandlerFunc(testutils.MockTxApiHandler))
-	ProtectTxApiHost = txApiServer.URL
+	t.Cleanup(txApiServer.Close)
+	deps.txStatus = NewProtectTxStatusClient(txApiServer.URL)
 	testutils.MockTxApiReset()
 }
 
-func setServerTimeNowOffset(td time.Duration) {
-	Now = func() time.Time {
-		return time.Now().Add(td)
-	}
+// Records a private tx that was sent to the relay, for the tx tracker
+func fakeTxSent(t *testing.T, deps *requestDeps, txHash string) {
+	ctx := context.Background()
+	err := deps.state.SetTxSentToRelay(ctx, txHash)
+	require.Nil(t, err, err)
+	err = deps.state.UpdateTxLifecycle(ctx, strings.ToLower(txHash), DefaultTxLifecycleRetention, func(lifecycle *types.TxLifecycle, found bool) bool {
+		lifecycle.Hash = strings.ToLower(txHash)
+		lifecycle.CreatedAt = deps.clock()
+		lifecycle.SetStatus(deps.clock(), types.TxStatusSent, types.TxEventSourceRelay, "")
+		return true
+	})
+	require.Nil(t, err, err)
 }
 
 func TestRequestshouldSendTxToRelay(t *testing.T) {
-	setupRedis()
-	setupMockTxApi()
-
-	request := RpcRequest{}
+	ctx := context.Background()
+	clock := &testClock{}
+	deps := newTestDeps()
+	deps.clock = clock.Now
+	deps.state = NewMemoryState(clock.Now)
+	setupMockTxApi(t, deps)
+	tracker := newTxTracker(TxTrackerConfig{}, deps, nil, NewLogger(""))
+
+	request := RpcRequest{requestDeps: deps, ctx: ctx, logger: NewLogger("")}
 	txHash := "0x0Foo"
 
 	// SEND when not seen before
@@ -48,33 +69,32 @@ func TestRequestshouldSendTxToRelay(t *testing.T) {
 	require.True(t, shouldSend)
 
 	// Fake a previous send
-	err := RState.SetTxSentToRelay(txHash)
-	require.Nil(t, err, err)
+	fakeTxSent(t, deps, txHash)
 
 	// Ensure tx status is UNKNOWN
-	txStatusApiResponse, err := GetTxStatus(txHash)
+	lifecycle, _, err := tracker.lookup(txHash)
 	require.Nil(t, err, err)
-	require.Equal(t, types.TxStatusUnknown, txStatusApiResponse.Status)
+	require.Equal(t, types.TxStatusUnknown, lifecycle.Status)
 
 	// NOT SEND when unknown and time since sent < 5 min
 	shouldSend = !request.blockResendingTxToRelay(txHash)
 	require.False(t, shouldSend)
 
 	// Set tx status to Failed
-	testutils.MockTxApiStatusForHash[txHash] = types.TxStatusFailed
-	txStatusApiResponse, err = GetTxStatus(txHash)
+	testutils.MockTxApiSetStatus(txHash, types.TxStatusFailed)
+	lifecycle, _, err = tracker.lookup(txHash)
 	require.Nil(t, err, err)
-	require.Equal(t, types.TxStatusFailed, txStatusApiResponse.Status)
+	require.Equal(t, types.TxStatusFailed, lifecycle.Status)
 
 	// SEND if failed
 	shouldSend = !request.blockResendingTxToRelay(txHash)
 	require.True(t, shouldSend)
 
 	// Set tx status to pending
-	testutils.MockTxApiStatusForHash[txHash] = types.TxStatusPending
-	txStatusApiResponse, err = GetTxStatus(txHash)
+	testutils.MockTxApiSetStatus(txHash, types.TxStatusPending)
+	lifecycle, _, err = tracker.lookup(txHash)
 	require.Nil(t, err, err)
-	require.Equal(t, types.TxStatusPending, txStatusApiResponse.Status)
+	require.Equal(t, types.TxStatusPending, lifecycle.Status)
 
 	// NOT SEND if pending
 	shouldSend = !request.blockResendingTxToRelay(txHash)
@@ -84,22 +104,67 @@ func TestRequestshouldSendTxToRelay(t *testing.T) {
 	// SEND if UNKNOWN and 5 minutes have passed
 	//
 	txHash = "0x0DeadBeef"
-	setServerTimeNowOffset(time.Minute * -6)
-	defer setServerTimeNowOffset(0)
-
-	err = RState.SetTxSentToRelay(txHash)
-	require.Nil(t, err, err)
+	clock.Set(time.Now().Add(time.Minute * -6))
+	fakeTxSent(t, deps, txHash)
+	clock.Set(time.Time{})
 
-	timeSent, found, err := RState.GetTxSentToRelay(txHash)
+	timeSent, found, err := deps.state.GetTxSentToRelay(ctx, txHash)
 	require.Nil(t, err, err)
 	require.True(t, found)
 	require.True(t, time.Since(timeSent) > time.Minute*4)
 
 	// Ensure tx status is UNKNOWN
-	txStatusApiResponse, err = GetTxStatus(txHash)
+	lifecycle, _, err = tracker.lookup(txHash)
 	require.Nil(t, err, err)
-	require.Equal(t, types.TxStatusUnknown, txStatusApiResponse.Status)
+	require.Equal(t, types.TxStatusUnknown, lifecycle.Status)
+
+	shouldSend = !request.blockResendingTxToRelay(txHash)
+	require.True(t, shouldSend)
 
+	// The status isn't looked up on the request path
+	testutils.MockTxApiSetStatus(txHash, types.TxStatusPending)
 	shouldSend = !request.blockResendingTxToRelay(txHash)
 	require.True(t, shouldSend)
 }
+
+// State store which cancels the request once the tx is marked as sent
+type cancelOnMarkState struct {
+	StateStore
+	cancel context.CancelFunc
+}
+
+func (s cancelOnMarkState) MarkTxSentToRelay(ctx context.Context, txHash string, prevTimeSent time.Time) (bool, error) {
+	defer s.cancel()
+	return s.StateStore.MarkTxSentToRelay(ctx, txHash, prevTimeSent)
+}
+
+// Relay client which records the context error of the sent tx
+type testRelayClient struct {
+	RelayClient
+	sent   bool
+	ctxErr error
+}
+
+func (c *testRelayClient) SendPrivateTransaction(ctx context.Context, privKey *ecdsa.PrivateKey, param types.SendPrivateTransactionRequest) (string, error) {
+	c.sent, c.ctxErr = true, ctx.Err()
+	return "", nil
+}
+
+// A tx marked as sent is sent to the relay even if the client disconnects, otherwise its resends would be blocked
+func TestSendTxToRelayAfterClientDisconnect(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	deps := newTestDeps()
+	deps.state = cancelOnMarkState{deps.state, cancel}
+	relay := &testRelayClient{}
+	deps.relays = []RelayTarget{{Name: "test", Client: relay}}
+	node := httptest.NewServer(http.HandlerFunc(testutils.RpcBackendHandler))
+	defer node.Close()
+
+	jsonReq := types.NewJsonRpcRequest(1, "eth_sendRawTransaction", []interface{}{testutils.TestTx_BundleFailedTooManyTimes_RawTx})
+	res := NewRpcRequest(ctx, deps, NewLogger(""), jsonReq, NewProxyPool([]string{node.URL}, ProxyPoolConfig{}), "127.0.0.1", "", "").ProcessRequest()
+	require.Nil(t, res.Error)
+	require.True(t, relay.sent)
+	require.Nil(t, relay.ctxErr)
+	require.NotNil(t, ctx.Err())
+}
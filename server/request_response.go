@@ -3,6 +3,7 @@ package server
 import (
 	"encoding/json"
 	"net/http"
+	"strconv"
 
 	"github.com/flashbots/rpc-endpoint/types"
 )
@@ -26,11 +27,16 @@ func (r *RpcRequestHandler) _writeRpcResponse(res *types.JsonRpcResponse) {
 	if res.Error != nil {
 		// TODO(Note): http.StatusUnauthorized is not mapped
 		switch res.Error.Code {
-		case types.JsonRpcInvalidRequest, types.JsonRpcInvalidParams:
+		case types.JsonRpcParseError, types.JsonRpcInvalidRequest, types.JsonRpcInvalidParams, types.JsonRpcInvalidInput:
 			statusCode = http.StatusBadRequest
 		case types.JsonRpcMethodNotFound:
 			statusCode = http.StatusNotFound
-		case types.JsonRpcInternalError, types.JsonRpcParseError:
+		case types.JsonRpcLimitExceeded:
+			statusCode = http.StatusTooManyRequests
+			if data, ok := res.Error.Data.(*types.RateLimitErrorData); ok {
+				(*r.respw).Header().Set("Retry-After", strconv.FormatInt(data.RetryAfter, 10))
+			}
+		case types.JsonRpcInternalError:
 			statusCode = http.StatusInternalServerError
 		default:
 			statusCode = http.StatusInternalServerError
@@ -1,11 +1,12 @@
 package server
 
 import (
-	"encoding/hex"
+	"context"
 	"fmt"
 	"github.com/flashbots/rpc-endpoint/types"
 	"strings"
 
+	"github.com/ethereum/go-ethereum/common"
 	ethtypes "github.com/ethereum/go-ethereum/core/types"
 	"github.com/flashbots/rpc-endpoint/utils"
 )
@@ -14,33 +15,32 @@ func (r *RpcRequest) handle_sendRawTransaction() {
 	var err error
 
 	// JSON-RPC sanity checks
-	if len(r.jsonReq.Params) < 1 {
-		r.logger.log("no params for eth_sendRawTransaction")
-		r.writeRpcError("empty params for eth_sendRawTransaction", types.JsonRpcInvalidParams)
+	if !r.decodeParams(&r.rawTxHex) {
 		return
 	}
 
-	if r.jsonReq.Params[0] == nil {
-		r.logger.log("nil param for eth_sendRawTransaction")
-		r.writeRpcError("nil params for eth_sendRawTransaction", types.JsonRpcInvalidParams)
-	}
-
-	r.rawTxHex = r.jsonReq.Params[0].(string)
 	if len(r.rawTxHex) < 2 {
 		r.logger.logError("invalid raw transaction (wrong length)")
 		r.writeRpcError("invalid raw transaction param (wrong length)", types.JsonRpcInvalidParams)
 		return
 	}
 
-	r.logger.log("rawTx: %s", r.rawTxHex)
+	r.logger.logDebug("rawTx: %s", r.rawTxHex)
 
 	r.tx, err = GetTx(r.rawTxHex)
 	if err != nil {
-		r.logger.log("reading transaction object failed - rawTx: %s", r.rawTxHex)
+		r.logger.logWarn("reading transaction object failed - rawTx: %s", r.rawTxHex)
 		r.writeRpcError(fmt.Sprintf("reading transaction object failed - rawTx: %s", r.rawTxHex), types.JsonRpcInvalidRequest)
 		return
 	}
 
+	// Reject txs signed for another chain before they are sent anywhere
+	if !r.chain.AllowsTxChainId(r.tx.ChainId()) {
+		r.logger.log("tx rejected - wrong chain id: %s (expected %d)", r.tx.ChainId(), r.chain.ChainId)
+		r.writeRpcError(fmt.Sprintf("invalid chain id %s for this network, expected %d", r.tx.ChainId(), r.chain.ChainId), types.JsonRpcInvalidParams)
+		return
+	}
+
 	// Get tx from address
 	r.txFrom, err = GetSenderFromRawTx(r.tx)
 	if err != nil {
@@ -49,6 +49,7 @@ func (r *RpcRequest) handle_sendRawTransaction() {
 		return
 	}
 
+	r.logger = r.logger.With("txHash", r.tx.Hash().Hex()).With("from", r.txFrom)
 	r.logger.log("txHash: %s - from: %s / to: %s / nonce: %d / gasPrice: %s", r.tx.Hash(), r.txFrom, utils.AddressPtrToStr(r.tx.To()), r.tx.Nonce(), utils.BigIntPtrToStr(r.tx.GasPrice()))
 	txFromLower := strings.ToLower(r.txFrom)
 
@@ -61,19 +62,30 @@ func (r *RpcRequest) handle_sendRawTransaction() {
 	txHashLower := strings.ToLower(r.tx.Hash().Hex())
 
 	// Remember sender of the tx, for lookup in getTransactionReceipt to possibly set nonce-fix
-	err = RState.SetSenderOfTxHash(txHashLower, txFromLower)
+	err = r.state.SetSenderOfTxHash(r.ctx, txHashLower, txFromLower)
 	if err != nil {
 		r.logger.logError("redis:SetSenderOfTxHash failed: %v", err)
 	}
 
-	if isOnOFACList(r.txFrom) {
+	if !r.checkSenderRateLimit() {
+		return
+	}
+
+	if r.isOnOFACList(common.HexToAddress(r.txFrom)) {
 		r.logger.log("BLOCKED TX FROM OFAC SANCTIONED ADDRESS")
 		r.writeRpcError("blocked tx from ofac sanctioned address", types.JsonRpcInvalidRequest)
 		return
 	}
 
+	if r.tx.To() != nil && r.isOnOFACList(*r.tx.To()) {
+		r.logger.log("BLOCKED TX TO OFAC SANCTIONED ADDRESS")
+		r.writeRpcError("blocked tx to ofac sanctioned address", types.JsonRpcInvalidRequest)
+		return
+	}
+
 	// Check if transaction needs protection
-	needsProtection := r.doesTxNeedFrontrunningProtection(r.tx)
+	r.protectionDecision = r.doesTxNeedFrontrunningProtection(r.tx)
+	needsProtection := r.protectionDecision.NeedsProtection
 
 	// Check for cancellation-tx
 	if len(r.tx.Data()) <= 2 && txFromLower == strings.ToLower(r.tx.To().Hex()) {
@@ -88,28 +100,35 @@ func (r *RpcRequest) handle_sendRawTransaction() {
 	}
 
 	if needsProtection {
+		metricTxRouting.Inc("relay")
 		r.sendTxToRelay()
 		return
 	}
 
-	if DebugDontSendTx {
+	metricTxRouting.Inc("mempool")
+
+	if r.debugDontSendTx {
 		r.logger.log("faked sending tx to mempool, did nothing")
 		r.writeRpcResult(r.tx.Hash().Hex())
 		return
 	}
 
 	// Proxy to public node now
-	readJsonRpcSuccess := r.proxyRequestRead(r.defaultProxyUrl)
+	err = r.proxyRequestRead()
 
 	// Log after proxying
-	if !readJsonRpcSuccess {
+	if err != nil {
 		r.logger.logError("Proxy to mempool failed: eth_sendRawTransaction")
-		r.writeRpcError("internal server error", types.JsonRpcInternalError)
+		r.writeProxyError(err)
 		return
 	}
 
 	// at the end, save the nonce for further spam protection checks
-	go RState.SetSenderMaxNonce(txFromLower, r.tx.Nonce())
+	r.inflight.Add(1)
+	go func() {
+		defer r.inflight.Done()
+		r.state.SetSenderMaxNonce(context.Background(), txFromLower, r.tx.Nonce()) // outlives the request
+	}()
 
 	if r.jsonRes.Error != nil {
 		r.logger.log("Proxied eth_sendRawTransaction to mempool - with JSON-RPC Error %s", r.jsonRes.Error.Message)
@@ -119,28 +138,30 @@ func (r *RpcRequest) handle_sendRawTransaction() {
 }
 
 // Check if a request needs frontrunning protection. There are many transactions that don't need frontrunning protection,
-// for example simple ERC20 transfers.
-func (r *RpcRequest) doesTxNeedFrontrunningProtection(tx *ethtypes.Transaction) bool {
-	gas := tx.Gas()
-	r.logger.log("[protect-check] gas: %v", gas)
+// for example simple ERC20 transfers. The decision is made by the current protection policy of the server (see policy.go).
+func (r *RpcRequest) doesTxNeedFrontrunningProtection(tx *ethtypes.Transaction) PolicyDecision {
+	r.logger.log("[protect-check] gas: %v", tx.Gas())
 
-	// Flashbots Relay will reject anything less than 42000 gas, so we just send those to the mempool
-	// Anyway things with that low of gas probably don't need frontrunning protection regardless
-	if gas < 42000 {
-		return false
+	decision := r.currentProtectionPolicy().Evaluate(tx)
+	if !decision.NeedsProtection && !r.prefs.MempoolFallback {
+		decision = PolicyDecision{NeedsProtection: true, Action: PolicyActionProtect, Rule: "user-no-mempool-fallback"}
 	}
+	r.logger.log("[protect-check] action: %s - rule: %s", decision.Action, decision.Rule)
+	return decision
+}
 
-	data := hex.EncodeToString(tx.Data())
-	r.logger.log("[protect-check] tx-data: %v", data)
-
-	if len(data) < 8 {
-		return false
+// Debug helper: returns the protection policy decision for a raw transaction, without sending it anywhere
+func (r *RpcRequest) handle_debugProtectionDecision() {
+	var rawTxHex string
+	if !r.decodeParams(&rawTxHex) {
+		return
 	}
 
-	if isOnFunctionWhiteList(data[0:8]) {
-		return false // function being called is on our whitelist and no protection needed
-	} else {
-		r.logger.log("[protect-check] tx needs protection - function: %v", data[0:8])
-		return true // needs protection if not on whitelist
+	tx, err := GetTx(rawTxHex)
+	if err != nil {
+		r.writeRpcError(err.Error(), types.JsonRpcInvalidParams)
+		return
 	}
+
+	r.writeRpcResult(r.doesTxNeedFrontrunningProtection(tx))
 }
@@ -1,106 +1,295 @@
 package server
 
 import (
-	"crypto/ecdsa"
+	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	_ "net/http/pprof"
 
-	"github.com/alicebob/miniredis"
+	"github.com/flashbots/rpc-endpoint/metrics"
 	"github.com/flashbots/rpc-endpoint/types"
-	"github.com/metachris/flashbotsrpc"
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/websocket"
 	"github.com/pkg/errors"
 )
 
-var Now = time.Now // used to mock time in tests
-
-var DebugDontSendTx = os.Getenv("DEBUG_DONT_SEND_RAWTX") != ""
-
 // No IPs blacklisted right now
 var blacklistedIps = []string{"127.0.0.2"}
 
-// Metamask fix helper
-var RState *RedisState
-
-var FlashbotsRPC *flashbotsrpc.FlashbotsRPC
+// Requests with an allowlisted API key in this header are exempt from rate limits
+const ApiKeyHeader = "X-Api-Key"
 
 func init() {
 	log.SetOutput(os.Stdout)
 }
 
 type RpcEndPointServer struct {
-	version         string
-	startTime       time.Time
-	listenAddress   string
-	proxyUrl        string
-	relaySigningKey *ecdsa.PrivateKey
+	version            string
+	startTime          time.Time
+	listenAddress      string
+	proxyPool          *ProxyPool
+	wsProxyUrl         string
+	adminApiKey        string
+	logger             Logger
+	shutdownDrainDelay time.Duration
+	shutdownTimeout    time.Duration
+
+	*requestDeps
+	inflightRequests sync.WaitGroup
+
+	httpServer *http.Server
+	draining   int32 // set atomically when shutdown begins
+
+	wsConnsMu sync.Mutex
+	wsConns   map[*wsConnection]bool
 }
 
-func NewRpcEndPointServer(version string, listenAddress, proxyUrl, relayUrl string, relaySigningKey *ecdsa.PrivateKey, redisUrl string) (*RpcEndPointServer, error) {
+func NewRpcEndPointServer(config RpcEndPointServerConfig) (*RpcEndPointServer, error) {
 	var err error
 
-	if DebugDontSendTx {
-		log.Println("DEBUG MODE: raw transactions will not be sent out!")
+	if len(config.ProxyUrls) == 0 {
+		return nil, errors.New("no proxy urls")
+	}
+	if config.StateStore == nil {
+		return nil, errors.New("no state store")
+	}
+
+	if config.Chain.ChainId == 0 {
+		config.Chain = Chains["mainnet"]
+	}
+	if err = config.Chain.Validate(); err != nil {
+		return nil, err
+	}
+	if err = ValidateSimulationMode(config.SimulationMode); err != nil {
+		return nil, err
+	}
+	if config.Clock == nil {
+		config.Clock = time.Now
+	}
+	if config.Logger == nil {
+		config.Logger = NewLogger("")
+	}
+	if len(config.Relays) == 0 {
+		relayClient := NewFlashbotsRelayClient(config.Chain.RelayUrl)
+		relayClient.Logger = config.Logger
+		config.Relays = []RelayTarget{{Name: DefaultRelayName, Client: relayClient}}
+	}
+	if config.TxStatusClient == nil {
+		config.TxStatusClient = NewProtectTxStatusClient(config.Chain.ProtectTxApiHost)
+	}
+	if config.ProtectionPolicy == nil {
+		config.ProtectionPolicy = DefaultProtectionPolicy()
+	}
+	if config.OFACList == nil {
+		config.OFACList = BuiltinOFACList()
+	}
+	if config.ProxyPool.Logger == nil {
+		config.ProxyPool.Logger = config.Logger
+	}
+	if config.TxLifecycleRetention == 0 {
+		config.TxLifecycleRetention = DefaultTxLifecycleRetention
+	}
+	if config.ShutdownTimeout == 0 {
+		config.ShutdownTimeout = DefaultShutdownTimeout
+	}
+
+	if config.DebugDontSendTx {
+		config.Logger.log("DEBUG MODE: raw transactions will not be sent out!")
+	}
+
+	s := &RpcEndPointServer{
+		startTime:          config.Clock(),
+		version:            config.Version,
+		listenAddress:      config.ListenAddress,
+		proxyPool:          NewProxyPool(config.ProxyUrls, config.ProxyPool),
+		wsProxyUrl:         config.WsProxyUrl,
+		adminApiKey:        config.AdminApiKey,
+		logger:             config.Logger,
+		shutdownDrainDelay: config.ShutdownDrainDelay,
+		shutdownTimeout:    config.ShutdownTimeout,
+		wsConns:            make(map[*wsConnection]bool),
+	}
+	s.requestDeps = &requestDeps{
+		state:           config.StateStore,
+		relays:          config.Relays,
+		txStatus:        config.TxStatusClient,
+		clock:           config.Clock,
+		chain:           config.Chain,
+		relaySigningKey: config.RelaySigningKey,
+		simulationMode:  config.SimulationMode,
+		debugDontSendTx: config.DebugDontSendTx,
+		timeouts:        config.Timeouts.withDefaults(),
+		inflight:        &s.inflightRequests,
+
+		txLifecycleRetention: config.TxLifecycleRetention,
+
+		protectionPolicy: config.ProtectionPolicy,
+		ofacList:         config.OFACList,
+
+		customProxyPolicy: config.CustomProxy.withDefaults(),
+		customProxyClient: NewCustomProxyClient(config.CustomProxy),
+	}
+
+	s.txTracker = newTxTracker(config.TxTracker, s.requestDeps, s.proxyPool, config.Logger)
+
+	// Rate limits and the shared response cache use Redis directly if the state is kept there
+	var redisClient redis.UniversalClient
+	if redisState, ok := config.StateStore.(*RedisState); ok {
+		redisClient = redisState.RedisClient
 	}
 
-	if redisUrl == "dev" {
-		log.Println("Using integrated in-memory Redis instance")
-		redisServer, err := miniredis.Run()
+	if config.ResponseCacheSize > 0 {
+		var cacheRedisClient redis.UniversalClient
+		if config.ResponseCacheRedis {
+			if redisClient == nil {
+				return nil, errors.New("sharing the response cache requires the redis state backend")
+			}
+			cacheRedisClient = redisClient
+		}
+		s.cache, err = NewResponseCache(config.ResponseCacheSize, cacheRedisClient, config.Chain.ChainId, config.Clock)
 		if err != nil {
-			return nil, err
+			return nil, errors.Wrap(err, "response cache init error")
 		}
-		redisUrl = redisServer.Addr()
 	}
 
-	// Setup redis connection
-	log.Println("Connecting to redis at", redisUrl, "...")
-	RState, err = NewRedisState(redisUrl)
-	if err != nil {
-		return nil, errors.Wrap(err, "Redis init error")
+	if config.RateLimits != nil {
+		s.rateLimiter = NewRateLimiter(redisClient, config.RateLimits, config.Clock)
 	}
 
-	FlashbotsRPC = flashbotsrpc.New(relayUrl)
-	FlashbotsRPC.Debug = true
-
-	return &RpcEndPointServer{
-		startTime:       Now(),
-		version:         version,
-		listenAddress:   listenAddress,
-		proxyUrl:        proxyUrl,
-		relaySigningKey: relaySigningKey,
-	}, nil
+	// Created here, so Shutdown doesn't race with Serve
+	s.httpServer = &http.Server{Handler: s.Handler()}
+	return s, nil
 }
 
+// Start serves requests until SIGINT or SIGTERM is received, and then shuts down gracefully
 func (s *RpcEndPointServer) Start() {
-	log.Printf("Starting rpc endpoint %s at %v...", s.version, s.listenAddress)
+	s.logger.log("Starting rpc endpoint %s at %v (%s)...", s.version, s.listenAddress, s.chain.Name)
 
 	// Regularly log debug info
 	go func() {
 		for {
-			log.Printf("num-goroutines: %d", runtime.NumGoroutine())
+			s.logger.log("num-goroutines: %d", runtime.NumGoroutine())
 			time.Sleep(10 * time.Second)
 		}
 	}()
 
-	// Handler for root URL (JSON-RPC on POST, public/index.html on GET)
-	http.HandleFunc("/", http.HandlerFunc(s.HandleHttpRequest))
-	http.HandleFunc("/health", http.HandlerFunc(s.handleHealthRequest))
+	// Regularly check health of the proxy nodes
+	go s.proxyPool.StartHealthChecks()
 
-	// Start serving
-	if err := http.ListenAndServe(s.listenAddress, nil); err != nil {
+	listener, err := net.Listen("tcp", s.listenAddress)
+	if err != nil {
 		log.Fatalf("Failed to start rpc endpoint: %v", err)
 	}
+
+	go func() {
+		if err := s.Serve(listener); err != nil {
+			log.Fatalf("Failed to start rpc endpoint: %v", err)
+		}
+	}()
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-sigCh
+	s.logger.log("Received %s, shutting down...", sig)
+	s.Shutdown()
+}
+
+// Handler returns the mux with all endpoints
+func (s *RpcEndPointServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+
+	// Handler for root URL (JSON-RPC on POST, public/index.html on GET)
+	mux.HandleFunc("/", http.HandlerFunc(s.HandleHttpRequest))
+	mux.HandleFunc("/health", http.HandlerFunc(s.handleHealthRequest))
+	mux.Handle("/metrics", metrics.Handler())
+	mux.HandleFunc("/admin/ofac", s.requireAdminApiKey(s.handleOFACListRequest))
+	mux.HandleFunc("/tx/", http.HandlerFunc(s.handleTxLifecycleRequest))
+	mux.Handle("/debug/pprof/", http.DefaultServeMux) // registered by net/http/pprof
+	return mux
+}
+
+// Serve blocks until the listener fails or Shutdown is called. It returns right away if Shutdown was called already.
+func (s *RpcEndPointServer) Serve(listener net.Listener) error {
+	if err := s.httpServer.Serve(listener); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+func (s *RpcEndPointServer) IsDraining() bool {
+	return atomic.LoadInt32(&s.draining) == 1
+}
+
+// Shutdown reports draining in /health, stops accepting connections after the drain delay, waits for in-flight
+// requests up to the shutdown timeout and closes the state store.
+func (s *RpcEndPointServer) Shutdown() {
+	if !atomic.CompareAndSwapInt32(&s.draining, 0, 1) {
+		return
+	}
+
+	s.logger.log("Draining for %s...", s.shutdownDrainDelay)
+	time.Sleep(s.shutdownDrainDelay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.shutdownTimeout)
+	defer cancel()
+
+	// Stop accepting connections, and wait for HTTP requests to finish
+	if err := s.httpServer.Shutdown(ctx); err != nil {
+		s.logger.logError("HTTP server shutdown error: %v", err)
+	}
+
+	// WebSocket connections are hijacked, so the HTTP server doesn't know about them
+	s.wsConnsMu.Lock()
+	for c := range s.wsConns {
+		c.stopReading()
+	}
+	s.wsConnsMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.inflightRequests.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		s.logger.log("All in-flight requests finished")
+	case <-ctx.Done():
+		s.logger.log("Shutdown timeout, abandoning in-flight requests")
+	}
+
+	// Background writes to the state store are done when the tx tracker stopped
+	s.txTracker.Stop()
+
+	if err := s.state.Close(); err != nil {
+		s.logger.logError("State store close error: %v", err)
+	}
 }
 
 func (s *RpcEndPointServer) HandleHttpRequest(respw http.ResponseWriter, req *http.Request) {
+	s.inflightRequests.Add(1)
+	defer s.inflightRequests.Done()
+
 	respw.Header().Set("Access-Control-Allow-Origin", "*")
-	respw.Header().Set("Access-Control-Allow-Headers", "Accept,Content-Type")
+	respw.Header().Set("Access-Control-Allow-Headers", "Accept,Content-Type,"+ApiKeyHeader+","+RequestIdHeader)
+	respw.Header().Set("Access-Control-Expose-Headers", RequestIdHeader)
+
+	if websocket.IsWebSocketUpgrade(req) {
+		s.handleWebSocket(respw, req)
+		return
+	}
 
 	if req.Method == "GET" {
 		http.Redirect(respw, req, "https://docs.flashbots.net/flashbots-protect/rpc/quick-start/", http.StatusFound)
@@ -112,20 +301,65 @@ func (s *RpcEndPointServer) HandleHttpRequest(respw http.ResponseWriter, req *ht
 		return
 	}
 
-	request := NewRpcRequestHandler(&respw, req, s.proxyUrl, s.relaySigningKey)
+	request := NewRpcRequestHandler(s.requestDeps, s.logger, &respw, req, s.proxyPool)
 	request.process()
 }
 
 func (s *RpcEndPointServer) handleHealthRequest(respw http.ResponseWriter, req *http.Request) {
 	res := types.HealthResponse{
-		Now:       Now(),
+		Now:       s.clock(),
 		StartTime: s.startTime,
 		Version:   s.version,
+		Status:    "ok",
+	}
+
+	status := http.StatusOK
+	if s.IsDraining() {
+		res.Status = "draining"
+		status = http.StatusServiceUnavailable
+	}
+
+	jsonResp, err := json.Marshal(res)
+	if err != nil {
+		s.logger.logError("healthCheck json error: %v", err)
+		respw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	respw.Header().Set("Content-Type", "application/json")
+	respw.WriteHeader(status)
+	respw.Write(jsonResp)
+}
+
+// requireAdminApiKey only passes requests with the admin API key as bearer token. Admin endpoints are not found if
+// there is no admin API key.
+func (s *RpcEndPointServer) requireAdminApiKey(handler http.HandlerFunc) http.HandlerFunc {
+	return func(respw http.ResponseWriter, req *http.Request) {
+		if s.adminApiKey == "" {
+			http.NotFound(respw, req)
+			return
+		}
+		token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.adminApiKey)) != 1 {
+			respw.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		handler(respw, req)
+	}
+}
+
+func (s *RpcEndPointServer) handleOFACListRequest(respw http.ResponseWriter, req *http.Request) {
+	list := s.currentOFACList()
+	res := types.OFACListResponse{
+		Version:  list.Version,
+		Entries:  list.Len(),
+		Invalid:  list.Invalid,
+		LoadedAt: list.LoadedAt,
 	}
 
 	jsonResp, err := json.Marshal(res)
 	if err != nil {
-		log.Println("healthCheck json error:", err)
+		s.logger.logError("ofac list json error: %v", err)
 		respw.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -0,0 +1,234 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/flashbots/rpc-endpoint/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGracefulShutdown(t *testing.T) {
+	// Slow proxy node, to have a request in flight when shutdown begins
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		time.Sleep(500 * time.Millisecond)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x22"}`))
+	}))
+	defer node.Close()
+
+	key, err := crypto.GenerateKey()
+	require.Nil(t, err, err)
+	state := NewMemoryState(time.Now)
+	s, err := NewRpcEndPointServer(RpcEndPointServerConfig{
+		Version:            "test",
+		ProxyUrls:          []string{node.URL},
+		RelaySigningKey:    key,
+		StateStore:         state,
+		ShutdownDrainDelay: 200 * time.Millisecond,
+		ShutdownTimeout:    5 * time.Second,
+	})
+	require.Nil(t, err, err)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err, err)
+	url := "http://" + listener.Addr().String()
+	go s.Serve(listener)
+
+	getHealth := func() (int, types.HealthResponse) {
+		resp, err := http.Get(url + "/health")
+		require.Nil(t, err, err)
+		defer resp.Body.Close()
+		var health types.HealthResponse
+		err = json.NewDecoder(resp.Body).Decode(&health)
+		require.Nil(t, err, err)
+		return resp.StatusCode, health
+	}
+
+	code, health := getHealth()
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "ok", health.Status)
+
+	// Request which is still in flight when the listener is closed
+	type result struct {
+		res *types.JsonRpcResponse
+		err error
+	}
+	resCh := make(chan result, 1)
+	go func() {
+		body, _ := json.Marshal(types.NewJsonRpcRequest(1, "eth_getTransactionCount", []interface{}{"0x7AaBc7915DF92a85E199DbB4B1D21E637e1a90A2", "latest"}))
+		resp, err := http.Post(url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			resCh <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		res := new(types.JsonRpcResponse)
+		err = json.NewDecoder(resp.Body).Decode(res)
+		resCh <- result{res, err}
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	shutdownDone := make(chan struct{})
+	go func() {
+		s.Shutdown()
+		close(shutdownDone)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// Load balancers see draining while the listener is still open
+	code, health = getHealth()
+	require.Equal(t, http.StatusServiceUnavailable, code)
+	require.Equal(t, "draining", health.Status)
+
+	inflight := <-resCh
+	require.Nil(t, inflight.err, inflight.err)
+	require.Nil(t, inflight.res.Error)
+	require.Equal(t, `"0x22"`, string(inflight.res.Result))
+
+	select {
+	case <-shutdownDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown did not finish")
+	}
+
+	// Listener and state store are closed
+	_, err = http.Get(url + "/health")
+	require.NotNil(t, err)
+	require.Equal(t, ErrStateStoreClosed, state.SetTxSentToRelay(context.Background(), "foo"))
+}
+
+// A shutdown before Serve runs still stops the HTTP server
+func TestShutdownBeforeServe(t *testing.T) {
+	s, err := NewRpcEndPointServer(RpcEndPointServerConfig{
+		ProxyUrls:  []string{"http://localhost:8545"},
+		StateStore: NewMemoryState(time.Now),
+	})
+	require.Nil(t, err, err)
+	s.Shutdown()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err, err)
+	defer listener.Close()
+	require.Nil(t, s.Serve(listener))
+}
+
+func TestMultipleServers(t *testing.T) {
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x22"}`))
+	}))
+	defer node.Close()
+
+	newServer := func(chain string, state StateStore) *RpcEndPointServer {
+		s, err := NewRpcEndPointServer(RpcEndPointServerConfig{
+			ProxyUrls:  []string{node.URL},
+			Chain:      Chains[chain],
+			StateStore: state,
+			Logger:     NewLogger(chain),
+		})
+		require.Nil(t, err, err)
+		return s
+	}
+
+	goerliState, sepoliaState := NewMemoryState(time.Now), NewMemoryState(time.Now)
+	goerli := httptest.NewServer(newServer("goerli", goerliState).Handler())
+	defer goerli.Close()
+	sepolia := httptest.NewServer(newServer("sepolia", sepoliaState).Handler())
+	defer sepolia.Close()
+
+	netVersion := func(url string) string {
+		body, _ := json.Marshal(types.NewJsonRpcRequest(1, "net_version", nil))
+		resp, err := http.Post(url, "application/json", bytes.NewReader(body))
+		require.Nil(t, err, err)
+		defer resp.Body.Close()
+		res := new(types.JsonRpcResponse)
+		err = json.NewDecoder(resp.Body).Decode(res)
+		require.Nil(t, err, err)
+		return string(res.Result)
+	}
+	require.Equal(t, `"5"`, netVersion(goerli.URL))
+	require.Equal(t, `"11155111"`, netVersion(sepolia.URL))
+
+	// Each server has its own state
+	err := goerliState.SetSenderMaxNonce(context.Background(), "0x0Sender", 3)
+	require.Nil(t, err, err)
+	_, found, err := sepoliaState.GetSenderMaxNonce(context.Background(), "0x0Sender")
+	require.Nil(t, err, err)
+	require.False(t, found)
+}
+
+func TestNewRpcEndPointServerConfig(t *testing.T) {
+	_, err := NewRpcEndPointServer(RpcEndPointServerConfig{ProxyUrls: []string{"http://localhost:8545"}})
+	require.NotNil(t, err) // no state store
+
+	_, err = NewRpcEndPointServer(RpcEndPointServerConfig{StateStore: NewMemoryState(time.Now)})
+	require.NotNil(t, err) // no proxy urls
+
+	_, err = NewRpcEndPointServer(RpcEndPointServerConfig{ProxyUrls: []string{"http://localhost:8545"}, StateStore: NewMemoryState(time.Now), Chain: ChainConfig{Name: "1337", ChainId: 1337}})
+	require.NotNil(t, err) // custom chain without relay
+
+	s, err := NewRpcEndPointServer(RpcEndPointServerConfig{ProxyUrls: []string{"http://localhost:8545"}, StateStore: NewMemoryState(time.Now)})
+	require.Nil(t, err, err)
+	require.Equal(t, uint64(1), s.chain.ChainId)
+	require.Equal(t, DefaultShutdownTimeout, s.shutdownTimeout)
+	require.Equal(t, DefaultProxyPoolConfig.HealthCheckInterval, s.proxyPool.config.HealthCheckInterval)
+	require.Equal(t, DefaultProxyPoolConfig.MaxBlockLag, s.proxyPool.config.MaxBlockLag)
+	require.Equal(t, s.logger, s.proxyPool.config.Logger)
+	require.Equal(t, DefaultTxLifecycleRetention, s.txLifecycleRetention)
+	require.Equal(t, "https://protect.flashbots.net", s.txStatus.(*ProtectTxStatusClient).ApiHost)
+}
+
+func TestRequestTimeout(t *testing.T) {
+	nodeCancelled := make(chan struct{}, 1)
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ioutil.ReadAll(req.Body) // the context is cancelled on disconnect only once the body was read
+		<-req.Context().Done()
+		nodeCancelled <- struct{}{}
+	}))
+	defer node.Close()
+
+	s, err := NewRpcEndPointServer(RpcEndPointServerConfig{
+		ProxyUrls:  []string{node.URL},
+		StateStore: NewMemoryState(time.Now),
+		Timeouts:   RequestTimeouts{Proxy: 100 * time.Millisecond},
+	})
+	require.Nil(t, err, err)
+	srv := httptest.NewServer(s.Handler())
+	defer srv.Close()
+
+	// The proxy deadline is exceeded
+	body, _ := json.Marshal(types.NewJsonRpcRequest(1, "eth_blockNumber", nil))
+	resp, err := http.Post(srv.URL, "application/json", bytes.NewReader(body))
+	require.Nil(t, err, err)
+	defer resp.Body.Close()
+	res := new(types.JsonRpcResponse)
+	err = json.NewDecoder(resp.Body).Decode(res)
+	require.Nil(t, err, err)
+	require.NotNil(t, res.Error)
+	require.Equal(t, types.JsonRpcTimeout, res.Error.Code)
+	<-nodeCancelled
+
+	// When the client goes away, the request to the node is cancelled before the deadline
+	s.timeouts.Proxy = time.Minute
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", srv.URL, bytes.NewReader(body))
+	require.Nil(t, err, err)
+	_, err = http.DefaultClient.Do(req)
+	require.NotNil(t, err)
+
+	select {
+	case <-nodeCancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("request to the node was not cancelled")
+	}
+}
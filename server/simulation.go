@@ -0,0 +1,219 @@
+// Optional simulation of transactions before they are sent to the relay, to reject reverting transactions right away
+// instead of letting them sit at the relay until they expire.
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	ethtypes "github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/flashbots/rpc-endpoint/tracing"
+	"github.com/flashbots/rpc-endpoint/types"
+	"github.com/metachris/flashbotsrpc"
+	"github.com/pkg/errors"
+)
+
+const (
+	SimulationModeRelay = "relay" // eth_callBundle at the relay
+	SimulationModeNode  = "node"  // eth_call on the proxy nodes
+)
+
+type SimulationResult struct {
+	Reverted     bool
+	RevertReason string // decoded revert reason, if any
+	RevertData   string // raw revert data as hex, if any
+	GasUsed      uint64
+}
+
+func ValidateSimulationMode(mode string) error {
+	switch mode {
+	case "", SimulationModeRelay, SimulationModeNode:
+		return nil
+	}
+	return fmt.Errorf("invalid simulation mode: %s (use %s or %s)", mode, SimulationModeRelay, SimulationModeNode)
+}
+
+// Result of a single tx in an eth_callBundle response (flashbotsrpc.FlashbotsCallBundleResult lacks the error fields)
+type callBundleTxResult struct {
+	TxHash  string `json:"txHash"`
+	GasUsed uint64 `json:"gasUsed"`
+	Error   string `json:"error,omitempty"`
+	Revert  string `json:"revert,omitempty"` // revert data, as string of the raw bytes
+}
+
+type callBundleResponse struct {
+	Results []callBundleTxResult `json:"results"`
+}
+
+var revertSelector = crypto.Keccak256([]byte("Error(string)"))[:4]
+
+// Decodes Error(string) revert data, or returns the empty string
+func decodeRevertReason(data []byte) string {
+	reason, err := abi.UnpackRevert(data)
+	if err != nil {
+		return ""
+	}
+	return reason
+}
+
+// eth_callBundle returns the revert data as a string of the raw bytes, which mangles the selector because it isn't
+// valid UTF-8. The rest of the encoding survives for ASCII reasons, so it is decoded from the offset word onwards.
+func decodeCallBundleRevertReason(revert string) string {
+	data := []byte(revert)
+	if reason := decodeRevertReason(data); reason != "" {
+		return reason
+	}
+
+	offsetWord := append(make([]byte, 31), 0x20)
+	i := bytes.Index(data, offsetWord)
+	if i < 0 {
+		return ""
+	}
+	return decodeRevertReason(append(append([]byte{}, revertSelector...), data[i:]...))
+}
+
+func (r *RpcRequest) simulateTx() (*SimulationResult, error) {
+	defer r.startSpan("simulateTx", tracing.Attr("simulation.mode", r.simulationMode))()
+	switch r.simulationMode {
+	case SimulationModeRelay:
+		return r.simulateTxAtRelay()
+	case SimulationModeNode:
+		return r.simulateTxAtNode()
+	}
+	return nil, fmt.Errorf("invalid simulation mode: %s", r.simulationMode)
+}
+
+func (r *RpcRequest) simulateTxAtRelay() (*SimulationResult, error) {
+	proxyCtx, cancel := r.stageContext(r.timeouts.Proxy)
+	defer cancel()
+	blockNumber, err := r.proxyPool.BlockNumber(proxyCtx)
+	if err != nil {
+		return nil, errors.Wrap(err, "block number")
+	}
+
+	param := flashbotsrpc.FlashbotsCallBundleParam{
+		Txs:              []string{r.rawTxHex},
+		BlockNumber:      hexutil.EncodeUint64(blockNumber + 1),
+		StateBlockNumber: "latest",
+	}
+	relayCtx, cancel := r.stageContext(r.timeouts.Relay)
+	defer cancel()
+	rawRes, err := r.relays[0].Client.CallWithFlashbotsSignature(relayCtx, "eth_callBundle", r.relaySigningKey, param)
+	if err != nil {
+		return nil, err
+	}
+
+	res := new(callBundleResponse)
+	if err = json.Unmarshal(rawRes, res); err != nil {
+		return nil, errors.Wrap(err, "unmarshal eth_callBundle response")
+	}
+	if len(res.Results) != 1 {
+		return nil, fmt.Errorf("eth_callBundle returned %d results", len(res.Results))
+	}
+
+	txRes := res.Results[0]
+	result := &SimulationResult{GasUsed: txRes.GasUsed}
+	if txRes.Error != "" || txRes.Revert != "" {
+		result.Reverted = true
+		result.RevertReason = decodeCallBundleRevertReason(txRes.Revert)
+		if result.RevertReason == "" {
+			result.RevertReason = txRes.Error
+		}
+	}
+	return result, nil
+}
+
+// Call arguments for simulating the tx with eth_call
+func txCallArgs(tx *ethtypes.Transaction, from string) map[string]interface{} {
+	args := map[string]interface{}{
+		"from":  from,
+		"gas":   hexutil.EncodeUint64(tx.Gas()),
+		"value": hexutil.EncodeBig(tx.Value()),
+		"data":  hexutil.Encode(tx.Data()),
+	}
+	if tx.To() != nil {
+		args["to"] = tx.To().Hex()
+	}
+	if tx.Type() == ethtypes.DynamicFeeTxType {
+		args["maxFeePerGas"] = hexutil.EncodeBig(tx.GasFeeCap())
+		args["maxPriorityFeePerGas"] = hexutil.EncodeBig(tx.GasTipCap())
+	} else {
+		args["gasPrice"] = hexutil.EncodeBig(tx.GasPrice())
+	}
+	return args
+}
+
+func (r *RpcRequest) simulateTxAtNode() (*SimulationResult, error) {
+	req := types.NewJsonRpcRequest(1, "eth_call", []interface{}{txCallArgs(r.tx, r.txFrom), "latest"})
+	ctx, cancel := r.stageContext(r.timeouts.Proxy)
+	defer cancel()
+	res, err := r.proxyPool.SendRpcAndParseResponse(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if res.Error == nil {
+		return &SimulationResult{}, nil
+	}
+
+	// Only reverts reject the tx, other errors are left for the relay to decide
+	if !strings.Contains(res.Error.Message, "revert") {
+		return nil, res.Error
+	}
+
+	result := &SimulationResult{Reverted: true}
+	if data, ok := res.Error.Data.(string); ok && data != "" {
+		result.RevertData = data
+		if dataBytes, err := hexutil.Decode(data); err == nil {
+			result.RevertReason = decodeRevertReason(dataBytes)
+		}
+	}
+	if result.RevertReason == "" {
+		result.RevertReason = strings.TrimPrefix(strings.TrimPrefix(res.Error.Message, "execution reverted"), ": ")
+	}
+	return result, nil
+}
+
+// simulationAllowsTx returns false (and sets the error response) if the tx reverts in simulation. If the simulation itself
+// fails, the tx is allowed, so an unavailable simulation backend doesn't block all transactions. Only if the request
+// itself is over its deadline (or cancelled), the error response is set and false is returned.
+func (r *RpcRequest) simulationAllowsTx() bool {
+	timeStart := time.Now()
+	result, err := r.simulateTx()
+	metricSimulationDuration.Observe(time.Since(timeStart).Seconds(), r.simulationMode)
+	if err != nil && r.ctx.Err() != nil {
+		metricSimulations.Inc(r.simulationMode, "error")
+		r.writeContextError(r.ctx.Err(), "simulation")
+		return false
+	}
+	if err != nil {
+		metricSimulations.Inc(r.simulationMode, "error")
+		r.logger.logError("[simulation] %s failed: %v", r.simulationMode, err)
+		return true
+	}
+
+	if !result.Reverted {
+		metricSimulations.Inc(r.simulationMode, "ok")
+		r.logger.log("[simulation] ok - gas used: %d", result.GasUsed)
+		return true
+	}
+
+	metricSimulations.Inc(r.simulationMode, "reverted")
+	r.logger.log("[simulation] tx reverted: %s", result.RevertReason)
+
+	msg := "tx reverted in simulation"
+	if result.RevertReason != "" {
+		msg += ": " + result.RevertReason
+	}
+	if result.RevertData != "" {
+		r.writeRpcErrorWithData(msg, types.JsonRpcInvalidInput, result.RevertData)
+	} else {
+		r.writeRpcError(msg, types.JsonRpcInvalidInput)
+	}
+	return false
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/flashbots/rpc-endpoint/testutils"
+	"github.com/stretchr/testify/require"
+)
+
+func testRevertData(t *testing.T, reason string) []byte {
+	typ, err := abi.NewType("string", "", nil)
+	require.Nil(t, err, err)
+	data, err := abi.Arguments{{Type: typ}}.Pack(reason)
+	require.Nil(t, err, err)
+	return append(append([]byte{}, revertSelector...), data...)
+}
+
+func TestDecodeRevertReason(t *testing.T) {
+	data := testRevertData(t, "Ownable: caller is not the owner")
+	require.Equal(t, "Ownable: caller is not the owner", decodeRevertReason(data))
+	require.Equal(t, "", decodeRevertReason(data[:4]))
+	require.Equal(t, "", decodeRevertReason(nil))
+}
+
+func TestDecodeCallBundleRevertReason(t *testing.T) {
+	data := testRevertData(t, "UniswapV2: EXPIRED")
+
+	// JSON encoding replaces the invalid UTF-8 bytes of the selector
+	mangled := string([]rune(string(data)))
+	require.NotEqual(t, string(data), mangled)
+	require.Equal(t, "UniswapV2: EXPIRED", decodeCallBundleRevertReason(mangled))
+	require.Equal(t, "UniswapV2: EXPIRED", decodeCallBundleRevertReason(string(data)))
+	require.Equal(t, "", decodeCallBundleRevertReason(""))
+}
+
+func TestTxCallArgs(t *testing.T) {
+	// Dynamic fee tx
+	tx, err := GetTx(testutils.TestTx_BundleFailedTooManyTimes_RawTx)
+	require.Nil(t, err, err)
+	args := txCallArgs(tx, testutils.TestTx_BundleFailedTooManyTimes_From)
+	require.Equal(t, testutils.TestTx_BundleFailedTooManyTimes_From, args["from"])
+	require.Equal(t, tx.To().Hex(), args["to"])
+	require.Equal(t, hexutil.EncodeUint64(tx.Gas()), args["gas"])
+	require.Equal(t, hexutil.EncodeBig(tx.GasFeeCap()), args["maxFeePerGas"])
+	require.NotContains(t, args, "gasPrice")
+
+	// Legacy tx
+	tx, err = GetTx(testutils.TestTx_MM2_RawTx)
+	require.Nil(t, err, err)
+	args = txCallArgs(tx, testutils.TestTx_MM2_From)
+	require.Equal(t, hexutil.EncodeBig(tx.GasPrice()), args["gasPrice"])
+	require.NotContains(t, args, "maxFeePerGas")
+}
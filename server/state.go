@@ -0,0 +1,305 @@
+// Storage of the tx-sent/nonce-fix/sender state, with Redis, in-memory and embedded on-disk (LevelDB) backends.
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flashbots/rpc-endpoint/types"
+)
+
+const (
+	StateBackendRedis   = "redis"   // shared between replicas
+	StateBackendMemory  = "memory"  // lost on restart, for single-instance deployments and tests
+	StateBackendLevelDB = "leveldb" // embedded on-disk database, for single-instance deployments
+)
+
+var ErrStateStoreClosed = errors.New("state store closed")
+
+// Failed nonce of a nonce-fix which was armed without knowing the nonce of the failed tx
+const NonceFixNonceUnknown uint64 = math.MaxUint64
+
+// How often the in-memory and LevelDB stores delete expired entries
+var StateCleanupInterval = time.Duration(10 * time.Minute)
+
+type StateStore interface {
+	// Enable lookup of timeSentToRelay by txHash
+	SetTxSentToRelay(ctx context.Context, txHash string) error
+	MarkTxSentToRelay(ctx context.Context, txHash string, prevTimeSent time.Time) (marked bool, err error)
+	GetTxSentToRelay(ctx context.Context, txHash string) (timeSent time.Time, found bool, err error)
+
+	// Enable lookup of txHash by txFrom+nonce
+	SetTxHashForSenderAndNonce(ctx context.Context, txFrom string, nonce uint64, txHash string) error
+	GetTxHashForSenderAndNonce(ctx context.Context, txFrom string, nonce uint64) (txHash string, found bool, err error)
+
+	// nonce-fix per account
+	SetNonceFixForAccount(ctx context.Context, txFrom string, numTimesSent uint64) error
+	CreateNonceFixForAccount(ctx context.Context, txFrom string, failedNonce uint64) (created bool, err error)
+	IncNonceFixForAccount(ctx context.Context, txFrom string, maxTimesSent uint64) (numTimesSent uint64, failedNonce uint64, incremented bool, err error)
+	DelNonceFixForAccount(ctx context.Context, txFrom string) error
+	GetNonceFixForAccount(ctx context.Context, txFrom string) (numTimesSent uint64, found bool, err error)
+
+	// Enable lookup of txFrom by txHash
+	SetSenderOfTxHash(ctx context.Context, txHash string, txFrom string) error
+	GetSenderOfTxHash(ctx context.Context, txHash string) (txSender string, found bool, err error)
+
+	// Highest nonce of pending txs of a sender (only stored if higher than the current one)
+	SetSenderMaxNonce(ctx context.Context, txFrom string, nonce uint64) error
+	GetSenderMaxNonce(ctx context.Context, txFrom string) (senderMaxNonce uint64, found bool, err error)
+
+	// Lifecycle records of private txs. UpdateTxLifecycle calls update with the record (an empty one if not found),
+	// and saves it for retention if update returns true. update can be called again if the record was changed
+	// concurrently.
+	GetTxLifecycle(ctx context.Context, txHash string) (lifecycle *types.TxLifecycle, found bool, err error)
+	UpdateTxLifecycle(ctx context.Context, txHash string, retention time.Duration, update func(lifecycle *types.TxLifecycle, found bool) (save bool)) error
+
+	// Claims of the tx trackers, so each tx is tracked by one instance. The claim is taken or renewed if there is none
+	// or it's owner's own, and expires if it's not renewed.
+	ClaimTxTracking(ctx context.Context, txHash string, owner string, expiry time.Duration) (claimed bool, err error)
+
+	Close() error
+}
+
+// NewStateStore creates the store for the backend. redisConfig is only used by the Redis backend, path only by LevelDB.
+func NewStateStore(backend string, redisConfig *RedisConfig, path string, clock Clock) (StateStore, error) {
+	switch backend {
+	case StateBackendRedis:
+		return NewRedisStateWithConfig(redisConfig, clock)
+	case StateBackendMemory:
+		return NewMemoryState(clock), nil
+	case StateBackendLevelDB:
+		return NewLevelDBState(path, clock)
+	}
+	return nil, fmt.Errorf("invalid state backend: %s (use %s, %s or %s)", backend, StateBackendRedis, StateBackendMemory, StateBackendLevelDB)
+}
+
+// Minimal key-value store with expiry, for the backends other than Redis
+type kvStore interface {
+	get(key string) (value string, found bool, err error)
+	set(key string, value string, expiry time.Duration) error
+	del(key string) error
+	deleteExpired() error
+	close() error
+}
+
+// kvState implements StateStore on a kvStore, with the same keys and expiries as RedisState
+type kvState struct {
+	kv    kvStore
+	clock Clock
+
+	// serializes read-modify-write operations
+	mu sync.Mutex
+
+	cleanupLock sync.Mutex
+	nextCleanup time.Time
+}
+
+func newKVState(kv kvStore, clock Clock) *kvState {
+	return &kvState{kv: kv, clock: clock, nextCleanup: clock().Add(StateCleanupInterval)}
+}
+
+func (s *kvState) set(key string, value string, expiry time.Duration) error {
+	s.maybeCleanup()
+	return s.kv.set(key, value, expiry)
+}
+
+// Expired entries are ignored on read, and deleted from time to time on write
+func (s *kvState) maybeCleanup() {
+	s.cleanupLock.Lock()
+	if s.clock().Before(s.nextCleanup) {
+		s.cleanupLock.Unlock()
+		return
+	}
+	s.nextCleanup = s.clock().Add(StateCleanupInterval)
+	s.cleanupLock.Unlock()
+
+	s.kv.deleteExpired()
+}
+
+func (s *kvState) getUint(key string) (val uint64, found bool, err error) {
+	str, found, err := s.kv.get(key)
+	if err != nil || !found {
+		return 0, false, err
+	}
+
+	val, err = strconv.ParseUint(str, 10, 64)
+	if err != nil {
+		return 0, true, err
+	}
+	return val, true, nil
+}
+
+func (s *kvState) SetTxSentToRelay(ctx context.Context, txHash string) error {
+	return s.set(RedisKeyTxSentToRelay(txHash), strconv.FormatInt(s.clock().UTC().Unix(), 10), RedisExpiryTxSentToRelay)
+}
+
+func (s *kvState) MarkTxSentToRelay(ctx context.Context, txHash string, prevTimeSent time.Time) (marked bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	timeSent, found, err := s.GetTxSentToRelay(ctx, txHash)
+	if err != nil {
+		return false, err
+	}
+	if found && (prevTimeSent.IsZero() || timeSent.Unix() != prevTimeSent.Unix()) {
+		return false, nil
+	}
+	return true, s.SetTxSentToRelay(ctx, txHash)
+}
+
+func (s *kvState) GetTxSentToRelay(ctx context.Context, txHash string) (timeSent time.Time, found bool, err error) {
+	timestamp, found, err := s.getUint(RedisKeyTxSentToRelay(txHash))
+	if err != nil || !found {
+		return time.Time{}, found, err
+	}
+	return time.Unix(int64(timestamp), 0), true, nil
+}
+
+func (s *kvState) SetTxHashForSenderAndNonce(ctx context.Context, txFrom string, nonce uint64, txHash string) error {
+	return s.set(RedisKeyTxHashForSenderAndNonce(txFrom, nonce), strings.ToLower(txHash), RedisExpiryTxHashForSenderAndNonce)
+}
+
+func (s *kvState) GetTxHashForSenderAndNonce(ctx context.Context, txFrom string, nonce uint64) (txHash string, found bool, err error) {
+	return s.kv.get(RedisKeyTxHashForSenderAndNonce(txFrom, nonce))
+}
+
+func (s *kvState) SetNonceFixForAccount(ctx context.Context, txFrom string, numTimesSent uint64) error {
+	return s.set(RedisKeyNonceFixForAccount(txFrom), strconv.FormatUint(numTimesSent, 10), RedisExpiryNonceFixForAccount)
+}
+
+func (s *kvState) CreateNonceFixForAccount(ctx context.Context, txFrom string, failedNonce uint64) (created bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, found, err := s.GetNonceFixForAccount(ctx, txFrom)
+	if err != nil || found {
+		return false, err
+	}
+	if failedNonce == NonceFixNonceUnknown {
+		err = s.kv.del(RedisKeyNonceFixNonce(txFrom))
+	} else {
+		err = s.set(RedisKeyNonceFixNonce(txFrom), strconv.FormatUint(failedNonce, 10), RedisExpiryNonceFixForAccount)
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, s.SetNonceFixForAccount(ctx, txFrom, 0)
+}
+
+func (s *kvState) IncNonceFixForAccount(ctx context.Context, txFrom string, maxTimesSent uint64) (numTimesSent uint64, failedNonce uint64, incremented bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	numTimesSent, found, err := s.GetNonceFixForAccount(ctx, txFrom)
+	if err != nil || !found {
+		return 0, NonceFixNonceUnknown, false, err
+	}
+	failedNonce, found, err = s.getUint(RedisKeyNonceFixNonce(txFrom))
+	if err != nil {
+		return 0, NonceFixNonceUnknown, false, err
+	}
+	if !found {
+		failedNonce = NonceFixNonceUnknown
+	}
+	if numTimesSent >= maxTimesSent {
+		return numTimesSent, failedNonce, false, nil
+	}
+	numTimesSent++
+	return numTimesSent, failedNonce, true, s.SetNonceFixForAccount(ctx, txFrom, numTimesSent)
+}
+
+func (s *kvState) DelNonceFixForAccount(ctx context.Context, txFrom string) error {
+	if err := s.kv.del(RedisKeyNonceFixNonce(txFrom)); err != nil {
+		return err
+	}
+	return s.kv.del(RedisKeyNonceFixForAccount(txFrom))
+}
+
+func (s *kvState) GetNonceFixForAccount(ctx context.Context, txFrom string) (numTimesSent uint64, found bool, err error) {
+	return s.getUint(RedisKeyNonceFixForAccount(txFrom))
+}
+
+func (s *kvState) SetSenderOfTxHash(ctx context.Context, txHash string, txFrom string) error {
+	return s.set(RedisKeySenderOfTxHash(txHash), strings.ToLower(txFrom), RedisExpirySenderOfTxHash)
+}
+
+func (s *kvState) GetSenderOfTxHash(ctx context.Context, txHash string) (txSender string, found bool, err error) {
+	txSender, found, err = s.kv.get(RedisKeySenderOfTxHash(txHash))
+	return strings.ToLower(txSender), found, err
+}
+
+func (s *kvState) SetSenderMaxNonce(ctx context.Context, txFrom string, nonce uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prevMaxNonce, found, err := s.GetSenderMaxNonce(ctx, txFrom)
+	if err != nil {
+		return err
+	}
+
+	// Do nothing if current nonce is not higher than already existing
+	if found && prevMaxNonce >= nonce {
+		return nil
+	}
+	return s.set(RedisKeySenderMaxNonce(txFrom), strconv.FormatUint(nonce, 10), RedisExpirySenderMaxNonce)
+}
+
+func (s *kvState) GetSenderMaxNonce(ctx context.Context, txFrom string) (senderMaxNonce uint64, found bool, err error) {
+	return s.getUint(RedisKeySenderMaxNonce(txFrom))
+}
+
+func (s *kvState) GetTxLifecycle(ctx context.Context, txHash string) (lifecycle *types.TxLifecycle, found bool, err error) {
+	data, found, err := s.kv.get(RedisKeyTxLifecycle(txHash))
+	if err != nil || !found {
+		return nil, false, err
+	}
+	lifecycle = new(types.TxLifecycle)
+	if err = json.Unmarshal([]byte(data), lifecycle); err != nil {
+		return nil, true, err
+	}
+	return lifecycle, true, nil
+}
+
+func (s *kvState) UpdateTxLifecycle(ctx context.Context, txHash string, retention time.Duration, update func(lifecycle *types.TxLifecycle, found bool) (save bool)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	lifecycle, found, err := s.GetTxLifecycle(ctx, txHash)
+	if err != nil {
+		return err
+	}
+	if !found {
+		lifecycle = &types.TxLifecycle{}
+	}
+	if !update(lifecycle, found) {
+		return nil
+	}
+	data, err := json.Marshal(lifecycle)
+	if err != nil {
+		return err
+	}
+	return s.set(RedisKeyTxLifecycle(txHash), string(data), retention)
+}
+
+func (s *kvState) ClaimTxTracking(ctx context.Context, txHash string, owner string, expiry time.Duration) (claimed bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := RedisKeyTxTrackerClaim(txHash)
+	cur, found, err := s.kv.get(key)
+	if err != nil || (found && cur != owner) {
+		return false, err
+	}
+	return true, s.set(key, owner, expiry)
+}
+
+func (s *kvState) Close() error {
+	return s.kv.close()
+}
@@ -0,0 +1,497 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/flashbots/rpc-endpoint/types"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/require"
+)
+
+// Runs the test against every state backend
+func forEachStateStore(t *testing.T, test func(t *testing.T, store StateStore, clock *testClock)) {
+	backends := map[string]func(t *testing.T, clock *testClock) StateStore{
+		StateBackendRedis: func(t *testing.T, clock *testClock) StateStore {
+			resetRedis()
+
+			// miniredis doesn't lock while running Lua scripts, so with several connections concurrent scripts
+			// interleave (Redis runs them atomically). One connection still interleaves non-atomic read-then-writes.
+			return &RedisState{RedisClient: redis.NewClient(&redis.Options{Addr: redisServer.Addr(), PoolSize: 1}), clock: clock.Now}
+		},
+		StateBackendMemory: func(t *testing.T, clock *testClock) StateStore {
+			return NewMemoryState(clock.Now)
+		},
+		StateBackendLevelDB: func(t *testing.T, clock *testClock) StateStore {
+			store, err := NewLevelDBState(t.TempDir(), clock.Now)
+			require.Nil(t, err, err)
+			return store
+		},
+	}
+
+	for name, newStore := range backends {
+		t.Run(name, func(t *testing.T) {
+			clock := &testClock{}
+			store := newStore(t, clock)
+			defer store.Close()
+			test(t, store, clock)
+		})
+	}
+}
+
+func TestTxSentToRelay(t *testing.T) {
+	ctx := context.Background()
+	forEachStateStore(t, func(t *testing.T, store StateStore, clock *testClock) {
+		var err error
+
+		timeBeforeSet := time.Now()
+		err = store.SetTxSentToRelay(ctx, "foo")
+		require.Nil(t, err, err)
+
+		timeSent, found, err := store.GetTxSentToRelay(ctx, "foo")
+		require.Nil(t, err, err)
+		require.True(t, found)
+
+		// Returned time should be after time set and within 1 second of current time
+		require.True(t, time.Since(timeSent) >= time.Since(timeBeforeSet))
+		require.True(t, time.Since(timeSent) < time.Second)
+
+		// Invalid key should return found: false but no error
+		timeSent, found, err = store.GetTxSentToRelay(ctx, "XXX")
+		require.Nil(t, err, err)
+		require.False(t, found)
+	})
+}
+
+func TestTxHashForSenderAndNonce(t *testing.T) {
+	ctx := context.Background()
+	forEachStateStore(t, func(t *testing.T, store StateStore, clock *testClock) {
+		var err error
+
+		txFrom := "0x0Sender"
+		nonce := uint64(1337)
+		txHash := "0x0TxHash"
+
+		// Ensure key is correct
+		key := RedisKeyTxHashForSenderAndNonce(txFrom, nonce)
+		expectedKey := fmt.Sprintf("%s%s_%d", RedisPrefixTxHashForSenderAndNonce, strings.ToLower(txFrom), nonce)
+		require.Equal(t, expectedKey, key)
+
+		// Get before set: should return not found
+		txHashFromRedis, found, err := store.GetTxHashForSenderAndNonce(ctx, txFrom, nonce)
+		require.Nil(t, err, err)
+		require.False(t, found)
+		require.Equal(t, "", txHashFromRedis)
+
+		// Set
+		err = store.SetTxHashForSenderAndNonce(ctx, txFrom, nonce, txHash)
+		require.Nil(t, err, err)
+
+		// Get
+		txHashFromRedis, found, err = store.GetTxHashForSenderAndNonce(ctx, txFrom, nonce)
+		require.Nil(t, err, err)
+		require.True(t, found)
+
+		// The txHash is stored lowercased, so it doesn't match directly
+		require.NotEqual(t, txHash, txHashFromRedis)
+		require.Equal(t, strings.ToLower(txHash), txHashFromRedis)
+	})
+}
+
+func TestNonceFixForAccount(t *testing.T) {
+	ctx := context.Background()
+	forEachStateStore(t, func(t *testing.T, store StateStore, clock *testClock) {
+		var err error
+
+		txFrom := "0x0Sender"
+
+		numTimesSent, found, err := store.GetNonceFixForAccount(ctx, txFrom)
+		require.Nil(t, err, err)
+		require.False(t, found)
+		require.Equal(t, uint64(0), numTimesSent)
+
+		err = store.SetNonceFixForAccount(ctx, txFrom, 0)
+		require.Nil(t, err, err)
+
+		numTimesSent, found, err = store.GetNonceFixForAccount(ctx, txFrom)
+		require.Nil(t, err, err)
+		require.True(t, found)
+		require.Equal(t, uint64(0), numTimesSent)
+
+		err = store.DelNonceFixForAccount(ctx, txFrom)
+		require.Nil(t, err, err)
+
+		numTimesSent, found, err = store.GetNonceFixForAccount(ctx, txFrom)
+		require.Nil(t, err, err)
+		require.False(t, found)
+		require.Equal(t, uint64(0), numTimesSent)
+
+		err = store.SetNonceFixForAccount(ctx, txFrom, 17)
+		require.Nil(t, err, err)
+
+		numTimesSent, found, err = store.GetNonceFixForAccount(ctx, txFrom)
+		require.Nil(t, err, err)
+		require.True(t, found)
+		require.Equal(t, uint64(17), numTimesSent)
+
+		// Ensure it matches txFrom case-insensitive
+		numTimesSent, found, err = store.GetNonceFixForAccount(ctx, strings.ToUpper(txFrom))
+		require.Nil(t, err, err)
+		require.True(t, found)
+		require.Equal(t, uint64(17), numTimesSent)
+	})
+}
+
+func TestSenderOfTxHash(t *testing.T) {
+	ctx := context.Background()
+	forEachStateStore(t, func(t *testing.T, store StateStore, clock *testClock) {
+		var err error
+
+		txFrom := "0x0Sender"
+		txHash := "0xDeadBeef"
+
+		val, found, err := store.GetSenderOfTxHash(ctx, txHash)
+		require.Nil(t, err, err)
+		require.False(t, found)
+		require.Equal(t, "", val)
+
+		err = store.SetSenderOfTxHash(ctx, txHash, txFrom)
+		require.Nil(t, err, err)
+
+		val, found, err = store.GetSenderOfTxHash(ctx, txHash)
+		require.Nil(t, err, err)
+		require.True(t, found)
+		require.Equal(t, strings.ToLower(txFrom), val)
+	})
+}
+
+func TestSenderMaxNonce(t *testing.T) {
+	ctx := context.Background()
+	forEachStateStore(t, func(t *testing.T, store StateStore, clock *testClock) {
+		var err error
+
+		txFrom := "0x0Sender"
+
+		val, found, err := store.GetSenderMaxNonce(ctx, txFrom)
+		require.Nil(t, err, err)
+		require.False(t, found)
+		require.Equal(t, uint64(0), val)
+
+		err = store.SetSenderMaxNonce(ctx, txFrom, 17)
+		require.Nil(t, err, err)
+
+		val, found, err = store.GetSenderMaxNonce(ctx, txFrom)
+		require.Nil(t, err, err)
+		require.True(t, found)
+		require.Equal(t, uint64(17), val)
+
+		err = store.SetSenderMaxNonce(ctx, txFrom, 16)
+		require.Nil(t, err, err)
+
+		val, found, err = store.GetSenderMaxNonce(ctx, txFrom)
+		require.Nil(t, err, err)
+		require.True(t, found)
+		require.Equal(t, uint64(17), val)
+
+		err = store.SetSenderMaxNonce(ctx, txFrom, 18)
+		require.Nil(t, err, err)
+
+		val, found, err = store.GetSenderMaxNonce(ctx, txFrom)
+		require.Nil(t, err, err)
+		require.True(t, found)
+		require.Equal(t, uint64(18), val)
+	})
+}
+
+func TestStateExpiry(t *testing.T) {
+	ctx := context.Background()
+	forEachStateStore(t, func(t *testing.T, store StateStore, clock *testClock) {
+		timeNow := time.Now()
+		clock.Set(timeNow)
+
+		err := store.SetSenderMaxNonce(ctx, "0x0Sender", 17)
+		require.Nil(t, err, err)
+		err = store.SetNonceFixForAccount(ctx, "0x0Sender", 1)
+		require.Nil(t, err, err)
+
+		clock.Set(timeNow.Add(RedisExpirySenderMaxNonce + time.Second))
+		if _, ok := store.(*RedisState); ok {
+			redisServer.FastForward(RedisExpirySenderMaxNonce + time.Second)
+		}
+
+		_, found, err := store.GetSenderMaxNonce(ctx, "0x0Sender")
+		require.Nil(t, err, err)
+		require.False(t, found)
+		_, found, err = store.GetNonceFixForAccount(ctx, "0x0Sender")
+		require.Nil(t, err, err)
+		require.True(t, found)
+	})
+}
+
+func TestStateStoreClosed(t *testing.T) {
+	ctx := context.Background()
+	forEachStateStore(t, func(t *testing.T, store StateStore, clock *testClock) {
+		require.Nil(t, store.Close())
+		require.NotNil(t, store.SetTxSentToRelay(ctx, "foo"))
+		_, _, err := store.GetTxSentToRelay(ctx, "foo")
+		require.NotNil(t, err)
+	})
+}
+
+func TestLevelDBStatePersists(t *testing.T) {
+	ctx := context.Background()
+	path := t.TempDir()
+	store, err := NewLevelDBState(path, time.Now)
+	require.Nil(t, err, err)
+	err = store.SetSenderOfTxHash(ctx, "0xDeadBeef", "0x0Sender")
+	require.Nil(t, err, err)
+	require.Nil(t, store.Close())
+
+	store, err = NewLevelDBState(path, time.Now)
+	require.Nil(t, err, err)
+	defer store.Close()
+	txFrom, found, err := store.GetSenderOfTxHash(ctx, "0xDeadBeef")
+	require.Nil(t, err, err)
+	require.True(t, found)
+	require.Equal(t, "0x0sender", txFrom)
+}
+
+func TestNewStateStore(t *testing.T) {
+	store, err := NewStateStore(StateBackendMemory, nil, "", time.Now)
+	require.Nil(t, err, err)
+	require.IsType(t, &MemoryState{}, store)
+
+	_, err = NewStateStore(StateBackendLevelDB, nil, "", time.Now)
+	require.NotNil(t, err)
+	_, err = NewStateStore("foo", nil, "", time.Now)
+	require.NotNil(t, err)
+}
+
+func TestMarkTxSentToRelay(t *testing.T) {
+	ctx := context.Background()
+	forEachStateStore(t, func(t *testing.T, store StateStore, clock *testClock) {
+		marked, err := store.MarkTxSentToRelay(ctx, "0xTx", time.Time{})
+		require.Nil(t, err, err)
+		require.True(t, marked)
+
+		// Already marked
+		marked, err = store.MarkTxSentToRelay(ctx, "0xTx", time.Time{})
+		require.Nil(t, err, err)
+		require.False(t, marked)
+
+		// Resending with the time seen before works once
+		timeSent, _, _ := store.GetTxSentToRelay(ctx, "0xTx")
+		marked, err = store.MarkTxSentToRelay(ctx, "0xTx", timeSent)
+		require.Nil(t, err, err)
+		require.True(t, marked)
+		marked, err = store.MarkTxSentToRelay(ctx, "0xTx", timeSent.Add(-time.Hour))
+		require.Nil(t, err, err)
+		require.False(t, marked)
+	})
+}
+
+func TestNonceFixCounter(t *testing.T) {
+	ctx := context.Background()
+	forEachStateStore(t, func(t *testing.T, store StateStore, clock *testClock) {
+		_, _, incremented, err := store.IncNonceFixForAccount(ctx, "0x0Sender", 4)
+		require.Nil(t, err, err)
+		require.False(t, incremented)
+
+		created, err := store.CreateNonceFixForAccount(ctx, "0x0Sender", 7)
+		require.Nil(t, err, err)
+		require.True(t, created)
+
+		numTimesSent, failedNonce, incremented, err := store.IncNonceFixForAccount(ctx, "0x0SENDER", 4)
+		require.Nil(t, err, err)
+		require.True(t, incremented)
+		require.Equal(t, uint64(1), numTimesSent)
+		require.Equal(t, uint64(7), failedNonce)
+
+		// Creating again doesn't reset the counter or the failed nonce
+		created, err = store.CreateNonceFixForAccount(ctx, "0x0Sender", 9)
+		require.Nil(t, err, err)
+		require.False(t, created)
+		numTimesSent, failedNonce, _, _ = store.IncNonceFixForAccount(ctx, "0x0Sender", 1)
+		require.Equal(t, uint64(1), numTimesSent)
+		require.Equal(t, uint64(7), failedNonce)
+
+		// The failed nonce is removed with the nonce-fix
+		err = store.DelNonceFixForAccount(ctx, "0x0Sender")
+		require.Nil(t, err, err)
+		created, err = store.CreateNonceFixForAccount(ctx, "0x0Sender", NonceFixNonceUnknown)
+		require.Nil(t, err, err)
+		require.True(t, created)
+		_, failedNonce, _, err = store.IncNonceFixForAccount(ctx, "0x0Sender", 4)
+		require.Nil(t, err, err)
+		require.Equal(t, NonceFixNonceUnknown, failedNonce)
+	})
+}
+
+func TestStateConcurrentUpdates(t *testing.T) {
+	ctx := context.Background()
+	forEachStateStore(t, func(t *testing.T, store StateStore, clock *testClock) {
+		const numWorkers = 50
+		var wg sync.WaitGroup
+
+		// Max nonce never goes down, whatever the order of the updates
+		for i := 0; i < numWorkers; i++ {
+			wg.Add(1)
+			go func(nonce uint64) {
+				defer wg.Done()
+				require.Nil(t, store.SetSenderMaxNonce(ctx, "0x0Sender", nonce))
+			}(uint64(i))
+		}
+		wg.Wait()
+		maxNonce, found, err := store.GetSenderMaxNonce(ctx, "0x0Sender")
+		require.Nil(t, err, err)
+		require.True(t, found)
+		require.Equal(t, uint64(numWorkers-1), maxNonce)
+
+		// Nonce-fix is created once and counted up to the max
+		var numCreated, numIncremented int32
+		for i := 0; i < numWorkers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				created, err := store.CreateNonceFixForAccount(ctx, "0x0Sender", 1)
+				require.Nil(t, err, err)
+				if created {
+					atomic.AddInt32(&numCreated, 1)
+				}
+				_, _, incremented, err := store.IncNonceFixForAccount(ctx, "0x0Sender", 4)
+				require.Nil(t, err, err)
+				if incremented {
+					atomic.AddInt32(&numIncremented, 1)
+				}
+			}()
+		}
+		wg.Wait()
+		require.Equal(t, int32(1), numCreated)
+		require.Equal(t, int32(4), numIncremented)
+		numTimesSent, _, _ := store.GetNonceFixForAccount(ctx, "0x0Sender")
+		require.Equal(t, uint64(4), numTimesSent)
+
+		// Only one of the concurrent submissions of a tx is sent to the relay
+		var numMarked int32
+		for i := 0; i < numWorkers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				marked, err := store.MarkTxSentToRelay(ctx, "0xTx", time.Time{})
+				require.Nil(t, err, err)
+				if marked {
+					atomic.AddInt32(&numMarked, 1)
+				}
+			}()
+		}
+		wg.Wait()
+		require.Equal(t, int32(1), numMarked)
+	})
+}
+
+func TestTxLifecycle(t *testing.T) {
+	ctx := context.Background()
+	forEachStateStore(t, func(t *testing.T, store StateStore, clock *testClock) {
+		timeNow := time.Now()
+		clock.Set(timeNow)
+		retention := time.Hour
+
+		_, found, err := store.GetTxLifecycle(ctx, "0xTx")
+		require.Nil(t, err, err)
+		require.False(t, found)
+
+		err = store.UpdateTxLifecycle(ctx, "0xTx", retention, func(lifecycle *types.TxLifecycle, found bool) bool {
+			require.False(t, found)
+			lifecycle.Hash = "0xTx"
+			lifecycle.SetStatus(timeNow, types.TxStatusSent, types.TxEventSourceRelay, "")
+			return true
+		})
+		require.Nil(t, err, err)
+
+		// Not saved if the update returns false
+		err = store.UpdateTxLifecycle(ctx, "0xTx", retention, func(lifecycle *types.TxLifecycle, found bool) bool {
+			require.True(t, found)
+			lifecycle.FailureReason = "foo"
+			return false
+		})
+		require.Nil(t, err, err)
+
+		// Concurrent updates all apply
+		const numWorkers = 10
+		var wg sync.WaitGroup
+		for i := 0; i < numWorkers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				err := store.UpdateTxLifecycle(ctx, "0xTx", retention, func(lifecycle *types.TxLifecycle, found bool) bool {
+					lifecycle.Relays = append(lifecycle.Relays, types.TxRelayResponse{Relay: "relay", Accepted: true})
+					return true
+				})
+				require.Nil(t, err, err)
+			}()
+		}
+		wg.Wait()
+
+		lifecycle, found, err := store.GetTxLifecycle(ctx, "0xTx")
+		require.Nil(t, err, err)
+		require.True(t, found)
+		require.Equal(t, types.TxStatusSent, lifecycle.Status)
+		require.Equal(t, 1, len(lifecycle.Events))
+		require.Equal(t, "", lifecycle.FailureReason)
+		require.Equal(t, numWorkers, len(lifecycle.Relays))
+
+		clock.Set(timeNow.Add(retention + time.Second))
+		if _, ok := store.(*RedisState); ok {
+			redisServer.FastForward(retention + time.Second)
+		}
+		_, found, err = store.GetTxLifecycle(ctx, "0xTx")
+		require.Nil(t, err, err)
+		require.False(t, found)
+	})
+}
+
+func TestClaimTxTracking(t *testing.T) {
+	ctx := context.Background()
+	forEachStateStore(t, func(t *testing.T, store StateStore, clock *testClock) {
+		timeNow := time.Now()
+		clock.Set(timeNow)
+
+		claimed, err := store.ClaimTxTracking(ctx, "0xTx", "a", time.Minute)
+		require.Nil(t, err, err)
+		require.True(t, claimed)
+		claimed, err = store.ClaimTxTracking(ctx, "0xTx", "b", time.Minute)
+		require.Nil(t, err, err)
+		require.False(t, claimed)
+
+		// Renewed by its owner
+		clock.Set(timeNow.Add(50 * time.Second))
+		if _, ok := store.(*RedisState); ok {
+			redisServer.FastForward(50 * time.Second)
+		}
+		claimed, err = store.ClaimTxTracking(ctx, "0xTx", "a", time.Minute)
+		require.Nil(t, err, err)
+		require.True(t, claimed)
+
+		clock.Set(timeNow.Add(100 * time.Second))
+		if _, ok := store.(*RedisState); ok {
+			redisServer.FastForward(50 * time.Second)
+		}
+		claimed, err = store.ClaimTxTracking(ctx, "0xTx", "b", time.Minute)
+		require.Nil(t, err, err)
+		require.False(t, claimed)
+
+		// Taken over after it expired
+		clock.Set(timeNow.Add(111 * time.Second))
+		if _, ok := store.(*RedisState); ok {
+			redisServer.FastForward(11 * time.Second)
+		}
+		claimed, err = store.ClaimTxTracking(ctx, "0xTx", "b", time.Minute)
+		require.Nil(t, err, err)
+		require.True(t, claimed)
+	})
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"context"
+	"strings"
+
+	"github.com/flashbots/rpc-endpoint/tracing"
+	"github.com/go-redis/redis/v8"
+)
+
+// startSpan starts a span for a stage of the request. Calls made with r.ctx until end is called are children of it.
+func (r *RpcRequest) startSpan(name string, attrs ...tracing.Attribute) (end func()) {
+	parentCtx := r.ctx
+	jsonResBefore := r.jsonRes
+	var span *tracing.Span
+	r.ctx, span = tracing.Start(parentCtx, name, attrs...)
+	return func() {
+		if r.jsonRes != jsonResBefore && r.jsonRes != nil && r.jsonRes.Error != nil {
+			span.SetError(r.jsonRes.Error.Message) // the stage failed the request
+		}
+		span.End()
+		r.ctx = parentCtx
+	}
+}
+
+type redisSpanKey struct{}
+
+// redisTracingHook records a client span for each Redis command and pipeline of a request (background commands are
+// not recorded)
+type redisTracingHook struct{}
+
+func (redisTracingHook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	if !tracing.SpanContextFromContext(ctx).IsValid() {
+		return ctx, nil
+	}
+	spanCtx, span := tracing.StartWithKind(ctx, "redis "+cmd.Name(), tracing.SpanKindClient,
+		tracing.Attr("db.system", "redis"),
+		tracing.Attr("db.operation", cmd.Name()),
+	)
+	return context.WithValue(spanCtx, redisSpanKey{}, span), nil
+}
+
+func (redisTracingHook) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	endRedisSpan(ctx, cmd.Err())
+	return nil
+}
+
+func (redisTracingHook) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	if !tracing.SpanContextFromContext(ctx).IsValid() {
+		return ctx, nil
+	}
+	names := make([]string, len(cmds))
+	for i, cmd := range cmds {
+		names[i] = cmd.Name()
+	}
+	spanCtx, span := tracing.StartWithKind(ctx, "redis pipeline", tracing.SpanKindClient,
+		tracing.Attr("db.system", "redis"),
+		tracing.Attr("db.operation", strings.Join(names, " ")),
+	)
+	return context.WithValue(spanCtx, redisSpanKey{}, span), nil
+}
+
+func (redisTracingHook) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	var err error
+	for _, cmd := range cmds {
+		if cmdErr := cmd.Err(); cmdErr != nil && cmdErr != redis.Nil {
+			err = cmdErr
+			break
+		}
+	}
+	endRedisSpan(ctx, err)
+	return nil
+}
+
+func endRedisSpan(ctx context.Context, err error) {
+	span, ok := ctx.Value(redisSpanKey{}).(*tracing.Span)
+	if !ok || span == nil {
+		return // not traced
+	}
+	if err != nil && err != redis.Nil { // redis.Nil is a missing key
+		span.RecordError(err)
+	}
+	span.End()
+}
@@ -0,0 +1,204 @@
+// Lifecycle records of private txs (see types.TxLifecycle), written when a tx is sent to or cancelled at the relays
+// and when the tx tracker looks up its status, and served at /tx/{hash}.
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/flashbots/rpc-endpoint/types"
+	"github.com/pkg/errors"
+)
+
+// Lifecycle updates are not cancelled with the request, the record should be complete even if the client went away
+func (r *RpcRequest) updateTxLifecycle(txHash string, update func(lifecycle *types.TxLifecycle, found bool) (save bool)) {
+	if err := r.state.UpdateTxLifecycle(context.Background(), strings.ToLower(txHash), r.txLifecycleRetention, update); err != nil {
+		r.logger.logError("[tx-lifecycle] update of %s failed: %v", txHash, err)
+	}
+}
+
+func (r *RpcRequest) relayResponses(call string) []types.TxRelayResponse {
+	now := r.clock().UTC()
+	responses := make([]types.TxRelayResponse, len(r.relayResults))
+	for i, result := range r.relayResults {
+		responses[i] = types.TxRelayResponse{
+			Relay:      result.Relay,
+			Call:       call,
+			Accepted:   result.Accepted,
+			DurationMs: result.Duration.Milliseconds(),
+			Time:       now,
+		}
+		if result.Err != nil {
+			responses[i].Error = result.Err.Error()
+		}
+	}
+	return responses
+}
+
+// recordTxSent records the tx with the routing decision and the responses of the relays it was sent to
+func (r *RpcRequest) recordTxSent(args types.SendPrivateTransactionRequest, relays []RelayTarget) {
+	now := r.clock().UTC()
+	relayNames := make([]string, len(relays))
+	for i, relay := range relays {
+		relayNames[i] = relay.Name
+	}
+
+	r.updateTxLifecycle(r.tx.Hash().Hex(), func(lifecycle *types.TxLifecycle, found bool) bool {
+		if !found {
+			lifecycle.Hash = strings.ToLower(r.tx.Hash().Hex())
+			lifecycle.CreatedAt = now
+		}
+		lifecycle.RawTx = r.rawTxHex
+		lifecycle.From = strings.ToLower(r.txFrom)
+		if r.tx.To() != nil {
+			lifecycle.To = strings.ToLower(r.tx.To().Hex())
+		}
+		lifecycle.Nonce = r.tx.Nonce()
+		lifecycle.Routing = types.TxRouting{
+			Action:         string(r.protectionDecision.Action),
+			Rule:           r.protectionDecision.Rule,
+			Relays:         relayNames,
+			Fast:           args.Preferences != nil && args.Preferences.Fast,
+			MaxBlockNumber: args.MaxBlockNumber,
+		}
+		lifecycle.Relays = append(lifecycle.Relays, r.relayResponses("send")...)
+
+		if err := relayFanOutError(r.relayResults); err != nil {
+			lifecycle.FailureReason = err.Error()
+			lifecycle.SetStatus(now, types.TxStatusRejected, types.TxEventSourceRelay, err.Error())
+		} else {
+			lifecycle.FailureReason = ""
+			lifecycle.SetStatus(now, types.TxStatusSent, types.TxEventSourceRelay, "")
+		}
+		lifecycle.UpdatedAt = now
+		return true
+	})
+
+	if relayFanOutError(r.relayResults) == nil {
+		r.txTracker.Track(r.tx.Hash().Hex(), now)
+	}
+}
+
+// recordTxCancelled records the cancellation of a tx at the relays by a cancel-tx
+func (r *RpcRequest) recordTxCancelled(txHash, cancelTxHash string) {
+	now := r.clock().UTC()
+	r.updateTxLifecycle(txHash, func(lifecycle *types.TxLifecycle, found bool) bool {
+		if !found {
+			return false
+		}
+		lifecycle.Relays = append(lifecycle.Relays, r.relayResponses("cancel")...)
+		if relayFanOutError(r.relayResults) == nil {
+			lifecycle.FailureReason = "cancelled by " + cancelTxHash
+			lifecycle.SetStatus(now, types.TxStatusCancelled, types.TxEventSourceCancel, "cancelled by "+cancelTxHash)
+		}
+		lifecycle.UpdatedAt = now
+		return true
+	})
+}
+
+// updateTxLifecycleStatus sets the status of a recorded tx, with the reason of a failure and the inclusion block if
+// known (not 0). It returns the record after the update (nil if there is none), and whether its status changed.
+func (d *requestDeps) updateTxLifecycleStatus(txHash string, status types.PrivateTxStatus, source, failureReason string, includedBlock uint64) (record *types.TxLifecycle, changed bool, err error) {
+	now := d.clock().UTC()
+	err = d.state.UpdateTxLifecycle(context.Background(), strings.ToLower(txHash), d.txLifecycleRetention, func(lifecycle *types.TxLifecycle, found bool) bool {
+		record, changed = nil, false
+		if !found {
+			return false // not sent by us
+		}
+		record = lifecycle
+
+		// A cancelled tx is only changed by its inclusion (the cancellation came too late)
+		if lifecycle.Status == types.TxStatusCancelled && status != types.TxStatusIncluded {
+			return false
+		}
+
+		changed = lifecycle.SetStatus(now, status, source, failureReason)
+		save := changed
+		switch {
+		case status == types.TxStatusIncluded:
+			lifecycle.FailureReason = ""
+		case status == types.TxStatusFailed && changed:
+			lifecycle.FailureReason = failureReason
+			if failureReason == "" {
+				lifecycle.FailureReason = "failed according to the tx status API"
+			}
+		}
+		if includedBlock > 0 && lifecycle.IncludedBlock != includedBlock {
+			lifecycle.IncludedBlock = includedBlock
+			lifecycle.UpdatedAt = now
+			save = true
+		}
+		return save
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return record, changed, nil
+}
+
+// txInclusionBlock returns the block of the tx from its receipt, or 0 if it has none
+func txInclusionBlock(ctx context.Context, proxyPool *ProxyPool, txHash string) (uint64, error) {
+	res, err := proxyPool.SendRpcAndParseResponse(ctx, types.NewJsonRpcRequest(1, "eth_getTransactionReceipt", []interface{}{txHash}))
+	if err != nil {
+		return 0, err
+	}
+	if res.Error != nil {
+		return 0, errors.New(res.Error.Message)
+	}
+
+	var receipt *struct {
+		BlockNumber hexutil.Uint64 `json:"blockNumber"`
+	}
+	if err = json.Unmarshal(res.Result, &receipt); err != nil {
+		return 0, errors.Wrap(err, "receipt")
+	}
+	if receipt == nil {
+		return 0, nil
+	}
+	return uint64(receipt.BlockNumber), nil
+}
+
+var txHashRegexp = regexp.MustCompile(`^0x[0-9a-fA-F]{64}$`)
+
+// handleTxLifecycleRequest serves the lifecycle record of a private tx at /tx/{hash}. The raw tx is only included once
+// the tx is included, before that anyone knowing the hash could send it to the mempool.
+func (s *RpcEndPointServer) handleTxLifecycleRequest(respw http.ResponseWriter, req *http.Request) {
+	respw.Header().Set("Access-Control-Allow-Origin", "*")
+	respw.Header().Set("Content-Type", "application/json")
+
+	writeError := func(statusCode int, msg string) {
+		respw.WriteHeader(statusCode)
+		json.NewEncoder(respw).Encode(map[string]string{"error": msg})
+	}
+
+	if req.Method != http.MethodGet {
+		writeError(http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	txHash := strings.TrimPrefix(req.URL.Path, "/tx/")
+	if !txHashRegexp.MatchString(txHash) {
+		writeError(http.StatusBadRequest, "invalid tx hash")
+		return
+	}
+
+	lifecycle, found, err := s.state.GetTxLifecycle(req.Context(), strings.ToLower(txHash))
+	if err != nil {
+		s.logger.logError("[tx-lifecycle] get %s failed: %v", txHash, err)
+		writeError(http.StatusInternalServerError, "internal server error")
+		return
+	}
+	if !found {
+		writeError(http.StatusNotFound, "tx not found")
+		return
+	}
+
+	if lifecycle.Status != types.TxStatusIncluded {
+		lifecycle.RawTx = ""
+	}
+	json.NewEncoder(respw).Encode(lifecycle)
+}
@@ -0,0 +1,383 @@
+// Background tracking of the status of private txs. Txs sent to the relays are looked up at the tx status API until
+// their status is final, with backoff, and the status is stored in their lifecycle record. Requests read the stored
+// status instead of calling the API. Each tx is tracked by one instance, which claims it in the state store.
+package server
+
+import (
+	"container/heap"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/flashbots/rpc-endpoint/types"
+)
+
+type TxTrackerConfig struct {
+	MinInterval time.Duration // between lookups of a tx, doubled after each lookup without a status change
+	MaxInterval time.Duration
+	MaxAge      time.Duration // txs aren't tracked anymore this long after they were sent
+	Workers     int           // concurrent lookups
+}
+
+var DefaultTxTrackerConfig = TxTrackerConfig{
+	MinInterval: time.Duration(5 * time.Second),
+	MaxInterval: time.Duration(time.Minute),
+	MaxAge:      time.Duration(time.Hour),
+	Workers:     4,
+}
+
+// Sets the zero fields to the defaults
+func (c TxTrackerConfig) withDefaults() TxTrackerConfig {
+	if c.MinInterval == 0 {
+		c.MinInterval = DefaultTxTrackerConfig.MinInterval
+	}
+	if c.MaxInterval == 0 {
+		c.MaxInterval = DefaultTxTrackerConfig.MaxInterval
+	}
+	if c.MaxInterval < c.MinInterval {
+		c.MaxInterval = c.MinInterval
+	}
+	if c.MaxAge == 0 {
+		c.MaxAge = DefaultTxTrackerConfig.MaxAge
+	}
+	if c.Workers == 0 {
+		c.Workers = DefaultTxTrackerConfig.Workers
+	}
+	return c
+}
+
+type trackedTx struct {
+	hash      string
+	sentAt    time.Time
+	status    types.PrivateTxStatus // of the last lookup
+	interval  time.Duration
+	nextCheck time.Time
+}
+
+// txQueue is a heap of the tracked txs by time of the next lookup
+type txQueue []*trackedTx
+
+func (q txQueue) Len() int           { return len(q) }
+func (q txQueue) Less(i, j int) bool { return q[i].nextCheck.Before(q[j].nextCheck) }
+func (q txQueue) Swap(i, j int)      { q[i], q[j] = q[j], q[i] }
+
+func (q *txQueue) Push(x interface{}) {
+	*q = append(*q, x.(*trackedTx))
+}
+
+func (q *txQueue) Pop() interface{} {
+	old := *q
+	tx := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return tx
+}
+
+// txTracker looks up the status of the tracked txs in the background. The workers are started with the first tracked
+// tx. All methods can be called on a nil tracker, which tracks nothing.
+type txTracker struct {
+	config    TxTrackerConfig
+	deps      *requestDeps
+	proxyPool *ProxyPool // for the block of included txs
+	logger    Logger
+	id        string // owner of the claims of this instance
+
+	mu      sync.Mutex
+	txs     map[string]*trackedTx
+	queue   txQueue
+	stopped bool
+
+	wake      chan struct{} // a tx is due or was added
+	stop      chan struct{}
+	startOnce sync.Once
+	workers   sync.WaitGroup
+}
+
+func newTxTracker(config TxTrackerConfig, deps *requestDeps, proxyPool *ProxyPool, logger Logger) *txTracker {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return &txTracker{
+		config:    config.withDefaults(),
+		deps:      deps,
+		proxyPool: proxyPool,
+		logger:    logger,
+		id:        hex.EncodeToString(id),
+		txs:       make(map[string]*trackedTx),
+		wake:      make(chan struct{}, 1),
+		stop:      make(chan struct{}),
+	}
+}
+
+// Track adds a tx which was sent at sentAt, unless it's already tracked or too old. It's looked up a min interval
+// after it was sent.
+func (t *txTracker) Track(txHash string, sentAt time.Time) {
+	if t == nil {
+		return
+	}
+	now := t.deps.clock()
+	if now.Sub(sentAt) >= t.config.MaxAge {
+		return
+	}
+	t.startOnce.Do(t.start)
+
+	txHash = strings.ToLower(txHash)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, found := t.txs[txHash]; found || t.stopped {
+		return
+	}
+
+	tx := &trackedTx{hash: txHash, sentAt: sentAt, interval: t.config.MinInterval, nextCheck: sentAt.Add(t.config.MinInterval)}
+	if tx.nextCheck.Before(now) {
+		tx.nextCheck = now
+	}
+	t.txs[txHash] = tx
+	heap.Push(&t.queue, tx)
+	metricTxTrackerQueueDepth.Set(float64(len(t.txs)), t.deps.chain.Name)
+	t.notify()
+}
+
+// QueueDepth returns the number of tracked txs
+func (t *txTracker) QueueDepth() int {
+	if t == nil {
+		return 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.txs)
+}
+
+// Stop waits for the lookups in progress, and stops tracking
+func (t *txTracker) Stop() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	if t.stopped {
+		t.mu.Unlock()
+		return
+	}
+	t.stopped = true
+	t.mu.Unlock()
+
+	close(t.stop)
+	t.workers.Wait()
+}
+
+func (t *txTracker) start() {
+	for i := 0; i < t.config.Workers; i++ {
+		t.workers.Add(1)
+		go t.work()
+	}
+}
+
+func (t *txTracker) notify() {
+	select {
+	case t.wake <- struct{}{}:
+	default: // a worker will wake up anyway
+	}
+}
+
+func (t *txTracker) work() {
+	defer t.workers.Done()
+	for {
+		tx, wait := t.next()
+		if tx != nil {
+			t.check(tx)
+			continue
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-t.stop:
+			timer.Stop()
+			return
+		case <-t.wake:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// next takes the next due tx from the queue, or returns how long to wait for it
+func (t *txTracker) next() (*trackedTx, time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stopped {
+		return nil, 0
+	}
+	if len(t.queue) == 0 {
+		return nil, t.config.MaxInterval
+	}
+
+	now := t.deps.clock()
+	tx := t.queue[0]
+	if wait := tx.nextCheck.Sub(now); wait > 0 {
+		return nil, wait
+	}
+	heap.Pop(&t.queue)
+	metricTxTrackerLag.Set(now.Sub(tx.nextCheck).Seconds(), t.deps.chain.Name)
+
+	// Let another worker take the next one if it's due as well
+	if len(t.queue) > 0 && !t.queue[0].nextCheck.After(now) {
+		t.notify()
+	}
+	return tx, 0
+}
+
+// A claim outlives the longest interval between lookups, so it's only taken over if its owner is gone
+func (t *txTracker) claimExpiry() time.Duration {
+	return 2*t.config.MaxInterval + t.deps.timeouts.TxStatus
+}
+
+// claim takes or renews the claim of the tx, it returns false if another instance tracks it
+func (t *txTracker) claim(txHash string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), t.deps.timeouts.TxStatus)
+	defer cancel()
+	claimed, err := t.deps.state.ClaimTxTracking(ctx, txHash, t.id, t.claimExpiry())
+	if err != nil {
+		t.logger.logError("[tx-tracker] claim of %s failed: %v", txHash, err)
+		return true // look it up anyway
+	}
+	return claimed
+}
+
+// check looks up the status of the tx, and schedules the next lookup unless the status is final
+func (t *txTracker) check(tx *trackedTx) {
+	if !t.claim(tx.hash) {
+		t.mu.Lock()
+		delete(t.txs, tx.hash)
+		metricTxTrackerQueueDepth.Set(float64(len(t.txs)), t.deps.chain.Name)
+		t.mu.Unlock()
+		return
+	}
+
+	var status types.PrivateTxStatus
+	lifecycle, changed, err := t.lookup(tx.hash)
+	if err != nil {
+		t.logger.logError("[tx-tracker] status of %s failed: %v", tx.hash, err)
+		metricTxTrackerChecks.Inc("error")
+	} else if lifecycle != nil {
+		status = lifecycle.Status
+		metricTxTrackerChecks.Inc(strings.ToLower(string(status)))
+	} else {
+		metricTxTrackerChecks.Inc("not_found")
+	}
+	if changed {
+		t.updateNonceFix(lifecycle)
+	}
+
+	now := t.deps.clock()
+	expired := false
+	t.mu.Lock()
+
+	// Back off while the status doesn't change
+	if lifecycle != nil && status != tx.status {
+		t.logger.log("[tx-tracker] %s: %s", tx.hash, status)
+		tx.status = status
+		tx.interval = t.config.MinInterval
+	} else {
+		tx.interval *= 2
+		if tx.interval > t.config.MaxInterval {
+			tx.interval = t.config.MaxInterval
+		}
+	}
+
+	switch {
+	case err == nil && (lifecycle == nil || status.IsFinal()):
+		delete(t.txs, tx.hash)
+	case now.Sub(tx.sentAt) >= t.config.MaxAge:
+		t.logger.log("[tx-tracker] not tracking %s anymore, status after %s: %s", tx.hash, t.config.MaxAge, tx.status)
+		delete(t.txs, tx.hash)
+		expired = true
+	case !t.stopped:
+		tx.nextCheck = now.Add(tx.interval)
+		heap.Push(&t.queue, tx)
+	}
+	metricTxTrackerQueueDepth.Set(float64(len(t.txs)), t.deps.chain.Name)
+	t.mu.Unlock()
+
+	if expired {
+		t.expire(tx.hash)
+	}
+}
+
+// expire marks a tx which isn't tracked anymore as unknown if its status isn't final, as nothing updates it later
+func (t *txTracker) expire(txHash string) {
+	now := t.deps.clock().UTC()
+	reason := fmt.Sprintf("not tracked anymore after %s", t.config.MaxAge)
+	err := t.deps.state.UpdateTxLifecycle(context.Background(), txHash, t.deps.txLifecycleRetention, func(lifecycle *types.TxLifecycle, found bool) bool {
+		return found && !lifecycle.Status.IsFinal() && lifecycle.SetStatus(now, types.TxStatusUnknown, types.TxEventSourceTracker, reason)
+	})
+	if err != nil {
+		t.logger.logError("[tx-tracker] expiry of %s failed: %v", txHash, err)
+	}
+}
+
+// Blocks after the max block of a tx until it counts as not included, so the status API can catch up with its inclusion
+const maxBlockExpiryMargin = 2
+
+// lookup gets the status of the tx from the tx status API and stores it in the lifecycle record. Txs which were not
+// included by their max block are failed. It returns the record (nil if it expired), and whether its status changed.
+func (t *txTracker) lookup(txHash string) (lifecycle *types.TxLifecycle, changed bool, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), t.deps.timeouts.TxStatus)
+	defer cancel()
+	res, err := t.deps.txStatus.GetTxStatus(ctx, txHash)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var includedBlock uint64
+	if res.Status == types.TxStatusIncluded {
+		ctx, cancel := context.WithTimeout(context.Background(), t.deps.timeouts.Proxy)
+		defer cancel()
+		if includedBlock, err = txInclusionBlock(ctx, t.proxyPool, txHash); err != nil {
+			t.logger.logError("[tx-tracker] receipt of %s failed: %v", txHash, err)
+		}
+	}
+
+	lifecycle, changed, err = t.deps.updateTxLifecycleStatus(txHash, res.Status, types.TxEventSourceStatusApi, "", includedBlock)
+	if err != nil || lifecycle == nil || lifecycle.Status.IsFinal() || lifecycle.Routing.MaxBlockNumber == "" {
+		return lifecycle, changed, err
+	}
+
+	maxBlock, err := hexutil.DecodeUint64(lifecycle.Routing.MaxBlockNumber)
+	if err != nil {
+		return lifecycle, changed, nil // invalid, the tx never expires
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), t.deps.timeouts.Proxy)
+	defer cancel()
+	head, err := t.proxyPool.BlockNumber(ctx)
+	if err != nil {
+		t.logger.logError("[tx-tracker] block number failed: %v", err)
+		return lifecycle, changed, nil
+	}
+	if head <= maxBlock+maxBlockExpiryMargin {
+		return lifecycle, changed, nil
+	}
+
+	reason := fmt.Sprintf("not included by max block %d", maxBlock)
+	return t.deps.updateTxLifecycleStatus(txHash, types.TxStatusFailed, types.TxEventSourceTracker, reason, 0)
+}
+
+// cachedTxStatus returns the status of a private tx from its lifecycle record, without calling the tx status API. Txs
+// which are not final are tracked if no instance tracks them (e.g. after a restart).
+func (r *RpcRequest) cachedTxStatus(txHash string) (status types.PrivateTxStatus, found bool) {
+	lifecycle, found, err := r.state.GetTxLifecycle(r.ctx, strings.ToLower(txHash))
+	if err != nil {
+		r.logger.logError("[tx-tracker] redis:GetTxLifecycle failed: %v", err)
+		return "", false
+	}
+	if !found {
+		return "", false
+	}
+	if !lifecycle.Status.IsFinal() {
+		r.txTracker.Track(txHash, lifecycle.CreatedAt)
+	}
+	return lifecycle.Status, true
+}
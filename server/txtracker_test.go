@@ -0,0 +1,132 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/flashbots/rpc-endpoint/testutils"
+	"github.com/flashbots/rpc-endpoint/types"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestTxTracker(t *testing.T, config TxTrackerConfig) (*txTracker, *requestDeps) {
+	deps := newTestDeps()
+	setupMockTxApi(t, deps)
+	tracker := newTxTracker(config, deps, nil, NewLogger(""))
+	deps.txTracker = tracker
+	return tracker, deps
+}
+
+func txLifecycleStatus(t *testing.T, deps *requestDeps, txHash string) types.PrivateTxStatus {
+	lifecycle, found, err := deps.state.GetTxLifecycle(context.Background(), txHash)
+	require.Nil(t, err, err)
+	require.True(t, found)
+	return lifecycle.Status
+}
+
+func TestTxTracker(t *testing.T) {
+	tracker, deps := newTestTxTracker(t, TxTrackerConfig{MinInterval: time.Millisecond, MaxInterval: 5 * time.Millisecond})
+	defer tracker.Stop()
+
+	txHash := "0xfoo"
+	fakeTxSent(t, deps, txHash)
+	tracker.Track(txHash, time.Now())
+	tracker.Track(txHash, time.Now()) // only once
+	require.Equal(t, 1, tracker.QueueDepth())
+	require.Equal(t, float64(1), metricTxTrackerQueueDepth.Value(deps.chain.Name))
+
+	// Tracked while pending
+	testutils.MockTxApiSetStatus(txHash, types.TxStatusPending)
+	require.Eventually(t, func() bool { return txLifecycleStatus(t, deps, txHash) == types.TxStatusPending }, time.Second, time.Millisecond)
+	require.Equal(t, 1, tracker.QueueDepth())
+
+	// Not tracked anymore when the status is final
+	testutils.MockTxApiSetStatus(txHash, types.TxStatusFailed)
+	require.Eventually(t, func() bool { return tracker.QueueDepth() == 0 }, time.Second, time.Millisecond)
+	require.Equal(t, types.TxStatusFailed, txLifecycleStatus(t, deps, txHash))
+	require.Equal(t, float64(0), metricTxTrackerQueueDepth.Value(deps.chain.Name))
+
+	// Txs without a lifecycle record are not tracked after the first lookup
+	tracker.Track("0xbar", time.Now())
+	require.Eventually(t, func() bool { return tracker.QueueDepth() == 0 }, time.Second, time.Millisecond)
+
+	// Too old to track
+	tracker.Track(txHash, time.Now().Add(-DefaultTxTrackerConfig.MaxAge))
+	require.Equal(t, 0, tracker.QueueDepth())
+}
+
+func TestTxTrackerBackoff(t *testing.T) {
+	clock := &testClock{}
+	tracker, deps := newTestTxTracker(t, TxTrackerConfig{MinInterval: time.Second, MaxInterval: 4 * time.Second, MaxAge: 20 * time.Second})
+	deps.clock = clock.Now
+	now := time.Now()
+	clock.Set(now)
+
+	txHash := "0xfoo"
+	fakeTxSent(t, deps, txHash)
+	tracker.txs[txHash] = &trackedTx{hash: txHash, sentAt: now, interval: time.Second}
+
+	// The interval is doubled up to the max while the status doesn't change
+	tracker.check(tracker.txs[txHash])
+	require.Equal(t, types.TxStatusUnknown, tracker.txs[txHash].status)
+	require.Equal(t, time.Second, tracker.txs[txHash].interval)
+	for _, interval := range []time.Duration{2 * time.Second, 4 * time.Second, 4 * time.Second} {
+		tx, _ := tracker.next()
+		require.Nil(t, tx) // not due yet
+		clock.Set(tracker.queue[0].nextCheck)
+		tx, _ = tracker.next()
+		require.NotNil(t, tx)
+		tracker.check(tx)
+		require.Equal(t, interval, tx.interval)
+	}
+
+	// Reset on a status change
+	testutils.MockTxApiSetStatus(txHash, types.TxStatusPending)
+	clock.Set(tracker.queue[0].nextCheck)
+	tx, _ := tracker.next()
+	tracker.check(tx)
+	require.Equal(t, time.Second, tx.interval)
+	require.Equal(t, 1, tracker.QueueDepth())
+
+	// Given up after the max age, the status isn't known anymore
+	clock.Set(now.Add(20 * time.Second))
+	tx, _ = tracker.next()
+	tracker.check(tx)
+	require.Equal(t, 0, tracker.QueueDepth())
+	lifecycle, _, err := deps.state.GetTxLifecycle(context.Background(), txHash)
+	require.Nil(t, err, err)
+	require.Equal(t, types.TxStatusUnknown, lifecycle.Status)
+	lastEvent := lifecycle.Events[len(lifecycle.Events)-1]
+	require.Equal(t, types.TxEventSourceTracker, lastEvent.Source)
+	require.Equal(t, "not tracked anymore after 20s", lastEvent.Message)
+}
+
+// Instances sharing the state store don't track the same tx, unless its tracker is gone
+func TestTxTrackerClaim(t *testing.T) {
+	clock := &testClock{}
+	now := time.Now()
+	clock.Set(now)
+	config := TxTrackerConfig{MinInterval: time.Second, MaxInterval: 4 * time.Second}
+	tracker, deps := newTestTxTracker(t, config)
+	deps.clock = clock.Now
+	deps.state = NewMemoryState(clock.Now)
+	other := newTxTracker(config, deps, nil, NewLogger(""))
+
+	txHash := "0xfoo"
+	fakeTxSent(t, deps, txHash)
+	testutils.MockTxApiSetStatus(txHash, types.TxStatusPending)
+	tracker.txs[txHash] = &trackedTx{hash: txHash, sentAt: now, interval: time.Second}
+	other.txs[txHash] = &trackedTx{hash: txHash, sentAt: now, interval: time.Second}
+
+	tracker.check(tracker.txs[txHash])
+	require.Equal(t, 1, tracker.QueueDepth())
+	other.check(other.txs[txHash])
+	require.Equal(t, 0, other.QueueDepth())
+
+	// Taken over once the claim expired
+	clock.Set(now.Add(tracker.claimExpiry()))
+	other.txs[txHash] = &trackedTx{hash: txHash, sentAt: now, interval: time.Second}
+	other.check(other.txs[txHash])
+	require.Equal(t, 1, other.QueueDepth())
+}
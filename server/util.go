@@ -2,16 +2,12 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"encoding/hex"
-	"encoding/json"
-	"fmt"
-	"io/ioutil"
 	"net/http"
 	"strconv"
-	"time"
 
 	ethtypes "github.com/ethereum/go-ethereum/core/types"
-	"github.com/flashbots/rpc-endpoint/types"
 	"github.com/pkg/errors"
 )
 
@@ -29,9 +25,10 @@ func Max(a uint64, b uint64) uint64 {
 	return b
 }
 
-func ProxyRequest(proxyUrl string, body []byte) (*http.Response, error) {
+// The request is cancelled with ctx, which also limits the time to read the response body
+func ProxyRequest(ctx context.Context, client *http.Client, proxyUrl string, body []byte) (*http.Response, error) {
 	// Create new request:
-	req, err := http.NewRequest("POST", proxyUrl, bytes.NewBuffer(body))
+	req, err := http.NewRequestWithContext(ctx, "POST", proxyUrl, bytes.NewBuffer(body))
 	if err != nil {
 		return nil, err
 	}
@@ -39,9 +36,6 @@ func ProxyRequest(proxyUrl string, body []byte) (*http.Response, error) {
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Content-Length", strconv.Itoa(len(body)))
 
-	client := &http.Client{
-		Timeout: time.Duration(10 * time.Second),
-	}
 	return client.Do(req)
 }
 
@@ -80,26 +74,3 @@ func GetSenderFromRawTx(tx *ethtypes.Transaction) (string, error) {
 
 	return from, nil
 }
-
-func GetTxStatus(txHash string) (*types.PrivateTxApiResponse, error) {
-	privTxApiUrl := fmt.Sprintf("%s/tx/%s", ProtectTxApiHost, txHash)
-	resp, err := http.Get(privTxApiUrl)
-	if err != nil {
-		return nil, errors.Wrap(err, "privTxApi call failed for "+txHash)
-	}
-	defer resp.Body.Close()
-
-	bodyBytes, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, errors.Wrap(err, "privTxApi body-read failed for "+txHash)
-	}
-
-	respObj := new(types.PrivateTxApiResponse)
-	err = json.Unmarshal(bodyBytes, respObj)
-	if err != nil {
-		msg := fmt.Sprintf("privTxApi jsonUnmarshal failed for %s - status: %d / body: %s", txHash, resp.StatusCode, string(bodyBytes))
-		return nil, errors.Wrap(err, msg)
-	}
-
-	return respObj, nil
-}
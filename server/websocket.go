@@ -0,0 +1,329 @@
+/*
+WebSocket JSON-RPC transport. Requests go through the same RpcRequest pipeline as HTTP requests, except for
+eth_subscribe/eth_unsubscribe which are proxied to a WebSocket-capable upstream node.
+*/
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/flashbots/rpc-endpoint/tracing"
+	"github.com/flashbots/rpc-endpoint/types"
+	"github.com/flashbots/rpc-endpoint/utils"
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+)
+
+var WsPingInterval = time.Duration(30 * time.Second)
+var WsMaxMessageSize int64 = 1024 * 1024 // 1 MB (large enough for big rawTx payloads)
+
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	CheckOrigin:     func(r *http.Request) bool { return true }, // same as Access-Control-Allow-Origin: *
+}
+
+func isSubscriptionMethod(method string) bool {
+	return method == "eth_subscribe" || method == "eth_unsubscribe"
+}
+
+// A single client WebSocket connection
+type wsConnection struct {
+	*requestDeps
+	conn       *websocket.Conn
+	writeMu    sync.Mutex
+	logger     Logger
+	ip         string
+	origin     string
+	apiKey     string
+	proxyPool  *ProxyPool
+	wsProxyUrl string
+	prefs      UserPreferences
+	prefsErr   error // invalid options in the connection URL
+
+	// Upstream connection for subscriptions, dialed on first eth_subscribe
+	upstreamMu sync.Mutex
+	upstream   *websocket.Conn
+
+	// Cancelled when the client goes away, which aborts in-flight messages. Not on shutdown, where they are finished.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	pending   sync.WaitGroup // messages being processed
+	stopping  int32          // set atomically on server shutdown
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func (s *RpcEndPointServer) handleWebSocket(respw http.ResponseWriter, req *http.Request) {
+	ip := utils.GetIP(req)
+	id := requestId(req)
+	respw.Header().Set(RequestIdHeader, id)
+	logger := s.logger.With("requestId", id).With("ip", ip).With("origin", req.Header.Get("Origin")).With("apiKey", req.Header.Get(ApiKeyHeader))
+
+	if IsBlacklisted(ip) {
+		logger.logWarn("Blocked IP: %s", ip)
+		respw.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if s.IsDraining() {
+		respw.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	conn, err := wsUpgrader.Upgrade(respw, req, http.Header{RequestIdHeader: {id}})
+	if err != nil {
+		logger.logError("[ws] upgrade failed: %v", err) // Upgrade has already responded with an http error
+		return
+	}
+
+	logger.log("[ws] connection opened from %s", ip)
+	c := &wsConnection{
+		conn:        conn,
+		logger:      logger,
+		ip:          ip,
+		origin:      req.Header.Get("Origin"),
+		apiKey:      req.Header.Get(ApiKeyHeader),
+		requestDeps: s.requestDeps,
+		proxyPool:   s.proxyPool,
+		wsProxyUrl:  s.wsProxyUrl,
+		done:        make(chan struct{}),
+	}
+	c.ctx, c.cancel = context.WithCancel(tracing.Extract(req.Context(), req.Header)) // messages continue the trace of the client
+	var ignoredOptions []string
+	c.prefs, ignoredOptions, c.prefsErr = ParseUserPreferences(req.URL, s.relays)
+	if len(ignoredOptions) > 0 {
+		c.logger.logDebug("[ws] ignored url options: %s", strings.Join(ignoredOptions, ", "))
+	}
+
+	s.wsConnsMu.Lock()
+	s.wsConns[c] = true
+	s.wsConnsMu.Unlock()
+
+	c.run()
+
+	s.wsConnsMu.Lock()
+	delete(s.wsConns, c)
+	s.wsConnsMu.Unlock()
+	logger.log("[ws] connection closed")
+}
+
+func (c *wsConnection) run() {
+	defer c.close()
+	defer c.pending.Wait() // let in-flight messages write their response before closing
+
+	c.conn.SetReadLimit(WsMaxMessageSize)
+	c.conn.SetReadDeadline(time.Now().Add(2 * WsPingInterval))
+	c.conn.SetPongHandler(func(string) error {
+		if atomic.LoadInt32(&c.stopping) == 1 {
+			return nil // keep the deadline set by stopReading
+		}
+		return c.conn.SetReadDeadline(time.Now().Add(2 * WsPingInterval))
+	})
+	go c.pingLoop()
+
+	for count := 0; ; count++ {
+		_, msg, err := c.conn.ReadMessage()
+		if err != nil {
+			if atomic.LoadInt32(&c.stopping) == 1 {
+				c.logger.log("[ws] stopped reading for shutdown")
+				return
+			}
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				c.logger.log("[ws] read error: %v", err)
+			}
+			c.cancel() // nobody is left to read the responses
+			return
+		}
+
+		// Process messages concurrently, like requests in a batch
+		c.pending.Add(1)
+		c.inflight.Add(1)
+		go func(logger Logger, msg []byte) {
+			defer c.inflight.Done()
+			defer c.pending.Done()
+			c.handleMessage(logger, msg)
+		}(c.logger.With("message", count), msg)
+	}
+}
+
+func (c *wsConnection) pingLoop() {
+	ticker := time.NewTicker(WsPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.writeMu.Lock()
+			err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second))
+			c.writeMu.Unlock()
+			if err != nil {
+				c.close()
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// stopReading makes the read loop exit, after which the connection is closed once in-flight messages are answered
+func (c *wsConnection) stopReading() {
+	atomic.StoreInt32(&c.stopping, 1)
+	c.conn.SetReadDeadline(time.Now())
+}
+
+func (c *wsConnection) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.cancel()
+		if atomic.LoadInt32(&c.stopping) == 1 {
+			c.writeMu.Lock()
+			c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"), time.Now().Add(time.Second))
+			c.writeMu.Unlock()
+		}
+		c.conn.Close()
+
+		c.upstreamMu.Lock()
+		if c.upstream != nil {
+			c.upstream.Close()
+		}
+		c.upstreamMu.Unlock()
+	})
+}
+
+func (c *wsConnection) write(msg []byte) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	if err := c.conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+		c.logger.logError("[ws] write failed: %v", err)
+	}
+}
+
+func (c *wsConnection) writeJson(v interface{}) {
+	msg, err := json.Marshal(v)
+	if err != nil {
+		c.logger.logError("[ws] failed marshalling response: %v", err)
+		return
+	}
+	c.write(msg)
+}
+
+func (c *wsConnection) handleMessage(logger Logger, msg []byte) {
+	entries, isBatch, errRes := parseJsonRpcPayload(msg)
+	if errRes != nil {
+		logger.logError("[ws] parse payload: %s", errRes.Error.Message)
+		c.writeJson(errRes)
+		return
+	}
+
+	if !isBatch {
+		jsonReq := entries[0].req
+		if jsonReq == nil {
+			c.writeJson(entries[0].errRes)
+			return
+		}
+
+		if isSubscriptionMethod(jsonReq.Method) {
+			if res := c.rateLimitResponse(logger, jsonReq); res != nil {
+				c.writeJson(res)
+				return
+			}
+
+			// Response comes back through the upstream reader
+			if err := c.forwardToUpstream(msg); err != nil {
+				logger.logError("[ws] %s failed: %v", jsonReq.Method, err)
+				c.writeJson(jsonRpcErrorResponse(jsonReq.Id, err.Error(), types.JsonRpcInternalError))
+			}
+			return
+		}
+
+		res := c.processRequest(logger, jsonReq)
+		if !jsonReq.IsNotification() {
+			c.writeJson(res)
+		}
+		return
+	}
+
+	responses := processJsonRpcBatch(entries, func(i int, jsonReq *types.JsonRpcRequest) *types.JsonRpcResponse {
+		if isSubscriptionMethod(jsonReq.Method) {
+			return jsonRpcErrorResponse(jsonReq.Id, jsonReq.Method+" is not supported in batch requests", types.JsonRpcInvalidRequest)
+		}
+		return c.processRequest(logger.With("batchIndex", i), jsonReq)
+	})
+	if len(responses) > 0 {
+		c.writeJson(responses)
+	}
+}
+
+func (c *wsConnection) processRequest(logger Logger, jsonReq *types.JsonRpcRequest) *types.JsonRpcResponse {
+	ctx, cancel := context.WithTimeout(c.ctx, c.timeouts.Request)
+	defer cancel()
+	rpcReq := NewRpcRequest(ctx, c.requestDeps, logger, jsonReq, c.proxyPool, c.ip, c.origin, c.apiKey)
+	rpcReq.prefs, rpcReq.prefsErr = c.prefs, c.prefsErr
+	return rpcReq.ProcessRequest()
+}
+
+// Returns the error response if the client is over its rate limit for a request that doesn't go through ProcessRequest
+func (c *wsConnection) rateLimitResponse(logger Logger, jsonReq *types.JsonRpcRequest) *types.JsonRpcResponse {
+	ctx, cancel := context.WithTimeout(c.ctx, c.timeouts.Request)
+	defer cancel()
+	rpcReq := NewRpcRequest(ctx, c.requestDeps, logger, jsonReq, c.proxyPool, c.ip, c.origin, c.apiKey)
+	if rpcReq.checkIpRateLimit() {
+		return nil
+	}
+	return rpcReq.jsonRes
+}
+
+// Sends a subscription request upstream, dialing the upstream connection if needed
+func (c *wsConnection) forwardToUpstream(msg []byte) error {
+	c.upstreamMu.Lock()
+	defer c.upstreamMu.Unlock()
+
+	if c.wsProxyUrl == "" {
+		return errors.New("subscriptions are not supported")
+	}
+
+	if c.upstream == nil {
+		select {
+		case <-c.done:
+			return errors.New("connection closed")
+		default:
+		}
+
+		upstream, _, err := websocket.DefaultDialer.Dial(c.wsProxyUrl, nil)
+		if err != nil {
+			return errors.Wrap(err, "upstream dial failed")
+		}
+		c.upstream = upstream
+		go c.readUpstream(upstream)
+	}
+
+	return c.upstream.WriteMessage(websocket.TextMessage, msg)
+}
+
+// Passes all upstream messages (subscription responses and notifications) to the client
+func (c *wsConnection) readUpstream(upstream *websocket.Conn) {
+	// Subscriptions cannot survive losing the upstream, so the client needs to reconnect
+	defer c.close()
+
+	for {
+		_, msg, err := upstream.ReadMessage()
+		if err != nil {
+			select {
+			case <-c.done:
+			default:
+				c.logger.log("[ws] upstream read error: %v", err)
+			}
+			return
+		}
+		c.write(msg)
+	}
+}
@@ -1,7 +1,7 @@
 // Whitelist for smart contract functions that never need protection.
 package server
 
-// Functions that never need protection
+// Functions that never need protection (used by the default protection policy)
 var allowedFunctions = map[string]bool{
 	"a9059cbb": true, // transfer
 	"23b872dd": true, // transferFrom
@@ -11,17 +11,6 @@ var allowedFunctions = map[string]bool{
 	"f242432a": true, // safe transfer NFT
 }
 
-func isOnFunctionWhiteList(data string) bool {
-	if len(data) < 8 {
-		return false
-	}
-	if allowedFunctions[data[0:8]] {
-		return true
-	} else {
-		return false
-	}
-}
-
 var allowedLargeTxTargets = map[string]bool{
 	"0x737901bea3eeb88459df9ef1be8ff3ae1b42a2ba": true, // Aztec rollup contract
 }
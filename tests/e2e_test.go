@@ -5,6 +5,7 @@ package tests
 
 import (
 	"bytes"
+	"context"
 	"crypto/ecdsa"
 	"encoding/json"
 	"fmt"
@@ -16,7 +17,6 @@ import (
 	"testing"
 	"time"
 
-	"github.com/alicebob/miniredis"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/flashbots/rpc-endpoint/server"
 	"github.com/flashbots/rpc-endpoint/testutils"
@@ -28,6 +28,12 @@ import (
 
 var RpcBackendServerUrl string
 
+// State store of the current RPC endpoint server
+var rpcState server.StateStore
+
+// The current RPC endpoint server, which is shut down on reset so its tx tracker stops calling the mock backends
+var rpcServer *server.RpcEndPointServer
+
 var relaySigningKey *ecdsa.PrivateKey
 
 func init() {
@@ -38,17 +44,15 @@ func init() {
 	}
 }
 
-// func setServerTimeNowOffset(td time.Duration) {
-// 	server.Now = func() time.Time {
-// 		return time.Now().Add(td)
-// 	}
-// }
-
 // Reset the RPC endpoint and mock backend servers
 func resetTestServers() {
-	redisServer, err := miniredis.Run()
-	if err != nil {
-		panic(err)
+	resetTestServersWithConfig(nil)
+}
+
+// Reset the servers, with changes to the default config of the RPC endpoint
+func resetTestServersWithConfig(configure func(config *server.RpcEndPointServerConfig)) {
+	if rpcServer != nil {
+		rpcServer.Shutdown()
 	}
 
 	// Create a fresh mock backend server (covers for both eth node and relay)
@@ -57,17 +61,38 @@ func resetTestServers() {
 	testutils.MockBackendLastRawRequest = nil
 	testutils.MockBackendLastJsonRpcRequest = nil
 	testutils.MockBackendLastJsonRpcRequestTimestamp = time.Time{}
+	testutils.MockBackendRevertReason = ""
+
+	// Mock backend for subscriptions over WebSocket
+	rpcBackendWsServer := httptest.NewServer(http.HandlerFunc(testutils.RpcBackendWsHandler))
+	rpcBackendWsUrl := strings.Replace(rpcBackendWsServer.URL, "http", "ws", 1)
 
 	testutils.MockTxApiReset()
 	txApiServer := httptest.NewServer(http.HandlerFunc(testutils.MockTxApiHandler))
-	server.ProtectTxApiHost = txApiServer.URL
 
 	// Create a fresh RPC endpoint server
-	rpcServer, err := server.NewRpcEndPointServer("test", "", rpcBackendServer.URL, rpcBackendServer.URL, relaySigningKey, redisServer.Addr())
+	chain := server.Chains["mainnet"]
+	chain.RelayUrl = rpcBackendServer.URL
+	chain.ProtectTxApiHost = txApiServer.URL
+	rpcState = server.NewMemoryState(time.Now)
+	config := server.RpcEndPointServerConfig{
+		Version:         "test",
+		ProxyUrls:       []string{rpcBackendServer.URL},
+		WsProxyUrl:      rpcBackendWsUrl,
+		RelaySigningKey: relaySigningKey,
+		Chain:           chain,
+		StateStore:      rpcState,
+		TxTracker:       server.TxTrackerConfig{MinInterval: time.Millisecond, MaxInterval: 10 * time.Millisecond},
+	}
+	if configure != nil {
+		configure(&config)
+	}
+	var err error
+	rpcServer, err = server.NewRpcEndPointServer(config)
 	if err != nil {
 		panic(err)
 	}
-	rpcEndpointServer := httptest.NewServer(http.HandlerFunc(rpcServer.HandleHttpRequest))
+	rpcEndpointServer := httptest.NewServer(rpcServer.Handler())
 	testutils.RpcEndpointUrl = rpcEndpointServer.URL
 }
 
@@ -97,6 +122,30 @@ func TestStandardHeaders(t *testing.T) {
 	assert.Equal(t, "application/json", strings.ToLower(contentTypeHeader))
 }
 
+// The request id is echoed back if valid, otherwise generated
+func TestRequestIdHeader(t *testing.T) {
+	resetTestServers()
+
+	for requestId, echoed := range map[string]bool{
+		"":                      false,
+		"lb-1234.abc:5":         true,
+		"invalid id":            false,
+		strings.Repeat("a", 65): false,
+	} {
+		req, err := http.NewRequest("POST", testutils.RpcEndpointUrl, strings.NewReader(`{"jsonrpc":"2.0","id":1,"method":"eth_chainId","params":[]}`))
+		require.Nil(t, err, err)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(server.RequestIdHeader, requestId)
+		resp, err := http.DefaultClient.Do(req)
+		require.Nil(t, err, err)
+		resp.Body.Close()
+
+		responseId := resp.Header.Get(server.RequestIdHeader)
+		require.NotEmpty(t, responseId, requestId)
+		require.Equal(t, echoed, responseId == requestId, requestId)
+	}
+}
+
 // Check json-rpc id and version
 func TestJsonRpc(t *testing.T) {
 	resetTestServers()
@@ -165,6 +214,20 @@ func TestSendBundleResponse(t *testing.T) {
 	require.Equal(t, testutils.TestTx_BundleFailedTooManyTimes_Hash, rpcResult)
 }
 
+func TestDebugProtectionDecision(t *testing.T) {
+	resetTestServers()
+
+	req := types.NewJsonRpcRequest(1, "flashbots_debugProtectionDecision", []interface{}{testutils.TestTx_MM2_RawTx})
+	res := testutils.SendRpcAndParseResponseOrFailNow(t, req)
+
+	var decision server.PolicyDecision
+	err := json.Unmarshal(res.Result, &decision)
+	require.Nil(t, err, err)
+	require.False(t, decision.NeedsProtection)
+	require.Equal(t, server.PolicyActionMempool, decision.Action)
+	require.Equal(t, "low-gas", decision.Rule)
+}
+
 func TestNull(t *testing.T) {
 	resetTestServers()
 	expectedResultRaw := `{"id":1,"result":null,"jsonrpc":"2.0"}` + "\n"
@@ -211,23 +274,24 @@ func TestGetTxReceiptNull(t *testing.T) {
 
 func TestMetamaskFix(t *testing.T) {
 	resetTestServers()
-	testutils.MockTxApiStatusForHash[testutils.TestTx_MM2_Hash] = types.TxStatusFailed
+	testutils.MockTxApiSetStatus(testutils.TestTx_BundleFailedTooManyTimes_Hash, types.TxStatusFailed)
 
-	req_getTransactionCount := types.NewJsonRpcRequest(1, "eth_getTransactionCount", []interface{}{testutils.TestTx_MM2_From, "latest"})
+	req_getTransactionCount := types.NewJsonRpcRequest(1, "eth_getTransactionCount", []interface{}{testutils.TestTx_BundleFailedTooManyTimes_From, "latest"})
 	txCountBefore := testutils.SendRpcAndParseResponseOrFailNowString(t, req_getTransactionCount)
 
-	// first sendRawTransaction call: rawTx that triggers the error (creates MM cache entry)
-	req_sendRawTransaction := types.NewJsonRpcRequest(1, "eth_sendRawTransaction", []interface{}{testutils.TestTx_MM2_RawTx})
+	// first sendRawTransaction call: private rawTx that triggers the error (creates MM cache entry)
+	req_sendRawTransaction := types.NewJsonRpcRequest(1, "eth_sendRawTransaction", []interface{}{testutils.TestTx_BundleFailedTooManyTimes_RawTx})
 	r1 := testutils.SendRpcAndParseResponseOrFailNowAllowRpcError(t, req_sendRawTransaction)
 	require.Nil(t, r1.Error, r1.Error)
 	fmt.Printf("\n\n\n\n\n")
 
-	// call getTxReceipt to trigger query to Tx API
-	req_getTransactionReceipt := types.NewJsonRpcRequest(1, "eth_getTransactionReceipt", []interface{}{testutils.TestTx_MM2_Hash})
-	jsonResp := testutils.SendRpcAndParseResponseOrFailNow(t, req_getTransactionReceipt)
-	require.Nil(t, jsonResp.Error)
-	require.Equal(t, "null", string(jsonResp.Result))
-	// require.Equal(t, "Transaction failed", jsonResp.Error.Message)
+	// The tx tracker looks up the failed status in the background, and sets the nonce-fix without a receipt poll
+	waitForTxStatus(t, testutils.TestTx_BundleFailedTooManyTimes_Hash, types.TxStatusFailed)
+	require.Eventually(t, func() bool {
+		_, found, err := rpcState.GetNonceFixForAccount(context.Background(), testutils.TestTx_BundleFailedTooManyTimes_From)
+		require.Nil(t, err, err)
+		return found
+	}, time.Second, time.Millisecond)
 
 	// At this point, the tx hash should be blacklisted and too high a nonce is returned
 	valueAfter1 := testutils.SendRpcAndParseResponseOrFailNowString(t, req_getTransactionCount)
@@ -251,6 +315,38 @@ func TestMetamaskFix(t *testing.T) {
 	require.Equal(t, txCountBefore, valueAfter5)
 }
 
+// The nonce-fix is removed once the on-chain nonce of the sender is past the failed nonce
+func TestMetamaskFixClearedOnChain(t *testing.T) {
+	resetTestServers()
+	ctx := context.Background()
+	from := strings.ToLower(testutils.TestTx_MM2_From)
+	req_getTransactionCount := types.NewJsonRpcRequest(1, "eth_getTransactionCount", []interface{}{testutils.TestTx_MM2_From, "latest"})
+
+	// The mock node returns 0x22, so a failed tx with that nonce can still be dropped
+	_, err := rpcState.CreateNonceFixForAccount(ctx, from, 0x22)
+	require.Nil(t, err, err)
+	require.Equal(t, "0x3b9aca01", testutils.SendRpcAndParseResponseOrFailNowString(t, req_getTransactionCount))
+
+	// A tx with the failed nonce is on chain
+	err = rpcState.DelNonceFixForAccount(ctx, from)
+	require.Nil(t, err, err)
+	_, err = rpcState.CreateNonceFixForAccount(ctx, from, 0x21)
+	require.Nil(t, err, err)
+	require.Equal(t, "0x22", testutils.SendRpcAndParseResponseOrFailNowString(t, req_getTransactionCount))
+	_, found, err := rpcState.GetNonceFixForAccount(ctx, from)
+	require.Nil(t, err, err)
+	require.False(t, found)
+}
+
+// Invalid params of eth_getTransactionCount are left to the node to answer
+func TestGetTransactionCountInvalidParams(t *testing.T) {
+	resetTestServers()
+	req := types.NewJsonRpcRequest(1, "eth_getTransactionCount", []interface{}{"0x12", "latest"})
+	res := testutils.SendRpcAndParseResponseOrFailNowAllowRpcError(t, req)
+	require.Nil(t, res.Error)
+	require.Equal(t, "eth_getTransactionCount", testutils.MockBackendLastJsonRpcRequest.Method)
+}
+
 func TestRelayTx(t *testing.T) {
 	resetTestServers()
 
@@ -282,7 +378,7 @@ func TestRelayTx(t *testing.T) {
 	require.Equal(t, timeStampFirstRequest, testutils.MockBackendLastJsonRpcRequestTimestamp)
 
 	// Ensure nonce is saved to redis
-	nonce, found, err := server.RState.GetSenderMaxNonce(testutils.TestTx_BundleFailedTooManyTimes_From)
+	nonce, found, err := rpcState.GetSenderMaxNonce(context.Background(), testutils.TestTx_BundleFailedTooManyTimes_From)
 	require.Nil(t, err, err)
 	require.True(t, found)
 	require.Equal(t, uint64(30), nonce)
@@ -315,6 +411,138 @@ func TestRelayCancelTx(t *testing.T) {
 	require.Equal(t, testutils.TestTx_CancelAtRelay_Cancel_Hash, res)
 }
 
+// Txs and cancellations are sent to all relays, and accepted if any relay accepts them
+func TestRelayTxMultipleRelays(t *testing.T) {
+	relays := testutils.NewMockRelays(3)
+	for _, relay := range relays {
+		defer relay.Close()
+	}
+	builderKey, err := crypto.GenerateKey()
+	require.Nil(t, err, err)
+
+	resetTestServersWithConfig(func(config *server.RpcEndPointServerConfig) {
+		config.Relays = []server.RelayTarget{
+			{Name: "relay", Client: server.NewFlashbotsRelayClient(relays[0].Url())},
+			{Name: "unsigned", Client: &server.FlashbotsRelayClient{Url: relays[1].Url(), HttpClient: http.DefaultClient, Unsigned: true}},
+			{Name: "own-key", Client: &server.FlashbotsRelayClient{Url: relays[2].Url(), HttpClient: http.DefaultClient, SigningKey: builderKey}},
+		}
+	})
+
+	// Two relays fail, one accepts
+	relays[0].SetError("bundle rejected")
+	relays[1].SetStatusCode(http.StatusBadGateway)
+	req := types.NewJsonRpcRequest(1, "eth_sendRawTransaction", []interface{}{testutils.TestTx_CancelAtRelay_Initial_RawTx})
+	res := testutils.SendRpcAndParseResponseOrFailNow(t, req)
+	require.Nil(t, res.Error)
+	for _, relay := range relays {
+		require.Equal(t, 1, len(relay.Requests("eth_sendPrivateTransaction")))
+	}
+
+	// Each relay with its own signing
+	require.True(t, strings.HasPrefix(relays[0].Signatures()[0], crypto.PubkeyToAddress(relaySigningKey.PublicKey).Hex()+":"))
+	require.Equal(t, "", relays[1].Signatures()[0])
+	require.True(t, strings.HasPrefix(relays[2].Signatures()[0], crypto.PubkeyToAddress(builderKey.PublicKey).Hex()+":"))
+
+	// Cancellation goes to all relays
+	req = types.NewJsonRpcRequest(1, "eth_sendRawTransaction", []interface{}{testutils.TestTx_CancelAtRelay_Cancel_RawTx})
+	res = testutils.SendRpcAndParseResponseOrFailNow(t, req)
+	require.Nil(t, res.Error)
+	for _, relay := range relays {
+		require.Equal(t, 1, len(relay.Requests("eth_cancelPrivateTransaction")))
+	}
+
+	// If all relays fail, the error of the first one is returned
+	relays[2].SetError("tx rejected")
+	req = types.NewJsonRpcRequest(1, "eth_sendRawTransaction", []interface{}{testutils.TestTx_BundleFailedTooManyTimes_RawTx})
+	res = testutils.SendRpcAndParseResponseOrFailNowAllowRpcError(t, req)
+	require.NotNil(t, res.Error)
+	require.Contains(t, res.Error.Message, "bundle rejected")
+}
+
+// Options in the endpoint URL are applied to private txs and the routing decision
+func TestUserPreferences(t *testing.T) {
+	relays := testutils.NewMockRelays(2)
+	for _, relay := range relays {
+		defer relay.Close()
+	}
+	resetTestServersWithConfig(func(config *server.RpcEndPointServerConfig) {
+		config.Relays = []server.RelayTarget{
+			{Name: "relay", Client: server.NewFlashbotsRelayClient(relays[0].Url())},
+			{Name: "builder", Client: server.NewFlashbotsRelayClient(relays[1].Url())},
+		}
+	})
+	endpointUrl := testutils.RpcEndpointUrl
+	defer func() { testutils.RpcEndpointUrl = endpointUrl }()
+
+	// Only the selected builder, with the max block number from the current block (0x10)
+	testutils.RpcEndpointUrl = endpointUrl + "/fast?maxBlocks=5&builder=builder"
+	req := types.NewJsonRpcRequest(1, "eth_sendRawTransaction", []interface{}{testutils.TestTx_CancelAtRelay_Initial_RawTx})
+	res := testutils.SendRpcAndParseResponseOrFailNow(t, req)
+	require.Nil(t, res.Error)
+	require.Equal(t, 1, len(relays[0].Requests("eth_sendPrivateTransaction"))) // fast mode sends to all relays
+	sent := relays[1].Requests("eth_sendPrivateTransaction")
+	require.Equal(t, 1, len(sent))
+	param := sent[0].Params[0].(map[string]interface{})
+	require.Equal(t, "0x15", param["maxBlockNumber"])
+	require.Equal(t, map[string]interface{}{"fast": true}, param["preferences"])
+
+	testutils.RpcEndpointUrl = endpointUrl + "?maxBlockNumber=100&builder=builder"
+	req = types.NewJsonRpcRequest(1, "eth_sendRawTransaction", []interface{}{testutils.TestTx_BundleFailedTooManyTimes_RawTx})
+	res = testutils.SendRpcAndParseResponseOrFailNow(t, req)
+	require.Nil(t, res.Error)
+	require.Equal(t, 1, len(relays[0].Requests("eth_sendPrivateTransaction")))
+	sent = relays[1].Requests("eth_sendPrivateTransaction")
+	require.Equal(t, 2, len(sent))
+	param = sent[1].Params[0].(map[string]interface{})
+	require.Equal(t, "0x64", param["maxBlockNumber"])
+	require.Nil(t, param["preferences"])
+
+	// Low gas tx is protected instead of going to the mempool
+	testutils.RpcEndpointUrl = endpointUrl + "?mempoolFallback=false"
+	req = types.NewJsonRpcRequest(1, "flashbots_debugProtectionDecision", []interface{}{testutils.TestTx_MM2_RawTx})
+	var decision server.PolicyDecision
+	err := json.Unmarshal(testutils.SendRpcAndParseResponseOrFailNow(t, req).Result, &decision)
+	require.Nil(t, err, err)
+	require.True(t, decision.NeedsProtection)
+	require.Equal(t, "user-no-mempool-fallback", decision.Rule)
+
+	// Invalid options
+	testutils.RpcEndpointUrl = endpointUrl + "?maxBlocks=1000"
+	res = testutils.SendRpcAndParseResponseOrFailNowAllowRpcError(t, types.NewJsonRpcRequest(1, "eth_blockNumber", nil))
+	require.NotNil(t, res.Error)
+	require.Equal(t, types.JsonRpcInvalidRequest, res.Error.Code)
+	require.Equal(t, `invalid url option: invalid maxBlocks "1000", must be between 1 and 100`, res.Error.Message)
+}
+
+// Cancellations only go to the relays the tx was sent to
+func TestRelayCancelTxSelectedRelays(t *testing.T) {
+	relays := testutils.NewMockRelays(2)
+	for _, relay := range relays {
+		defer relay.Close()
+	}
+	resetTestServersWithConfig(func(config *server.RpcEndPointServerConfig) {
+		config.Relays = []server.RelayTarget{
+			{Name: "relay", Client: server.NewFlashbotsRelayClient(relays[0].Url())},
+			{Name: "builder", Client: server.NewFlashbotsRelayClient(relays[1].Url())},
+		}
+	})
+	endpointUrl := testutils.RpcEndpointUrl
+	defer func() { testutils.RpcEndpointUrl = endpointUrl }()
+
+	testutils.RpcEndpointUrl = endpointUrl + "?builder=builder"
+	req := types.NewJsonRpcRequest(1, "eth_sendRawTransaction", []interface{}{testutils.TestTx_CancelAtRelay_Initial_RawTx})
+	res := testutils.SendRpcAndParseResponseOrFailNow(t, req)
+	require.Nil(t, res.Error)
+
+	// Also without the builder option in the URL of the cancellation
+	testutils.RpcEndpointUrl = endpointUrl
+	req = types.NewJsonRpcRequest(1, "eth_sendRawTransaction", []interface{}{testutils.TestTx_CancelAtRelay_Cancel_RawTx})
+	res = testutils.SendRpcAndParseResponseOrFailNow(t, req)
+	require.Nil(t, res.Error)
+	require.Equal(t, 0, len(relays[0].Requests("eth_cancelPrivateTransaction")))
+	require.Equal(t, 1, len(relays[1].Requests("eth_cancelPrivateTransaction")))
+}
+
 // cancel-tx without initial related tx would just go to mempool
 func TestRelayCancelTxWithoutInitialTx(t *testing.T) {
 	resetTestServers()
@@ -350,6 +578,135 @@ func TestRelayTxWithWrongNonce(t *testing.T) {
 	require.Equal(t, "invalid nonce", resp1.Error.Message)
 }
 
+func TestRelayTxOFAC(t *testing.T) {
+	resetTestServers()
+
+	req := types.NewJsonRpcRequest(1, "eth_sendRawTransaction", []interface{}{testutils.TestTx_MM2_RawTx})
+
+	// Sender is sanctioned (lower-cased entry must match the checksummed sender)
+	rpcServer.SetOFACList(server.NewOFACList([]string{strings.ToLower(testutils.TestTx_MM2_From)}, "test"))
+	res := testutils.SendRpcAndParseResponseOrFailNowAllowRpcError(t, req)
+	require.NotNil(t, res.Error)
+	require.Equal(t, "blocked tx from ofac sanctioned address", res.Error.Message)
+
+	// Recipient is sanctioned
+	rpcServer.SetOFACList(server.NewOFACList([]string{"0x09f427f1bd2d7537a02812275d03be7747dbd68c"}, "test"))
+	res = testutils.SendRpcAndParseResponseOrFailNowAllowRpcError(t, req)
+	require.NotNil(t, res.Error)
+	require.Equal(t, "blocked tx to ofac sanctioned address", res.Error.Message)
+}
+
+func TestChainConfig(t *testing.T) {
+	resetTestServersWithConfig(func(config *server.RpcEndPointServerConfig) {
+		chain := server.Chains["goerli"]
+		chain.CheckContract = "0x0000000000000000000000000000000000000123"
+		chain.RelayUrl = config.Chain.RelayUrl
+		chain.ProtectTxApiHost = config.Chain.ProtectTxApiHost
+		config.Chain = chain
+	})
+
+	rpcResult := testutils.SendRpcAndParseResponseOrFailNowString(t, types.NewJsonRpcRequest(1, "net_version", nil))
+	require.Equal(t, "5", rpcResult)
+
+	// Check contract of the configured chain
+	req := types.NewJsonRpcRequest(1, "eth_call", []interface{}{map[string]string{"to": "0x0000000000000000000000000000000000000123"}})
+	rpcResult = testutils.SendRpcAndParseResponseOrFailNowString(t, req)
+	require.Equal(t, "0x0000000000000000000000000000000000000000000000000000000000000001", rpcResult)
+	req = types.NewJsonRpcRequest(1, "eth_call", []interface{}{map[string]string{"to": "0xf1a54b0759b58661cea17cff19dd37940a9b5f1a"}})
+	rpcResult = testutils.SendRpcAndParseResponseOrFailNowString(t, req)
+	require.Equal(t, "0x12345", rpcResult)
+
+	// Mainnet tx is rejected before reaching the relay
+	testutils.MockBackendLastJsonRpcRequest = nil
+	req = types.NewJsonRpcRequest(1, "eth_sendRawTransaction", []interface{}{testutils.TestTx_BundleFailedTooManyTimes_RawTx})
+	res := testutils.SendRpcAndParseResponseOrFailNowAllowRpcError(t, req)
+	require.NotNil(t, res.Error)
+	require.Equal(t, types.JsonRpcInvalidParams, res.Error.Code)
+	require.Equal(t, "invalid chain id 1 for this network, expected 5", res.Error.Message)
+	require.Nil(t, testutils.MockBackendLastJsonRpcRequest)
+}
+
+func TestRateLimit(t *testing.T) {
+	resetTestServersWithConfig(func(config *server.RpcEndPointServerConfig) {
+		config.RateLimits = &server.RateLimitConfig{
+			Default: server.MethodRateLimits{IP: &server.RateLimit{Rate: 0.01, Burst: 2}},
+			Methods: map[string]server.MethodRateLimits{
+				"eth_sendRawTransaction": {Sender: &server.RateLimit{Rate: 0.01, Burst: 1}},
+			},
+			ExemptApiKeys: []string{"secret"},
+		}
+	})
+
+	postNetVersion := func(apiKey string) *http.Response {
+		body, _ := json.Marshal(types.NewJsonRpcRequest(1, "net_version", nil))
+		req, err := http.NewRequest("POST", testutils.RpcEndpointUrl, bytes.NewReader(body))
+		require.Nil(t, err, err)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(server.ApiKeyHeader, apiKey)
+		resp, err := http.DefaultClient.Do(req)
+		require.Nil(t, err, err)
+		return resp
+	}
+
+	for i := 0; i < 2; i++ {
+		resp := postNetVersion("")
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	// Over the ip limit
+	resp := postNetVersion("")
+	require.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	require.Equal(t, "100", resp.Header.Get("Retry-After"))
+
+	var res struct {
+		Error struct {
+			Code int                      `json:"code"`
+			Data types.RateLimitErrorData `json:"data"`
+		} `json:"error"`
+	}
+	err := json.NewDecoder(resp.Body).Decode(&res)
+	require.Nil(t, err, err)
+	require.Equal(t, types.JsonRpcLimitExceeded, res.Error.Code)
+	require.Equal(t, int64(100), res.Error.Data.RetryAfter)
+
+	// Exempt API keys are not limited
+	resp = postNetVersion("secret")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Sender limit of eth_sendRawTransaction
+	req := types.NewJsonRpcRequest(1, "eth_sendRawTransaction", []interface{}{testutils.TestTx_MM2_RawTx})
+	rpcRes := testutils.SendRpcAndParseResponseOrFailNowAllowRpcError(t, req)
+	require.Nil(t, rpcRes.Error)
+	rpcRes = testutils.SendRpcAndParseResponseOrFailNowAllowRpcError(t, req)
+	require.NotNil(t, rpcRes.Error)
+	require.Equal(t, types.JsonRpcLimitExceeded, rpcRes.Error.Code)
+}
+
+func TestRelayTxSimulation(t *testing.T) {
+	for _, mode := range []string{server.SimulationModeNode, server.SimulationModeRelay} {
+		t.Run(mode, func(t *testing.T) {
+			resetTestServersWithConfig(func(config *server.RpcEndPointServerConfig) {
+				config.SimulationMode = mode
+			})
+
+			// Reverting tx is rejected with the revert reason, and not sent to the relay
+			testutils.MockBackendRevertReason = "UniswapV2: INSUFFICIENT_OUTPUT_AMOUNT"
+			req := types.NewJsonRpcRequest(1, "eth_sendRawTransaction", []interface{}{testutils.TestTx_BundleFailedTooManyTimes_RawTx})
+			res := testutils.SendRpcAndParseResponseOrFailNowAllowRpcError(t, req)
+			require.NotNil(t, res.Error)
+			require.Equal(t, types.JsonRpcInvalidInput, res.Error.Code)
+			require.Equal(t, "tx reverted in simulation: UniswapV2: INSUFFICIENT_OUTPUT_AMOUNT", res.Error.Message)
+			require.NotEqual(t, "eth_sendPrivateTransaction", testutils.MockBackendLastJsonRpcRequest.Method)
+
+			// Once it doesn't revert anymore, it is sent to the relay (the rejected attempt didn't mark it as sent)
+			testutils.MockBackendRevertReason = ""
+			res = testutils.SendRpcAndParseResponseOrFailNow(t, req)
+			require.Nil(t, res.Error)
+			require.Equal(t, "eth_sendPrivateTransaction", testutils.MockBackendLastJsonRpcRequest.Method)
+		})
+	}
+}
+
 // Test batch request with multiple eth raw transaction
 func TestBatch_eth_sendRawTransaction(t *testing.T) {
 	resetTestServers()
@@ -0,0 +1,176 @@
+/*
+ * JSON-RPC 2.0 conformance tests, mostly the examples of https://www.jsonrpc.org/specification#examples
+ */
+package tests
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/flashbots/rpc-endpoint/testutils"
+	"github.com/flashbots/rpc-endpoint/types"
+	"github.com/stretchr/testify/require"
+)
+
+// Posts a raw payload to the endpoint, and returns the http status and the response body
+func postRawPayload(t *testing.T, payload string) (int, []byte) {
+	resp, err := http.Post(testutils.RpcEndpointUrl, "application/json", strings.NewReader(payload))
+	require.Nil(t, err, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	require.Nil(t, err, err)
+	return resp.StatusCode, body
+}
+
+func postRawPayloadSingle(t *testing.T, payload string) (int, *types.JsonRpcResponse) {
+	statusCode, body := postRawPayload(t, payload)
+	res := new(types.JsonRpcResponse)
+	err := json.Unmarshal(body, res)
+	require.Nil(t, err, string(body))
+	return statusCode, res
+}
+
+func postRawPayloadBatch(t *testing.T, payload string) (int, []*types.JsonRpcResponse) {
+	statusCode, body := postRawPayload(t, payload)
+	var res []*types.JsonRpcResponse
+	err := json.Unmarshal(body, &res)
+	require.Nil(t, err, string(body))
+	return statusCode, res
+}
+
+func TestJsonRpcParseError(t *testing.T) {
+	resetTestServers()
+
+	for _, payload := range []string{
+		``,
+		`{"jsonrpc": "2.0", "method": "foobar, "params": "bar", "baz]`,
+		`[
+		  {"jsonrpc": "2.0", "method": "sum", "params": [1,2,4], "id": "1"},
+		  {"jsonrpc": "2.0", "method"
+		]`,
+	} {
+		statusCode, res := postRawPayloadSingle(t, payload)
+		require.Equal(t, http.StatusBadRequest, statusCode, payload)
+		require.NotNil(t, res.Error, payload)
+		require.Equal(t, types.JsonRpcParseError, res.Error.Code, payload)
+		require.Nil(t, res.Id, payload)
+		require.Equal(t, "2.0", res.Version)
+	}
+}
+
+func TestJsonRpcInvalidRequest(t *testing.T) {
+	resetTestServers()
+
+	for payload, id := range map[string]interface{}{
+		`{"jsonrpc": "2.0", "method": 1, "params": "bar"}`:               nil,
+		`{"jsonrpc": "2.0", "method": "null", "params": "bar", "id": 1}`: nil, // params must be structured
+		`{"jsonrpc": "1.0", "method": "null", "id": "a"}`:                "a",
+		`{"jsonrpc": "2.0", "id": 1}`:                                    float64(1),
+		`{"jsonrpc": "2.0", "method": "null", "id": {"foo": 1}}`:         nil,
+		`{"jsonrpc": "2.0", "method": "null", "id": true}`:               nil,
+		`"foo"`: nil,
+		`[]`:    nil, // empty batch
+	} {
+		statusCode, res := postRawPayloadSingle(t, payload)
+		require.Equal(t, http.StatusBadRequest, statusCode, payload)
+		require.NotNil(t, res.Error, payload)
+		require.Equal(t, types.JsonRpcInvalidRequest, res.Error.Code, payload)
+		require.Equal(t, id, res.Id, payload)
+	}
+
+	// Each invalid request of a batch gets an error
+	statusCode, batchRes := postRawPayloadBatch(t, `[1,2,3]`)
+	require.Equal(t, http.StatusOK, statusCode)
+	require.Equal(t, 3, len(batchRes))
+	for _, res := range batchRes {
+		require.Equal(t, types.JsonRpcInvalidRequest, res.Error.Code)
+		require.Nil(t, res.Id)
+	}
+}
+
+// Requests without the jsonrpc member are processed like JSON-RPC 2.0 requests
+func TestJsonRpcMissingVersion(t *testing.T) {
+	resetTestServers()
+
+	statusCode, res := postRawPayloadSingle(t, `{"method": "eth_blockNumber", "params": [], "id": 1}`)
+	require.Equal(t, http.StatusOK, statusCode)
+	require.Nil(t, res.Error)
+	require.Equal(t, float64(1), res.Id)
+	require.Equal(t, "2.0", res.Version)
+	require.Equal(t, `"0x10"`, string(res.Result))
+	require.Equal(t, "2.0", testutils.MockBackendLastJsonRpcRequest.Version)
+}
+
+func TestJsonRpcNotification(t *testing.T) {
+	resetTestServers()
+
+	// Notifications are processed, but get no response
+	statusCode, body := postRawPayload(t, `{"jsonrpc": "2.0", "method": "eth_blockNumber", "params": []}`)
+	require.Equal(t, http.StatusNoContent, statusCode)
+	require.Equal(t, 0, len(body))
+	require.Equal(t, "eth_blockNumber", testutils.MockBackendLastJsonRpcRequest.Method)
+
+	statusCode, body = postRawPayload(t, `[
+		{"jsonrpc": "2.0", "method": "null", "params": [1,2,4]},
+		{"jsonrpc": "2.0", "method": "null", "params": [7]}
+	]`)
+	require.Equal(t, http.StatusNoContent, statusCode)
+	require.Equal(t, 0, len(body))
+
+	// A null id is not a notification
+	statusCode, res := postRawPayloadSingle(t, `{"jsonrpc": "2.0", "method": "eth_blockNumber", "id": null}`)
+	require.Equal(t, http.StatusOK, statusCode)
+	require.Nil(t, res.Error)
+	require.Nil(t, res.Id)
+	require.Equal(t, `"0x10"`, string(res.Result))
+}
+
+func TestJsonRpcBatch(t *testing.T) {
+	resetTestServers()
+
+	// Responses in the order of the requests, without notifications
+	statusCode, res := postRawPayloadBatch(t, `[
+		{"jsonrpc": "2.0", "method": "net_version", "params": [], "id": "1"},
+		{"jsonrpc": "2.0", "method": "null", "params": [7]},
+		{"jsonrpc": "2.0", "method": "eth_blockNumber", "params": [], "id": "2"},
+		{"foo": "boo"},
+		{"jsonrpc": "2.0", "method": "eth_call", "params": [{"to": "0x0000000000000000000000000000000000000001"}, "latest"], "id": 3},
+		{"jsonrpc": "2.0", "method": "eth_getTransactionCount", "params": ["0x0000000000000000000000000000000000000002", "latest"], "id": "4"}
+	]`)
+	require.Equal(t, http.StatusOK, statusCode)
+	require.Equal(t, 5, len(res))
+
+	require.Equal(t, "1", res[0].Id)
+	require.Equal(t, `"1"`, string(res[0].Result))
+	require.Equal(t, "2", res[1].Id)
+	require.Equal(t, `"0x10"`, string(res[1].Result))
+	require.Nil(t, res[2].Id)
+	require.Equal(t, types.JsonRpcInvalidRequest, res[2].Error.Code)
+	require.Equal(t, float64(3), res[3].Id)
+	require.Equal(t, `"0x12345"`, string(res[3].Result))
+	require.Equal(t, "4", res[4].Id)
+	require.Equal(t, `"0x22"`, string(res[4].Result))
+}
+
+func TestJsonRpcNamedParams(t *testing.T) {
+	resetTestServers()
+
+	// Named params are passed through to the node as an object
+	statusCode, res := postRawPayloadSingle(t, `{"jsonrpc": "2.0", "method": "null", "params": {"subtrahend": 23, "minuend": 42}, "id": 3}`)
+	require.Equal(t, http.StatusOK, statusCode)
+	require.Nil(t, res.Error)
+	require.Equal(t, float64(3), res.Id)
+
+	backendReq := testutils.MockBackendLastJsonRpcRequest
+	require.Equal(t, "null", backendReq.Method)
+	require.Nil(t, backendReq.Params)
+	require.Equal(t, map[string]interface{}{"subtrahend": float64(23), "minuend": float64(42)}, backendReq.NamedParams)
+
+	// Methods the endpoint handles itself take positional params
+	_, res = postRawPayloadSingle(t, `{"jsonrpc": "2.0", "method": "eth_sendRawTransaction", "params": {"tx": "0x1234"}, "id": 4}`)
+	require.NotNil(t, res.Error)
+	require.Equal(t, types.JsonRpcInvalidParams, res.Error.Code)
+}
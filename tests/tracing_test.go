@@ -0,0 +1,106 @@
+package tests
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/flashbots/rpc-endpoint/server"
+	"github.com/flashbots/rpc-endpoint/testutils"
+	"github.com/flashbots/rpc-endpoint/tracing"
+	"github.com/stretchr/testify/require"
+)
+
+func findSpan(t *testing.T, spans []tracing.SpanData, name string, kind tracing.SpanKind) tracing.SpanData {
+	for _, span := range spans {
+		if span.Name == name && span.Kind == kind {
+			return span
+		}
+	}
+	require.FailNow(t, "span not found", name)
+	return tracing.SpanData{}
+}
+
+func isDescendantSpan(spans []tracing.SpanData, span tracing.SpanData, ancestor tracing.SpanID) bool {
+	for span.Parent.IsValid() {
+		if span.Parent == ancestor {
+			return true
+		}
+		found := false
+		for _, parent := range spans {
+			if parent.SpanContext.SpanID == span.Parent {
+				span, found = parent, true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return false
+}
+
+func TestTracingSendRawTransaction(t *testing.T) {
+	resetTestServers()
+
+	recorder := tracing.NewRecorder()
+	tracer := tracing.NewTracer(tracing.Config{Exporter: recorder})
+	tracing.SetTracer(tracer)
+	defer tracing.SetTracer(nil)
+
+	// The trace of the client is continued
+	traceId := "0af7651916cd43dd8448eb211c80319c"
+	payload := `{"jsonrpc":"2.0","id":1,"method":"eth_sendRawTransaction","params":["` + testutils.TestTx_BundleFailedTooManyTimes_RawTx + `"]}`
+	req, err := http.NewRequest("POST", testutils.RpcEndpointUrl, strings.NewReader(payload))
+	require.Nil(t, err, err)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(tracing.TraceparentHeader, "00-"+traceId+"-b7ad6b7169203331-01")
+	resp, err := http.DefaultClient.Do(req)
+	require.Nil(t, err, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	err = tracer.Flush(context.Background())
+	require.Nil(t, err, err)
+	spans := recorder.Spans()
+	for _, span := range spans {
+		require.Equal(t, traceId, span.SpanContext.TraceID.String(), span.Name)
+	}
+
+	// Each stage has a span within the one of the request
+	serverSpan := findSpan(t, spans, "HTTP POST", tracing.SpanKindServer)
+	require.Equal(t, "b7ad6b7169203331", serverSpan.Parent.String())
+	requestSpan := findSpan(t, spans, "eth_sendRawTransaction", tracing.SpanKindInternal)
+	require.Equal(t, serverSpan.SpanContext.SpanID, requestSpan.Parent)
+	for _, name := range []string{"GetAddressNonceRange", "blockResendingTxToRelay", "sendTxToRelay"} {
+		require.True(t, isDescendantSpan(spans, findSpan(t, spans, name, tracing.SpanKindInternal), requestSpan.SpanContext.SpanID), name)
+	}
+	relaySpan := findSpan(t, spans, "relay "+server.DefaultRelayName, tracing.SpanKindInternal)
+	require.Equal(t, findSpan(t, spans, "sendTxToRelay", tracing.SpanKindInternal).SpanContext.SpanID, relaySpan.Parent)
+	require.False(t, relaySpan.Failed)
+
+	// The relay got the context of the client span of its call
+	sc, ok := tracing.ParseTraceparent(testutils.MockBackendLastRawRequest.Header.Get(tracing.TraceparentHeader))
+	require.True(t, ok)
+	require.Equal(t, traceId, sc.TraceID.String())
+	for _, span := range spans {
+		if span.SpanContext.SpanID == sc.SpanID {
+			require.Equal(t, tracing.SpanKindClient, span.Kind)
+			require.Equal(t, relaySpan.SpanContext.SpanID, span.Parent)
+		}
+	}
+}
+
+// Without a tracer, no trace context is sent to upstreams
+func TestTracingDisabled(t *testing.T) {
+	resetTestServers()
+
+	req, err := http.NewRequest("POST", testutils.RpcEndpointUrl, strings.NewReader(`{"jsonrpc":"2.0","id":1,"method":"eth_blockNumber","params":[]}`))
+	require.Nil(t, err, err)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	require.Nil(t, err, err)
+	resp.Body.Close()
+	require.Equal(t, "", testutils.MockBackendLastRawRequest.Header.Get(tracing.TraceparentHeader))
+}
@@ -0,0 +1,79 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/flashbots/rpc-endpoint/server"
+	"github.com/flashbots/rpc-endpoint/testutils"
+	"github.com/flashbots/rpc-endpoint/types"
+	"github.com/stretchr/testify/require"
+)
+
+func getTxLifecycle(t *testing.T, txHash string) (int, *types.TxLifecycle) {
+	resp, err := http.Get(testutils.RpcEndpointUrl + "/tx/" + txHash)
+	require.Nil(t, err, err)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, nil
+	}
+
+	lifecycle := new(types.TxLifecycle)
+	err = json.NewDecoder(resp.Body).Decode(lifecycle)
+	require.Nil(t, err, err)
+	return resp.StatusCode, lifecycle
+}
+
+// Waits until the tx tracker stored the status of a tx
+func waitForTxStatus(t *testing.T, txHash string, status types.PrivateTxStatus) {
+	require.Eventually(t, func() bool {
+		lifecycle, found, err := rpcState.GetTxLifecycle(context.Background(), strings.ToLower(txHash))
+		require.Nil(t, err, err)
+		return found && lifecycle.Status == status
+	}, time.Second, time.Millisecond)
+}
+
+func TestTxLifecycle(t *testing.T) {
+	resetTestServers()
+	txHash := testutils.TestTx_BundleFailedTooManyTimes_Hash
+
+	statusCode, _ := getTxLifecycle(t, txHash)
+	require.Equal(t, http.StatusNotFound, statusCode)
+	statusCode, _ = getTxLifecycle(t, "0xfoo")
+	require.Equal(t, http.StatusBadRequest, statusCode)
+
+	req := types.NewJsonRpcRequest(1, "eth_sendRawTransaction", []interface{}{testutils.TestTx_BundleFailedTooManyTimes_RawTx})
+	res := testutils.SendRpcAndParseResponseOrFailNowAllowRpcError(t, req)
+	require.Nil(t, res.Error)
+
+	// Sent to the relay, without the raw tx as it's not included yet
+	statusCode, lifecycle := getTxLifecycle(t, txHash)
+	require.Equal(t, http.StatusOK, statusCode)
+	require.Equal(t, txHash, lifecycle.Hash)
+	require.Equal(t, "", lifecycle.RawTx)
+	require.Equal(t, strings.ToLower(testutils.TestTx_BundleFailedTooManyTimes_From), lifecycle.From)
+	require.Equal(t, types.TxStatusSent, lifecycle.Status)
+	require.Equal(t, string(server.PolicyActionProtect), lifecycle.Routing.Action)
+	require.Equal(t, []string{server.DefaultRelayName}, lifecycle.Routing.Relays)
+	require.Equal(t, 1, len(lifecycle.Relays))
+	require.Equal(t, server.DefaultRelayName, lifecycle.Relays[0].Relay)
+	require.Equal(t, "send", lifecycle.Relays[0].Call)
+	require.True(t, lifecycle.Relays[0].Accepted)
+	require.Equal(t, 1, len(lifecycle.Events))
+	require.Equal(t, types.TxEventSourceRelay, lifecycle.Events[0].Source)
+
+	// The status from the tx status API is recorded by the tx tracker
+	testutils.MockTxApiSetStatus(txHash, types.TxStatusFailed)
+	waitForTxStatus(t, txHash, types.TxStatusFailed)
+
+	_, lifecycle = getTxLifecycle(t, txHash)
+	require.Equal(t, types.TxStatusFailed, lifecycle.Status)
+	require.NotEqual(t, "", lifecycle.FailureReason)
+	lastEvent := lifecycle.Events[len(lifecycle.Events)-1]
+	require.Equal(t, types.TxStatusFailed, lastEvent.Status)
+	require.Equal(t, types.TxEventSourceStatusApi, lastEvent.Source)
+}
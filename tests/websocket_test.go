@@ -0,0 +1,174 @@
+/*
+ * RPC endpoint WebSocket tests.
+ */
+package tests
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/flashbots/rpc-endpoint/server"
+	"github.com/flashbots/rpc-endpoint/testutils"
+	"github.com/flashbots/rpc-endpoint/types"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+func dialRpcEndpointWs(t *testing.T) *websocket.Conn {
+	wsUrl := strings.Replace(testutils.RpcEndpointUrl, "http", "ws", 1)
+	conn, _, err := websocket.DefaultDialer.Dial(wsUrl, nil)
+	require.Nil(t, err, err)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
+func wsSendAndReadResponse(t *testing.T, conn *websocket.Conn, req interface{}, res interface{}) {
+	err := conn.WriteJSON(req)
+	require.Nil(t, err, err)
+	err = conn.ReadJSON(res)
+	require.Nil(t, err, err)
+}
+
+func TestWsProxyRequest(t *testing.T) {
+	resetTestServers()
+	conn := dialRpcEndpointWs(t)
+	defer conn.Close()
+
+	var res types.JsonRpcResponse
+	req := types.NewJsonRpcRequest(1, "eth_getTransactionCount", []interface{}{testutils.TestTx_MM2_From, "latest"})
+	wsSendAndReadResponse(t, conn, req, &res)
+	require.Nil(t, res.Error)
+	require.Equal(t, float64(1), res.Id)
+	require.Equal(t, `"0x22"`, string(res.Result))
+}
+
+func TestWsIntercepts(t *testing.T) {
+	resetTestServers()
+	conn := dialRpcEndpointWs(t)
+	defer conn.Close()
+
+	// net_version is answered by the endpoint itself
+	var res types.JsonRpcResponse
+	wsSendAndReadResponse(t, conn, types.NewJsonRpcRequest(1, "net_version", nil), &res)
+	require.Equal(t, `"1"`, string(res.Result))
+
+	// eth_call to the Flashbots RPC contract is intercepted
+	req := types.NewJsonRpcRequest(2, "eth_call", []interface{}{map[string]string{
+		"from": "0xb60e8dd61c5d32be8058bb8eb970870f07233155",
+		"to":   "0xf1a54b0759b58661cea17cff19dd37940a9b5f1a",
+	}})
+	wsSendAndReadResponse(t, conn, req, &res)
+	require.Equal(t, `"0x0000000000000000000000000000000000000000000000000000000000000001"`, string(res.Result))
+}
+
+// eth_sendRawTransaction over WebSocket goes through the same relay routing as over HTTP
+func TestWsRelayTx(t *testing.T) {
+	resetTestServers()
+	conn := dialRpcEndpointWs(t)
+	defer conn.Close()
+
+	var res types.JsonRpcResponse
+	req := types.NewJsonRpcRequest(1, "eth_sendRawTransaction", []interface{}{testutils.TestTx_BundleFailedTooManyTimes_RawTx})
+	wsSendAndReadResponse(t, conn, req, &res)
+	require.Nil(t, res.Error)
+	require.Equal(t, "eth_sendPrivateTransaction", testutils.MockBackendLastJsonRpcRequest.Method)
+
+	var txHash string
+	json.Unmarshal(res.Result, &txHash)
+	require.Equal(t, testutils.TestTx_BundleFailedTooManyTimes_Hash, txHash)
+}
+
+func TestWsBatch(t *testing.T) {
+	resetTestServers()
+	conn := dialRpcEndpointWs(t)
+	defer conn.Close()
+
+	batch := []*types.JsonRpcRequest{
+		types.NewJsonRpcRequest(1, "net_version", nil),
+		types.NewJsonRpcRequest(2, "eth_call", []interface{}{map[string]string{"to": "0xf1a54b0759b58661cea17cff19dd37940a9b5f1b"}}),
+		types.NewJsonRpcRequest(3, "eth_subscribe", []interface{}{"newHeads"}),
+	}
+	var res []*types.JsonRpcResponse
+	wsSendAndReadResponse(t, conn, batch, &res)
+	require.Equal(t, 3, len(res))
+	require.Equal(t, `"1"`, string(res[0].Result))
+	require.Equal(t, `"0x12345"`, string(res[1].Result))
+	require.Equal(t, types.JsonRpcInvalidRequest, res[2].Error.Code)
+}
+
+// null requests get an error response, and don't break the connection
+func TestWsNullRequest(t *testing.T) {
+	resetTestServers()
+	conn := dialRpcEndpointWs(t)
+	defer conn.Close()
+
+	var res types.JsonRpcResponse
+	wsSendAndReadResponse(t, conn, nil, &res)
+	require.Equal(t, types.JsonRpcInvalidRequest, res.Error.Code)
+
+	var batchRes []*types.JsonRpcResponse
+	wsSendAndReadResponse(t, conn, []*types.JsonRpcRequest{nil, types.NewJsonRpcRequest(1, "net_version", nil)}, &batchRes)
+	require.Equal(t, 2, len(batchRes))
+	require.Equal(t, types.JsonRpcInvalidRequest, batchRes[0].Error.Code)
+	require.Equal(t, `"1"`, string(batchRes[1].Result))
+}
+
+// Subscriptions are rate limited like other requests
+func TestWsSubscriptionRateLimit(t *testing.T) {
+	resetTestServersWithConfig(func(config *server.RpcEndPointServerConfig) {
+		config.RateLimits = &server.RateLimitConfig{
+			Default: server.MethodRateLimits{IP: &server.RateLimit{Rate: 0.01, Burst: 1}},
+		}
+	})
+	conn := dialRpcEndpointWs(t)
+	defer conn.Close()
+
+	var res types.JsonRpcResponse
+	wsSendAndReadResponse(t, conn, types.NewJsonRpcRequest(1, "eth_subscribe", []interface{}{"newHeads"}), &res)
+	require.Nil(t, res.Error)
+
+	// Skip the notification of the first subscription
+	var notification json.RawMessage
+	err := conn.ReadJSON(&notification)
+	require.Nil(t, err, err)
+
+	res = types.JsonRpcResponse{}
+	wsSendAndReadResponse(t, conn, types.NewJsonRpcRequest(2, "eth_subscribe", []interface{}{"newHeads"}), &res)
+	require.NotNil(t, res.Error)
+	require.Equal(t, types.JsonRpcLimitExceeded, res.Error.Code)
+}
+
+func TestWsSubscription(t *testing.T) {
+	resetTestServers()
+	conn := dialRpcEndpointWs(t)
+	defer conn.Close()
+
+	// Subscribe
+	var res types.JsonRpcResponse
+	wsSendAndReadResponse(t, conn, types.NewJsonRpcRequest(7, "eth_subscribe", []interface{}{"newHeads"}), &res)
+	require.Nil(t, res.Error)
+	require.Equal(t, float64(7), res.Id)
+	require.Equal(t, `"`+testutils.MockWsSubscriptionId+`"`, string(res.Result))
+
+	// Notification from upstream is passed on to the client
+	var notification struct {
+		Method string `json:"method"`
+		Params struct {
+			Subscription string            `json:"subscription"`
+			Result       map[string]string `json:"result"`
+		} `json:"params"`
+	}
+	err := conn.ReadJSON(&notification)
+	require.Nil(t, err, err)
+	require.Equal(t, "eth_subscription", notification.Method)
+	require.Equal(t, testutils.MockWsSubscriptionId, notification.Params.Subscription)
+	require.Equal(t, testutils.MockBackendBlockNumber, notification.Params.Result["number"])
+
+	// Unsubscribe
+	res = types.JsonRpcResponse{}
+	wsSendAndReadResponse(t, conn, types.NewJsonRpcRequest(8, "eth_unsubscribe", []interface{}{testutils.MockWsSubscriptionId}), &res)
+	require.Nil(t, res.Error)
+	require.Equal(t, "true", string(res.Result))
+}
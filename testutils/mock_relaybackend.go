@@ -0,0 +1,137 @@
+/*
+ * Fake relays (or builders) for eth_sendPrivateTransaction and eth_cancelPrivateTransaction. Several can be started to
+ * test the fan-out to multiple relays, and each one can be set to fail.
+ */
+package testutils
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	ethtypes "github.com/ethereum/go-ethereum/core/types"
+	"github.com/flashbots/rpc-endpoint/types"
+)
+
+type MockRelay struct {
+	Server *httptest.Server
+
+	mu         sync.Mutex
+	errorMsg   string // responds with {"error": errorMsg} if set
+	statusCode int    // responds with this http status if set
+	requests   []*types.JsonRpcRequest
+	signatures []string
+}
+
+func NewMockRelay() *MockRelay {
+	relay := &MockRelay{}
+	relay.Server = httptest.NewServer(http.HandlerFunc(relay.handle))
+	return relay
+}
+
+// NewMockRelays starts n fake relays
+func NewMockRelays(n int) []*MockRelay {
+	relays := make([]*MockRelay, n)
+	for i := range relays {
+		relays[i] = NewMockRelay()
+	}
+	return relays
+}
+
+func (m *MockRelay) Url() string {
+	return m.Server.URL
+}
+
+func (m *MockRelay) Close() {
+	m.Server.Close()
+}
+
+// SetError makes the relay reject all requests with a relay error response (or accept them again if msg is empty)
+func (m *MockRelay) SetError(msg string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.errorMsg = msg
+}
+
+// SetStatusCode makes the relay respond to all requests with an empty body and the http status (or normally if 0)
+func (m *MockRelay) SetStatusCode(statusCode int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.statusCode = statusCode
+}
+
+// Requests returns the requests with the method the relay received
+func (m *MockRelay) Requests(method string) []*types.JsonRpcRequest {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	requests := make([]*types.JsonRpcRequest, 0)
+	for _, req := range m.requests {
+		if req.Method == method {
+			requests = append(requests, req)
+		}
+	}
+	return requests
+}
+
+// Signatures returns the X-Flashbots-Signature headers of all requests ("" if unsigned)
+func (m *MockRelay) Signatures() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string{}, m.signatures...)
+}
+
+func (m *MockRelay) handle(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	jsonReq := new(types.JsonRpcRequest)
+	if err = json.Unmarshal(body, jsonReq); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	m.mu.Lock()
+	m.requests = append(m.requests, jsonReq)
+	m.signatures = append(m.signatures, req.Header.Get("X-Flashbots-Signature"))
+	errorMsg, statusCode := m.errorMsg, m.statusCode
+	m.mu.Unlock()
+
+	if statusCode != 0 {
+		w.WriteHeader(statusCode)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if errorMsg != "" {
+		json.NewEncoder(w).Encode(types.RelayErrorResponse{Error: errorMsg})
+		return
+	}
+
+	var result interface{}
+	switch jsonReq.Method {
+	case "eth_sendPrivateTransaction":
+		param, _ := jsonReq.Params[0].(map[string]interface{})
+		rawTx, _ := param["tx"].(string)
+		tx := new(ethtypes.Transaction)
+		if err = tx.UnmarshalBinary(common.FromHex(rawTx)); err != nil {
+			json.NewEncoder(w).Encode(types.RelayErrorResponse{Error: "invalid tx"})
+			return
+		}
+		result = tx.Hash().Hex()
+	case "eth_cancelPrivateTransaction":
+		result = true
+	default:
+		json.NewEncoder(w).Encode(types.RelayErrorResponse{Error: "method not supported: " + jsonReq.Method})
+		return
+	}
+
+	resBytes, _ := json.Marshal(result)
+	json.NewEncoder(w).Encode(types.NewJsonRpcResponse(jsonReq.Id, resBytes))
+}
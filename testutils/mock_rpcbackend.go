@@ -12,6 +12,9 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/flashbots/rpc-endpoint/types"
 )
 
@@ -20,6 +23,11 @@ var getBundleStatusByTransactionHash_Response = types.GetBundleStatusByTransacti
 	Status: "FAILED_BUNDLE",
 }
 
+var MockBackendBlockNumber = "0x10"
+
+// If set, eth_call and eth_callBundle revert with this reason
+var MockBackendRevertReason = ""
+
 var MockBackendLastRawRequest *http.Request
 var MockBackendLastJsonRpcRequest *types.JsonRpcRequest
 var MockBackendLastJsonRpcRequestTimestamp time.Time
@@ -37,8 +45,14 @@ func handleRpcRequest(req *types.JsonRpcRequest) (result interface{}, err error)
 		return "0x22", nil
 
 	case "eth_call":
+		if MockBackendRevertReason != "" {
+			return nil, &types.JsonRpcError{Code: 3, Message: "execution reverted: " + MockBackendRevertReason, Data: hexutil.Encode(revertData(MockBackendRevertReason))}
+		}
 		return "0x12345", nil
 
+	case "eth_blockNumber":
+		return MockBackendBlockNumber, nil
+
 	case "eth_getTransactionReceipt":
 		if req.Params[0] == TestTx_BundleFailedTooManyTimes_Hash {
 			return nil, nil
@@ -68,6 +82,14 @@ func handleRpcRequest(req *types.JsonRpcRequest) (result interface{}, err error)
 			return "tx-hash2", nil
 		}
 
+	case "eth_callBundle":
+		txResult := map[string]interface{}{"gasUsed": 21000}
+		if MockBackendRevertReason != "" {
+			txResult["error"] = "execution reverted"
+			txResult["revert"] = string(revertData(MockBackendRevertReason))
+		}
+		return map[string]interface{}{"results": []interface{}{txResult}}, nil
+
 	case "eth_cancelPrivateTransaction":
 		param := req.Params[0].(map[string]interface{})
 		if param["txHash"] == TestTx_CancelAtRelay_Cancel_Hash {
@@ -80,6 +102,13 @@ func handleRpcRequest(req *types.JsonRpcRequest) (result interface{}, err error)
 	return "", fmt.Errorf("no RPC method handler implemented for %s", req.Method)
 }
 
+// ABI encoded Error(string)
+func revertData(reason string) []byte {
+	typ, _ := abi.NewType("string", "", nil)
+	data, _ := abi.Arguments{{Type: typ}}.Pack(reason)
+	return append(crypto.Keccak256([]byte("Error(string)"))[:4], data...)
+}
+
 func RpcBackendHandler(w http.ResponseWriter, req *http.Request) {
 	defer req.Body.Close()
 	MockBackendLastRawRequest = req
@@ -120,7 +149,10 @@ func RpcBackendHandler(w http.ResponseWriter, req *http.Request) {
 	}
 
 	rawRes, err := handleRpcRequest(jsonReq)
-	if err != nil {
+	if rpcErr, ok := err.(*types.JsonRpcError); ok {
+		json.NewEncoder(w).Encode(types.JsonRpcResponse{Id: jsonReq.Id, Version: "2.0", Error: rpcErr})
+		return
+	} else if err != nil {
 		returnError(jsonReq.Id, err.Error())
 		return
 	}
@@ -6,14 +6,25 @@ import (
 	"log"
 	"net/http"
 	"strings"
+	"sync"
 
 	"github.com/flashbots/rpc-endpoint/types"
 )
 
-var MockTxApiStatusForHash map[string]types.PrivateTxStatus = make(map[string]types.PrivateTxStatus)
+// The tx tracker of the server polls the mock in the background, so the statuses are guarded by a lock
+var mockTxApiLock sync.Mutex
+var mockTxApiStatusForHash map[string]types.PrivateTxStatus = make(map[string]types.PrivateTxStatus)
 
 func MockTxApiReset() {
-	MockTxApiStatusForHash = make(map[string]types.PrivateTxStatus)
+	mockTxApiLock.Lock()
+	defer mockTxApiLock.Unlock()
+	mockTxApiStatusForHash = make(map[string]types.PrivateTxStatus)
+}
+
+func MockTxApiSetStatus(txHash string, status types.PrivateTxStatus) {
+	mockTxApiLock.Lock()
+	defer mockTxApiLock.Unlock()
+	mockTxApiStatusForHash[txHash] = status
 }
 
 func MockTxApiHandler(w http.ResponseWriter, req *http.Request) {
@@ -29,9 +40,11 @@ func MockTxApiHandler(w http.ResponseWriter, req *http.Request) {
 	txHash := req.URL.Path[4:] // by default, the first 4 characters are "/tx/"
 	resp := types.PrivateTxApiResponse{Status: types.TxStatusUnknown}
 
-	if status, found := MockTxApiStatusForHash[txHash]; found {
+	mockTxApiLock.Lock()
+	if status, found := mockTxApiStatusForHash[txHash]; found {
 		resp.Status = status
 	}
+	mockTxApiLock.Unlock()
 
 	if err := json.NewEncoder(w).Encode(resp); err != nil {
 		log.Printf("error writing response 2: %v - data: %v", err, resp)
@@ -0,0 +1,80 @@
+/*
+ * Dummy WebSocket RPC backend for subscriptions.
+ */
+package testutils
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/flashbots/rpc-endpoint/types"
+	"github.com/gorilla/websocket"
+)
+
+var MockWsSubscriptionId = "0xcd0c3e8af590364c09d0fa6a1210faf5"
+
+var wsUpgrader = websocket.Upgrader{}
+
+type wsNotification struct {
+	Version string                   `json:"jsonrpc"`
+	Method  string                   `json:"method"`
+	Params  wsNotificationParameters `json:"params"`
+}
+
+type wsNotificationParameters struct {
+	Subscription string      `json:"subscription"`
+	Result       interface{} `json:"result"`
+}
+
+// RpcBackendWsHandler answers eth_subscribe with MockWsSubscriptionId followed by one notification,
+// and eth_unsubscribe with true. Other methods are answered like by RpcBackendHandler.
+func RpcBackendWsHandler(w http.ResponseWriter, req *http.Request) {
+	conn, err := wsUpgrader.Upgrade(w, req, nil)
+	if err != nil {
+		log.Println("ws upgrade failed:", err)
+		return
+	}
+	defer conn.Close()
+
+	for {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		jsonReq := new(types.JsonRpcRequest)
+		if err = json.Unmarshal(msg, jsonReq); err != nil {
+			log.Println("ws failed to parse JSON RPC request:", err)
+			return
+		}
+
+		var result interface{}
+		switch jsonReq.Method {
+		case "eth_subscribe":
+			result = MockWsSubscriptionId
+		case "eth_unsubscribe":
+			result = true
+		default:
+			result, err = handleRpcRequest(jsonReq)
+			if err != nil {
+				conn.WriteJSON(types.JsonRpcResponse{Id: jsonReq.Id, Version: "2.0", Error: &types.JsonRpcError{Code: -32603, Message: err.Error()}})
+				continue
+			}
+		}
+
+		resBytes, _ := json.Marshal(result)
+		conn.WriteJSON(types.NewJsonRpcResponse(jsonReq.Id, resBytes))
+
+		if jsonReq.Method == "eth_subscribe" {
+			conn.WriteJSON(wsNotification{
+				Version: "2.0",
+				Method:  "eth_subscription",
+				Params: wsNotificationParameters{
+					Subscription: MockWsSubscriptionId,
+					Result:       map[string]string{"number": MockBackendBlockNumber},
+				},
+			})
+		}
+	}
+}
@@ -0,0 +1,275 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var spanKindNames = map[SpanKind]string{
+	SpanKindInternal: "internal",
+	SpanKindServer:   "server",
+	SpanKindClient:   "client",
+}
+
+// WriterExporter writes each span as a JSON object on a line, e.g. to stdout
+type WriterExporter struct {
+	w io.Writer
+}
+
+func NewWriterExporter(w io.Writer) *WriterExporter {
+	return &WriterExporter{w: w}
+}
+
+type writerSpan struct {
+	Name       string                 `json:"name"`
+	Kind       string                 `json:"kind"`
+	TraceId    string                 `json:"traceId"`
+	SpanId     string                 `json:"spanId"`
+	ParentId   string                 `json:"parentSpanId,omitempty"`
+	Start      time.Time              `json:"start"`
+	DurationMs float64                `json:"durationMs"`
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+	Error      *string                `json:"error,omitempty"`
+}
+
+func (e *WriterExporter) ExportSpans(ctx context.Context, spans []SpanData) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, span := range spans {
+		entry := writerSpan{
+			Name:       span.Name,
+			Kind:       spanKindNames[span.Kind],
+			TraceId:    span.SpanContext.TraceID.String(),
+			SpanId:     span.SpanContext.SpanID.String(),
+			Start:      span.Start.UTC(),
+			DurationMs: float64(span.End.Sub(span.Start).Microseconds()) / 1000,
+		}
+		if span.Parent.IsValid() {
+			entry.ParentId = span.Parent.String()
+		}
+		if len(span.Attributes) > 0 {
+			entry.Attributes = make(map[string]interface{}, len(span.Attributes))
+			for _, attr := range span.Attributes {
+				entry.Attributes[attr.Key] = attr.Value
+			}
+		}
+		if span.Failed {
+			entry.Error = &span.StatusMessage
+		}
+		if err := enc.Encode(entry); err != nil {
+			return err
+		}
+	}
+	_, err := e.w.Write(buf.Bytes())
+	return err
+}
+
+func (e *WriterExporter) Shutdown(ctx context.Context) error {
+	return nil
+}
+
+// Recorder keeps the exported spans in memory, for tests
+type Recorder struct {
+	mu    sync.Mutex
+	spans []SpanData
+}
+
+func NewRecorder() *Recorder {
+	return &Recorder{}
+}
+
+func (r *Recorder) ExportSpans(ctx context.Context, spans []SpanData) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = append(r.spans, spans...)
+	return nil
+}
+
+func (r *Recorder) Shutdown(ctx context.Context) error {
+	return nil
+}
+
+// Spans returns the exported spans, in the order they ended
+func (r *Recorder) Spans() []SpanData {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]SpanData(nil), r.spans...)
+}
+
+func (r *Recorder) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = nil
+}
+
+// OTLPExporter sends spans to an OpenTelemetry collector with OTLP/HTTP, in the JSON encoding
+type OTLPExporter struct {
+	Url         string            // e.g. http://localhost:4318/v1/traces
+	Headers     map[string]string // e.g. for authentication
+	ServiceName string
+	HttpClient  *http.Client // not traced, that would trace the exports
+}
+
+// NewOTLPExporter returns an exporter to the collector at endpoint, like OTEL_EXPORTER_OTLP_ENDPOINT the path
+// /v1/traces is appended
+func NewOTLPExporter(endpoint, serviceName string, headers map[string]string) *OTLPExporter {
+	return &OTLPExporter{
+		Url:         strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		Headers:     headers,
+		ServiceName: serviceName,
+		HttpClient:  &http.Client{},
+	}
+}
+
+// ParseOTLPHeaders parses headers like OTEL_EXPORTER_OTLP_HEADERS: "key1=value1,key2=value2"
+func ParseOTLPHeaders(s string) (map[string]string, error) {
+	headers := make(map[string]string)
+	if s == "" {
+		return headers, nil
+	}
+	for _, entry := range strings.Split(s, ",") {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("invalid header %q, must be key=value", entry)
+		}
+		headers[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return headers, nil
+}
+
+// The JSON encoding of OTLP, https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceId           string          `json:"traceId"`
+	SpanId            string          `json:"spanId"`
+	ParentSpanId      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"` // 0: unset, 2: error
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+// OTLP span kinds are one more than ours, 0 is unspecified
+var otlpSpanKinds = map[SpanKind]int{
+	SpanKindInternal: 1,
+	SpanKindServer:   2,
+	SpanKindClient:   3,
+}
+
+func otlpAttributeOf(attr Attribute) otlpAttribute {
+	var value map[string]interface{}
+	switch v := attr.Value.(type) {
+	case string:
+		value = map[string]interface{}{"stringValue": v}
+	case bool:
+		value = map[string]interface{}{"boolValue": v}
+	case int:
+		value = map[string]interface{}{"intValue": strconv.FormatInt(int64(v), 10)}
+	case int64:
+		value = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+	case uint64:
+		value = map[string]interface{}{"intValue": strconv.FormatUint(v, 10)}
+	case float64:
+		value = map[string]interface{}{"doubleValue": v}
+	default:
+		value = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+	}
+	return otlpAttribute{Key: attr.Key, Value: value}
+}
+
+func (e *OTLPExporter) ExportSpans(ctx context.Context, spans []SpanData) error {
+	otlpSpans := make([]otlpSpan, len(spans))
+	for i, span := range spans {
+		otlpSpans[i] = otlpSpan{
+			TraceId:           span.SpanContext.TraceID.String(),
+			SpanId:            span.SpanContext.SpanID.String(),
+			Name:              span.Name,
+			Kind:              otlpSpanKinds[span.Kind],
+			StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+		}
+		if span.Parent.IsValid() {
+			otlpSpans[i].ParentSpanId = span.Parent.String()
+		}
+		for _, attr := range span.Attributes {
+			otlpSpans[i].Attributes = append(otlpSpans[i].Attributes, otlpAttributeOf(attr))
+		}
+		if span.Failed {
+			otlpSpans[i].Status = otlpStatus{Code: 2, Message: span.StatusMessage}
+		}
+	}
+
+	body, err := json.Marshal(otlpTraces{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: []otlpAttribute{otlpAttributeOf(Attr("service.name", e.ServiceName))}},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "github.com/flashbots/rpc-endpoint"}, Spans: otlpSpans}},
+	}}})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", e.Url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range e.Headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := e.HttpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("collector responded with %s: %s", resp.Status, msg)
+	}
+	return nil
+}
+
+func (e *OTLPExporter) Shutdown(ctx context.Context) error {
+	e.HttpClient.CloseIdleConnections()
+	return nil
+}
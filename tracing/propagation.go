@@ -0,0 +1,113 @@
+package tracing
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// W3C trace context header, https://www.w3.org/TR/trace-context/#traceparent-header
+const TraceparentHeader = "traceparent"
+
+// Inject sets the traceparent header to the span context of ctx, if any
+func Inject(ctx context.Context, header http.Header) {
+	sc := SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return
+	}
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	header.Set(TraceparentHeader, fmt.Sprintf("00-%s-%s-%s", sc.TraceID, sc.SpanID, flags))
+}
+
+// Extract returns a context with the span context of a valid traceparent header as the parent of the next span
+func Extract(ctx context.Context, header http.Header) context.Context {
+	sc, ok := ParseTraceparent(header.Get(TraceparentHeader))
+	if !ok {
+		return ctx
+	}
+	return ContextWithRemoteSpanContext(ctx, sc)
+}
+
+// ParseTraceparent parses a traceparent header value like "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+func ParseTraceparent(value string) (sc SpanContext, ok bool) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, false
+	}
+	version, err := hex.DecodeString(parts[0])
+	if err != nil || version[0] == 0xff || (version[0] == 0 && len(parts) != 4) {
+		return sc, false
+	}
+	if _, err = hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return sc, false
+	}
+	if _, err = hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return sc, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return sc, false
+	}
+	sc.Sampled = flags[0]&1 == 1
+	sc.Remote = true
+	return sc, sc.IsValid()
+}
+
+// Transport records a client span for each request made within a trace (requests of e.g. health checks are not
+// recorded), and sets its traceparent header if Propagate is set
+type Transport struct {
+	Base      http.RoundTripper // default: http.DefaultTransport
+	Propagate bool              // false for requests to third parties, which shouldn't get our trace ids
+}
+
+// NewTransport returns a transport which records spans and propagates the trace context
+func NewTransport(base http.RoundTripper) *Transport {
+	return &Transport{Base: base, Propagate: true}
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	if !SpanContextFromContext(req.Context()).IsValid() {
+		return base.RoundTrip(req)
+	}
+
+	// The url is left out, its path or query can contain api keys
+	ctx, span := StartWithKind(req.Context(), "HTTP "+req.Method, SpanKindClient,
+		Attr("http.method", req.Method),
+		Attr("net.peer.name", req.URL.Hostname()),
+	)
+	if span == nil {
+		return base.RoundTrip(req)
+	}
+	defer span.End()
+
+	if t.Propagate {
+		req = req.Clone(ctx) // a RoundTripper must not modify the request
+		Inject(ctx, req.Header)
+	}
+
+	resp, err := base.RoundTrip(req)
+	if err != nil {
+		span.RecordError(err)
+		return resp, err
+	}
+	span.SetAttributes(Attr("http.status_code", resp.StatusCode))
+	if resp.StatusCode >= 500 {
+		span.SetError(resp.Status)
+	}
+	return resp, nil
+}
+
+// NewClient returns an http client with a Transport which propagates the trace context
+func NewClient() *http.Client {
+	return &http.Client{Transport: NewTransport(http.DefaultTransport)}
+}
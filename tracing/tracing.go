@@ -0,0 +1,386 @@
+/*
+Package tracing records spans of the stages of a request and exports them in batches, e.g. with OTLP/HTTP to an
+OpenTelemetry collector. Trace context is propagated to and from other services with the W3C traceparent header.
+
+Spans are only recorded once a tracer is set with SetTracer. Until then Start returns nil spans, which do nothing.
+
+This is a small subset of OpenTelemetry instead of its Go SDK, which needs newer versions of dependencies we share
+with go-ethereum (e.g. golang.org/x/sys) than this module can use. We only need spans and the OTLP/HTTP JSON export,
+which is tested by decoding it with the protobuf types of OTLP, like a collector does.
+*/
+package tracing
+
+import (
+	"context"
+	crand "crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"log"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type TraceID [16]byte
+
+func (id TraceID) String() string { return hex.EncodeToString(id[:]) }
+func (id TraceID) IsValid() bool  { return id != TraceID{} }
+
+type SpanID [8]byte
+
+func (id SpanID) String() string { return hex.EncodeToString(id[:]) }
+func (id SpanID) IsValid() bool  { return id != SpanID{} }
+
+// SpanContext identifies a span, also one of another service
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+	Remote  bool // from a traceparent header
+}
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+type SpanKind int
+
+const (
+	SpanKindInternal SpanKind = iota
+	SpanKindServer
+	SpanKindClient
+)
+
+type Attribute struct {
+	Key   string
+	Value interface{} // string, bool, integer or float
+}
+
+func Attr(key string, value interface{}) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// SpanData is an ended span, as passed to the exporter
+type SpanData struct {
+	Name          string
+	SpanContext   SpanContext
+	Parent        SpanID // invalid for root spans
+	Kind          SpanKind
+	Start         time.Time
+	End           time.Time
+	Attributes    []Attribute
+	Failed        bool
+	StatusMessage string
+}
+
+// Span is a started span. All methods can be called on nil spans, and do nothing on spans which are not sampled.
+type Span struct {
+	tracer *Tracer // nil if not recording
+	mu     sync.Mutex
+	data   SpanData
+	ended  bool
+}
+
+func (s *Span) SpanContext() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.data.SpanContext
+}
+
+func (s *Span) IsRecording() bool {
+	return s != nil && s.tracer != nil
+}
+
+func (s *Span) SetAttributes(attrs ...Attribute) {
+	if !s.IsRecording() {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Attributes = append(s.data.Attributes, attrs...)
+}
+
+// SetError marks the span as failed
+func (s *Span) SetError(msg string) {
+	if !s.IsRecording() {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Failed = true
+	s.data.StatusMessage = msg
+}
+
+// RecordError marks the span as failed if err is not nil
+func (s *Span) RecordError(err error) {
+	if err != nil {
+		s.SetError(err.Error())
+	}
+}
+
+// End ends the span and queues it for export, only the first call has an effect
+func (s *Span) End() {
+	if !s.IsRecording() {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.End = time.Now()
+	data := s.data
+	s.mu.Unlock()
+	s.tracer.enqueue(data)
+}
+
+type spanKey struct{}
+type remoteSpanContextKey struct{}
+
+func ContextWithSpan(ctx context.Context, span *Span) context.Context {
+	return context.WithValue(ctx, spanKey{}, span)
+}
+
+// SpanFromContext returns the current span, or nil
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// ContextWithRemoteSpanContext sets the parent of the next span, if the context has no span
+func ContextWithRemoteSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	sc.Remote = true
+	return context.WithValue(ctx, remoteSpanContextKey{}, sc)
+}
+
+// SpanContextFromContext returns the context of the current span, or the remote one
+func SpanContextFromContext(ctx context.Context) SpanContext {
+	if span := SpanFromContext(ctx); span != nil {
+		return span.SpanContext()
+	}
+	sc, _ := ctx.Value(remoteSpanContextKey{}).(SpanContext)
+	return sc
+}
+
+// Exporter sends batches of ended spans somewhere. ExportSpans is not called concurrently, and must not keep the slice.
+type Exporter interface {
+	ExportSpans(ctx context.Context, spans []SpanData) error
+	Shutdown(ctx context.Context) error
+}
+
+type Config struct {
+	Exporter      Exporter
+	SampleRatio   float64       // fraction of new traces which are recorded, default: all (the parent decides for others)
+	BatchSize     int           // default: 512
+	BatchTimeout  time.Duration // max time until an ended span is exported, default: 5s
+	ExportTimeout time.Duration // default: 10s
+	QueueSize     int           // spans are dropped if the queue is full, default: 2048
+}
+
+func (c Config) withDefaults() Config {
+	if c.SampleRatio <= 0 || c.SampleRatio > 1 {
+		c.SampleRatio = 1
+	}
+	if c.BatchSize <= 0 {
+		c.BatchSize = 512
+	}
+	if c.BatchTimeout <= 0 {
+		c.BatchTimeout = 5 * time.Second
+	}
+	if c.ExportTimeout <= 0 {
+		c.ExportTimeout = 10 * time.Second
+	}
+	if c.QueueSize <= 0 {
+		c.QueueSize = 2048
+	}
+	return c
+}
+
+// Tracer starts spans and exports them in the background
+type Tracer struct {
+	config Config
+	queue  chan SpanData
+	flush  chan chan struct{}
+	stop   chan struct{}
+	done   chan struct{}
+
+	stopOnce sync.Once
+	dropped  uint64 // atomic
+
+	randMu sync.Mutex
+	rand   *rand.Rand
+}
+
+func NewTracer(config Config) *Tracer {
+	var seed int64
+	_ = binary.Read(crand.Reader, binary.LittleEndian, &seed)
+
+	config = config.withDefaults()
+	t := &Tracer{
+		config: config,
+		queue:  make(chan SpanData, config.QueueSize),
+		flush:  make(chan chan struct{}),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+		rand:   rand.New(rand.NewSource(seed)),
+	}
+	go t.run()
+	return t
+}
+
+// Start starts a span, which is a child of the span in ctx, and returns a context with it
+func (t *Tracer) Start(ctx context.Context, name string, kind SpanKind, attrs ...Attribute) (context.Context, *Span) {
+	parent := SpanContextFromContext(ctx)
+	sc := SpanContext{TraceID: parent.TraceID, Sampled: parent.Sampled}
+
+	t.randMu.Lock()
+	if !parent.IsValid() {
+		t.rand.Read(sc.TraceID[:])
+		sc.Sampled = t.rand.Float64() < t.config.SampleRatio
+	}
+	t.rand.Read(sc.SpanID[:])
+	t.randMu.Unlock()
+
+	span := &Span{data: SpanData{
+		Name:        name,
+		SpanContext: sc,
+		Parent:      parent.SpanID,
+		Kind:        kind,
+		Start:       time.Now(),
+		Attributes:  attrs,
+	}}
+	if sc.Sampled {
+		span.tracer = t
+	}
+	return ContextWithSpan(ctx, span), span
+}
+
+func (t *Tracer) enqueue(span SpanData) {
+	select {
+	case t.queue <- span:
+	default:
+		atomic.AddUint64(&t.dropped, 1)
+	}
+}
+
+// Dropped returns the number of spans which were dropped because the queue was full
+func (t *Tracer) Dropped() uint64 {
+	return atomic.LoadUint64(&t.dropped)
+}
+
+func (t *Tracer) run() {
+	defer close(t.done)
+	batch := make([]SpanData, 0, t.config.BatchSize)
+	ticker := time.NewTicker(t.config.BatchTimeout)
+	defer ticker.Stop()
+
+	export := func() {
+		if len(batch) == 0 {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), t.config.ExportTimeout)
+		defer cancel()
+		if err := t.config.Exporter.ExportSpans(ctx, batch); err != nil {
+			log.Printf("[tracing] exporting %d spans failed: %v", len(batch), err)
+		}
+		batch = batch[:0]
+	}
+
+	// Exports all queued spans
+	drain := func() {
+		for {
+			select {
+			case span := <-t.queue:
+				batch = append(batch, span)
+				if len(batch) >= t.config.BatchSize {
+					export()
+				}
+			default:
+				export()
+				return
+			}
+		}
+	}
+
+	for {
+		select {
+		case span := <-t.queue:
+			batch = append(batch, span)
+			if len(batch) >= t.config.BatchSize {
+				export()
+			}
+		case <-ticker.C:
+			export()
+		case flushed := <-t.flush:
+			drain()
+			close(flushed)
+		case <-t.stop:
+			drain()
+			return
+		}
+	}
+}
+
+// Flush exports the spans which have ended so far
+func (t *Tracer) Flush(ctx context.Context) error {
+	flushed := make(chan struct{})
+	select {
+	case t.flush <- flushed:
+	case <-t.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-flushed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Shutdown exports the remaining spans and shuts down the exporter, spans ending afterwards are dropped
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	t.stopOnce.Do(func() { close(t.stop) })
+	select {
+	case <-t.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return t.config.Exporter.Shutdown(ctx)
+}
+
+var (
+	globalTracerMu sync.RWMutex
+	globalTracer   *Tracer
+)
+
+// SetTracer sets the tracer of Start and StartWithKind, nil disables tracing
+func SetTracer(t *Tracer) {
+	globalTracerMu.Lock()
+	defer globalTracerMu.Unlock()
+	globalTracer = t
+}
+
+func getTracer() *Tracer {
+	globalTracerMu.RLock()
+	defer globalTracerMu.RUnlock()
+	return globalTracer
+}
+
+// Start starts an internal span with the tracer set with SetTracer
+func Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, *Span) {
+	return StartWithKind(ctx, name, SpanKindInternal, attrs...)
+}
+
+// StartWithKind starts a span with the tracer set with SetTracer, without one it returns ctx and a nil span
+func StartWithKind(ctx context.Context, name string, kind SpanKind, attrs ...Attribute) (context.Context, *Span) {
+	t := getTracer()
+	if t == nil {
+		return ctx, nil
+	}
+	return t.Start(ctx, name, kind, attrs...)
+}
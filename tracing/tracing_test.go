@@ -0,0 +1,286 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+func newTestTracer(config Config) (*Tracer, *Recorder) {
+	recorder := NewRecorder()
+	config.Exporter = recorder
+	return NewTracer(config), recorder
+}
+
+func TestTraceparent(t *testing.T) {
+	sc, ok := ParseTraceparent("00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	require.True(t, ok)
+	require.Equal(t, "0af7651916cd43dd8448eb211c80319c", sc.TraceID.String())
+	require.Equal(t, "b7ad6b7169203331", sc.SpanID.String())
+	require.True(t, sc.Sampled)
+	require.True(t, sc.Remote)
+
+	// Future versions can have more fields
+	sc, ok = ParseTraceparent("01-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-00-foo")
+	require.True(t, ok)
+	require.False(t, sc.Sampled)
+
+	for _, value := range []string{
+		"",
+		"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331",
+		"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01-foo",
+		"ff-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+		"00-00000000000000000000000000000000-b7ad6b7169203331-01",
+		"00-0af7651916cd43dd8448eb211c80319c-0000000000000000-01",
+		"00-0af7651916cd43dd8448eb211c80319x-b7ad6b7169203331-01",
+		"00-0af7651916cd43dd8448eb211c80319c-b7ad6b716920333-01",
+	} {
+		_, ok = ParseTraceparent(value)
+		require.False(t, ok, value)
+	}
+
+	// Inject and Extract
+	header := make(http.Header)
+	Inject(context.Background(), header)
+	require.Equal(t, "", header.Get(TraceparentHeader))
+	ctx := ContextWithRemoteSpanContext(context.Background(), sc)
+	Inject(ctx, header)
+	require.Equal(t, "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-00", header.Get(TraceparentHeader))
+	require.Equal(t, sc, SpanContextFromContext(Extract(context.Background(), header)))
+}
+
+func TestTracerSpans(t *testing.T) {
+	tracer, recorder := newTestTracer(Config{})
+
+	ctx, root := tracer.Start(context.Background(), "root", SpanKindServer, Attr("a", 1))
+	_, child := tracer.Start(ctx, "child", SpanKindInternal)
+	child.SetAttributes(Attr("b", "x"))
+	child.RecordError(errors.New("failed"))
+	child.End()
+	child.End() // only once
+	root.RecordError(nil)
+	root.End()
+
+	require.Nil(t, tracer.Flush(context.Background()))
+	spans := recorder.Spans()
+	require.Equal(t, 2, len(spans))
+	require.Equal(t, "child", spans[0].Name)
+	require.Equal(t, root.SpanContext().TraceID, spans[0].SpanContext.TraceID)
+	require.Equal(t, root.SpanContext().SpanID, spans[0].Parent)
+	require.Equal(t, []Attribute{{"b", "x"}}, spans[0].Attributes)
+	require.True(t, spans[0].Failed)
+	require.Equal(t, "failed", spans[0].StatusMessage)
+	require.Equal(t, "root", spans[1].Name)
+	require.False(t, spans[1].Parent.IsValid())
+	require.False(t, spans[1].Failed)
+	require.Equal(t, SpanKindServer, spans[1].Kind)
+
+	// Spans of a remote parent which isn't sampled are not recorded, but propagated
+	recorder.Reset()
+	remote, _ := ParseTraceparent("00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-00")
+	ctx, span := tracer.Start(ContextWithRemoteSpanContext(context.Background(), remote), "unsampled", SpanKindServer)
+	require.False(t, span.IsRecording())
+	require.Equal(t, remote.TraceID, SpanContextFromContext(ctx).TraceID)
+	span.End()
+	require.Nil(t, tracer.Shutdown(context.Background()))
+	require.Equal(t, 0, len(recorder.Spans()))
+}
+
+func TestNoTracer(t *testing.T) {
+	ctx, span := Start(context.Background(), "span")
+	require.Nil(t, span)
+	require.Equal(t, context.Background(), ctx)
+
+	// All methods work on nil spans
+	span.SetAttributes(Attr("a", 1))
+	span.SetError("failed")
+	span.End()
+	require.False(t, span.SpanContext().IsValid())
+}
+
+func TestTransport(t *testing.T) {
+	tracer, recorder := newTestTracer(Config{})
+	SetTracer(tracer)
+	defer SetTracer(nil)
+
+	var traceparent string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		traceparent = req.Header.Get(TraceparentHeader)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	doRequest := func(ctx context.Context, transport *Transport) {
+		req, err := http.NewRequestWithContext(ctx, "GET", server.URL+"/path?apiKey=secret", nil)
+		require.Nil(t, err, err)
+		resp, err := (&http.Client{Transport: transport}).Do(req)
+		require.Nil(t, err, err)
+		resp.Body.Close()
+		require.Equal(t, "", req.Header.Get(TraceparentHeader)) // the request wasn't modified
+	}
+
+	// Requests outside of a trace are not recorded
+	doRequest(context.Background(), NewTransport(nil))
+	require.Equal(t, "", traceparent)
+
+	ctx, span := Start(context.Background(), "parent")
+	doRequest(ctx, NewTransport(nil))
+	sc, ok := ParseTraceparent(traceparent)
+	require.True(t, ok)
+	require.Equal(t, span.SpanContext().TraceID, sc.TraceID)
+
+	// No trace context for third parties
+	doRequest(ctx, &Transport{})
+	require.Equal(t, "", traceparent)
+
+	require.Nil(t, tracer.Flush(context.Background()))
+	spans := recorder.Spans()
+	require.Equal(t, 2, len(spans))
+	require.Equal(t, sc.SpanID, spans[0].SpanContext.SpanID)
+	require.Equal(t, span.SpanContext().SpanID, spans[0].Parent)
+	require.Equal(t, "HTTP GET", spans[0].Name)
+	require.Equal(t, SpanKindClient, spans[0].Kind)
+	require.True(t, spans[0].Failed)
+	require.Equal(t, []Attribute{{"http.method", "GET"}, {"net.peer.name", "127.0.0.1"}, {"http.status_code", 502}}, spans[0].Attributes)
+}
+
+func TestWriterExporter(t *testing.T) {
+	var buf bytes.Buffer
+	tracer := NewTracer(Config{Exporter: NewWriterExporter(&buf)})
+	_, span := tracer.Start(context.Background(), "span", SpanKindClient, Attr("a", "b"))
+	span.SetError("failed")
+	span.End()
+	require.Nil(t, tracer.Shutdown(context.Background()))
+
+	entry := make(map[string]interface{})
+	err := json.Unmarshal(buf.Bytes(), &entry)
+	require.Nil(t, err, err)
+	require.Equal(t, "span", entry["name"])
+	require.Equal(t, "client", entry["kind"])
+	require.Equal(t, span.SpanContext().TraceID.String(), entry["traceId"])
+	require.Equal(t, map[string]interface{}{"a": "b"}, entry["attributes"])
+	require.Equal(t, "failed", entry["error"])
+	require.Nil(t, entry["parentSpanId"])
+}
+
+func TestOTLPExporter(t *testing.T) {
+	var body []byte
+	var header http.Header
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		require.Equal(t, "/v1/traces", req.URL.Path)
+		header = req.Header
+		body, _ = ioutil.ReadAll(req.Body)
+	}))
+	defer collector.Close()
+
+	headers, err := ParseOTLPHeaders("Authorization=Bearer abc, X-Team=rpc")
+	require.Nil(t, err, err)
+	_, err = ParseOTLPHeaders("Authorization")
+	require.NotNil(t, err)
+
+	tracer := NewTracer(Config{Exporter: NewOTLPExporter(collector.URL+"/", "rpc-endpoint", headers)})
+	ctx, parent := tracer.Start(context.Background(), "parent", SpanKindServer)
+	_, span := tracer.Start(ctx, "span", SpanKindClient, Attr("s", "x"), Attr("i", 5), Attr("b", true), Attr("f", 0.5))
+	span.SetError("failed")
+	span.End()
+	require.Nil(t, tracer.Shutdown(context.Background()))
+
+	require.Equal(t, "application/json", header.Get("Content-Type"))
+	require.Equal(t, "Bearer abc", header.Get("Authorization"))
+	require.Equal(t, "rpc", header.Get("X-Team"))
+
+	expected := `{"resourceSpans":[{
+		"resource":{"attributes":[{"key":"service.name","value":{"stringValue":"rpc-endpoint"}}]},
+		"scopeSpans":[{"scope":{"name":"github.com/flashbots/rpc-endpoint"},"spans":[{
+			"traceId":"` + span.SpanContext().TraceID.String() + `",
+			"spanId":"` + span.SpanContext().SpanID.String() + `",
+			"parentSpanId":"` + parent.SpanContext().SpanID.String() + `",
+			"name":"span",
+			"kind":3,
+			"startTimeUnixNano":"START",
+			"endTimeUnixNano":"END",
+			"attributes":[
+				{"key":"s","value":{"stringValue":"x"}},
+				{"key":"i","value":{"intValue":"5"}},
+				{"key":"b","value":{"boolValue":true}},
+				{"key":"f","value":{"doubleValue":0.5}}
+			],
+			"status":{"code":2,"message":"failed"}
+		}]}]
+	}]}`
+	var spanJson map[string]interface{}
+	err = json.Unmarshal(body, &spanJson)
+	require.Nil(t, err, err)
+	otlpSpan := spanJson["resourceSpans"].([]interface{})[0].(map[string]interface{})["scopeSpans"].([]interface{})[0].(map[string]interface{})["spans"].([]interface{})[0].(map[string]interface{})
+	require.NotEmpty(t, otlpSpan["startTimeUnixNano"])
+	expected = strings.Replace(expected, "START", otlpSpan["startTimeUnixNano"].(string), 1)
+	expected = strings.Replace(expected, "END", otlpSpan["endTimeUnixNano"].(string), 1)
+	require.JSONEq(t, expected, string(body))
+
+	// Errors of the collector are returned
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	}))
+	defer failing.Close()
+	err = NewOTLPExporter(failing.URL, "rpc-endpoint", nil).ExportSpans(context.Background(), []SpanData{{Name: "span"}})
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "401")
+}
+
+// The payload decodes into the OTLP protobuf messages, which rejects unknown fields and wrong value types, like a collector
+func TestOTLPExporterPayloadDecodes(t *testing.T) {
+	var body []byte
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ = ioutil.ReadAll(req.Body)
+	}))
+	defer collector.Close()
+
+	tracer := NewTracer(Config{Exporter: NewOTLPExporter(collector.URL, "rpc-endpoint", nil)})
+	ctx, parent := tracer.Start(context.Background(), "parent", SpanKindServer, Attr("u", uint64(7)))
+	_, span := tracer.Start(ctx, "span", SpanKindClient, Attr("s", "x"), Attr("i", 5), Attr("b", true), Attr("f", 0.5))
+	span.RecordError(errors.New("failed"))
+	span.End()
+	parent.End()
+	require.Nil(t, tracer.Shutdown(context.Background()))
+
+	traces := new(tracepb.TracesData)
+	err := protojson.Unmarshal(body, traces)
+	require.Nil(t, err, err)
+	require.Equal(t, 1, len(traces.ResourceSpans))
+	resourceSpans := traces.ResourceSpans[0]
+	require.Equal(t, "service.name", resourceSpans.Resource.Attributes[0].Key)
+	require.Equal(t, "rpc-endpoint", resourceSpans.Resource.Attributes[0].Value.GetStringValue())
+
+	spans := resourceSpans.ScopeSpans[0].Spans
+	require.Equal(t, 2, len(spans))
+	child, root := spans[0], spans[1]
+	require.Equal(t, "span", child.Name)
+	require.Equal(t, tracepb.Span_SPAN_KIND_CLIENT, child.Kind)
+	require.Equal(t, tracepb.Span_SPAN_KIND_SERVER, root.Kind)
+	require.True(t, child.StartTimeUnixNano > 0 && child.EndTimeUnixNano >= child.StartTimeUnixNano)
+	require.Equal(t, tracepb.Status_STATUS_CODE_ERROR, child.Status.Code)
+	require.Equal(t, "failed", child.Status.Message)
+	require.Equal(t, tracepb.Status_STATUS_CODE_UNSET, root.Status.Code)
+
+	require.Equal(t, "x", child.Attributes[0].Value.GetStringValue())
+	require.Equal(t, int64(5), child.Attributes[1].Value.GetIntValue())
+	require.True(t, child.Attributes[2].Value.GetBoolValue())
+	require.Equal(t, 0.5, child.Attributes[3].Value.GetDoubleValue())
+	require.Equal(t, int64(7), root.Attributes[0].Value.GetIntValue())
+
+	// OTLP/JSON has hex ids, protojson decodes them as base64, so they are only compared with each other here (the hex
+	// values are checked in TestOTLPExporter)
+	require.Equal(t, root.SpanId, child.ParentSpanId)
+	require.Equal(t, root.TraceId, child.TraceId)
+	require.Empty(t, root.ParentSpanId)
+}
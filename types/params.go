@@ -0,0 +1,54 @@
+package types
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+// InvalidParamsError is returned by DecodeParams, its message is meant for a JsonRpcInvalidParams response
+type InvalidParamsError struct {
+	Msg string
+}
+
+func (err *InvalidParamsError) Error() string {
+	return err.Msg
+}
+
+// Call object of eth_call and eth_estimateGas, with the fields the endpoint looks at
+type CallArgs struct {
+	From  *common.Address `json:"from"`
+	To    *common.Address `json:"to"`
+	Data  *hexutil.Bytes  `json:"data"`
+	Input *hexutil.Bytes  `json:"input"`
+}
+
+// DecodeParams decodes the positional params into the targets, which are pointers to e.g. common.Address,
+// common.Hash, hexutil.Bytes, hexutil.Uint64, CallArgs or string. All targets are required, further params are ignored.
+// Like geth, it returns errors such as "invalid argument 0: hex string without 0x prefix".
+func (req *JsonRpcRequest) DecodeParams(targets ...interface{}) error {
+	if req.NamedParams != nil {
+		return &InvalidParamsError{Msg: "params must be given by position"}
+	}
+
+	for i, target := range targets {
+		if i >= len(req.Params) {
+			return &InvalidParamsError{Msg: fmt.Sprintf("missing value for required argument %d", i)}
+		}
+		if req.Params[i] == nil {
+			return &InvalidParamsError{Msg: fmt.Sprintf("invalid argument %d: null", i)}
+		}
+
+		// Params were decoded into interface{} values, encoding them again gives equivalent JSON
+		raw, err := json.Marshal(req.Params[i])
+		if err != nil {
+			return &InvalidParamsError{Msg: fmt.Sprintf("invalid argument %d: %v", i, err)}
+		}
+		if err = json.Unmarshal(raw, target); err != nil {
+			return &InvalidParamsError{Msg: fmt.Sprintf("invalid argument %d: %v", i, err)}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package types
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/stretchr/testify/require"
+)
+
+func parseRequest(t *testing.T, payload string) *JsonRpcRequest {
+	req := new(JsonRpcRequest)
+	err := json.Unmarshal([]byte(payload), req)
+	require.Nil(t, err, err)
+	return req
+}
+
+func TestDecodeParams(t *testing.T) {
+	req := parseRequest(t, `{"jsonrpc":"2.0","id":1,"method":"foo","params":[
+		"0x7AaBc7915DF92a85E199DbB4B1D21E637e1a90A2",
+		"0x0aeb9c61b342f7fc94a10d41c5d30a049a9cfa9ab764c6dd02204a19960ee567",
+		"0x1234",
+		{"to":"0xf1a54b0759b58661cea17cff19dd37940a9b5f1a","data":"0xabcd"},
+		"latest"
+	]}`)
+
+	var address common.Address
+	var hash common.Hash
+	var data hexutil.Bytes
+	var callArgs CallArgs
+	err := req.DecodeParams(&address, &hash, &data, &callArgs)
+	require.Nil(t, err, err)
+	require.Equal(t, common.HexToAddress("0x7AaBc7915DF92a85E199DbB4B1D21E637e1a90A2"), address)
+	require.Equal(t, common.HexToHash("0x0aeb9c61b342f7fc94a10d41c5d30a049a9cfa9ab764c6dd02204a19960ee567"), hash)
+	require.Equal(t, hexutil.Bytes{0x12, 0x34}, data)
+	require.Equal(t, common.HexToAddress("0xf1a54b0759b58661cea17cff19dd37940a9b5f1a"), *callArgs.To)
+	require.Equal(t, hexutil.Bytes{0xab, 0xcd}, *callArgs.Data)
+	require.Nil(t, callArgs.From)
+
+	// Only the first params
+	err = req.DecodeParams(&address)
+	require.Nil(t, err, err)
+}
+
+func TestDecodeParamsErrors(t *testing.T) {
+	// Messages start like those of geth
+	for payload, msgPrefix := range map[string]string{
+		`{"method":"foo","params":[]}`:                       "missing value for required argument 0",
+		`{"method":"foo"}`:                                   "missing value for required argument 0",
+		`{"method":"foo","params":[null]}`:                   "invalid argument 0: null",
+		`{"method":"foo","params":[1]}`:                      "invalid argument 0: json: cannot unmarshal",
+		`{"method":"foo","params":[["0x1"]]}`:                "invalid argument 0: json: cannot unmarshal",
+		`{"method":"foo","params":["0x1234"]}`:               "invalid argument 0: hex string has length 4",
+		`{"method":"foo","params":{"address":"0x1234"}}`:     "params must be given by position",
+		`{"method":"foo","params":["7AaBc7915DF92a85E199"]}`: "invalid argument 0: json: cannot unmarshal hex string without 0x prefix",
+	} {
+		var address common.Address
+		err := parseRequest(t, payload).DecodeParams(&address)
+		require.NotNil(t, err, payload)
+		require.True(t, strings.HasPrefix(err.Error(), msgPrefix), err.Error())
+	}
+
+	// The second param is invalid
+	var hash common.Hash
+	var callArgs CallArgs
+	err := parseRequest(t, `{"method":"foo","params":["0x0aeb9c61b342f7fc94a10d41c5d30a049a9cfa9ab764c6dd02204a19960ee567",{"to":5}]}`).DecodeParams(&hash, &callArgs)
+	require.NotNil(t, err)
+	require.True(t, strings.HasPrefix(err.Error(), "invalid argument 1: "), err.Error())
+}
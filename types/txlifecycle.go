@@ -0,0 +1,75 @@
+package types
+
+import "time"
+
+// Statuses of a private tx which the endpoint sets itself, the others come from the tx status API
+var TxStatusSent PrivateTxStatus = "SENT"         // accepted by at least one relay
+var TxStatusRejected PrivateTxStatus = "REJECTED" // not accepted by any relay
+var TxStatusCancelled PrivateTxStatus = "CANCELLED"
+
+// IsFinal returns true if the status of the tx won't change anymore
+func (s PrivateTxStatus) IsFinal() bool {
+	return s == TxStatusIncluded || s == TxStatusFailed || s == TxStatusRejected || s == TxStatusCancelled
+}
+
+// Sources of lifecycle events
+const (
+	TxEventSourceRelay     = "relay"
+	TxEventSourceStatusApi = "status-api"
+	TxEventSourceCancel    = "cancel"
+	TxEventSourceTracker   = "tracker" // e.g. not included by the max block
+)
+
+// TxLifecycle is the record of a private tx, from sending it to a relay to its final status
+type TxLifecycle struct {
+	Hash          string             `json:"hash"`
+	RawTx         string             `json:"rawTx,omitempty"`
+	From          string             `json:"from"`
+	To            string             `json:"to,omitempty"`
+	Nonce         uint64             `json:"nonce"`
+	Routing       TxRouting          `json:"routing"`
+	Relays        []TxRelayResponse  `json:"relays,omitempty"`
+	Status        PrivateTxStatus    `json:"status"`
+	Events        []TxLifecycleEvent `json:"events"`
+	IncludedBlock uint64             `json:"includedBlock,omitempty"`
+	FailureReason string             `json:"failureReason,omitempty"`
+	CreatedAt     time.Time          `json:"createdAt"`
+	UpdatedAt     time.Time          `json:"updatedAt"`
+}
+
+// TxRouting is why and how the tx was sent to the relays
+type TxRouting struct {
+	Action         string   `json:"action"` // of the protection policy
+	Rule           string   `json:"rule"`
+	Relays         []string `json:"relays"`
+	Fast           bool     `json:"fast,omitempty"`
+	MaxBlockNumber string   `json:"maxBlockNumber,omitempty"` // hex
+}
+
+// TxRelayResponse is the response of a relay to sending or cancelling the tx
+type TxRelayResponse struct {
+	Relay      string    `json:"relay"`
+	Call       string    `json:"call"` // send or cancel
+	Accepted   bool      `json:"accepted"`
+	Error      string    `json:"error,omitempty"`
+	DurationMs int64     `json:"durationMs"`
+	Time       time.Time `json:"time"`
+}
+
+type TxLifecycleEvent struct {
+	Time    time.Time       `json:"time"`
+	Status  PrivateTxStatus `json:"status"`
+	Source  string          `json:"source"`
+	Message string          `json:"message,omitempty"`
+}
+
+// SetStatus adds an event if the status changed, and returns whether it did
+func (l *TxLifecycle) SetStatus(t time.Time, status PrivateTxStatus, source, message string) bool {
+	if status == l.Status {
+		return false
+	}
+	l.Status = status
+	l.Events = append(l.Events, TxLifecycleEvent{Time: t, Status: status, Source: source, Message: message})
+	l.UpdatedAt = t
+	return true
+}
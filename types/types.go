@@ -1,7 +1,9 @@
 package types
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"time"
 )
@@ -16,11 +18,69 @@ const (
 	JsonRpcInternalError  = -32603
 )
 
+// Server errors used by Ethereum nodes (EIP-1474)
+const (
+	JsonRpcInvalidInput  = -32000
+	JsonRpcTimeout       = -32002 // as used by geth when a request deadline is exceeded
+	JsonRpcLimitExceeded = -32005
+)
+
 type JsonRpcRequest struct {
-	Id      interface{}   `json:"id"`
-	Method  string        `json:"method"`
-	Params  []interface{} `json:"params"`
-	Version string        `json:"jsonrpc,omitempty"`
+	Id          interface{}            `json:"id"`
+	Method      string                 `json:"method"`
+	Params      []interface{}          `json:"params"`
+	NamedParams map[string]interface{} `json:"-"` // params by name, sent as the params object instead of Params
+	Version     string                 `json:"jsonrpc,omitempty"`
+
+	notification bool // the id member is missing
+}
+
+// IsNotification is true for requests without id, which must not be answered
+func (req *JsonRpcRequest) IsNotification() bool {
+	return req.notification
+}
+
+// UnmarshalJSON accepts params by position (array) or by name (object), and remembers whether the request has an id
+func (req *JsonRpcRequest) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Id      json.RawMessage `json:"id"` // "null" if the id is null, empty if missing
+		Method  string          `json:"method"`
+		Params  json.RawMessage `json:"params"`
+		Version string          `json:"jsonrpc"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	*req = JsonRpcRequest{Method: raw.Method, Version: raw.Version, notification: len(raw.Id) == 0}
+	if len(raw.Id) > 0 {
+		if err := json.Unmarshal(raw.Id, &req.Id); err != nil {
+			return err
+		}
+	}
+
+	params := bytes.TrimSpace(raw.Params)
+	switch {
+	case len(params) == 0 || bytes.Equal(params, []byte("null")):
+	case params[0] == '[':
+		return json.Unmarshal(params, &req.Params)
+	case params[0] == '{':
+		return json.Unmarshal(params, &req.NamedParams)
+	default:
+		return errors.New("params must be an array or an object")
+	}
+	return nil
+}
+
+func (req JsonRpcRequest) MarshalJSON() ([]byte, error) {
+	type plainRequest JsonRpcRequest // without the MarshalJSON method
+	if req.NamedParams == nil {
+		return json.Marshal(plainRequest(req))
+	}
+	return json.Marshal(struct {
+		plainRequest
+		Params map[string]interface{} `json:"params"`
+	}{plainRequest(req), req.NamedParams})
 }
 
 func NewJsonRpcRequest(id interface{}, method string, params []interface{}) *JsonRpcRequest {
@@ -45,8 +105,14 @@ type JsonRpcResponse struct {
 
 // RpcError: https://www.jsonrpc.org/specification#error_object
 type JsonRpcError struct {
-	Code    int    `json:"code"`
-	Message string `json:"message"`
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+// Data of JsonRpcLimitExceeded errors
+type RateLimitErrorData struct {
+	RetryAfter int64 `json:"retryAfter"` // seconds
 }
 
 func (err JsonRpcError) Error() string {
@@ -75,6 +141,14 @@ type HealthResponse struct {
 	Now       time.Time `json:"time"`
 	StartTime time.Time `json:"startTime"`
 	Version   string    `json:"version"`
+	Status    string    `json:"status"` // ok or draining
+}
+
+type OFACListResponse struct {
+	Version  string    `json:"version"`
+	Entries  int       `json:"entries"`
+	Invalid  int       `json:"invalid"`
+	LoadedAt time.Time `json:"loadedAt"`
 }
 
 type TransactionReceipt struct {
@@ -95,6 +169,17 @@ type PrivateTxApiResponse struct {
 	MaxBlockNumber int             `json:"maxBlockNumber"`
 }
 
+// Params of eth_sendPrivateTransaction, like flashbotsrpc.FlashbotsSendPrivateTransactionRequest with the optional fields
+type SendPrivateTransactionRequest struct {
+	Tx             string                `json:"tx"`
+	MaxBlockNumber string                `json:"maxBlockNumber,omitempty"` // hex, relay default if empty
+	Preferences    *PrivateTxPreferences `json:"preferences,omitempty"`
+}
+
+type PrivateTxPreferences struct {
+	Fast bool `json:"fast"`
+}
+
 type RelayErrorResponse struct {
 	Error string `json:"error"`
 }
@@ -2,6 +2,7 @@ package utils
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"io/ioutil"
 	"math/big"
@@ -31,16 +32,32 @@ func IsMetamaskMoz(r *http.Request) bool {
 }
 
 func SendRpcAndParseResponseTo(url string, req *types.JsonRpcRequest) (*types.JsonRpcResponse, error) {
+	return SendRpcAndParseResponseToWithContext(context.Background(), url, req)
+}
+
+// Like SendRpcAndParseResponseTo, but the request is cancelled with ctx
+func SendRpcAndParseResponseToWithContext(ctx context.Context, url string, req *types.JsonRpcRequest) (*types.JsonRpcResponse, error) {
+	return SendRpcAndParseResponseToWithClient(ctx, http.DefaultClient, url, req)
+}
+
+// Like SendRpcAndParseResponseToWithContext, but the request is sent with client
+func SendRpcAndParseResponseToWithClient(ctx context.Context, client *http.Client, url string, req *types.JsonRpcRequest) (*types.JsonRpcResponse, error) {
 	jsonData, err := json.Marshal(req)
 	if err != nil {
 		return nil, errors.Wrap(err, "marshal")
 	}
 
 	// fmt.Printf("%s\n", jsonData)
-	resp, err := http.Post(url, "application/json", bytes.NewBuffer(jsonData))
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, errors.Wrap(err, "request")
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(httpReq)
 	if err != nil {
 		return nil, errors.Wrap(err, "post")
 	}
+	defer resp.Body.Close()
 
 	respData, err := ioutil.ReadAll(resp.Body)
 	if err != nil {